@@ -1,863 +1,1335 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+
+	"zos/sp/pseudofat"
 )
 
-func CopyFile(filename, src, dest string, fs_format FileSystemFormat) {
-	// fmt.Println("*** Copying file ***")
+// TIME_FORMAT is how the commands print timestamps
+const TIME_FORMAT = "2006-01-02 15:04:05"
 
-	// **Locate the source cluster and name**
-	src_cluster, src_name, err := ParsePath(filename, src, fs_format, true)
-	if err != nil {
-		// fmt.Println("Error parsing source path:", err)
-		fmt.Println("PATH NOT FOUND")
-		return
+// MAX_COMMAND_WORDS is a command followed by up to three arguments
+const MAX_COMMAND_WORDS = 4
+
+// stdin is shared by the shell and the snapshot browser, both read whole lines from it
+var stdin = bufio.NewReader(os.Stdin)
+
+// readLine prints the prompt and reads one line, io.EOF once the input has ended
+func readLine(prompt string) (string, error) {
+
+	fmt.Print(prompt)
+	line, err := stdin.ReadString('\n')
+	if errors.Is(err, io.EOF) && line != "" {
+		err = nil
 	}
 
-	// **Locate the source file in the current directory**
-	src_entry, err := FindEntry(filename, src_name, src_cluster, fs_format)
-	if err != nil {
-		// fmt.Println("Error checking source file:", err)
-		fmt.Println("FILE NOT FOUND")
-		return
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// splitCommand splits a command line into words. Double or single quotes keep spaces inside
+// a word, a backslash outside of single quotes takes the next character as it is.
+func splitCommand(line string) ([]string, error) {
+
+	var words []string
+	var word strings.Builder
+	var quote rune
+	in_word, escaped := false, false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, in_word = true, true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, in_word = r, true
+		case unicode.IsSpace(r):
+			if in_word {
+				words = append(words, word.String())
+				word.Reset()
+				in_word = false
+			}
+		default:
+			word.WriteRune(r)
+			in_word = true
+		}
 	}
 
-	// **Check if source is a directory**
-	if src_entry.Is_directory == 1 {
-		fmt.Println("Source is a directory and cannot be copied:", src_name)
-		return
+	if quote != 0 {
+		return nil, fmt.Errorf("missing closing %c", quote)
 	}
+	if escaped {
+		return nil, errors.New("backslash at the end of the line")
+	}
+
+	if in_word {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
 
-	// **Locate the destination cluster and name**
-	entry_dest_cluster, dest_name, err := ParsePath(filename, dest, fs_format, true)
+// parseCommand splits a line into the command and its arguments, missing arguments are empty
+func parseCommand(line string) ([MAX_COMMAND_WORDS]string, error) {
+
+	var words [MAX_COMMAND_WORDS]string
+
+	fields, err := splitCommand(line)
 	if err != nil {
-		// fmt.Println("Error parsing destination path:", err)
-		fmt.Println("PATH NOT FOUND")
-		return
+		return words, err
 	}
 
-	// fmt.Println("Destination Cluster:", entry_dest_cluster, "Destination Name:", dest_name)
+	if len(fields) > MAX_COMMAND_WORDS {
+		return words, fmt.Errorf("too many arguments, %s takes at most %d", fields[0], MAX_COMMAND_WORDS-1)
+	}
 
-	// **Check if destination already exists**
-	if CheckIfDirectoryExists(filename, entry_dest_cluster, dest_name, fs_format) {
-		fmt.Println("Destination already exists:", dest_name)
-		return
+	copy(words[:], fields)
+	return words, nil
+}
+
+// XATTR_SIDECAR is appended to the name of a host file to name the file that carries its extended
+// attributes where the host cannot store them, one name="value" line per attribute
+const XATTR_SIDECAR = ".xattr"
+
+// PrintError maps file system errors to the status messages required by the assignment
+func PrintError(err error) {
+
+	switch {
+	case errors.Is(err, pseudofat.ErrPathNotFound):
+		fmt.Println("PATH NOT FOUND")
+	case errors.Is(err, pseudofat.ErrNotFound):
+		fmt.Println("FILE NOT FOUND")
+	case errors.Is(err, pseudofat.ErrExist):
+		fmt.Println("EXIST")
+	case errors.Is(err, pseudofat.ErrNotEmpty):
+		fmt.Println("NOT EMPTY")
+	case errors.Is(err, pseudofat.ErrQuota):
+		fmt.Println("QUOTA EXCEEDED")
+	case errors.Is(err, pseudofat.ErrNoSpace):
+		fmt.Println("NO SPACE")
+	case errors.Is(err, pseudofat.ErrPermission):
+		fmt.Println("PERMISSION DENIED")
+	case errors.Is(err, pseudofat.ErrNoAttr):
+		fmt.Println("ATTRIBUTE NOT FOUND")
+	default:
+		fmt.Println(err)
 	}
+}
+
+func CopyFile(fs *pseudofat.FileSystem, src, dest string) {
 
-	// **Read file contents using the helper function**
-	file_contents, err := ReadFileContents(filename, src_entry.First_cluster, src_entry.Size, fs_format)
+	err := fs.Copy(src, dest)
 	if err != nil {
-		fmt.Println("Error reading source file contents:", err)
+		PrintError(err)
 		return
 	}
 
-	// **Find the first free cluster for the file**
-	dest_cluster, err := FindFreeCluster(filename, fs_format.fat1_start)
+	fmt.Println("OK")
+}
+
+func CopyTree(fs *pseudofat.FileSystem, src, dest string) {
+
+	err := fs.CopyTree(src, dest)
 	if err != nil {
-		fmt.Println("Error finding free cluster:", err)
+		PrintError(err)
 		return
 	}
 
-	if dest_cluster == -1 {
-		fmt.Println("Error: Not enough free space in the file system.")
+	fmt.Println("OK")
+}
+
+func MoveFile(fs *pseudofat.FileSystem, src, dest string) {
+
+	err := fs.Rename(src, dest)
+	if err != nil {
+		PrintError(err)
 		return
 	}
 
-	// fmt.Println("First Free Cluster:", dest_cluster)
+	fmt.Println("OK")
+}
+
+// LinkFile creates a hard link, or a symbolic link when symbolic is set
+func LinkFile(fs *pseudofat.FileSystem, target, link string, symbolic bool) {
 
-	// **Write file contents to the destination clusters**
-	err = WriteFileContents(filename, dest_cluster, file_contents, fs_format)
+	var err error
+	if symbolic {
+		err = fs.Symlink(target, link)
+	} else {
+		err = fs.Link(target, link)
+	}
 	if err != nil {
-		fmt.Println("Error writing file contents:", err)
+		PrintError(err)
 		return
 	}
 
-	// **Create a directory entry for the new file**
-	dest_entry := DirectoryEntry{
-		Size:          src_entry.Size,
-		First_cluster: dest_cluster,
-		Is_directory:  src_entry.Is_directory,
+	fmt.Println("OK")
+}
+
+func RemoveFile(fs *pseudofat.FileSystem, file string) {
+
+	// **rm only removes files and links, directories go through rmdir**
+	entry, err := fs.Lstat(file)
+	if err == nil && entry.Is_directory == 1 {
+		err = pseudofat.ErrIsDir
 	}
-	copy(dest_entry.Name[:], dest_name)
 
-	// **Write the new directory entry to the directory**
-	err = WriteDirectoryEntry(filename, entry_dest_cluster, dest_entry, fs_format)
+	if err == nil {
+		err = fs.Remove(file)
+	}
 	if err != nil {
-		fmt.Println("Error writing directory entry:", err)
+		PrintError(err)
 		return
 	}
 
-	// fmt.Println("*** Copy completed successfully ***")
 	fmt.Println("OK")
 }
 
-func MoveFile(filename, src, dest string, fs_format FileSystemFormat) {
-	// fmt.Println("*** Moving file ***")
+func RemoveTree(fs *pseudofat.FileSystem, path string) {
 
-	src_cluster, src_name, err := ParsePath(filename, src, fs_format, true)
+	err := fs.RemoveTree(path)
 	if err != nil {
-		// fmt.Println("Error parsing source path:", err)
-		fmt.Println("PATH NOT FOUND")
+		PrintError(err)
+		return
 	}
 
-	// fmt.Println("Source Cluster:", src_cluster, "Source Name:", src_name)
+	fmt.Println("OK")
+}
+
+func MakeDirectory(fs *pseudofat.FileSystem, dir_name string) {
 
-	// **Locate the source file in the current directory**
-	src_entry, err := FindEntry(filename, src_name, src_cluster, fs_format)
+	err := fs.Mkdir(dir_name)
 	if err != nil {
-		// fmt.Println("Error checking source file:", err)
-		fmt.Println("FILE NOT FOUND")
+		PrintError(err)
 		return
 	}
 
-	// **Check if source is a directory**
-	if src_entry.Is_directory == 1 {
-		fmt.Println("Source is a directory and cannot be moved:", src_name)
+	fmt.Println("OK")
+}
+
+func MakeDirectories(fs *pseudofat.FileSystem, dir_path string) {
+
+	err := fs.MkdirAll(dir_path)
+	if err != nil {
+		PrintError(err)
 		return
 	}
 
-	// **Locate the destination cluster and name**
-	dest_cluster, dest_name, err := ParsePath(filename, dest, fs_format, true)
+	fmt.Println("OK")
+}
+
+func RemoveDirectory(fs *pseudofat.FileSystem, dir_name string) {
+
+	// **rmdir only removes directories, not links to them**
+	entry, err := fs.Lstat(dir_name)
+	if err == nil && entry.Is_directory != 1 {
+		err = pseudofat.ErrNotDir
+	}
+
+	if err == nil {
+		err = fs.Remove(dir_name)
+	}
 	if err != nil {
-		// fmt.Println("Error parsing destination path:", err)
-		fmt.Println("PATH NOT FOUND")
+		PrintError(err)
 		return
 	}
 
-	// fmt.Println("Dest Cluster:", dest_cluster, "Dest Name:", dest_name)
+	fmt.Println("OK")
+}
+
+func PrintDirectoryContents(fs *pseudofat.FileSystem, src string) {
 
-	// **Check if destination already exists**
-	var rename bool
-	dest_entry, err := FindEntry(filename, dest_name, dest_cluster, fs_format)
+	dir_entries, err := fs.ReadDir(src)
 	if err != nil {
-		fmt.Println("Rename true")
-		rename = true
+		PrintError(err)
+		return
 	}
 
-	// **Check if destination already exists**
-	if !rename {
-		if dest_entry.Is_directory != 1 {
-			fmt.Println("Destination is not a directory:", dest_name)
-			return
+	fmt.Printf("%-11s %-10s %-10s %-20s %-10s %-15s %-15s %-6s\n", "Mode", "Owner", "Group", "Name", "Size", "First Cluster", "Is Directory", "Links")
+
+	for _, entry := range dir_entries {
+
+		// **A symbolic link shows where it points to**
+		name := entry.FileName()
+		if entry.IsSymlink() {
+			target, err := fs.Readlink(path.Join(src, name))
+			if err == nil {
+				name += " -> " + target
+			}
 		}
+
+		owner, group := fs.Owner(entry)
+		fmt.Printf("%-11s %-10s %-10s %-20s %-10d %-15d %-15d %-6d\n", entry.ModeString(), owner, group, name, entry.Size, entry.First_cluster, entry.Is_directory, entry.Links)
 	}
+}
+
+func PrintStat(fs *pseudofat.FileSystem, file string) {
 
-	// **Read the source file contents**
-	file_contents, err := ReadFileContents(filename, src_entry.First_cluster, src_entry.Size, fs_format)
+	entry, err := fs.Lstat(file)
 	if err != nil {
-		fmt.Println("Error reading source file contents:", err)
+		PrintError(err)
 		return
 	}
 
-	// **Find the first free cluster for the file**
-	free_cluster, err := FindFreeCluster(filename, fs_format.fat1_start)
+	chain, err := fs.ClusterChain(file)
 	if err != nil {
-		fmt.Println("Error finding free cluster:", err)
+		PrintError(err)
 		return
 	}
 
-	if free_cluster == -1 {
-		fmt.Println("Error: Not enough free space in the file system.")
-		return
-	}
+	file_type := "file"
+	if entry.Is_directory == 1 {
+		file_type = "directory"
+	} else if entry.IsSymlink() {
+		target, err := fs.Readlink(file)
+		if err != nil {
+			PrintError(err)
+			return
+		}
+		file_type = "symbolic link to " + target
+	}
+
+	// **The root directory is described by its '.' entry**
+	name := entry.FileName()
+	if name == "." {
+		name = file
+	}
+
+	fmt.Printf("%-15s %s\n", "Name:", name)
+	fmt.Printf("%-15s %s\n", "Type:", file_type)
+	fmt.Printf("%-15s %d\n", "Size:", entry.Size)
+	fmt.Printf("%-15s %d\n", "Links:", entry.Links)
+	owner, group := fs.Owner(entry)
+	fmt.Printf("%-15s %s:%s\n", "Owner:", owner, group)
+	fmt.Printf("%-15s %04o (%s)\n", "Mode:", entry.Mode, entry.ModeString())
+	fmt.Printf("%-15s %d\n", "First cluster:", entry.First_cluster)
+	fmt.Printf("%-15s %d\n", "Clusters:", len(chain))
+	fmt.Printf("%-15s %s\n", "Created:", entry.CreationTime().Format(TIME_FORMAT))
+	fmt.Printf("%-15s %s\n", "Modified:", entry.ModTime().Format(TIME_FORMAT))
+	fmt.Printf("%-15s %s\n", "Accessed:", entry.AccessTime().Format(TIME_FORMAT))
+}
+
+func Touch(fs *pseudofat.FileSystem, file string) {
 
-	// **Write file contents to the destination clusters**
-	err = WriteFileContents(filename, free_cluster, file_contents, fs_format)
+	// **A missing file is created empty, an existing one gets the current time**
+	_, err := fs.Stat(file)
+	if errors.Is(err, pseudofat.ErrNotFound) {
+		err = fs.WriteFile(file, nil)
+	} else if err == nil {
+		now := time.Now()
+		err = fs.Chtimes(file, now, now)
+	}
 	if err != nil {
-		fmt.Println("Error writing file contents:", err)
+		PrintError(err)
 		return
 	}
-	// **Create a new directory entry for the copied file**
-	new_entry := DirectoryEntry{
-		Size:          src_entry.Size,
-		First_cluster: free_cluster,
-		Is_directory:  src_entry.Is_directory,
-	}
 
-	if rename {
-		copy(new_entry.Name[:], dest_name)
-		dest_entry.First_cluster = dest_cluster
-	} else {
-		copy(new_entry.Name[:], src)
-	}
+	fmt.Println("OK")
+}
 
-	// **Write the new directory entry to the destination directory**
-	// fmt.Println("Writing to cluster:", dest_entry.First_cluster, "Entry:", src)
-	err = WriteDirectoryEntry(filename, dest_entry.First_cluster, new_entry, fs_format)
+func PrintFileContents(fs *pseudofat.FileSystem, file string) {
+
+	// **Read the file contents**
+	file_contents, err := fs.ReadFile(file)
 	if err != nil {
-		fmt.Println("Error writing directory entry:", err)
+		PrintError(err)
 		return
 	}
 
-	// **Remove the source file from the directory**
-	// fmt.Println("Removing in cluster:", current_cluster, "Entry:", src)
-	err = RemoveDirectoryEntry(filename, src_cluster, src_name, fs_format)
+	// **Print the file contents**
+	fmt.Println(string(file_contents))
+}
+
+func ChangePath(fs *pseudofat.FileSystem, path string) {
+
+	err := fs.Chdir(path)
 	if err != nil {
-		fmt.Println("Error removing source file:", err)
+		PrintError(err)
 		return
 	}
 
-	// fmt.Println("*** Move completed successfully ***")
 	fmt.Println("OK")
 }
 
-func RemoveFile(filename, file string, fs_format FileSystemFormat) {
+func PrintCurrentPath(fs *pseudofat.FileSystem) {
 
-	// fmt.Println("*** Removing file ***")
+	fmt.Println(fs.Getwd())
+}
+
+func PrintInformation(fs *pseudofat.FileSystem, src string) {
 
-	file_cluster, file_name, err := ParsePath(filename, file, fs_format, true)
+	chain, err := fs.ClusterChain(src)
 	if err != nil {
-		// fmt.Println("Error parsing file path:", err)
-		fmt.Println("PATH NOT FOUND")
+		PrintError(err)
+		return
+	}
+
+	fmt.Print(src, ": ")
+	for _, cluster := range chain {
+		fmt.Printf("%d ", cluster)
+	}
+	fmt.Println()
+}
+
+func Incp(fs *pseudofat.FileSystem, src string, dest string) {
+
+	// **Read the source file's contents**
+	file_contents, err := os.ReadFile(src)
+	if err != nil {
+		fmt.Println("FILE NOT FOUND")
 		return
 	}
 
-	// **Locate the source file in the current directory**
-	entry, err := FindEntry(filename, file_name, file_cluster, fs_format)
+	host_info, err := os.Stat(src)
 	if err != nil {
-		// fmt.Println("Error checking file:", err)
 		fmt.Println("FILE NOT FOUND")
 		return
 	}
 
-	// **Check if file exists**
-	if IsZeroEntry(entry) {
-		fmt.Println("File not found:", file_name)
+	// **The extended attributes come from the host file and from its sidecar**
+	attrs, err := importXattrs(src)
+	if err != nil {
+		PrintError(err)
 		return
 	}
 
-	// **Remove the file**
-	err = RemoveDirectoryEntry(filename, file_cluster, file_name, fs_format)
+	// **Write the file data into the VFS, the copy keeps the modification time of the host file**
+	err = fs.ImportFile(dest, file_contents, host_info.ModTime(), attrs)
 	if err != nil {
-		fmt.Println("Error removing file:", err)
+		PrintError(err)
 		return
 	}
 
-	// fmt.Println("File removed successfully:", file)
 	fmt.Println("OK")
 }
 
-func MakeDirectory(dir_name, filename string, fs_format FileSystemFormat) {
+func Outcp(fs *pseudofat.FileSystem, src string, dest string) {
 
-	CreateDirectory(filename, dir_name, fs_format)
-	fmt.Println("OK")
-}
-
-func RemoveDirectory(filename, dir_name string, fs_format FileSystemFormat) {
+	// **Read the file contents from the VFS**
+	file_contents, err := fs.ReadFile(src)
+	if err != nil {
+		PrintError(err)
+		return
+	}
 
-	dir_cluster, dir_name, err := ParsePath(filename, dir_name, fs_format, true)
+	// **Write the file contents to the destination file**
+	err = os.WriteFile(dest, file_contents, 0644)
 	if err != nil {
-		// fmt.Println("Error parsing directory path:", err)
 		fmt.Println("PATH NOT FOUND")
 		return
 	}
 
-	err = RemoveDirectoryEntry(filename, dir_cluster, dir_name, fs_format)
+	// **The extended attributes go to the host file, or to a sidecar where the host cannot store them**
+	err = exportXattrs(fs, src, dest)
 	if err != nil {
-		fmt.Println("Error removing directory:", err)
+		PrintError(err)
 		return
 	}
+
 	fmt.Println("OK")
 }
 
-func PrintDirectoryContents(filename, src string, fs_format FileSystemFormat) {
+// importXattrs reads the attributes of the host file src, the sidecar wins over host attributes
+func importXattrs(src string) (map[string][]byte, error) {
 
-	current_cluster := GetCurrentCluster()
+	attrs, err := readHostXattrs(src)
+	if err != nil {
+		attrs = make(map[string][]byte)
+	}
 
-	// fmt.Println("Current Cluster:", current_cluster)
+	sidecar, err := readSidecar(src + XATTR_SIDECAR)
+	if err != nil {
+		return nil, err
+	}
+	maps.Copy(attrs, sidecar)
 
-	if src != "" {
+	return attrs, nil
+}
 
-		// fmt.Println("Changing directory to:", src)
+// exportXattrs copies the attributes of src to the host file dest
+func exportXattrs(fs *pseudofat.FileSystem, src, dest string) error {
 
-		var err error
-		current_cluster, _, err = ParsePath(filename, src, fs_format, false)
+	names, err := fs.Listxattr(src)
+	if err != nil || len(names) == 0 {
+		return err
+	}
+
+	attrs := make(map[string][]byte)
+	for _, name := range names {
+		attrs[name], err = fs.Getxattr(src, name)
 		if err != nil {
-			// fmt.Println("Error parsing path:", err)
-			fmt.Println("PATH NOT FOUND")
-			return
+			return err
 		}
-		// fmt.Println("New Cluster:", current_cluster)
 	}
 
-	// fmt.Println("Current Cluster before read:", current_cluster)
+	if writeHostXattrs(dest, attrs) == nil {
+		return nil
+	}
+
+	return writeSidecar(dest+XATTR_SIDECAR, attrs)
+}
 
-	dir_entries, err := ReadDirectoryEntries(filename, current_cluster, fs_format)
+// readSidecar reads the attributes of a sidecar file, a missing sidecar holds none
+func readSidecar(sidecar string) (map[string][]byte, error) {
+
+	raw, err := os.ReadFile(sidecar)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
 	}
 
-	// fmt.Println("Directory Contents:")
-	fmt.Printf("%-20s %-10s %-15s %-15s\n", "Name", "Size", "First Cluster", "Is Directory")
+	attrs := make(map[string][]byte)
+	for _, line := range strings.Split(string(raw), "\n") {
 
-	for _, entry := range dir_entries {
-
-		if !IsZeroEntry(entry) {
+		if line == "" {
+			continue
+		}
 
-			dir_name_str := string(bytes.Trim(entry.Name[:], "\x00"))
-			fmt.Printf("%-20s %-10d %-15d %-15d\n", dir_name_str, entry.Size, entry.First_cluster, entry.Is_directory)
+		name, quoted, found := strings.Cut(line, "=")
+		value, err := strconv.Unquote(quoted)
+		if !found || err != nil {
+			return nil, fmt.Errorf("invalid line in %s: %s", sidecar, line)
 		}
+
+		attrs[name] = []byte(value)
 	}
+
+	return attrs, nil
 }
 
-func PrintFileContents(filename, file string, fs_format FileSystemFormat) {
+// writeSidecar writes the attributes into a sidecar file sorted by name
+func writeSidecar(sidecar string, attrs map[string][]byte) error {
 
-	file_cluster, file_name, err := ParsePath(filename, file, fs_format, true)
-	if err != nil {
-		// fmt.Println("Error parsing file path:", err)
-		fmt.Println("PATH NOT FOUND")
-		return
+	var lines strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(attrs)) {
+		fmt.Fprintf(&lines, "%s=%q\n", name, attrs[name])
 	}
 
-	// **Locate the file in the current directory**
-	entry, err := FindEntry(filename, file_name, file_cluster, fs_format)
-	if err != nil {
-		fmt.Println("FILE NOT FOUND")
-		return
-	}
+	return os.WriteFile(sidecar, []byte(lines.String()), 0644)
+}
 
-	// **Read the file contents**
-	file_contents, err := ReadFileContents(filename, entry.First_cluster, entry.Size, fs_format)
-	if err != nil {
-		fmt.Println("Error reading file contents:", err)
-		return
-	}
+// PrintXattrs prints an extended attribute as name="value", without a name all of them
+func PrintXattrs(fs *pseudofat.FileSystem, file, name string) {
 
-	// **Print the file contents**
-	fmt.Println(string(file_contents))
+	names := []string{name}
+	if name == "" {
+		var err error
+		names, err = fs.Listxattr(file)
+		if err != nil {
+			PrintError(err)
+			return
+		}
+	}
 
-	// fmt.Println("File Contents:")
-	// fmt.Println(string(file_contents))
+	for _, name := range names {
+		value, err := fs.Getxattr(file, name)
+		if err != nil {
+			PrintError(err)
+			return
+		}
+		fmt.Printf("%s=%q\n", name, value)
+	}
 }
 
-func ChangePath(filename, path string, fs_format FileSystemFormat) {
-
-	// fmt.Println("Changing directory to:", path)
+// SetXattr creates or replaces an extended attribute
+func SetXattr(fs *pseudofat.FileSystem, file, name, value string) {
 
-	// Check if the path is absolute or relative
-	var start_cluster int32
-	if path == "/" {
-		// fmt.Println("Root directory")
-		// Root directory case
-		SetCurrentCluster(fs_format.data_start / CLUSTER_SIZE)
-		SetCurrentPath(path)
-		fmt.Println("OK")
+	err := fs.Setxattr(file, name, []byte(value))
+	if err != nil {
+		PrintError(err)
 		return
-	} else if path[0] == '/' {
-		// fmt.Println("Absolute path")
-		// Absolute path, start from root cluster
-		start_cluster = GetCurrentCluster()
-		path = path[1:] // Remove leading '/'
-	} else {
-		// fmt.Println("Relative path")
-		// Relative path, start from the current directory cluster
-		start_cluster = GetCurrentCluster()
 	}
 
-	// fmt.Println("Start Cluster:", start_cluster)
+	fmt.Println("OK")
+}
 
-	// Split the path into directory components
-	path_components := strings.Split(path, "/")
-	current_cluster := start_cluster
+// RemoveXattr deletes an extended attribute
+func RemoveXattr(fs *pseudofat.FileSystem, file, name string) {
 
-	// Traverse each component in the path
-	for _, component := range path_components {
+	err := fs.Removexattr(file, name)
+	if err != nil {
+		PrintError(err)
+		return
+	}
 
-		if component == "." || component == "" {
-			// Stay in the current directory
-			// fmt.Println("Staying in the current directory")
-			continue
-		}
+	fmt.Println("OK")
+}
 
-		if component == ".." {
-			// Move up to the parent directory
-			// fmt.Println("Moving up to the parent directory")
-			current_cluster = GetParentCluster(filename, current_cluster, fs_format)
-			continue
-		}
+// Quota sets or prints quotas, a target is user:NAME or a directory path
+func Quota(fs *pseudofat.FileSystem, action, target, limits string) {
 
-		// Search for the component in the current directory entries
-		dir_entries, err := ReadDirectoryEntries(filename, current_cluster, fs_format)
+	switch action {
+	case "set":
+		SetQuota(fs, target, limits)
+	case "show":
+		ShowQuota(fs, target)
+	case "report":
+		infos, err := fs.Quotas()
 		if err != nil {
-			fmt.Println("Error reading directory entries:", err)
+			PrintError(err)
 			return
 		}
+		PrintQuotas(infos)
+	default:
+		fmt.Println("Usage: quota set user:NAME|PATH CLUSTERS:ENTRIES, quota show [user:NAME|PATH], quota report")
+	}
+}
 
-		found := false
-		for _, entry := range dir_entries {
-			entryName := bytes.Trim(entry.Name[:], "\x00")
-			if entry.Is_directory == 1 && string(entryName) == component {
-				// Found the directory; update the current cluster
-				current_cluster = entry.First_cluster
-				found = true
-				// fmt.Println("Found directory:", component)
-				// fmt.Println("New Cluster:", current_cluster)
-				// fmt.Println()
-				break
-			}
-		}
+// SetQuota parses CLUSTERS:ENTRIES, 0 is no limit and 0:0 removes the quota
+func SetQuota(fs *pseudofat.FileSystem, target, limits string) {
 
-		if !found {
-			fmt.Println("PATH NOT FOUND")
-			return
-		}
+	clusters_text, entries_text, found := strings.Cut(limits, ":")
+	max_clusters, err1 := strconv.Atoi(clusters_text)
+	max_entries, err2 := strconv.Atoi(entries_text)
+	if target == "" || !found || err1 != nil || err2 != nil {
+		fmt.Println("Usage: quota set user:NAME|PATH CLUSTERS:ENTRIES")
+		return
+	}
+
+	var err error
+	if user, ok := strings.CutPrefix(target, "user:"); ok {
+		err = fs.SetUserQuota(user, max_clusters, max_entries)
+	} else {
+		err = fs.SetDirQuota(target, max_clusters, max_entries)
+	}
+	if err != nil {
+		PrintError(err)
+		return
 	}
 
-	// Update the current directory cluster if path traversal succeeded
-	SetCurrentCluster(current_cluster)
-	SetCurrentPath(path)
-	// fmt.Println("Directory changed to:", path)
 	fmt.Println("OK")
 }
 
-func PrintCurrentPath() {
+// ShowQuota prints the quota of a user or a directory, without a target the one of the current user
+func ShowQuota(fs *pseudofat.FileSystem, target string) {
 
-	GetCurrentPath()
+	var info pseudofat.QuotaInfo
+	var err error
+	if user, ok := strings.CutPrefix(target, "user:"); ok || target == "" {
+		info, err = fs.UserQuota(user)
+	} else {
+		info, err = fs.DirQuota(target)
+	}
+	if err != nil {
+		PrintError(err)
+		return
+	}
+
+	PrintQuotas([]pseudofat.QuotaInfo{info})
 }
 
-func PrintInformation(filename, src string, fs_format FileSystemFormat) {
+// PrintQuotas prints the usage against the limits, - for no limit
+func PrintQuotas(infos []pseudofat.QuotaInfo) {
 
-	src_cluster, src_name, err := ParsePath(filename, src, fs_format, true)
-	if err != nil {
-		// fmt.Println("Error parsing file path:", err)
-		fmt.Println("PATH NOT FOUND")
-		return
+	limit := func(value int) string {
+		if value == 0 {
+			return "-"
+		}
+		return strconv.Itoa(value)
+	}
+
+	fmt.Printf("%-5s %-20s %-10s %-10s %-10s %-10s\n", "Type", "Target", "Clusters", "Limit", "Entries", "Limit")
+	for _, info := range infos {
+		kind, target := "user", info.User
+		if info.User == "" {
+			kind, target = "dir", info.Path
+		}
+		fmt.Printf("%-5s %-20s %-10d %-10s %-10d %-10s\n", kind, target, info.Clusters, limit(info.MaxClusters), info.Entries, limit(info.MaxEntries))
 	}
+}
 
-	src_entry, err := FindEntry(filename, src_name, src_cluster, fs_format)
+func LoadFile(fs *pseudofat.FileSystem, script string) {
+
+	// **Read the commands from the script file**
+	data, err := os.ReadFile(script)
 	if err != nil {
-		fmt.Println("Error checking file:", err)
+		fmt.Println("FILE NOT FOUND")
 		return
 	}
 
-	// fmt.Println("Source cluster:", src_cluster, "Source name:", src_name)
-	// fmt.Println("Source entry cluster:", src_entry.First_cluster)
+	// **Split the commands by newline**
+	lines := strings.Split(string(data), "\n")
+	for number, line := range lines {
 
-	fmt.Print(src_name, ": ")
-	current_cluster := src_entry.First_cluster
-	for current_cluster != FAT_EOF {
+		// **Print empty lines**
+		if strings.TrimSpace(line) == "" {
+			fmt.Println()
+			continue
+		}
 
-		fmt.Printf("%d ", current_cluster)
+		// **Print the comment**
+		if strings.HasPrefix(line, "#") {
+			fmt.Println(line)
+			continue
+		}
 
-		next_cluster, err := ReadFatEntry(filename, current_cluster, fs_format)
+		// **Split the command like the shell does, the script stops at a line it cannot parse**
+		words, err := parseCommand(line)
 		if err != nil {
-			fmt.Println("Error reading FAT entry:", err)
+			fmt.Printf("Error on line %d: %v\n", number+1, err)
 			return
 		}
 
-		if next_cluster == FAT_EOF {
-			break
-		}
-
-		current_cluster = next_cluster
-
+		fmt.Println("Executing:", strings.TrimSpace(line))
+		ExecuteCommand(fs, words[0], words[1], words[2], words[3])
 	}
-	fmt.Println()
 }
 
-func Incp(filename string, src string, dest string, fs_format FileSystemFormat) {
+func FormatFileCmd(fs *pseudofat.FileSystem, size, cluster_size int) {
 
-	// **Open the source file for reading**
-	file, err := os.Open(src)
+	err := fs.Format(size, cluster_size)
+	if errors.Is(err, pseudofat.ErrPermission) {
+		PrintError(err)
+		return
+	}
 	if err != nil {
-		fmt.Println("FILE NOT FOUND")
-		// fmt.Println("Error opening source file:", err)
+		fmt.Println("CANNOT CREATE FILE")
 		return
 	}
-	defer file.Close()
 
-	// **Get the size of the source file**
-	file_info, err := file.Stat()
+	fmt.Println("OK")
+}
+
+func BugTest(fs *pseudofat.FileSystem, bug_file string) {
+
+	err := fs.MarkBad(bug_file)
 	if err != nil {
-		fmt.Println("Error getting file information:", err)
+		PrintError(err)
 		return
 	}
-	file_size := int32(file_info.Size())
 
-	// fmt.Println("Source File Size:", file_size)
+	fmt.Printf("Marked file '%s' as corrupted (FAT_BAD_CLUSTER).\n", bug_file)
+}
+
+func CheckForBugs(fs *pseudofat.FileSystem) {
 
-	// **Read the source file's contents**
-	file_contents := make([]byte, file_size)
-	_, err = file.Read(file_contents)
+	// **Check for bad clusters in the FAT tables**
+	bad_clusters, err := fs.BadClusters()
 	if err != nil {
-		fmt.Println("Error reading source file:", err)
+		PrintError(err)
 		return
 	}
 
-	// fmt.Println("File contents size:", len(file_contents))
-	// fmt.Println("File contents:", string(file_contents))
-	// fmt.Println("File contents:", file_contents)
+	for _, cluster := range bad_clusters {
+		fmt.Printf("Bad cluster found in FAT table: Cluster %d\n", cluster)
+	}
+
+	fmt.Println("OK")
+}
+
+func CheckFileSystem(fs *pseudofat.FileSystem, repair bool) {
 
-	// **Parse the destination path**
-	dest_cluster, dest_name, err := ParsePath(filename, dest, fs_format, true)
+	report, err := fs.Check(repair)
+	for _, problem := range report.Problems {
+		fmt.Println(problem)
+	}
 	if err != nil {
-		fmt.Println("PATH NOT FOUND")
-		// fmt.Println("Error parsing destination path:", err)
+		PrintError(err)
 		return
 	}
 
-	// fmt.Println("Destination Cluster:", dest_cluster, "Destination Name:", dest_name)
+	if len(report.Problems) == 0 {
+		fmt.Println("No problems found.")
+	} else if !report.Repaired {
+		fmt.Printf("%d problems found, run 'fsck -y' to repair them.\n", len(report.Problems))
+	} else {
+		fmt.Printf("%d problems repaired, %d clusters reclaimed, %d chains moved to /%s.\n", len(report.Problems), report.Reclaimed, report.Recovered, pseudofat.LOST_FOUND)
+	}
+
+	fmt.Println("OK")
+}
+
+func Defragment(fs *pseudofat.FileSystem, target string, dry_run bool) {
 
-	// **Check if a file with the same name already exists**
-	dir_entries, err := ReadDirectoryEntries(filename, dest_cluster, fs_format)
+	report, err := fs.Defrag(target, dry_run)
 	if err != nil {
-		fmt.Println("Error reading directory entries:", err)
+		PrintError(err)
 		return
 	}
 
-	for _, entry := range dir_entries {
-		if string(bytes.Trim(entry.Name[:], "\x00")) == dest_name {
-			fmt.Println("Destination file already exists:", dest_name)
-			return
+	if dry_run {
+		fmt.Printf("%-30s %-10s %-10s %-6s\n", "Path", "Clusters", "Fragments", "Score")
+		for _, chain := range report.Chains {
+			fmt.Printf("%-30s %-10d %-10d %.1f%%\n", chain.Path, chain.Clusters, chain.Fragments, chain.Score())
 		}
+		fmt.Println()
 	}
 
-	// **Find the first free cluster for the file**
-	first_cluster, err := FindFreeCluster(filename, fs_format.fat1_start)
-	if err != nil {
-		fmt.Println("Error finding free cluster:", err)
-		return
+	for _, move := range report.Moves {
+		fmt.Printf("%s: %d clusters from %d to %d-%d\n", move.Path, move.Clusters, move.From, move.To, move.To+int32(move.Clusters)-1)
+	}
+	for _, skipped := range report.Skipped {
+		fmt.Printf("%s: stays fragmented\n", skipped)
 	}
 
-	if first_cluster == -1 {
-		fmt.Println("Error: Not enough free space in the file system.")
-		return
+	fmt.Printf("Fragmentation: %.1f%% before, %.1f%% after\n", report.Before, report.After)
+	if !dry_run {
+		fmt.Println("OK")
 	}
+}
 
-	// fmt.Println("First Free Cluster:", first_cluster)
+func Snapshot(fs *pseudofat.FileSystem, action, name string) {
 
-	// **Write the file data into the VFS**
-	err = WriteFileContents(filename, first_cluster, file_contents, fs_format)
-	if err != nil {
-		fmt.Println("Error writing file contents:", err)
+	if action != "list" && name == "" {
+		fmt.Println("Usage: snapshot create|delete|rollback|browse NAME, snapshot list")
 		return
 	}
 
-	// **Create a directory entry for the new file**
-	new_entry := DirectoryEntry{
-		Size:          file_size,
-		First_cluster: first_cluster,
-		Is_directory:  0, // 0 indicates a file
+	var err error
+	switch action {
+	case "create":
+		err = fs.CreateSnapshot(name)
+	case "delete":
+		err = fs.DeleteSnapshot(name)
+	case "rollback":
+		err = fs.RollbackSnapshot(name)
+	case "list":
+		ListSnapshots(fs)
+		return
+	case "browse":
+		BrowseSnapshot(fs, name)
+		return
+	default:
+		fmt.Println("Usage: snapshot create|delete|rollback|browse NAME, snapshot list")
+		return
 	}
-	copy(new_entry.Name[:], dest_name)
 
-	// **Write the new directory entry to the directory**
-	err = WriteDirectoryEntry(filename, dest_cluster, new_entry, fs_format)
 	if err != nil {
-		fmt.Println("Error writing directory entry:", err)
+		PrintError(err)
 		return
 	}
 
-	// fmt.Println("File successfully copied into the virtual file system as:", dest)
 	fmt.Println("OK")
 }
 
-func Outcp(filename string, src string, dest string, fs_format FileSystemFormat) {
+func ListSnapshots(fs *pseudofat.FileSystem) {
 
-	// **Parse the source path and locate the source file**
-	src_cluster, src_name, err := ParsePath(filename, src, fs_format, true)
+	snapshots, err := fs.Snapshots()
 	if err != nil {
-		fmt.Println("Error parsing source path:", err)
+		PrintError(err)
 		return
 	}
 
-	// fmt.Println("Source Cluster:", src_cluster)
+	fmt.Printf("%-14s %-20s %-10s %-10s\n", "Name", "Created", "Clusters", "Exclusive")
+	for _, snapshot := range snapshots {
+		fmt.Printf("%-14s %-20s %-10d %-10d\n", snapshot.Name, snapshot.Created.Format(TIME_FORMAT), snapshot.Clusters, snapshot.Exclusive)
+	}
+}
+
+// BrowseSnapshot runs the shell on a read-only view of the snapshot until exit
+func BrowseSnapshot(fs *pseudofat.FileSystem, name string) {
 
-	// **Locate the source file in the directory**
-	dir_entries, err := ReadDirectoryEntries(filename, src_cluster, fs_format)
+	view, err := fs.OpenSnapshot(name)
 	if err != nil {
-		fmt.Println("Error reading directory entries:", err)
+		PrintError(err)
 		return
 	}
+	defer view.Close()
 
-	var src_entry DirectoryEntry
-	found := false
-	for _, entry := range dir_entries {
-		if string(bytes.Trim(entry.Name[:], "\x00")) == src_name {
-			src_entry = entry
-			found = true
+	fmt.Printf("Browsing snapshot %s read-only, exit returns to the volume.\n", name)
+
+	for {
+		line, err := readLine(fmt.Sprintf("Snapshot %s: ", name))
+		if err != nil {
 			break
 		}
+
+		words, err := parseCommand(line)
+		if err != nil {
+			fmt.Println("Invalid command:", err)
+			continue
+		}
+
+		if words[0] == "exit" || words[0] == "quit" || words[0] == "q" {
+			break
+		}
+		ExecuteCommand(view, words[0], words[1], words[2], words[3])
 	}
 
-	if !found {
-		fmt.Println("FILE NOT FOUND")
-		// fmt.Println("Source file not found:", src)
+	fmt.Println("OK")
+}
+
+// CaseMode prints the name lookup mode or switches it, a switch fails when two names of a directory would collide
+func CaseMode(fs *pseudofat.FileSystem, mode string) {
+
+	switch mode {
+	case "":
+		if fs.CaseInsensitive() {
+			fmt.Println("insensitive")
+		} else {
+			fmt.Println("sensitive")
+		}
+		return
+	case "sensitive", "insensitive":
+	default:
+		fmt.Println("Usage: case [sensitive|insensitive]")
 		return
 	}
 
-	// **Check if source is a directory**
-	if src_entry.Is_directory == 1 {
-		fmt.Println("Source is a directory and cannot be copied:", src)
+	err := fs.SetCaseInsensitive(mode == "insensitive")
+	if err != nil {
+		PrintError(err)
 		return
 	}
 
-	// **Read the file contents from the VFS using ReadFileContents**
-	file_contents, err := ReadFileContents(filename, src_entry.First_cluster, src_entry.Size, fs_format)
+	fmt.Println("OK")
+}
+
+// ChangeMode sets the permission bits from an octal mode like 750 or from symbolic changes like u+x,go-w
+func ChangeMode(fs *pseudofat.FileSystem, mode_spec, file string) {
+
+	entry, err := fs.Stat(file)
 	if err != nil {
-		fmt.Println("Error reading source file from VFS:", err)
+		PrintError(err)
 		return
 	}
 
-	// **Open the destination file for writing**
-	destFile, err := os.Create(dest)
+	mode, err := parseMode(mode_spec, entry.Mode)
 	if err != nil {
-		fmt.Println("PATH NOT FOUND")
-		// fmt.Println("Error creating destination file:", err)
+		fmt.Println(err)
 		return
 	}
-	defer destFile.Close()
 
-	// **Write the file contents to the destination file**
-	_, err = destFile.Write(file_contents)
+	err = fs.Chmod(file, mode)
 	if err != nil {
-		fmt.Println("Error writing to destination file:", err)
+		PrintError(err)
 		return
 	}
 
-	// fmt.Println("File successfully copied from VFS to external destination:", dest)
 	fmt.Println("OK")
 }
 
-func LoadFile(filename, script string, fs_format FileSystemFormat) {
+// parseMode returns the mode the octal or symbolic mode_spec makes of the current mode
+func parseMode(mode_spec string, current uint16) (uint16, error) {
 
-	// **Read the commands from the script file**
-	data, err := os.ReadFile(script)
-	if err != nil {
-		fmt.Println("FILE NOT FOUND")
-		return
+	octal, err := strconv.ParseUint(mode_spec, 8, 16)
+	if err == nil && octal <= pseudofat.MODE_MASK {
+		return uint16(octal), nil
 	}
 
-	// **Split the commands by newline**
-	lines := strings.Split(string(data), "\n")
-	for _, line := range lines {
+	// **Every clause is [ugoa]*[+-=][rwx]*, no class means all of them**
+	mode := current
+	for _, clause := range strings.Split(mode_spec, ",") {
 
-		// **Print empty lines**
-		if line == "" || line == "\n" || line == "\r" || line == "\r\n" || strings.TrimSpace(line) == "" {
-			fmt.Println()
-			continue
+		op := strings.IndexAny(clause, "+-=")
+		if op < 0 {
+			return 0, fmt.Errorf("Invalid mode: %s", mode_spec)
 		}
 
-		// **Print the comment**
-		if strings.HasPrefix(line, "#") {
-			fmt.Println(line)
-			continue
+		var classes, bits uint16
+		for _, class := range clause[:op] {
+			switch class {
+			case 'u':
+				classes |= 0o700
+			case 'g':
+				classes |= 0o070
+			case 'o':
+				classes |= 0o007
+			case 'a':
+				classes |= 0o777
+			default:
+				return 0, fmt.Errorf("Invalid mode: %s", mode_spec)
+			}
 		}
-
-		// **Split the command by space**
-		words := strings.Fields(line)
-
-		var command, arg1, arg2 string
-		if len(words) == 1 {
-			command = words[0]
-		} else if len(words) == 2 {
-			command = words[0]
-			arg1 = words[1]
-		} else if len(words) == 3 {
-			command = words[0]
-			arg1 = words[1]
-			arg2 = words[2]
+		if classes == 0 {
+			classes = 0o777
 		}
 
-		fmt.Println("Executing:", command, arg1, arg2)
-		ExecuteCommand(filename, command, arg1, arg2, fs_format)
+		for _, perm := range clause[op+1:] {
+			switch perm {
+			case 'r':
+				bits |= 0o444
+			case 'w':
+				bits |= 0o222
+			case 'x':
+				bits |= 0o111
+			default:
+				return 0, fmt.Errorf("Invalid mode: %s", mode_spec)
+			}
+		}
+		bits &= classes
+
+		switch clause[op] {
+		case '+':
+			mode |= bits
+		case '-':
+			mode &^= bits
+		case '=':
+			mode = mode&^classes | bits
+		}
 	}
 
-	// fmt.Println("OK")
+	return mode, nil
 }
 
-func FormatFileCmd(filename string, size int) {
-	Format(filename, size)
+// ChangeOwner gives a file to USER, USER:GROUP or :GROUP
+func ChangeOwner(fs *pseudofat.FileSystem, owner, file string) {
+
+	user, group, _ := strings.Cut(owner, ":")
+	err := fs.Chown(file, user, group)
+	if err != nil {
+		PrintError(err)
+		return
+	}
+
 	fmt.Println("OK")
 }
 
-func BugTest(filename, bug_file string, fs_format FileSystemFormat) {
+// AddUser adds a user with its password, the user joins group or a new group of its own name
+func AddUser(fs *pseudofat.FileSystem, name, password, group string) {
 
-	bug_file_cluster, bug_file_name, err := ParsePath(filename, bug_file, fs_format, true)
+	err := fs.UserAdd(name, password, group)
 	if err != nil {
-		fmt.Println("Error parsing file path:", err)
+		PrintError(err)
 		return
 	}
 
-	// Read all directory entries in the current directory
-	dir_entries, err := ReadDirectoryEntries(filename, bug_file_cluster, fs_format)
-	if err != nil {
-		fmt.Println("Error reading directory entries:", err)
+	fmt.Println("OK")
+}
+
+// Login switches to another user, without a name it prints the current one
+func Login(fs *pseudofat.FileSystem, name, password string) {
+
+	if name == "" {
+		user, group := fs.User()
+		fmt.Printf("%s:%s\n", user, group)
 		return
 	}
 
-	// Search for the specified file in the directory
-	var start_cluster int32 = -1
-	for _, entry := range dir_entries {
-		if !IsZeroEntry(entry) { // Skip empty entries
-			entryName := string(bytes.Trim(entry.Name[:], "\x00"))
-			if entryName == bug_file_name {
-				start_cluster = entry.First_cluster
-				break
-			}
-		}
+	err := fs.Login(name, password)
+	if err != nil {
+		PrintError(err)
+		return
 	}
 
-	// If the file is not found, display an error message
-	if start_cluster == -1 {
-		fmt.Printf("Error: File '%s' not found or is not a file.\n", bug_file)
-		return
+	fmt.Println("OK")
+}
+
+// ChangePassword sets the password of the current user or, for root, of any user
+func ChangePassword(fs *pseudofat.FileSystem, name, password string) {
+
+	if name == "" {
+		name, _ = fs.User()
 	}
 
-	// Update the FAT entry to mark the file as corrupted (FAT_BAD_CLUSTER)
-	err = UpdateFatEntry(filename, start_cluster, FAT_BAD, fs_format)
+	err := fs.Passwd(name, password)
 	if err != nil {
-		fmt.Printf("Error marking file '%s' as corrupted: %v\n", bug_file, err)
+		PrintError(err)
 		return
 	}
 
-	fmt.Printf("Marked file '%s' as corrupted (FAT_BAD_CLUSTER).\n", bug_file)
+	fmt.Println("OK")
 }
 
-func CheckForBugs(filename string, fs_format FileSystemFormat) {
+func PrintFreeSpace(fs *pseudofat.FileSystem) {
 
-	// **Load the FAT tables from the file system**
-	fat1, fat2 := LoadFileSystem(filename)
+	free_bytes, total_bytes := fs.FreeSpace()
 
-	// **Check for bad clusters in the FAT tables**
-	for i := 0; i < len(fat1); i++ {
-		if fat1[i] == FAT_BAD || fat2[i] == FAT_BAD {
-			fmt.Printf("Bad cluster found in FAT table: Cluster %d\n", i)
-		}
+	fmt.Printf("%-12s %-12s %-12s %-6s\n", "Size", "Used", "Free", "Use%")
+	fmt.Printf("%-12d %-12d %-12d %d%%\n", total_bytes, total_bytes-free_bytes, free_bytes, (total_bytes-free_bytes)*100/max(total_bytes, 1))
+}
+
+func PrintTables(fs *pseudofat.FileSystem, filename string) {
+
+	fat1, fat2, err := fs.ReadFAT()
+	if err != nil {
+		PrintError(err)
+		return
 	}
 
-	fmt.Println("OK")
+	err = pseudofat.PrintFileSystem(fat1, fat2, filename)
+	if err != nil {
+		PrintError(err)
+	}
 }
 
 func PrintHelp() {
 	fmt.Println("Commands:")
-	fmt.Println("cp - Copy the file")
-	fmt.Println("mv - Move the file")
-	fmt.Println("rm - Remove the file")
-	fmt.Println("mkdir - Make a directory")
+	fmt.Println("cp - Copy the file, cp -r copies a directory tree")
+	fmt.Println("mv - Move or rename a file or a directory")
+	fmt.Println("ln - Give a file another name, ln -s creates a symbolic link")
+	fmt.Println("rm - Remove the file, rm -r removes a directory tree")
+	fmt.Println("mkdir - Make a directory, mkdir -p also makes the missing parents")
 	fmt.Println("rmdir - Remove a directory")
 	fmt.Println("ls - Print the contents of the directory")
 	fmt.Println("cat - Print the contents of the file")
+	fmt.Println("stat - Print the metadata of a file or a directory")
+	fmt.Println("touch - Create an empty file or set its times to now")
 	fmt.Println("cd - Change the path")
 	fmt.Println("pwd - Print the current path")
 	fmt.Println("info - Print the information")
 	fmt.Println("incp - incp")
 	fmt.Println("outcp - outcp")
 	fmt.Println("load - Load the file")
-	fmt.Println("format - Format the file")
+	fmt.Println("format - Format the file, optionally with a cluster size in bytes")
 	fmt.Println("bug - Bug test")
 	fmt.Println("check - Check for bugs")
+	fmt.Println("fsck - Check the file system structure, fsck -y repairs it")
 	fmt.Println("print - Print the FAT tables to the file")
+	fmt.Println("df - Print the used and free space")
+	fmt.Println("defrag - Make the files contiguous, defrag [path] [--dry-run]")
+	fmt.Println("case - Print or set the name lookup mode, case [sensitive|insensitive]")
+	fmt.Println("snapshot - Manage snapshots, snapshot create|delete|rollback|browse NAME, snapshot list")
+	fmt.Println("chmod - Set the permissions, chmod 750|u+x,go-w PATH")
+	fmt.Println("chown - Set the owner, chown USER[:GROUP] PATH, only root")
+	fmt.Println("useradd - Add a user, useradd NAME PASSWORD [GROUP], only root")
+	fmt.Println("passwd - Set a password, passwd PASSWORD or passwd USER PASSWORD")
+	fmt.Println("login - Switch the user, login NAME [PASSWORD], without a name print the current one")
+	fmt.Println("getfattr - Print the extended attributes, getfattr PATH [NAME]")
+	fmt.Println("setfattr - Set an extended attribute, setfattr PATH NAME VALUE")
+	fmt.Println("rmfattr - Remove an extended attribute, rmfattr PATH NAME")
+	fmt.Println("quota - Manage quotas, quota set user:NAME|PATH CLUSTERS:ENTRIES, quota show [user:NAME|PATH], quota report")
 	fmt.Println("help - Print the help")
 	fmt.Println("exit - Exit the program")
 	fmt.Println()
 }
 
-func ExecuteCommand(filename, command, arg1, arg2 string, fs_format FileSystemFormat) {
+// ExecuteCommand runs one command, arg3 is only used by cp -r, ln -s, useradd, setfattr and quota set
+func ExecuteCommand(fs *pseudofat.FileSystem, command, arg1, arg2, arg3 string) {
 
 	switch command {
 	case "cp":
+		if arg1 == "-r" {
+			if arg2 == "" || arg3 == "" {
+				fmt.Println("Source and destination paths are required for copy.")
+				return
+			}
+			CopyTree(fs, arg2, arg3)
+			return
+		}
 		if arg1 == "" || arg2 == "" {
 			fmt.Println("Source and destination paths are required for copy.")
 			return
 		}
-		CopyFile(filename, arg1, arg2, fs_format)
+		CopyFile(fs, arg1, arg2)
 	case "mv":
 		if arg1 == "" || arg2 == "" {
 			fmt.Println("Source and destination paths are required for move.")
 			return
 		}
-		MoveFile(filename, arg1, arg2, fs_format)
+		MoveFile(fs, arg1, arg2)
+	case "ln":
+		if arg1 == "-s" {
+			if arg2 == "" || arg3 == "" {
+				fmt.Println("Target and link paths are required for ln -s.")
+				return
+			}
+			LinkFile(fs, arg2, arg3, true)
+			return
+		}
+		if arg1 == "" || arg2 == "" {
+			fmt.Println("Source and link paths are required for ln.")
+			return
+		}
+		LinkFile(fs, arg1, arg2, false)
 	case "rm":
+		if arg1 == "-r" {
+			if arg2 == "" {
+				fmt.Println("Path is required for remove.")
+				return
+			}
+			RemoveTree(fs, arg2)
+			return
+		}
 		if arg1 == "" {
 			fmt.Println("File path is required for remove.")
 			return
 		}
-		RemoveFile(filename, arg1, fs_format)
+		RemoveFile(fs, arg1)
 	case "mkdir":
+		if arg1 == "-p" {
+			if arg2 == "" {
+				fmt.Println("Directory name is required for mkdir.")
+				return
+			}
+			MakeDirectories(fs, arg2)
+			return
+		}
 		if arg1 == "" {
 			fmt.Println("Directory name is required for mkdir.")
 			return
 		}
-		MakeDirectory(arg1, filename, fs_format)
+		MakeDirectory(fs, arg1)
 	case "rmdir":
 		if arg1 == "" {
 			fmt.Println("Directory name is required for rmdir.")
 			return
 		}
-		RemoveDirectory(filename, arg1, fs_format)
+		RemoveDirectory(fs, arg1)
 	case "ls":
-		PrintDirectoryContents(filename, arg1, fs_format)
+		PrintDirectoryContents(fs, arg1)
 	case "cat":
 		if arg1 == "" {
 			fmt.Println("File path is required for cat.")
 			return
 		}
-		PrintFileContents(filename, arg1, fs_format)
+		PrintFileContents(fs, arg1)
+	case "stat":
+		if arg1 == "" {
+			fmt.Println("File path is required for stat.")
+			return
+		}
+		PrintStat(fs, arg1)
+	case "touch":
+		if arg1 == "" {
+			fmt.Println("File path is required for touch.")
+			return
+		}
+		Touch(fs, arg1)
 	case "cd":
 		if arg1 == "" {
 			fmt.Println("Path is required for cd.")
 			return
 		}
-		ChangePath(filename, arg1, fs_format)
+		ChangePath(fs, arg1)
 	case "pwd":
-		PrintCurrentPath()
+		PrintCurrentPath(fs)
 	case "info":
 		if arg1 == "" {
 			fmt.Println("File path is required for info.")
 			return
 		}
-		PrintInformation(filename, arg1, fs_format)
+		PrintInformation(fs, arg1)
 	case "incp":
 		if arg1 == "" || arg2 == "" {
 			fmt.Println("Source and destination paths are required for incp.")
 			return
 		}
-		Incp(filename, arg1, arg2, fs_format)
+		Incp(fs, arg1, arg2)
 	case "outcp":
 		if arg1 == "" || arg2 == "" {
 			fmt.Println("Source and destination paths are required for outcp.")
 			return
 		}
-		Outcp(filename, arg1, arg2, fs_format)
+		Outcp(fs, arg1, arg2)
 	case "load":
 		if arg1 == "" {
 			fmt.Println("Script file path is required for load.")
 			return
 		}
-		LoadFile(filename, arg1, fs_format)
+		LoadFile(fs, arg1)
 	case "format":
 		if arg1 == "" {
 			fmt.Println("Size is required for format.")
 			return
 		}
-		size, err := strconv.Atoi(arg1)
+		size, err := strconv.Atoi(strings.TrimSuffix(strings.ToUpper(arg1), "MB"))
 		if err != nil {
 			fmt.Println("Invalid size:", arg1)
 			return
 		}
-		FormatFileCmd(filename, size)
+		cluster_size := pseudofat.CLUSTER_SIZE
+		if arg2 != "" {
+			cluster_size, err = strconv.Atoi(strings.TrimSuffix(strings.ToUpper(arg2), "B"))
+			if err != nil {
+				fmt.Println("Invalid cluster size:", arg2)
+				return
+			}
+		}
+		FormatFileCmd(fs, size, cluster_size)
 	case "bug":
 		if arg1 == "" {
 			fmt.Println("File name is required for bug.")
 			return
 		}
-		BugTest(filename, arg1, fs_format)
+		BugTest(fs, arg1)
 	case "check":
-		CheckForBugs(filename, fs_format)
+		CheckForBugs(fs)
+	case "fsck":
+		if arg1 != "" && arg1 != "-y" {
+			fmt.Println("Usage: fsck [-y]")
+			return
+		}
+		CheckFileSystem(fs, arg1 == "-y")
 	case "print":
-		fat1, fat2 := LoadFileSystem(filename)
-		PrintFileSystem(fat1, fat2, "fats.txt")
+		PrintTables(fs, "fats.txt")
+	case "df":
+		PrintFreeSpace(fs)
+	case "defrag":
+		target, dry_run := arg1, arg2 == "--dry-run"
+		if arg1 == "--dry-run" {
+			target, dry_run = arg2, true
+		}
+		if target == "" {
+			target = "/"
+		}
+		Defragment(fs, target, dry_run)
+	case "case":
+		CaseMode(fs, arg1)
+	case "snapshot":
+		Snapshot(fs, arg1, arg2)
+	case "chmod":
+		if arg1 == "" || arg2 == "" {
+			fmt.Println("Mode and path are required for chmod.")
+			return
+		}
+		ChangeMode(fs, arg1, arg2)
+	case "chown":
+		if arg1 == "" || arg2 == "" {
+			fmt.Println("Owner and path are required for chown.")
+			return
+		}
+		ChangeOwner(fs, arg1, arg2)
+	case "useradd":
+		if arg1 == "" {
+			fmt.Println("User name is required for useradd.")
+			return
+		}
+		AddUser(fs, arg1, arg2, arg3)
+	case "passwd":
+		if arg1 == "" {
+			fmt.Println("Password is required for passwd.")
+			return
+		}
+		if arg2 == "" {
+			ChangePassword(fs, "", arg1)
+			return
+		}
+		ChangePassword(fs, arg1, arg2)
+	case "login":
+		Login(fs, arg1, arg2)
+	case "getfattr":
+		if arg1 == "" {
+			fmt.Println("Path is required for getfattr.")
+			return
+		}
+		PrintXattrs(fs, arg1, arg2)
+	case "setfattr":
+		if arg1 == "" || arg2 == "" {
+			fmt.Println("Path and attribute name are required for setfattr.")
+			return
+		}
+		SetXattr(fs, arg1, arg2, arg3)
+	case "rmfattr":
+		if arg1 == "" || arg2 == "" {
+			fmt.Println("Path and attribute name are required for rmfattr.")
+			return
+		}
+		RemoveXattr(fs, arg1, arg2)
+	case "quota":
+		Quota(fs, arg1, arg2, arg3)
 	case "help":
 		PrintHelp()
-	case "exit":
-	case "quit":
-	case "q":
+	case "exit", "quit", "q":
 		fmt.Println("Exiting the file system simulator.")
 		return
 	default:
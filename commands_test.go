@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"zos/sp/pseudofat"
+)
+
+// captureOutput returns what run prints to the standard output
+func captureOutput(t *testing.T, run func()) string {
+
+	t.Helper()
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = writer
+	run()
+	os.Stdout = stdout
+	writer.Close()
+
+	output, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(output)
+}
+
+func TestSplitCommand(t *testing.T) {
+
+	tests := []struct {
+		line  string
+		words []string
+	}{
+		{"", nil},
+		{"  ls  ", []string{"ls"}},
+		{"cp a b", []string{"cp", "a", "b"}},
+		{`mkdir "/my dir"`, []string{"mkdir", "/my dir"}},
+		{`mv 'a b' c\ d`, []string{"mv", "a b", "c d"}},
+		{`setfattr f k "say \"hi\""`, []string{"setfattr", "f", "k", `say "hi"`}},
+		{`setfattr f k 'a\b'`, []string{"setfattr", "f", "k", `a\b`}},
+		{`touch ""`, []string{"touch", ""}},
+	}
+
+	for _, test := range tests {
+		words, err := splitCommand(test.line)
+		if err != nil || !slices.Equal(words, test.words) {
+			t.Errorf("splitCommand(%q) = %q, %v, want %q", test.line, words, err, test.words)
+		}
+	}
+
+	for _, line := range []string{`mkdir "a`, `mkdir 'a`, `mkdir a\`} {
+		if _, err := splitCommand(line); err == nil {
+			t.Errorf("splitCommand(%q) accepted a broken line", line)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+
+	words, err := parseCommand(`cp -r "/a b" /c`)
+	if err != nil || words != [MAX_COMMAND_WORDS]string{"cp", "-r", "/a b", "/c"} {
+		t.Fatalf("parseCommand = %q, %v", words, err)
+	}
+
+	words, err = parseCommand("pwd")
+	if err != nil || words != [MAX_COMMAND_WORDS]string{"pwd"} {
+		t.Fatalf("parseCommand = %q, %v", words, err)
+	}
+
+	if _, err := parseCommand("mkdir a b c d"); err == nil {
+		t.Fatal("parseCommand accepted five words")
+	}
+}
+
+func TestPrintError(t *testing.T) {
+
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&os.PathError{Op: "cd", Path: "/a/b", Err: pseudofat.ErrPathNotFound}, "PATH NOT FOUND"},
+		{fmt.Errorf("cat: %w", pseudofat.ErrNotFound), "FILE NOT FOUND"},
+		{pseudofat.ErrExist, "EXIST"},
+		{pseudofat.ErrNotEmpty, "NOT EMPTY"},
+		{pseudofat.ErrNoSpace, "NO SPACE"},
+		{pseudofat.ErrPermission, "PERMISSION DENIED"},
+		{pseudofat.ErrCorrupt, pseudofat.ErrCorrupt.Error()},
+	}
+
+	for _, test := range tests {
+		output := captureOutput(t, func() { PrintError(test.err) })
+		if strings.TrimSpace(output) != test.want {
+			t.Errorf("PrintError(%v) printed %q, want %q", test.err, output, test.want)
+		}
+	}
+}
+
+func TestTimeCommands(t *testing.T) {
+
+	fs, err := pseudofat.FormatDevice(pseudofat.NewMemoryDevice(0), 2, pseudofat.CLUSTER_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	// **incp keeps the modification time of the host file**
+	host := filepath.Join(t.TempDir(), "host.txt")
+	mtime := time.Date(2010, 6, 7, 8, 9, 10, 0, time.Local)
+	if err := os.WriteFile(host, []byte("host"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(host, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if output := captureOutput(t, func() { Incp(fs, host, "/host.txt") }); strings.TrimSpace(output) != "OK" {
+		t.Fatalf("incp printed %q", output)
+	}
+	output := captureOutput(t, func() { PrintStat(fs, "/host.txt") })
+	if !strings.Contains(output, "Modified:       "+mtime.Format(TIME_FORMAT)) || !strings.Contains(output, "Size:           4") {
+		t.Fatalf("stat printed %q", output)
+	}
+
+	// **touch creates a missing file empty and moves the modification time of an existing one to now**
+	start := time.Now().Truncate(time.Second)
+	for _, name := range []string{"/new.txt", "/host.txt"} {
+		if output := captureOutput(t, func() { Touch(fs, name) }); strings.TrimSpace(output) != "OK" {
+			t.Fatalf("touch %s printed %q", name, output)
+		}
+		entry, err := fs.Stat(name)
+		if err != nil || entry.ModTime().Before(start) {
+			t.Fatalf("'%s' modified %v after touch, %v", name, entry.ModTime(), err)
+		}
+	}
+	if data, err := fs.ReadFile("/host.txt"); err != nil || string(data) != "host" {
+		t.Fatalf("touch changed the contents to %q, %v", data, err)
+	}
+	if entry, _ := fs.Stat("/new.txt"); entry.Size != 0 {
+		t.Fatalf("touch created a file of %d bytes", entry.Size)
+	}
+	if output := captureOutput(t, func() { Touch(fs, "/nodir/file") }); strings.TrimSpace(output) != "PATH NOT FOUND" {
+		t.Fatalf("touch in a missing directory printed %q", output)
+	}
+}
+
+func TestLinkCommands(t *testing.T) {
+
+	fs, err := pseudofat.FormatDevice(pseudofat.NewMemoryDevice(0), 2, pseudofat.CLUSTER_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err := fs.WriteFile("/f", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, link := range []struct {
+		name     string
+		symbolic bool
+	}{{"/hard", false}, {"/soft", true}} {
+		if output := captureOutput(t, func() { LinkFile(fs, "/f", link.name, link.symbolic) }); strings.TrimSpace(output) != "OK" {
+			t.Fatalf("ln %s printed %q", link.name, output)
+		}
+	}
+
+	// **ls shows the link count and where a symbolic link points to**
+	output := captureOutput(t, func() { PrintDirectoryContents(fs, "/") })
+	if !strings.Contains(output, "soft -> /f") {
+		t.Fatalf("ls printed %q", output)
+	}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && (fields[3] == "f" || fields[3] == "hard") && fields[len(fields)-1] != "2" {
+			t.Fatalf("ls shows %q", line)
+		}
+	}
+
+	output = captureOutput(t, func() { PrintStat(fs, "/soft") })
+	if !strings.Contains(output, "symbolic link to /f") {
+		t.Fatalf("stat printed %q", output)
+	}
+	if output := captureOutput(t, func() { RemoveFile(fs, "/soft") }); strings.TrimSpace(output) != "OK" {
+		t.Fatalf("rm of a link printed %q", output)
+	}
+	if data, err := fs.ReadFile("/hard"); err != nil || string(data) != "data" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+}
+
+func TestXattrCommands(t *testing.T) {
+
+	fs, err := pseudofat.FormatDevice(pseudofat.NewMemoryDevice(0), 2, pseudofat.CLUSTER_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err := fs.WriteFile("/f", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, attr := range [][2]string{{"user.src", "http://example.com"}, {"status", "a \"quoted\"\nvalue"}} {
+		if output := captureOutput(t, func() { SetXattr(fs, "/f", attr[0], attr[1]) }); strings.TrimSpace(output) != "OK" {
+			t.Fatalf("setfattr %s printed %q", attr[0], output)
+		}
+	}
+	want := "status=\"a \\\"quoted\\\"\\nvalue\"\nuser.src=\"http://example.com\"\n"
+	if output := captureOutput(t, func() { PrintXattrs(fs, "/f", "") }); output != want {
+		t.Fatalf("getfattr printed %q, want %q", output, want)
+	}
+
+	// **outcp and incp carry the attributes through the host, in a host xattr or in a sidecar**
+	host := filepath.Join(t.TempDir(), "f.txt")
+	if output := captureOutput(t, func() { Outcp(fs, "/f", host) }); strings.TrimSpace(output) != "OK" {
+		t.Fatalf("outcp printed %q", output)
+	}
+	if output := captureOutput(t, func() { Incp(fs, host, "/back") }); strings.TrimSpace(output) != "OK" {
+		t.Fatalf("incp printed %q", output)
+	}
+	if output := captureOutput(t, func() { PrintXattrs(fs, "/back", "") }); output != want {
+		t.Fatalf("attributes after the round trip %q, want %q", output, want)
+	}
+
+	if output := captureOutput(t, func() { RemoveXattr(fs, "/back", "status") }); strings.TrimSpace(output) != "OK" {
+		t.Fatalf("rmfattr printed %q", output)
+	}
+	if output := captureOutput(t, func() { PrintXattrs(fs, "/back", "status") }); strings.TrimSpace(output) != "ATTRIBUTE NOT FOUND" {
+		t.Fatalf("getfattr of a removed attribute printed %q", output)
+	}
+}
+
+func TestSidecar(t *testing.T) {
+
+	// **A sidecar keeps any value, a missing sidecar holds no attributes**
+	sidecar := filepath.Join(t.TempDir(), "f"+XATTR_SIDECAR)
+	attrs := map[string][]byte{"k": []byte("line\nbreak=\"q\""), "empty": nil, "bin": {0, 255}}
+	if err := writeSidecar(sidecar, attrs); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readSidecar(sidecar)
+	if err != nil || len(got) != len(attrs) {
+		t.Fatalf("read %v, %v", got, err)
+	}
+	for name, value := range attrs {
+		if string(got[name]) != string(value) {
+			t.Errorf("'%s' reads %q, want %q", name, got[name], value)
+		}
+	}
+
+	if got, err := readSidecar(sidecar + ".missing"); err != nil || len(got) != 0 {
+		t.Fatalf("missing sidecar: %v, %v", got, err)
+	}
+	if err := os.WriteFile(sidecar, []byte("no equals sign\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSidecar(sidecar); err == nil {
+		t.Fatal("a broken sidecar was accepted")
+	}
+}
+
+func TestQuotaCommands(t *testing.T) {
+
+	fs, err := pseudofat.FormatDevice(pseudofat.NewMemoryDevice(0), 2, pseudofat.CLUSTER_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err := fs.Mkdir("/lim"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.UserAdd("bob", "pw", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		action, target, limits string
+		want                   string
+	}{
+		{"set", "/lim", "5:3", "OK"},
+		{"set", "user:bob", "10:0", "OK"},
+		{"set", "user:ghost", "1:1", "quota ghost: no such user or group"},
+		{"set", "/lim", "five", "Usage: quota set user:NAME|PATH CLUSTERS:ENTRIES"},
+		{"bogus", "", "", "Usage: quota set user:NAME|PATH CLUSTERS:ENTRIES, quota show [user:NAME|PATH], quota report"},
+	}
+	for _, test := range tests {
+		output := captureOutput(t, func() { Quota(fs, test.action, test.target, test.limits) })
+		if strings.TrimSpace(output) != test.want {
+			t.Errorf("quota %s %s %s printed %q, want %q", test.action, test.target, test.limits, output, test.want)
+		}
+	}
+
+	// **show and report list the usage against the limits, - for no limit**
+	output := captureOutput(t, func() { Quota(fs, "show", "/lim", "") })
+	if lines := strings.Split(strings.TrimSpace(output), "\n"); len(lines) != 2 || !slices.Equal(strings.Fields(lines[1]), []string{"dir", "/lim", "1", "5", "0", "3"}) {
+		t.Fatalf("quota show printed %q", output)
+	}
+	output = captureOutput(t, func() { Quota(fs, "report", "", "") })
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 3 || !slices.Equal(strings.Fields(lines[1]), []string{"user", "bob", "0", "10", "0", "-"}) {
+		t.Fatalf("quota report printed %q", output)
+	}
+}
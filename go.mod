@@ -1,3 +1,5 @@
 module zos/sp
 
 go 1.23.1
+
+require golang.org/x/text v0.21.0
@@ -0,0 +1,64 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+)
+
+// HOST_XATTR_PREFIX is the host namespace outcp and incp keep the attributes of a file in
+const HOST_XATTR_PREFIX = "user."
+
+// readHostXattrs returns the user attributes of a host file without their namespace prefix
+func readHostXattrs(file string) (map[string][]byte, error) {
+
+	size, err := syscall.Listxattr(file, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]byte, size)
+	size, err = syscall.Listxattr(file, list)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string][]byte)
+	for _, raw_name := range bytes.Split(list[:size], []byte{0}) {
+
+		name := string(raw_name)
+		if !strings.HasPrefix(name, HOST_XATTR_PREFIX) {
+			continue
+		}
+
+		value_size, err := syscall.Getxattr(file, name, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		value := make([]byte, value_size)
+		value_size, err = syscall.Getxattr(file, name, value)
+		if err != nil {
+			return nil, err
+		}
+
+		attrs[strings.TrimPrefix(name, HOST_XATTR_PREFIX)] = value[:value_size]
+	}
+
+	return attrs, nil
+}
+
+// writeHostXattrs stores the attributes as user attributes of a host file
+func writeHostXattrs(file string, attrs map[string][]byte) error {
+
+	for name, value := range attrs {
+		err := syscall.Setxattr(file, HOST_XATTR_PREFIX+name, value, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// readHostXattrs is not available on this host, incp uses the sidecar file only
+func readHostXattrs(file string) (map[string][]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// writeHostXattrs is not available on this host, outcp falls back to the sidecar file
+func writeHostXattrs(file string, attrs map[string][]byte) error {
+	return errors.ErrUnsupported
+}
@@ -4,18 +4,30 @@ import (
 	"fmt"
 	"os"
 	"strings"
+
+	"zos/sp/pseudofat"
 )
 
-func enterCommand(filename string, fs_format FileSystemFormat) {
+func enterCommand(fs *pseudofat.FileSystem) {
 
 	PrintHelp()
 
 	for {
-		fmt.Print("Enter the command: ")
-		var command, arg1, arg2 string
-		fmt.Scanln(&command, &arg1, &arg2)
-		ExecuteCommand(filename, command, arg1, arg2, fs_format)
-		if command == "exit" || command == "quit" || command == "q" {
+		// **The end of the input ends the shell like exit**
+		line, err := readLine("Enter the command: ")
+		if err != nil {
+			fmt.Println()
+			break
+		}
+
+		words, err := parseCommand(line)
+		if err != nil {
+			fmt.Println("Invalid command:", err)
+			continue
+		}
+
+		ExecuteCommand(fs, words[0], words[1], words[2], words[3])
+		if words[0] == "exit" || words[0] == "quit" || words[0] == "q" {
 			break
 		}
 	}
@@ -52,7 +64,11 @@ func checkFile(filename string) {
 		fmt.Print("Enter the desired file size in MB: ")
 		fmt.Scanln(&file_size_mb)
 
-		Format(filename, file_size_mb)
+		err = pseudofat.Format(filename, file_size_mb, pseudofat.CLUSTER_SIZE)
+		if err != nil {
+			fmt.Println("Error formatting file:", err)
+			return
+		}
 		fmt.Printf("File created and formatted successfully.\n\n")
 
 	} else if err != nil {
@@ -80,13 +96,15 @@ func main() {
 
 	checkFile(filename)
 
-	fs_format := LoadFormat(filename)
-
-	SetCurrentCluster(fs_format.data_start / CLUSTER_SIZE)
+	fs, err := pseudofat.Open(filename)
+	if err != nil {
+		fmt.Println("Error opening file system:", err)
+		return
+	}
+	defer fs.Close()
 
-	enterCommand(filename, fs_format)
+	enterCommand(fs)
 
-	fat1, fat2 := LoadFileSystem(filename)
-	PrintFileSystem(fat1, fat2, "fats_after.txt")
+	PrintTables(fs, "fats_after.txt")
 
 }
@@ -0,0 +1,245 @@
+package pseudofat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// The free-cluster hint lives in the header cluster behind the superblock,
+// much like the FAT32 FSInfo sector. It commits in the same transaction as the
+// FAT it counts, so a mount trusts a valid hint and builds the bitmap from FAT1
+// only when the first cluster is allocated or released.
+const (
+	FSINFO_OFFSET    = SUPERBLOCK_SIZE // right behind the superblock
+	FSINFO_SIGNATURE = 0x61417272      // "rrAa", marks a valid hint
+	FSINFO_SIZE      = 12
+)
+
+// initAllocator rebuilds the bitmap and the free count from FAT1
+func (fs *FileSystem) initAllocator() {
+	fs.alloc = allocator{cursor: fs.rootCluster()}
+	fs.loadBitmap()
+}
+
+// loadBitmap builds the bitmap and the free count from FAT1 and the snapshots unless it is
+// built already. Clusters freed by the running transaction stay allocated until its commit.
+func (fs *FileSystem) loadBitmap() {
+
+	if fs.alloc.bitmap != nil {
+		return
+	}
+
+	cluster_count := len(fs.fat1)
+	bitmap := make([]uint64, (cluster_count+63)/64)
+	free_count := int32(0)
+
+	for cluster, value := range fs.fat1 {
+		if value == FAT_FREE && fs.snapshotRefs(int32(cluster)) == 0 {
+			free_count++
+		} else {
+			bitmap[cluster/64] |= 1 << (cluster % 64)
+		}
+	}
+
+	for _, cluster := range fs.journal.freed {
+		if bitmap[cluster/64]&(1<<(cluster%64)) == 0 {
+			bitmap[cluster/64] |= 1 << (cluster % 64)
+			free_count--
+		}
+	}
+
+	// **The bits past the last cluster never get allocated**
+	for cluster := cluster_count; cluster < len(bitmap)*64; cluster++ {
+		bitmap[cluster/64] |= 1 << (cluster % 64)
+	}
+
+	// **The count may differ from the hint the mount trusted, the next commit rewrites it**
+	fs.alloc.bitmap, fs.alloc.free_count = bitmap, free_count
+	fs.alloc.hint_dirty = true
+}
+
+// loadFSInfo takes the free count and the next-fit cursor over from a valid hint,
+// without one the bitmap is built right away and the hint is rewritten
+func (fs *FileSystem) loadFSInfo() error {
+
+	header := make([]byte, fs.clusterSize())
+	err := fs.device.ReadCluster(0, header)
+	if err != nil {
+		return fmt.Errorf("error reading free cluster hint: %w", err)
+	}
+
+	signature := binary.LittleEndian.Uint32(header[FSINFO_OFFSET:])
+	free_count := int32(binary.LittleEndian.Uint32(header[FSINFO_OFFSET+4:]))
+	cursor := int32(binary.LittleEndian.Uint32(header[FSINFO_OFFSET+8:]))
+
+	data_clusters := fs.fs_format.cluster_count - fs.rootCluster()
+	if signature != FSINFO_SIGNATURE || free_count < 0 || free_count > data_clusters ||
+		cursor < fs.rootCluster() || cursor >= int32(len(fs.fat1)) {
+
+		fs.loadBitmap()
+		return nil
+	}
+
+	// **Loading the snapshots built the bitmap already, the hint only has to agree with it**
+	if fs.alloc.bitmap != nil {
+		fs.alloc.hint_dirty = free_count != fs.alloc.free_count
+	} else {
+		fs.alloc.free_count = free_count
+	}
+	fs.alloc.cursor = cursor
+
+	return nil
+}
+
+// encodeFSInfo returns the hint for the given free count and the current cursor
+func (fs *FileSystem) encodeFSInfo(free_count int32) []byte {
+
+	fsinfo := make([]byte, FSINFO_SIZE)
+	binary.LittleEndian.PutUint32(fsinfo, FSINFO_SIGNATURE)
+	binary.LittleEndian.PutUint32(fsinfo[4:], uint32(free_count))
+	binary.LittleEndian.PutUint32(fsinfo[8:], uint32(fs.alloc.cursor))
+
+	return fsinfo
+}
+
+// saveFSInfo persists the free count and the cursor when they changed since the last save,
+// a commit stages the hint with its FAT instead
+func (fs *FileSystem) saveFSInfo() error {
+
+	if !fs.alloc.hint_dirty {
+		return nil
+	}
+
+	err := fs.writeBytes(fs.encodeFSInfo(fs.alloc.free_count), FSINFO_OFFSET)
+	if err != nil {
+		return fmt.Errorf("error writing free cluster hint: %w", err)
+	}
+
+	fs.alloc.hint_dirty = false
+	return nil
+}
+
+// markCluster keeps the bitmap and the free count in step with a FAT entry change
+func (fs *FileSystem) markCluster(cluster int32, used bool) {
+
+	// **A cluster a snapshot references stays allocated after the live tree lets it go**
+	if !used && fs.snapshotRefs(cluster) > 0 {
+		used = true
+	}
+
+	fs.loadBitmap()
+	word, bit := cluster/64, uint64(1)<<(cluster%64)
+	if (fs.alloc.bitmap[word]&bit != 0) == used {
+		return
+	}
+
+	fs.alloc.bitmap[word] ^= bit
+	if used {
+		fs.alloc.free_count--
+	} else {
+		fs.alloc.free_count++
+	}
+
+	fs.alloc.hint_dirty = true
+}
+
+// allocateCluster takes the next free cluster after the cursor and marks it as the end of a chain
+func (fs *FileSystem) allocateCluster() (int32, error) {
+
+	fs.loadBitmap()
+	if fs.alloc.free_count <= 0 {
+		return -1, ErrNoSpace
+	}
+
+	cluster := fs.nextFreeCluster(fs.alloc.cursor)
+	if cluster < 0 {
+		return -1, fmt.Errorf("free count %d does not match the bitmap: %w", fs.alloc.free_count, ErrCorrupt)
+	}
+
+	err := fs.updateFatEntry(cluster, FAT_EOF)
+	if err != nil {
+		return -1, err
+	}
+
+	fs.alloc.cursor = cluster + 1
+	if fs.alloc.cursor >= int32(len(fs.fat1)) {
+		fs.alloc.cursor = fs.rootCluster()
+	}
+
+	return cluster, nil
+}
+
+// allocateChain reserves n linked clusters at once, nothing stays allocated when it fails
+func (fs *FileSystem) allocateChain(n int) ([]int32, error) {
+
+	if !fs.hasFreeClusters(n) {
+		return nil, ErrNoSpace
+	}
+
+	chain := make([]int32, 0, n)
+	for len(chain) < n {
+
+		cluster, err := fs.allocateCluster()
+		if err == nil && len(chain) > 0 {
+			err = fs.updateFatEntry(chain[len(chain)-1], cluster)
+		}
+		if err != nil {
+			fs.releaseClusters(append(chain, cluster))
+			return nil, err
+		}
+
+		chain = append(chain, cluster)
+	}
+
+	return chain, nil
+}
+
+// releaseClusters returns reserved clusters to the free pool
+func (fs *FileSystem) releaseClusters(chain []int32) {
+	for _, cluster := range chain {
+		if cluster >= 0 {
+			fs.updateFatEntry(cluster, FAT_FREE)
+		}
+	}
+}
+
+// nextFreeCluster searches the bitmap from start to the end and then wraps around
+func (fs *FileSystem) nextFreeCluster(start int32) int32 {
+
+	fs.loadBitmap()
+	words := len(fs.alloc.bitmap)
+	for i := 0; i <= words; i++ {
+
+		word := (int(start/64) + i) % words
+		used := fs.alloc.bitmap[word]
+
+		// **Ignore the bits before the cursor in its own word on the first pass**
+		if i == 0 {
+			used |= 1<<(start%64) - 1
+		}
+
+		if used != ^uint64(0) {
+			return int32(word*64 + bits.TrailingZeros64(^used))
+		}
+	}
+
+	return -1
+}
+
+// hasFreeClusters reports whether n more clusters can be allocated
+func (fs *FileSystem) hasFreeClusters(n int) bool {
+
+	fs.loadBitmap()
+	return int64(n) <= int64(fs.alloc.free_count)
+}
+
+// FreeSpace returns the free and the total size of the data area in bytes
+func (fs *FileSystem) FreeSpace() (free_bytes, total_bytes int64) {
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	data_clusters := int64(fs.fs_format.cluster_count - fs.rootCluster())
+	return int64(fs.alloc.free_count) * fs.clusterSize(), data_clusters * fs.clusterSize()
+}
@@ -0,0 +1,186 @@
+package pseudofat
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestAllocator(t *testing.T) {
+
+	fs, device := newVolume(t, 1)
+	free_bytes, _ := fs.FreeSpace()
+
+	// **The free count follows every allocation and release**
+	if err := fs.WriteFile("/a", make([]byte, 3*CLUSTER_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/b", make([]byte, CLUSTER_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	if free, _ := fs.FreeSpace(); free != free_bytes-4*CLUSTER_SIZE {
+		t.Fatalf("%d bytes free, want %d", free, free_bytes-4*CLUSTER_SIZE)
+	}
+	if fs.alloc.free_count != countFree(fs) {
+		t.Fatalf("free count %d, FAT1 has %d free clusters", fs.alloc.free_count, countFree(fs))
+	}
+
+	// **Next fit continues behind the last allocation instead of reusing the freed start**
+	chain_b, err := fs.ClusterChain("/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/c", []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	chain_c, err := fs.ClusterChain("/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain_c[0] != chain_b[0]+1 {
+		t.Fatalf("/c starts at %d, want %d right behind /b", chain_c[0], chain_b[0]+1)
+	}
+
+	// **The hint on the device carries the free count and the cursor**
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	hint := device.data[FSINFO_OFFSET:]
+	if binary.LittleEndian.Uint32(hint) != FSINFO_SIGNATURE {
+		t.Fatal("no free cluster hint after close")
+	}
+	stored_free := int32(binary.LittleEndian.Uint32(hint[4:]))
+	stored_cursor := int32(binary.LittleEndian.Uint32(hint[8:]))
+	if stored_cursor != chain_c[0]+1 {
+		t.Fatalf("stored cursor %d, want %d", stored_cursor, chain_c[0]+1)
+	}
+
+	fs, err = OpenDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.alloc.hint_dirty || fs.alloc.free_count != stored_free || fs.alloc.cursor != stored_cursor {
+		t.Fatalf("hint %d/%d not taken over on mount, have %d/%d", stored_free, stored_cursor, fs.alloc.free_count, fs.alloc.cursor)
+	}
+	if fs.alloc.bitmap != nil {
+		t.Fatal("mount with a valid hint scanned FAT1")
+	}
+	fs.Close()
+
+	// **A wrong but plausible hint is trusted until the first allocation builds the bitmap**
+	binary.LittleEndian.PutUint32(hint[4:], uint32(stored_free-5))
+	fs, err = OpenDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.alloc.free_count != stored_free-5 {
+		t.Fatalf("free count %d, want the hint %d", fs.alloc.free_count, stored_free-5)
+	}
+	if err := fs.WriteFile("/d", []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	if fs.alloc.free_count != stored_free-1 || fs.alloc.free_count != countFree(fs) {
+		t.Fatalf("free count %d after the first allocation, want %d", fs.alloc.free_count, stored_free-1)
+	}
+	if free := int32(binary.LittleEndian.Uint32(hint[4:])); free != stored_free-1 {
+		t.Fatalf("hint %d after the commit, want %d", free, stored_free-1)
+	}
+	fs.Close()
+
+	// **A broken hint is replaced by the count built from FAT1**
+	binary.LittleEndian.PutUint32(hint, 0)
+	fs, err = OpenDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fs.alloc.hint_dirty || fs.alloc.bitmap == nil || fs.alloc.free_count != stored_free-1 {
+		t.Fatalf("free count %d from a broken hint, want %d", fs.alloc.free_count, stored_free-1)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint32(hint) != FSINFO_SIGNATURE || int32(binary.LittleEndian.Uint32(hint[4:])) != stored_free-1 {
+		t.Fatalf("hint %d after close, want %d", int32(binary.LittleEndian.Uint32(hint[4:])), stored_free-1)
+	}
+}
+
+func TestAllocateChainAllOrNothing(t *testing.T) {
+
+	fs, memory := newVolume(t, 1)
+	if err := fs.WriteFile("/src", make([]byte, 5*CLUSTER_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	device := &crashDevice{MemoryDevice: memory, writes_left: -1}
+	fs, err := OpenDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	free_bytes, _ := fs.FreeSpace()
+
+	// **A file larger than the free space is refused before anything is allocated**
+	if err := fs.WriteFile("/big", make([]byte, free_bytes+1)); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("write larger than the volume: %v", err)
+	}
+	if _, err := fs.Stat("/big"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("entry of a refused write: %v", err)
+	}
+
+	// **An operation failing at any write gives every reserved cluster back**
+	operations := []struct {
+		name string
+		run  func() error
+		undo func() error
+	}{
+		{"write", func() error { return fs.WriteFile("/x", make([]byte, 5*CLUSTER_SIZE)) }, func() error { return fs.Remove("/x") }},
+		{"copy", func() error { return fs.Copy("/src", "/y") }, func() error { return fs.Remove("/y") }},
+		{"mkdir", func() error { return fs.Mkdir("/d") }, func() error { return fs.Remove("/d") }},
+	}
+
+	for _, op := range operations {
+		for writes := 0; ; writes++ {
+
+			device.writes_left = writes
+			err := op.run()
+			device.writes_left = -1
+
+			if err != nil && !errors.Is(err, errCrash) {
+				t.Fatalf("%s after %d writes: %v", op.name, writes, err)
+			}
+
+			// **A crash after the journal commit still completes the operation**
+			if undo_err := op.undo(); undo_err != nil && (err == nil || !errors.Is(undo_err, ErrNotFound)) {
+				t.Fatal(op.name, undo_err)
+			}
+
+			if free, _ := fs.FreeSpace(); free != free_bytes {
+				t.Fatalf("%s failing after %d writes leaks %d bytes", op.name, writes, free_bytes-free)
+			}
+			checkClean(t, fs)
+
+			if err == nil {
+				break
+			}
+		}
+	}
+
+	// **The device holds the same free space after a remount**
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs, err = OpenDevice(memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free, _ := fs.FreeSpace(); free != free_bytes {
+		t.Fatalf("%d bytes free after remounting, want %d", free, free_bytes)
+	}
+	checkClean(t, fs)
+}
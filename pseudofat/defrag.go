@@ -0,0 +1,367 @@
+package pseudofat
+
+import (
+	"fmt"
+	"path"
+	"slices"
+)
+
+// ChainFragmentation describes how the chain of one entry is spread over the volume
+type ChainFragmentation struct {
+	Path      string
+	Clusters  int
+	Fragments int // runs of consecutive clusters
+}
+
+// Score returns 0 for a contiguous chain up to 100 when no two clusters are adjacent
+func (frag ChainFragmentation) Score() float64 {
+
+	if frag.Clusters <= 1 {
+		return 0
+	}
+
+	return float64(frag.Fragments-1) * 100 / float64(frag.Clusters-1)
+}
+
+// DefragMove relocates a whole chain into the contiguous run starting at To
+type DefragMove struct {
+	Path         string
+	From         int32 // first cluster before the move
+	To           int32 // first cluster of the new run
+	Clusters     int
+	is_directory bool
+}
+
+// DefragReport lists the chains under the defragmented path and the moves that make them contiguous
+type DefragReport struct {
+	Chains  []ChainFragmentation
+	Moves   []DefragMove
+	Skipped []string // fragmented chains that stay, the root directory or no free run large enough
+	Before  float64  // volume fragmentation score before the moves
+	After   float64  // volume fragmentation score once all moves are done
+}
+
+// Defrag makes the chain of every file and directory under target contiguous,
+// with dry_run set it only returns the fragmentation report and the planned moves
+func (s *Session) Defrag(target string, dry_run bool) (DefragReport, error) {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	err := s.fs.requireRoot()
+	if err != nil {
+		return DefragReport{}, pathError("defrag", target, err)
+	}
+
+	// **Work with absolute paths, the moves may relocate the working directory**
+	if !path.IsAbs(target) {
+		target = path.Join(s.current_path, target)
+	}
+
+	report, err := s.fs.planDefrag(path.Clean(target))
+	if err != nil || dry_run {
+		return report, pathError("defrag", target, err)
+	}
+
+	for _, move := range report.Moves {
+		err = s.fs.commit(s.fs.moveChain(move))
+		if err != nil {
+			return report, pathError("defrag", move.Path, err)
+		}
+	}
+
+	return report, nil
+}
+
+// defragTarget is one chain found under the defragmented path
+type defragTarget struct {
+	path  string
+	entry DirectoryEntry
+	chain []int32
+}
+
+// planDefrag measures the fragmentation under target and plans the moves on a copy of the
+// allocation bitmap, every move takes the first free run that fits and frees the old chain
+func (fs *FileSystem) planDefrag(target string) (DefragReport, error) {
+
+	parent_cluster, name, err := fs.parsePath(fs.rootCluster(), target, true)
+	if err != nil {
+		return DefragReport{}, err
+	}
+
+	// **The root directory has no entry of its own, use its '.' entry**
+	if name == "" {
+		name = "."
+	}
+
+	entry, err := fs.findEntry(name, parent_cluster)
+	if err != nil {
+		return DefragReport{}, err
+	}
+
+	var targets []defragTarget
+	err = fs.collectChains(target, entry, &targets)
+	if err != nil {
+		return DefragReport{}, err
+	}
+
+	var report DefragReport
+	var links, breaks_before, breaks_after int
+	fs.loadBitmap()
+	bitmap := slices.Clone(fs.alloc.bitmap)
+
+	moved := make(map[int32]bool)
+	for _, item := range targets {
+
+		// **Hard links share one chain, it is measured and moved once**
+		if moved[item.chain[0]] {
+			continue
+		}
+		moved[item.chain[0]] = true
+
+		frag := ChainFragmentation{Path: item.path, Clusters: len(item.chain), Fragments: countFragments(item.chain)}
+		report.Chains = append(report.Chains, frag)
+
+		links += frag.Clusters - 1
+		breaks_before += frag.Fragments - 1
+		if frag.Fragments == 1 {
+			continue
+		}
+
+		// **The root directory is found through its fixed first cluster**
+		if item.entry.First_cluster == fs.rootCluster() {
+			report.Skipped = append(report.Skipped, item.path)
+			breaks_after += frag.Fragments - 1
+			continue
+		}
+
+		start := findFreeRun(bitmap, fs.rootCluster(), len(item.chain))
+		if start < 0 {
+			report.Skipped = append(report.Skipped, item.path)
+			breaks_after += frag.Fragments - 1
+			continue
+		}
+
+		// **Replay the move on the copy so later moves see its effect**
+		for i := range int32(len(item.chain)) {
+			setBit(bitmap, start+i, true)
+		}
+		for _, cluster := range item.chain {
+			setBit(bitmap, cluster, false)
+		}
+
+		report.Moves = append(report.Moves, DefragMove{
+			Path:         item.path,
+			From:         item.chain[0],
+			To:           start,
+			Clusters:     len(item.chain),
+			is_directory: item.entry.Is_directory == 1,
+		})
+	}
+
+	if links > 0 {
+		report.Before = float64(breaks_before) * 100 / float64(links)
+		report.After = float64(breaks_after) * 100 / float64(links)
+	}
+
+	return report, nil
+}
+
+// collectChains lists the entry and, for a directory, everything below it with parents before children
+func (fs *FileSystem) collectChains(entry_path string, entry DirectoryEntry, targets *[]defragTarget) error {
+
+	chain, err := fs.readChain(entry.First_cluster)
+	if err != nil {
+		return fmt.Errorf("error reading '%s': %w", entry_path, err)
+	}
+
+	*targets = append(*targets, defragTarget{path: entry_path, entry: entry, chain: chain})
+	if entry.Is_directory != 1 {
+		return nil
+	}
+
+	dir_entries, err := fs.readDirectoryChain(chain)
+	if err != nil {
+		return err
+	}
+
+	for _, sub_entry := range dir_entries[2:] {
+		if !isUsedEntry(sub_entry) {
+			continue
+		}
+
+		err = fs.collectChains(path.Join(entry_path, sub_entry.FileName()), sub_entry, targets)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// countFragments returns the number of runs of consecutive clusters in the chain
+func countFragments(chain []int32) int {
+
+	fragments := 1
+	for i := 1; i < len(chain); i++ {
+		if chain[i] != chain[i-1]+1 {
+			fragments++
+		}
+	}
+
+	return fragments
+}
+
+// findFreeRun returns the first cluster of the lowest run of n free clusters at or after start, or -1
+func findFreeRun(bitmap []uint64, start int32, n int) int32 {
+
+	run := 0
+	for cluster := start; int(cluster) < len(bitmap)*64; cluster++ {
+
+		// **Skip whole words that are in use**
+		if cluster%64 == 0 && bitmap[cluster/64] == ^uint64(0) {
+			run = 0
+			cluster += 63
+			continue
+		}
+
+		if bitmap[cluster/64]&(1<<(cluster%64)) != 0 {
+			run = 0
+			continue
+		}
+
+		run++
+		if run == n {
+			return cluster - int32(n) + 1
+		}
+	}
+
+	return -1
+}
+
+func setBit(bitmap []uint64, cluster int32, used bool) {
+	if used {
+		bitmap[cluster/64] |= 1 << (cluster % 64)
+	} else {
+		bitmap[cluster/64] &^= 1 << (cluster % 64)
+	}
+}
+
+// moveChain copies the chain into its planned run, publishes it in the parent directory and frees the old chain
+func (fs *FileSystem) moveChain(move DefragMove) error {
+
+	// **Earlier moves may have relocated the parent, resolve it again**
+	parent_cluster, name, err := fs.parsePath(fs.rootCluster(), move.Path, true)
+	if err != nil {
+		return err
+	}
+
+	entry, err := fs.findEntry(name, parent_cluster)
+	if err != nil {
+		return err
+	}
+
+	chain, err := fs.readChain(entry.First_cluster)
+	if err != nil {
+		return err
+	}
+
+	if entry.First_cluster != move.From || len(chain) != move.Clusters {
+		return fmt.Errorf("chain changed since the move was planned: %w", ErrInvalid)
+	}
+
+	fs.loadBitmap()
+	for i := range int32(move.Clusters) {
+		if fs.alloc.bitmap[(move.To+i)/64]&(1<<((move.To+i)%64)) != 0 {
+			return fmt.Errorf("cluster %d of the planned run is in use: %w", move.To+i, ErrInvalid)
+		}
+	}
+
+	// **Allocate the run, the whole move commits as one transaction**
+	for i := range int32(move.Clusters) {
+		next := move.To + i + 1
+		if int(i) == move.Clusters-1 {
+			next = FAT_EOF
+		}
+
+		err = fs.updateFatEntry(move.To+i, next)
+		if err != nil {
+			return err
+		}
+	}
+
+	// **File contents are copied directly, directory clusters are staged like every directory write**
+	buffer := make([]byte, fs.clusterSize())
+	for i, cluster := range chain {
+
+		new_cluster := move.To + int32(i)
+
+		// **The '.' entry of a moved directory points to the new place**
+		if i == 0 && move.is_directory {
+			dir_entries, err := fs.readDirectoryChain(chain[:1])
+			if err != nil {
+				return err
+			}
+
+			dir_entries[0].First_cluster = move.To
+			err = fs.writeDirectoryEntries(new_cluster, dir_entries)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = fs.readCluster(cluster, buffer)
+		if err == nil && move.is_directory {
+			err = fs.stageBytes(buffer, fs.clusterOffset(new_cluster))
+		} else if err == nil {
+			err = fs.device.WriteCluster(new_cluster, buffer)
+		}
+		if err != nil {
+			return fmt.Errorf("error copying cluster %d: %w", cluster, err)
+		}
+	}
+
+	// **Publish the new chain and free the old one**
+	entry.First_cluster = move.To
+	err = fs.updateDirectoryEntry(parent_cluster, name, entry)
+	if err != nil {
+		return err
+	}
+
+	if move.is_directory {
+		fs.dir_moves++
+		err = fs.updateChildParents(move.To)
+		if err == nil {
+			err = fs.moveQuota(move.From, move.To)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return fs.freeChain(move.From)
+}
+
+// updateChildParents rewrites the '..' entry of every subdirectory of the directory at dir_cluster
+func (fs *FileSystem) updateChildParents(dir_cluster int32) error {
+
+	dir_entries, err := fs.readDirectoryEntries(dir_cluster)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range dir_entries[2:] {
+
+		if !isUsedEntry(entry) || entry.Is_directory != 1 {
+			continue
+		}
+
+		err = fs.setParentDirectory(entry.First_cluster, dir_cluster)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
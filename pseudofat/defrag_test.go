@@ -0,0 +1,174 @@
+package pseudofat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// fragmentVolume fills the volume with files and directories whose chains are split by removals
+// and appends, it returns the contents every file must keep
+func fragmentVolume(t *testing.T, fs *FileSystem) map[string][]byte {
+
+	t.Helper()
+
+	if err := fs.MkdirAll("/d/sub"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := make(map[string][]byte)
+	for i := range 30 {
+		for _, dir := range []string{"/", "/d/", "/d/sub/"} {
+			name := fmt.Sprintf("%sf%d", dir, i)
+			want[name] = bytes.Repeat([]byte{byte(i + len(dir))}, 700*(i%5+1))
+			if err := fs.WriteFile(name, want[name]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for i := 0; i < 30; i += 2 {
+		name := fmt.Sprintf("/f%d", i)
+		if err := fs.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, name)
+	}
+
+	for i := 1; i < 30; i += 2 {
+		name := fmt.Sprintf("/d/f%d", i)
+		tail := bytes.Repeat([]byte("x"), 1500)
+		appendFile(t, fs, name, string(tail))
+		want[name] = append(want[name], tail...)
+	}
+
+	for i := range 60 {
+		if err := fs.Mkdir(fmt.Sprintf("/d/g%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 60; i += 3 {
+		if err := fs.Remove(fmt.Sprintf("/d/g%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return want
+}
+
+// checkFiles fails unless every file holds its contents and fsck finds nothing
+func checkFiles(t *testing.T, fs *FileSystem, want map[string][]byte) {
+
+	t.Helper()
+
+	for name, data := range want {
+		got, err := fs.ReadFile(name)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("'%s' lost its contents, %v", name, err)
+		}
+	}
+
+	checkClean(t, fs)
+}
+
+func TestDefrag(t *testing.T) {
+
+	fs, _ := newVolume(t, 4)
+	want := fragmentVolume(t, fs)
+
+	session := fs.NewSession()
+	if err := session.Chdir("/d/sub"); err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.OpenFile("/d/sub/f3", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	// **A dry run only reports**
+	plan, err := fs.Defrag("/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Moves) == 0 || plan.Before <= plan.After {
+		t.Fatalf("dry run plans %d moves from score %.2f to %.2f", len(plan.Moves), plan.Before, plan.After)
+	}
+	checkFiles(t, fs, want)
+
+	report, err := fs.Defrag("/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, fs, want)
+
+	// **Nothing is left to move and the result is what the plan promised**
+	again, err := fs.Defrag("/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.Moves) != 0 || again.Before != report.After {
+		t.Fatalf("%d moves left, fragmentation %v, want %v", len(again.Moves), again.Before, report.After)
+	}
+
+	// **Sessions and open files follow the moved chains**
+	if data, err := session.ReadFile("f3"); err != nil || !bytes.Equal(data, want["/d/sub/f3"]) {
+		t.Fatalf("session lost its working directory: %v", err)
+	}
+	if err := session.Chdir(".."); err != nil || session.Getwd() != "/d" {
+		t.Fatal(session.Getwd(), err)
+	}
+	if _, err := session.Stat("g1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte("Q"), 0); err != nil {
+		t.Fatal(err)
+	}
+	want["/d/sub/f3"][0] = 'Q'
+	checkFiles(t, fs, want)
+}
+
+func TestDefragCrash(t *testing.T) {
+
+	fs, memory := newVolume(t, 4)
+	want := fragmentVolume(t, fs)
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// **Whenever the machine stops, a remount finds every file and defrag can finish the job**
+	for writes := 0; ; writes += 7 {
+
+		device := &crashDevice{MemoryDevice: cloneDevice(memory), writes_left: writes}
+		fs, err := OpenDevice(device)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = fs.Defrag("/", false)
+		if err != nil && !errors.Is(err, errCrash) {
+			t.Fatalf("defrag after %d writes: %v", writes, err)
+		}
+
+		remounted, err_mount := OpenDevice(device.MemoryDevice)
+		if err_mount != nil {
+			t.Fatalf("remount after %d writes: %v", writes, err_mount)
+		}
+		checkFiles(t, remounted, want)
+
+		if err == nil {
+			break
+		}
+
+		if _, err := remounted.Defrag("/", false); err != nil {
+			t.Fatal(err)
+		}
+		checkFiles(t, remounted, want)
+
+		if report, _ := remounted.Defrag("/", true); len(report.Moves) != 0 {
+			t.Fatalf("%d moves left after finishing the defrag interrupted at %d writes", len(report.Moves), writes)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package pseudofat
+
+import (
+	"fmt"
+	"os"
+)
+
+// BlockDevice is the storage a volume lives on, it is read and written in whole clusters.
+// The buffer length is the cluster size, cluster n starts at byte n*len(buffer) of the device.
+type BlockDevice interface {
+	ReadCluster(cluster int32, buffer []byte) error
+	WriteCluster(cluster int32, buffer []byte) error
+	Flush() error
+	Size() int64
+	Close() error
+}
+
+// Resizer is implemented by devices whose size can change, Format uses it to fit the device to the volume
+type Resizer interface {
+	Resize(size int64) error
+}
+
+// checkCluster validates the cluster number and buffer length of a cluster access
+func checkCluster(device BlockDevice, cluster int32, buffer []byte) error {
+
+	if !validClusterSize(len(buffer)) {
+		return fmt.Errorf("buffer of %d bytes is not one cluster: %w", len(buffer), ErrInvalid)
+	}
+
+	if cluster < 0 || (int64(cluster)+1)*int64(len(buffer)) > device.Size() {
+		return fmt.Errorf("cluster %d is outside of the device: %w", cluster, ErrInvalid)
+	}
+
+	return nil
+}
+
+// FileDevice stores the volume in a host file and keeps one descriptor open until Close
+type FileDevice struct {
+	file *os.File
+	size int64
+}
+
+// OpenFileDevice opens the host file with os.OpenFile flags, use os.O_RDONLY together with ReadOnly for read-only mounts
+func OpenFileDevice(filename string, flag int) (*FileDevice, error) {
+
+	file, err := os.OpenFile(filename, flag, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error reading file size: %w", err)
+	}
+
+	return &FileDevice{file: file, size: info.Size()}, nil
+}
+
+func (device *FileDevice) ReadCluster(cluster int32, buffer []byte) error {
+
+	err := checkCluster(device, cluster, buffer)
+	if err != nil {
+		return err
+	}
+
+	_, err = device.file.ReadAt(buffer, int64(cluster)*int64(len(buffer)))
+	if err != nil {
+		return fmt.Errorf("error reading cluster %d: %w", cluster, err)
+	}
+
+	return nil
+}
+
+func (device *FileDevice) WriteCluster(cluster int32, buffer []byte) error {
+
+	err := checkCluster(device, cluster, buffer)
+	if err != nil {
+		return err
+	}
+
+	_, err = device.file.WriteAt(buffer, int64(cluster)*int64(len(buffer)))
+	if err != nil {
+		return fmt.Errorf("error writing cluster %d: %w", cluster, err)
+	}
+
+	return nil
+}
+
+func (device *FileDevice) Flush() error {
+	return device.file.Sync()
+}
+
+func (device *FileDevice) Size() int64 {
+	return device.size
+}
+
+// Resize truncates or extends the host file, new space reads as zeros
+func (device *FileDevice) Resize(size int64) error {
+
+	err := device.file.Truncate(size)
+	if err != nil {
+		return fmt.Errorf("error truncating file: %w", err)
+	}
+
+	device.size = size
+	return nil
+}
+
+func (device *FileDevice) Close() error {
+	return device.file.Close()
+}
+
+// MemoryDevice keeps the whole volume in memory, it is meant for tests and scratch volumes
+type MemoryDevice struct {
+	data []byte
+}
+
+// NewMemoryDevice returns a zeroed in-memory device of the given size in bytes
+func NewMemoryDevice(size int64) *MemoryDevice {
+	return &MemoryDevice{data: make([]byte, size)}
+}
+
+func (device *MemoryDevice) ReadCluster(cluster int32, buffer []byte) error {
+
+	err := checkCluster(device, cluster, buffer)
+	if err != nil {
+		return err
+	}
+
+	copy(buffer, device.data[int64(cluster)*int64(len(buffer)):])
+	return nil
+}
+
+func (device *MemoryDevice) WriteCluster(cluster int32, buffer []byte) error {
+
+	err := checkCluster(device, cluster, buffer)
+	if err != nil {
+		return err
+	}
+
+	copy(device.data[int64(cluster)*int64(len(buffer)):], buffer)
+	return nil
+}
+
+func (device *MemoryDevice) Flush() error { return nil }
+func (device *MemoryDevice) Size() int64  { return int64(len(device.data)) }
+func (device *MemoryDevice) Close() error { return nil }
+
+// Resize drops or zero-extends the end of the device
+func (device *MemoryDevice) Resize(size int64) error {
+
+	if size < 0 {
+		return fmt.Errorf("negative device size: %w", ErrInvalid)
+	}
+
+	if size <= int64(len(device.data)) {
+		clear(device.data[size:])
+		device.data = device.data[:size]
+		return nil
+	}
+
+	device.data = append(device.data, make([]byte, size-int64(len(device.data)))...)
+	return nil
+}
+
+// readOnlyDevice rejects every write to the wrapped device
+type readOnlyDevice struct {
+	device BlockDevice
+}
+
+// ReadOnly wraps a device so that any attempt to modify the volume fails with ErrReadOnly
+func ReadOnly(device BlockDevice) BlockDevice {
+	return &readOnlyDevice{device: device}
+}
+
+func (device *readOnlyDevice) ReadCluster(cluster int32, buffer []byte) error {
+	return device.device.ReadCluster(cluster, buffer)
+}
+
+func (device *readOnlyDevice) WriteCluster(cluster int32, buffer []byte) error {
+	return fmt.Errorf("cannot write cluster %d: %w", cluster, ErrReadOnly)
+}
+
+func (device *readOnlyDevice) Flush() error { return nil }
+func (device *readOnlyDevice) Size() int64  { return device.device.Size() }
+func (device *readOnlyDevice) Close() error { return device.device.Close() }
+
+// readBytes fills p starting at the byte offset, reading whole clusters underneath
+// and seeing the clusters staged by the running transaction
+func (fs *FileSystem) readBytes(p []byte, offset int64) error {
+
+	cluster_size := fs.clusterSize()
+	buffer := make([]byte, cluster_size)
+	for len(p) > 0 {
+
+		cluster := int32(offset / cluster_size)
+		cluster_off := offset % cluster_size
+
+		err := fs.readCluster(cluster, buffer)
+		if err != nil {
+			return err
+		}
+
+		n := copy(p, buffer[cluster_off:])
+		p = p[n:]
+		offset += int64(n)
+	}
+
+	return nil
+}
+
+// writeBytes stores p on the device starting at the byte offset, partial clusters are read, patched and written back
+func (fs *FileSystem) writeBytes(p []byte, offset int64) error {
+
+	cluster_size := fs.clusterSize()
+	buffer := make([]byte, cluster_size)
+	for len(p) > 0 {
+
+		cluster := int32(offset / cluster_size)
+		cluster_off := offset % cluster_size
+		n := min(int64(len(p)), cluster_size-cluster_off)
+
+		// **A cluster staged by the running transaction is changed in the staged copy**
+		if staged, ok := fs.journal.staged[cluster]; ok {
+			copy(staged[cluster_off:], p[:n])
+			p = p[n:]
+			offset += n
+			continue
+		}
+
+		// **Only a partial cluster needs its old contents**
+		if n < cluster_size {
+			err := fs.device.ReadCluster(cluster, buffer)
+			if err != nil {
+				return err
+			}
+		}
+
+		copy(buffer[cluster_off:], p[:n])
+
+		err := fs.device.WriteCluster(cluster, buffer)
+		if err != nil {
+			return err
+		}
+
+		p = p[n:]
+		offset += n
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package pseudofat
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlockDevices(t *testing.T) {
+
+	image := filepath.Join(t.TempDir(), "device.dat")
+	file_device, err := OpenFileDevice(image, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file_device.Close()
+
+	devices := []struct {
+		name   string
+		device interface {
+			BlockDevice
+			Resizer
+		}
+	}{
+		{"file", file_device},
+		{"memory", NewMemoryDevice(0)},
+	}
+
+	for _, test := range devices {
+
+		device := test.device
+		if err := device.Resize(4 * CLUSTER_SIZE); err != nil || device.Size() != 4*CLUSTER_SIZE {
+			t.Fatal(test.name, device.Size(), err)
+		}
+
+		// **A written cluster reads back, the others stay zero**
+		written := bytes.Repeat([]byte{7}, CLUSTER_SIZE)
+		if err := device.WriteCluster(2, written); err != nil {
+			t.Fatal(test.name, err)
+		}
+
+		buffer := make([]byte, CLUSTER_SIZE)
+		for cluster, want := range map[int32][]byte{0: make([]byte, CLUSTER_SIZE), 2: written} {
+			if err := device.ReadCluster(cluster, buffer); err != nil || !bytes.Equal(buffer, want) {
+				t.Fatalf("%s: cluster %d reads wrong data, %v", test.name, cluster, err)
+			}
+		}
+
+		// **Accesses outside of the device or with a broken buffer are refused**
+		if err := device.ReadCluster(4, buffer); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: read past the end: %v", test.name, err)
+		}
+		if err := device.WriteCluster(-1, buffer); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: write before the start: %v", test.name, err)
+		}
+		if err := device.WriteCluster(0, buffer[:100]); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: write of a partial cluster: %v", test.name, err)
+		}
+
+		// **The read-only wrapper passes reads and refuses writes**
+		read_only := ReadOnly(device)
+		if err := read_only.ReadCluster(2, buffer); err != nil || !bytes.Equal(buffer, written) {
+			t.Fatalf("%s: read-only read: %v", test.name, err)
+		}
+		if err := read_only.WriteCluster(2, buffer); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%s: read-only write: %v", test.name, err)
+		}
+	}
+}
+
+func TestVolumeOnDevices(t *testing.T) {
+
+	memory := NewMemoryDevice(0)
+	fs, err := FormatDevice(memory, 1, CLUSTER_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/d/a", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// **The same image works from a host file**
+	image := filepath.Join(t.TempDir(), "volume.dat")
+	if err := os.WriteFile(image, memory.data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs, err = Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.ReadFile("/d/a"); err != nil || string(data) != "hello" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	fs.Close()
+
+	// **A read-only mount reads everything and changes nothing**
+	fs, err = OpenDevice(ReadOnly(memory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.ReadFile("/d/a"); err != nil || string(data) != "hello" {
+		t.Fatalf("read-only read %q, %v", data, err)
+	}
+
+	before := bytes.Clone(memory.data)
+	if err := fs.WriteFile("/b", nil); !errors.Is(err, ErrReadOnly) || !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("write on a read-only mount: %v", err)
+	}
+	if err := fs.Format(1, CLUSTER_SIZE); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("format of a read-only mount: %v", err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("close of a read-only mount: %v", err)
+	}
+	if !bytes.Equal(memory.data, before) {
+		t.Fatal("the read-only mount changed the device")
+	}
+
+	// **A device without a volume is not mounted**
+	if _, err := OpenDevice(NewMemoryDevice(4096)); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("mount of an empty device: %v", err)
+	}
+	if _, err := FormatDevice(ReadOnly(NewMemoryDevice(2<<20)), 1, CLUSTER_SIZE); err == nil {
+		t.Fatal("formatted a read-only device")
+	}
+}
@@ -0,0 +1,54 @@
+package pseudofat
+
+import (
+	"errors"
+	iofs "io/fs"
+)
+
+// fsError is a sentinel error that can also match a more general error (usually one from io/fs)
+type fsError struct {
+	message string
+	parent  error
+}
+
+func (err *fsError) Error() string { return err.message }
+func (err *fsError) Unwrap() error { return err.parent }
+
+// Errors returned by the file system, match them with errors.Is. Public methods wrap
+// them in *fs.PathError together with the operation and the path that failed.
+var (
+	ErrNotFound     error = &fsError{"file not found", iofs.ErrNotExist}
+	ErrPathNotFound error = &fsError{"path not found", ErrNotFound}
+	ErrExist        error = &fsError{"file already exists", iofs.ErrExist}
+	ErrNotEmpty     error = &fsError{"directory not empty", nil}
+	ErrNoSpace      error = &fsError{"no space left on volume", nil}
+	ErrNotDir       error = &fsError{"not a directory", nil}
+	ErrIsDir        error = &fsError{"is a directory", nil}
+	ErrCorrupt      error = &fsError{"file system structure is corrupted", nil}
+	ErrInvalid      error = &fsError{"invalid argument", iofs.ErrInvalid}
+	ErrNameTooLong  error = &fsError{"file name too long", ErrInvalid}
+	ErrReadOnly     error = &fsError{"read-only file system", iofs.ErrPermission}
+	ErrBusy         error = &fsError{"resource busy", nil}
+	ErrNotFormatted error = &fsError{"not a pseudo-FAT volume", ErrCorrupt}
+	ErrVersion      error = &fsError{"unsupported file system version", ErrCorrupt}
+	ErrLoop         error = &fsError{"too many levels of symbolic links", nil}
+	ErrPermission   error = &fsError{"permission denied", iofs.ErrPermission}
+	ErrNoUser       error = &fsError{"no such user or group", nil}
+	ErrNoAttr       error = &fsError{"no such attribute", nil}
+	ErrQuota        error = &fsError{"disk quota exceeded", nil}
+)
+
+// pathError wraps err into *fs.PathError unless it already is one
+func pathError(op, path string, err error) error {
+
+	if err == nil {
+		return nil
+	}
+
+	var path_err *iofs.PathError
+	if errors.As(err, &path_err) {
+		return err
+	}
+
+	return &iofs.PathError{Op: op, Path: path, Err: err}
+}
@@ -0,0 +1,81 @@
+package pseudofat
+
+import (
+	"errors"
+	iofs "io/fs"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+
+	fs, _ := newVolume(t, 1)
+	for _, dir := range []string{"/dir", "/full"} {
+		if err := fs.Mkdir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.WriteFile("/full/file", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	free_bytes, _ := fs.FreeSpace()
+
+	// **Every failure is a *fs.PathError naming the path around a sentinel**
+	tests := []struct {
+		name string
+		path string
+		run  func() error
+		want error
+	}{
+		{"read missing file", "/missing", func() error { _, err := fs.ReadFile("/missing"); return err }, ErrNotFound},
+		{"read in missing dir", "/nodir/file", func() error { _, err := fs.ReadFile("/nodir/file"); return err }, ErrPathNotFound},
+		{"remove missing file", "/missing", func() error { return fs.Remove("/missing") }, ErrNotFound},
+		{"mkdir existing", "/dir", func() error { return fs.Mkdir("/dir") }, ErrExist},
+		{"write over dir", "/dir", func() error { return fs.WriteFile("/dir", nil) }, ErrExist},
+		{"remove full dir", "/full", func() error { return fs.Remove("/full") }, ErrNotEmpty},
+		{"read dir", "/dir", func() error { _, err := fs.ReadFile("/dir"); return err }, ErrIsDir},
+		{"chdir to file", "/full/file", func() error { return fs.Chdir("/full/file") }, ErrNotDir},
+		{"write too much", "/big", func() error { return fs.WriteFile("/big", make([]byte, free_bytes+1)) }, ErrNoSpace},
+		{"remove root", "/", func() error { return fs.Remove("/") }, ErrInvalid},
+	}
+
+	for _, test := range tests {
+
+		err := test.run()
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: %v, want %v", test.name, err, test.want)
+			continue
+		}
+
+		var path_err *iofs.PathError
+		if !errors.As(err, &path_err) || path_err.Path != test.path || path_err.Op == "" {
+			t.Errorf("%s: %#v is not a *fs.PathError for '%s'", test.name, err, test.path)
+		}
+	}
+
+	// **The sentinels match the io/fs errors they stand for**
+	matches := []struct {
+		err, parent error
+	}{
+		{ErrNotFound, iofs.ErrNotExist},
+		{ErrPathNotFound, ErrNotFound},
+		{ErrPathNotFound, iofs.ErrNotExist},
+		{ErrExist, iofs.ErrExist},
+		{ErrInvalid, iofs.ErrInvalid},
+		{ErrReadOnly, iofs.ErrPermission},
+		{ErrNotFormatted, ErrCorrupt},
+	}
+	for _, match := range matches {
+		if !errors.Is(match.err, match.parent) {
+			t.Errorf("'%v' does not match '%v'", match.err, match.parent)
+		}
+	}
+	if errors.Is(ErrNotFound, ErrPathNotFound) {
+		t.Error("a missing file matches a missing path")
+	}
+
+	// **Failed operations change nothing**
+	if free, _ := fs.FreeSpace(); free != free_bytes {
+		t.Fatalf("%d bytes free after the failures, want %d", free, free_bytes)
+	}
+	checkClean(t, fs)
+}
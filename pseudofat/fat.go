@@ -0,0 +1,106 @@
+package pseudofat
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// loadFAT reads both FAT tables into memory, every later lookup is served from there
+func (fs *FileSystem) loadFAT() error {
+
+	fat1, err := fs.readFAT(fs.fs_format.fat1_start)
+	if err != nil {
+		return fmt.Errorf("error reading FAT1: %w", err)
+	}
+
+	fat2, err := fs.readFAT(fs.fs_format.fat2_start)
+	if err != nil {
+		return fmt.Errorf("error reading FAT2: %w", err)
+	}
+
+	fs.fat1 = fat1
+	fs.fat2 = fat2
+	fs.dirty_start, fs.dirty_end = 0, 0
+
+	return nil
+}
+
+func (fs *FileSystem) readFatEntry(cluster int32) (int32, error) {
+
+	if cluster < 0 || int(cluster) >= len(fs.fat1) {
+		return 0, fmt.Errorf("cluster %d is outside of the FAT: %w", cluster, ErrCorrupt)
+	}
+
+	return fs.fat1[cluster], nil
+}
+
+// updateFatEntry changes the entry in both tables, the change reaches the device on the next commit
+func (fs *FileSystem) updateFatEntry(cluster, value int32) error {
+
+	if cluster < 0 || int(cluster) >= len(fs.fat1) {
+		return fmt.Errorf("cluster %d is outside of the FAT: %w", cluster, ErrCorrupt)
+	}
+
+	// **Remember the committed value so an abort can restore it**
+	old_value, touched := fs.journal.undo[cluster]
+	if !touched {
+		if fs.journal.undo == nil {
+			fs.journal.undo = make(map[int32]int32)
+		}
+		old_value = fs.fat1[cluster]
+		fs.journal.undo[cluster] = old_value
+	}
+
+	fs.fat1[cluster] = value
+	fs.fat2[cluster] = value
+
+	// **A freed cluster drops its staged copy, if it is in use on the device it is reused only after the commit**
+	if value == FAT_FREE {
+		delete(fs.journal.staged, cluster)
+		fs.quotas = quotaCache{}
+	}
+	if value != FAT_FREE || old_value == FAT_FREE {
+		fs.markCluster(cluster, value != FAT_FREE)
+	} else {
+		fs.journal.freed = append(fs.journal.freed, cluster)
+	}
+
+	// **Grow the dirty range so it covers the entry**
+	if fs.dirty_start >= fs.dirty_end {
+		fs.dirty_start, fs.dirty_end = cluster, cluster+1
+	} else {
+		fs.dirty_start = min(fs.dirty_start, cluster)
+		fs.dirty_end = max(fs.dirty_end, cluster+1)
+	}
+
+	return nil
+}
+
+// dirtyFATClusters encodes the FAT1 clusters covering the dirty range, keyed by their cluster number
+func (fs *FileSystem) dirtyFATClusters() map[int32][]byte {
+
+	fat_clusters := make(map[int32][]byte)
+	if fs.dirty_start >= fs.dirty_end {
+		return fat_clusters
+	}
+
+	entries_per_cluster := fs.fs_format.cluster_size / FAT_ENTRY
+	first := fs.dirty_start / entries_per_cluster
+	last := (fs.dirty_end - 1) / entries_per_cluster
+
+	for fat_cluster := first; fat_cluster <= last; fat_cluster++ {
+
+		// **Encode one cluster worth of entries, the tail of the last FAT cluster stays zero**
+		start := fat_cluster * entries_per_cluster
+		end := min(start+entries_per_cluster, int32(len(fs.fat1)))
+
+		buffer := make([]byte, fs.clusterSize())
+		for i, value := range fs.fat1[start:end] {
+			binary.LittleEndian.PutUint32(buffer[i*FAT_ENTRY:], uint32(value))
+		}
+
+		fat_clusters[fs.clusterAt(fs.fs_format.fat1_start)+fat_cluster] = buffer
+	}
+
+	return fat_clusters
+}
@@ -0,0 +1,200 @@
+package pseudofat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// countingDevice counts the clusters read and written through it
+type countingDevice struct {
+	BlockDevice
+	reads  int
+	writes int
+}
+
+func (device *countingDevice) ReadCluster(cluster int32, buffer []byte) error {
+	device.reads++
+	return device.BlockDevice.ReadCluster(cluster, buffer)
+}
+
+func (device *countingDevice) WriteCluster(cluster int32, buffer []byte) error {
+	device.writes++
+	return device.BlockDevice.WriteCluster(cluster, buffer)
+}
+
+// readBigfile returns data/bigfile.txt repeated until it holds at least size bytes
+func readBigfile(tb testing.TB, size int) []byte {
+
+	tb.Helper()
+
+	data, err := os.ReadFile("../data/bigfile.txt")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return bytes.Repeat(data, max(1, (size+len(data)-1)/len(data)))
+}
+
+// openImage formats an image file and opens it through a counting device
+func openImage(tb testing.TB, size_mb int) (*FileSystem, *countingDevice, string) {
+
+	tb.Helper()
+
+	image := filepath.Join(tb.TempDir(), "bench.dat")
+	err := Format(image, size_mb, CLUSTER_SIZE)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	file_device, err := OpenFileDevice(image, os.O_RDWR)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	device := &countingDevice{BlockDevice: file_device}
+	fs, err := OpenDevice(device)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { fs.Close() })
+
+	return fs, device, image
+}
+
+func TestFATWriteThrough(t *testing.T) {
+
+	fs, device, image := openImage(t, 4)
+	data := readBigfile(t, 1<<20)
+
+	// **Writing a 1 MB file touches the FAT clusters once per commit, not once per entry**
+	device.reads, device.writes = 0, 0
+	if err := fs.WriteFile("/big.txt", data); err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := fs.ClusterChain("/big.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.writes > 2*len(chain) {
+		t.Fatalf("%d cluster writes for a chain of %d clusters", device.writes, len(chain))
+	}
+
+	// **Both tables on the device match the tables in memory**
+	fat1, fat2, err := fs.ReadFAT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(fat1, fs.fat1) || !slices.Equal(fat2, fs.fat2) {
+		t.Fatal("the FAT on the device differs from the FAT in memory")
+	}
+
+	// **A reopened volume loads the same chain**
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs, err = Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	reopened, err := fs.ClusterChain("/big.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(reopened, chain) {
+		t.Fatalf("chain %v after reopening, want %v", reopened, chain)
+	}
+
+	got, err := fs.ReadFile("/big.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("contents differ after reopening")
+	}
+}
+
+// BenchmarkWriteBigfile writes, reads and removes data/bigfile.txt on an image file
+func BenchmarkWriteBigfile(b *testing.B) {
+
+	for _, bench := range []struct {
+		name string
+		size int
+	}{
+		{"bigfile", 0},
+		{"bigfile-1MB", 1 << 20},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+
+			fs, device, _ := openImage(b, 8)
+			data := readBigfile(b, bench.size)
+
+			device.reads, device.writes = 0, 0
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+
+			for range b.N {
+
+				if err := fs.WriteFile("/big.txt", data); err != nil {
+					b.Fatal(err)
+				}
+
+				got, err := fs.ReadFile("/big.txt")
+				if err != nil || len(got) != len(data) {
+					b.Fatal(len(got), err)
+				}
+
+				if err := fs.Remove("/big.txt"); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportMetric(float64(device.reads+device.writes)/float64(b.N), "device-ops/op")
+		})
+	}
+}
+
+// BenchmarkFATLookup follows the chain of data/bigfile.txt grown to 1 MB, "memory" reads the FAT kept
+// in memory, "device" reads every entry from the image the way the FAT was read before it was cached
+func BenchmarkFATLookup(b *testing.B) {
+
+	fs, _, _ := openImage(b, 8)
+	if err := fs.WriteFile("/big.txt", readBigfile(b, 1<<20)); err != nil {
+		b.Fatal(err)
+	}
+
+	entry, err := fs.Stat("/big.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("memory", func(b *testing.B) {
+		for range b.N {
+			for cluster := entry.First_cluster; cluster != FAT_EOF; {
+				cluster, err = fs.readFatEntry(cluster)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("device", func(b *testing.B) {
+		raw := make([]byte, FAT_ENTRY)
+		for range b.N {
+			for cluster := entry.First_cluster; cluster != FAT_EOF; {
+				err = fs.readBytes(raw, fs.fs_format.fat1_start+int64(cluster)*FAT_ENTRY)
+				if err != nil {
+					b.Fatal(err)
+				}
+				cluster = int32(binary.LittleEndian.Uint32(raw))
+			}
+		}
+	})
+}
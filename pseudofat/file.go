@@ -0,0 +1,648 @@
+package pseudofat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"time"
+)
+
+// File is an open handle to a regular file with random access reads and writes
+type File struct {
+	fs          *FileSystem
+	name        string
+	file_path   string // absolute path the file was opened with, it may lead through symbolic links
+	dir_cluster int32
+	dir_moves   uint64
+	dir_renames uint64
+	entry_name  string
+	flag        int
+	offset      int64
+	closed      bool
+}
+
+// OpenFile opens a file with the os.O_* flags (O_RDONLY, O_WRONLY, O_RDWR, O_CREATE, O_EXCL, O_TRUNC, O_APPEND)
+func (s *Session) OpenFile(file_path string, flag int) (*File, error) {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	// **A symbolic link opens the file it points to**
+	dir_cluster, file_name, err := s.resolvePath(file_path)
+	if err != nil {
+		return nil, pathError("open", file_path, err)
+	}
+
+	if file_name == "" {
+		return nil, pathError("open", file_path, ErrIsDir)
+	}
+
+	entry, err := s.fs.findEntry(file_name, dir_cluster)
+	if errors.Is(err, ErrNotFound) && flag&os.O_CREATE != 0 {
+
+		// **Create an empty file when requested**
+		err = s.fs.checkDirAccess(dir_cluster, PERM_WRITE)
+		if err == nil {
+			err = s.fs.commit(s.fs.createFile(dir_cluster, file_name, nil))
+		}
+		if err != nil {
+			return nil, pathError("open", file_path, err)
+		}
+
+	} else if err != nil {
+		return nil, pathError("open", file_path, err)
+
+	} else {
+
+		if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			return nil, pathError("open", file_path, ErrExist)
+		}
+
+		if entry.Is_directory == 1 {
+			return nil, pathError("open", file_path, ErrIsDir)
+		}
+
+		// **Permissions are checked once, the handle keeps the access it was opened with**
+		want := uint16(0)
+		if flag&(os.O_WRONLY|os.O_RDWR) != os.O_WRONLY {
+			want |= PERM_READ
+		}
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			want |= PERM_WRITE
+		}
+
+		err = s.fs.checkAccess(entry, want)
+		if err != nil {
+			return nil, pathError("open", file_path, err)
+		}
+	}
+
+	abs_path := file_path
+	if !path.IsAbs(abs_path) {
+		abs_path = path.Join(s.current_path, abs_path)
+	}
+
+	file := &File{
+		fs:          s.fs,
+		name:        file_path,
+		file_path:   abs_path,
+		dir_cluster: dir_cluster,
+		dir_moves:   s.fs.dir_moves,
+		dir_renames: s.fs.dir_renames,
+		entry_name:  file_name,
+		flag:        flag,
+	}
+
+	// **Drop the old contents when requested**
+	if flag&os.O_TRUNC != 0 && file.writable() {
+		err = s.fs.commit(file.truncate(0))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return file, nil
+}
+
+// Name returns the path the file was opened with
+func (file *File) Name() string {
+	return file.name
+}
+
+// Stat returns the current file information
+func (file *File) Stat() (iofs.FileInfo, error) {
+
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	entry, err := file.loadEntry()
+	if err != nil {
+		return nil, err
+	}
+
+	return entryInfo{name: file.entry_name, entry: entry}, nil
+}
+
+// Read implements io.Reader
+func (file *File) Read(p []byte) (int, error) {
+
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	n, err := file.readAt(p, file.offset)
+	file.offset += int64(n)
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt
+func (file *File) ReadAt(p []byte, off int64) (int, error) {
+
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	return file.readAt(p, off)
+}
+
+func (file *File) readAt(p []byte, off int64) (int, error) {
+
+	if !file.readable() {
+		return 0, file.pathError("read", fmt.Errorf("file not opened for reading: %w", ErrInvalid))
+	}
+
+	if off < 0 {
+		return 0, file.pathError("read", fmt.Errorf("negative offset: %w", ErrInvalid))
+	}
+
+	entry, err := file.loadEntry()
+	if err != nil {
+		return 0, err
+	}
+
+	// **Never read past the end of the file**
+	size := int64(entry.Size)
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	n := int(min(int64(len(p)), size-off))
+
+	chain, err := file.fs.readChain(entry.First_cluster)
+	if err != nil {
+		return 0, file.pathError("read", err)
+	}
+
+	err = file.fs.readChainAt(chain, p[:n], off)
+	if err != nil {
+		return 0, file.pathError("read", err)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Write implements io.Writer, with O_APPEND every write goes to the end of the file
+func (file *File) Write(p []byte) (int, error) {
+
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	if file.flag&os.O_APPEND != 0 {
+
+		entry, err := file.loadEntry()
+		if err != nil {
+			return 0, err
+		}
+
+		file.offset = int64(entry.Size)
+	}
+
+	n, err := file.writeAt(p, file.offset)
+	file.offset += int64(n)
+	return n, file.fs.commit(err)
+}
+
+// WriteAt implements io.WriterAt, the file grows when writing past its end
+func (file *File) WriteAt(p []byte, off int64) (int, error) {
+
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	if file.flag&os.O_APPEND != 0 {
+		return 0, file.pathError("write", fmt.Errorf("invalid use of WriteAt on file opened with O_APPEND: %w", ErrInvalid))
+	}
+
+	n, err := file.writeAt(p, off)
+	return n, file.fs.commit(err)
+}
+
+// Seek implements io.Seeker
+func (file *File) Seek(offset int64, whence int) (int64, error) {
+
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	if file.closed {
+		return 0, iofs.ErrClosed
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += file.offset
+	case io.SeekEnd:
+		entry, err := file.loadEntry()
+		if err != nil {
+			return 0, err
+		}
+		offset += int64(entry.Size)
+	default:
+		return 0, file.pathError("seek", fmt.Errorf("invalid whence: %w", ErrInvalid))
+	}
+
+	if offset < 0 {
+		return 0, file.pathError("seek", fmt.Errorf("negative offset: %w", ErrInvalid))
+	}
+
+	file.offset = offset
+	return offset, nil
+}
+
+// Truncate changes the size of the file, freeing or zero-filling clusters as needed
+func (file *File) Truncate(size int64) error {
+
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	return file.fs.commit(file.truncate(size))
+}
+
+func (file *File) truncate(size int64) error {
+
+	if !file.writable() {
+		return file.pathError("truncate", fmt.Errorf("file not opened for writing: %w", ErrInvalid))
+	}
+
+	if size < 0 {
+		return file.pathError("truncate", fmt.Errorf("invalid size: %w", ErrInvalid))
+	}
+
+	entry, err := file.loadEntry()
+	if err != nil {
+		return err
+	}
+
+	// **Growing is the same as writing zeros past the end**
+	if size > int64(entry.Size) {
+		_, err = file.writeAt(nil, size)
+		return err
+	}
+
+	err = file.fs.resizeChain(entry.First_cluster, file.fs.clustersForSize(size))
+	if err != nil {
+		return file.pathError("truncate", err)
+	}
+
+	entry.Size = size
+	entry.Modified = time.Now().Unix()
+	return file.saveEntry(entry)
+}
+
+// Close releases the handle
+func (file *File) Close() error {
+
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	if file.closed {
+		return iofs.ErrClosed
+	}
+
+	file.closed = true
+	return nil
+}
+
+func (file *File) writeAt(p []byte, off int64) (int, error) {
+
+	if !file.writable() {
+		return 0, file.pathError("write", fmt.Errorf("file not opened for writing: %w", ErrInvalid))
+	}
+
+	if off < 0 {
+		return 0, file.pathError("write", fmt.Errorf("negative offset: %w", ErrInvalid))
+	}
+
+	end, err := addOffset(off, int64(len(p)))
+	if err != nil {
+		return 0, file.pathError("write", err)
+	}
+
+	entry, err := file.loadEntry()
+	if err != nil {
+		return 0, err
+	}
+
+	size := int64(entry.Size)
+
+	// **Extend the chain so it covers the whole write, the owner and the directory are charged first**
+	if end > size {
+		grow := file.fs.clustersForSize(end) - file.fs.clustersForSize(size)
+		err = file.fs.chargeQuota(file.dir_cluster, entry.Uid, quotaUsage{clusters: grow})
+		if err == nil {
+			err = file.fs.resizeChain(entry.First_cluster, file.fs.clustersForSize(end))
+		}
+		if err != nil {
+			return 0, file.pathError("write", err)
+		}
+	}
+
+	chain, err := file.fs.readChain(entry.First_cluster)
+	if err != nil {
+		return 0, file.pathError("write", err)
+	}
+
+	// **Never write into clusters a snapshot still references**
+	if start := min(off, size); end > start {
+		err = file.fs.unshareChain(chain, int(start/file.fs.clusterSize()), int((end-1)/file.fs.clusterSize()))
+		if err != nil {
+			return 0, file.pathError("write", err)
+		}
+	}
+
+	// **Fill the gap between the old end and the write offset with zeros, a cluster at a time**
+	zeros := make([]byte, min(max(off-size, 0), file.fs.clusterSize()))
+	for gap := size; gap < off; gap += int64(len(zeros)) {
+		err = file.fs.writeChainAt(chain, zeros[:min(int64(len(zeros)), off-gap)], gap)
+		if err != nil {
+			return 0, file.pathError("write", err)
+		}
+	}
+
+	err = file.fs.writeChainAt(chain, p, off)
+	if err != nil {
+		return 0, file.pathError("write", err)
+	}
+
+	// **Keep the directory entry size, first cluster and modification time in sync**
+	entry.Size = max(end, size)
+	entry.First_cluster = chain[0]
+	entry.Modified = time.Now().Unix()
+	err = file.saveEntry(entry)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (file *File) readable() bool {
+	return file.flag&(os.O_WRONLY|os.O_RDWR) != os.O_WRONLY
+}
+
+func (file *File) writable() bool {
+	return file.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+func (file *File) pathError(op string, err error) error {
+	return pathError(op, file.name, err)
+}
+
+func (file *File) loadEntry() (DirectoryEntry, error) {
+
+	if file.closed {
+		return DirectoryEntry{}, iofs.ErrClosed
+	}
+
+	// **Defrag may have moved the parent directory to another cluster, a rename to another path**
+	switch {
+	case file.dir_moves != file.fs.dir_moves:
+		cluster, name, err := file.fs.parsePath(file.fs.rootDirectory(), file.file_path, true)
+		if err == nil {
+			cluster, _, err = file.fs.followLinks(cluster, name, &pathWalk{})
+		}
+		if err == nil {
+			file.dir_cluster = cluster
+		}
+
+	case file.dir_renames != file.fs.dir_renames:
+		dir_path, err := file.fs.directoryPath(file.dir_cluster)
+		if err == nil {
+			file.file_path = path.Join(dir_path, file.entry_name)
+		}
+	}
+	file.dir_moves, file.dir_renames = file.fs.dir_moves, file.fs.dir_renames
+
+	entry, err := file.fs.findEntry(file.entry_name, file.dir_cluster)
+	if err != nil {
+		return DirectoryEntry{}, file.pathError("stat", err)
+	}
+
+	return entry, nil
+}
+
+func (file *File) saveEntry(entry DirectoryEntry) error {
+
+	err := file.fs.updateDirectoryEntry(file.dir_cluster, file.entry_name, entry)
+	if err != nil {
+		return file.pathError("write", err)
+	}
+
+	return nil
+}
+
+// clustersForSize returns the chain length for a file of the given size, every file owns at least one cluster
+func (fs *FileSystem) clustersForSize(size int64) int {
+	if size <= 0 {
+		return 1
+	}
+
+	return int((size-1)/fs.clusterSize() + 1)
+}
+
+func (fs *FileSystem) readChain(start_cluster int32) ([]int32, error) {
+
+	var chain []int32
+	current_cluster := start_cluster
+	for current_cluster >= 0 {
+
+		// **A chain longer than the volume is a loop**
+		if len(chain) >= int(fs.fs_format.cluster_count) {
+			return nil, fmt.Errorf("cluster chain starting at %d is cyclic: %w", start_cluster, ErrCorrupt)
+		}
+
+		chain = append(chain, current_cluster)
+
+		next_cluster, err := fs.readFatEntry(current_cluster)
+		if err != nil {
+			return nil, fmt.Errorf("error reading FAT entry: %w", err)
+		}
+
+		current_cluster = next_cluster
+	}
+
+	if current_cluster != FAT_EOF {
+		return nil, fmt.Errorf("cluster chain starting at %d ends with %d: %w", start_cluster, current_cluster, ErrCorrupt)
+	}
+
+	return chain, nil
+}
+
+// resizeChain grows or shrinks a chain to exactly cluster_count clusters, new clusters are zeroed
+func (fs *FileSystem) resizeChain(start_cluster int32, cluster_count int) error {
+
+	chain, err := fs.readChain(start_cluster)
+	if err != nil {
+		return err
+	}
+
+	// **Shrink: terminate the chain and free the tail**
+	if cluster_count < len(chain) {
+
+		err = fs.updateFatEntry(chain[cluster_count-1], FAT_EOF)
+		if err != nil {
+			return err
+		}
+
+		return fs.freeChain(chain[cluster_count])
+	}
+
+	if cluster_count == len(chain) {
+		return nil
+	}
+
+	// **Grow: reserve all new clusters, zero them and only then link them behind the last one**
+	new_chain, err := fs.allocateChain(cluster_count - len(chain))
+	if err != nil {
+		return err
+	}
+
+	zero_cluster := make([]byte, fs.clusterSize())
+	for _, new_cluster := range new_chain {
+		err = fs.device.WriteCluster(new_cluster, zero_cluster)
+		if err != nil {
+			fs.releaseClusters(new_chain)
+			return fmt.Errorf("error writing cluster %d: %w", new_cluster, err)
+		}
+	}
+
+	return fs.updateFatEntry(chain[len(chain)-1], new_chain[0])
+}
+
+func (fs *FileSystem) readChainAt(chain []int32, p []byte, off int64) error {
+
+	cluster_size := fs.clusterSize()
+	for len(p) > 0 {
+
+		index := off / cluster_size
+		cluster_off := off % cluster_size
+		n := min(int64(len(p)), cluster_size-cluster_off)
+
+		err := fs.readBytes(p[:n], fs.clusterOffset(chain[index])+cluster_off)
+		if err != nil {
+			return fmt.Errorf("error reading cluster %d: %w", chain[index], err)
+		}
+
+		p = p[n:]
+		off += n
+	}
+
+	return nil
+}
+
+func (fs *FileSystem) writeChainAt(chain []int32, p []byte, off int64) error {
+
+	cluster_size := fs.clusterSize()
+	for len(p) > 0 {
+
+		index := off / cluster_size
+		cluster_off := off % cluster_size
+		n := min(int64(len(p)), cluster_size-cluster_off)
+
+		err := fs.writeBytes(p[:n], fs.clusterOffset(chain[index])+cluster_off)
+		if err != nil {
+			return fmt.Errorf("error writing cluster %d: %w", chain[index], err)
+		}
+
+		p = p[n:]
+		off += n
+	}
+
+	return nil
+}
+
+// readHeaderChain reads the chain named by the cluster number kept in the header cluster at offset,
+// it returns the first cluster, 0 when there is no chain, and the contents of all its clusters
+func (fs *FileSystem) readHeaderChain(offset int64, what string) (int32, []byte, error) {
+
+	raw_pointer := make([]byte, 4)
+	err := fs.readBytes(raw_pointer, offset)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error reading %s: %w", what, err)
+	}
+
+	first_cluster := int32(binary.LittleEndian.Uint32(raw_pointer))
+	if first_cluster == 0 {
+		return 0, nil, nil
+	}
+
+	if first_cluster < fs.rootCluster() || first_cluster >= fs.fs_format.cluster_count {
+		return 0, nil, fmt.Errorf("%s at cluster %d: %w", what, first_cluster, ErrCorrupt)
+	}
+
+	chain, err := fs.readChain(first_cluster)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	raw := make([]byte, int64(len(chain))*fs.clusterSize())
+	err = fs.readChainAt(chain, raw, 0)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error reading %s: %w", what, err)
+	}
+
+	return first_cluster, raw, nil
+}
+
+// writeHeaderChain stages raw into the chain named in the header cluster at offset, the chain is
+// created when needed, grows and shrinks with raw and is freed when raw is empty
+func (fs *FileSystem) writeHeaderChain(offset int64, first_cluster int32, raw []byte, what string) error {
+
+	if len(raw) == 0 {
+		if first_cluster != 0 {
+			err := fs.freeChain(first_cluster)
+			if err != nil {
+				return err
+			}
+		}
+
+		return fs.stageBytes(make([]byte, 4), offset)
+	}
+
+	clusters := fs.clustersForSize(int64(len(raw)))
+	if first_cluster == 0 {
+
+		chain, err := fs.allocateChain(clusters)
+		if err != nil {
+			return err
+		}
+
+		raw_pointer := make([]byte, 4)
+		binary.LittleEndian.PutUint32(raw_pointer, uint32(chain[0]))
+		err = fs.stageBytes(raw_pointer, offset)
+		if err != nil {
+			return err
+		}
+
+		first_cluster = chain[0]
+
+	} else {
+		err := fs.resizeChain(first_cluster, clusters)
+		if err != nil {
+			return err
+		}
+	}
+
+	chain, err := fs.readChain(first_cluster)
+	if err != nil {
+		return err
+	}
+
+	// **Whole clusters are staged, the zeros behind the last record end the table**
+	padded := make([]byte, int64(len(chain))*fs.clusterSize())
+	copy(padded, raw)
+
+	for i, cluster := range chain {
+		err = fs.stageBytes(padded[int64(i)*fs.clusterSize():int64(i+1)*fs.clusterSize()], fs.clusterOffset(cluster))
+		if err != nil {
+			return fmt.Errorf("error writing %s: %w", what, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,1511 @@
+// Package pseudofat implements the KIV/ZOS pseudo-FAT file system stored in a single host image file
+// or on any other BlockDevice.
+package pseudofat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Open opens an existing pseudo-FAT image and keeps the host file open until Close
+func Open(filename string) (*FileSystem, error) {
+
+	// **Open the image for reading and writing**
+	device, err := OpenFileDevice(filename, os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+
+	fs, err := OpenDevice(device)
+	if err != nil {
+		device.Close()
+		return nil, fmt.Errorf("cannot open '%s': %w", filename, err)
+	}
+
+	return fs, nil
+}
+
+// OpenDevice mounts the volume stored on the device, Close closes the device as well
+func OpenDevice(device BlockDevice) (*FileSystem, error) {
+
+	fs := &FileSystem{device: device}
+
+	// **Load the file system format from the device**
+	var err error
+	fs.fs_format, err = fs.loadFormat()
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.fs_format.file_size == 0 {
+		return nil, fmt.Errorf("not a formatted file system: %w", ErrCorrupt)
+	}
+
+	if fs.fs_format.file_size > device.Size() {
+		return nil, fmt.Errorf("volume of %d bytes does not fit the device of %d bytes: %w", fs.fs_format.file_size, device.Size(), ErrCorrupt)
+	}
+
+	// **Apply the last transaction if it was committed but not written to its place**
+	err = fs.replayJournal()
+	if err != nil {
+		return nil, err
+	}
+
+	// **Keep both FAT tables in memory**
+	err = fs.loadFAT()
+	if err != nil {
+		return nil, err
+	}
+
+	// **Count the free clusters, the bitmap is built from FAT1 once it is needed**
+	fs.alloc = allocator{cursor: fs.rootCluster()}
+	err = fs.loadSnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	err = fs.loadFSInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	// **The default session starts in the root directory**
+	fs.session = fs.newSession()
+
+	return fs, nil
+}
+
+// Format creates (or overwrites) the image file and formats it to the given size
+// with clusters of cluster_size bytes, CLUSTER_SIZE is the usual choice
+func Format(filename string, file_size_mb, cluster_size int) error {
+
+	device, err := OpenFileDevice(filename, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		return err
+	}
+
+	fs, err := FormatDevice(device, file_size_mb, cluster_size)
+	if err != nil {
+		device.Close()
+		return err
+	}
+
+	return fs.Close()
+}
+
+// FormatDevice lays out an empty file system on the device and mounts it
+func FormatDevice(device BlockDevice, file_size_mb, cluster_size int) (*FileSystem, error) {
+
+	fs := &FileSystem{device: device}
+	fs.session = &Session{fs: fs}
+
+	err := fs.Format(file_size_mb, cluster_size)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+// Close flushes and releases the device backing the file system
+func (fs *FileSystem) Close() error {
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.device == nil {
+		return nil
+	}
+
+	// **A snapshot view only detaches, the device belongs to the live volume**
+	if fs.origin != nil {
+		fs.closeView()
+		fs.device = nil
+		return nil
+	}
+
+	err := fs.commit(nil)
+	if err == nil {
+		err = fs.saveFSInfo()
+	}
+
+	// **A stale free cluster hint is only rewritten when the device takes writes**
+	if errors.Is(err, ErrReadOnly) {
+		err = nil
+	}
+	if flush_err := fs.device.Flush(); err == nil {
+		err = flush_err
+	}
+	if close_err := fs.device.Close(); err == nil {
+		err = close_err
+	}
+
+	fs.device = nil
+	return err
+}
+
+// Format erases the open volume and lays out an empty file system of the given size,
+// the cluster size must be a power of two between MIN_CLUSTER_SIZE and MAX_CLUSTER_SIZE
+func (fs *FileSystem) Format(file_size_mb, cluster_size int) error {
+
+	fs.session.lock()
+	defer fs.mu.Unlock()
+
+	// **Only root may erase the volume of everybody**
+	err := fs.requireRoot()
+	if err != nil {
+		return err
+	}
+
+	file_size_bytes, err := mulOffset(int64(file_size_mb), 1024*1024)
+	if err != nil {
+		return fmt.Errorf("file system size %d MB: %w", file_size_mb, err)
+	}
+
+	// **Calculate the file system format**
+	fs_format, err := CalculateFS(file_size_bytes, cluster_size)
+	if err != nil {
+		return err
+	}
+
+	if int64(fs_format.cluster_count) <= fs_format.data_start/int64(fs_format.cluster_size) {
+		return fmt.Errorf("file system size %d MB is too small: %w", file_size_mb, ErrInvalid)
+	}
+
+	// **Drop any previous contents of the image**
+	zeroed := false
+	if resizer, ok := fs.device.(Resizer); ok {
+
+		err := resizer.Resize(0)
+		if err == nil {
+			err = resizer.Resize(fs_format.file_size)
+		}
+		if err != nil {
+			return err
+		}
+
+		zeroed = true
+
+	} else if fs_format.file_size > fs.device.Size() {
+		return fmt.Errorf("file system of %d MB does not fit the device: %w", file_size_mb, ErrNoSpace)
+	}
+
+	fs.fs_format = fs_format
+
+	// **Save the file system format to the file**
+	err = fs.saveFormat()
+	if err != nil {
+		return err
+	}
+
+	fat1 := make(FAT, fs_format.cluster_count)
+	fat2 := make(FAT, fs_format.cluster_count)
+
+	// **Initialize the FAT table**
+	for i := range fat1 {
+		fat1[i] = FAT_FREE
+		fat2[i] = FAT_FREE
+	}
+
+	// **Set the first two entries in the FAT table**
+	fat1[0] = FAT_EOF
+	fat2[0] = FAT_EOF
+
+	// **Set the entries for the FAT and journal clusters**
+	for i := int32(1); i < fs.rootCluster(); i++ {
+		fat1[i] = FAT_EOF
+		fat2[i] = FAT_EOF
+	}
+
+	// **Save the file system to the file**
+	err = fs.saveFileSystem(fat1, fat2, zeroed)
+	if err != nil {
+		return fmt.Errorf("error saving file system: %w", err)
+	}
+
+	fs.fat1, fs.fat2 = fat1, fat2
+	fs.dirty_start, fs.dirty_end = 0, 0
+	fs.journal = journal{}
+	fs.snapshot_refs = nil
+	fs.quotas = quotaCache{}
+	fs.initAllocator()
+	fs.alloc.hint_dirty = true
+
+	// **Allocate the first data cluster for the root directory**
+	free_cluster, err := fs.allocateCluster()
+	if err != nil {
+		return fmt.Errorf("error finding free cluster: %w", err)
+	}
+
+	// **Create the root directory**
+	err = fs.commit(fs.createRootDirectory(free_cluster))
+	if err != nil {
+		return err
+	}
+
+	// **The default session starts in the new root directory**
+	fs.session.current_cluster = free_cluster
+	fs.session.current_path = "/"
+
+	return nil
+}
+
+func (fs *FileSystem) saveFileSystem(fat1, fat2 FAT, zeroed bool) error {
+
+	// **Write FAT1 table at fat1_start position**
+	err := fs.writeFAT(fat1, fs.fs_format.fat1_start)
+	if err != nil {
+		return fmt.Errorf("error writing FAT1: %w", err)
+	}
+
+	// **Write FAT2 table at fat2_start position**
+	err = fs.writeFAT(fat2, fs.fs_format.fat2_start)
+	if err != nil {
+		return fmt.Errorf("error writing FAT2: %w", err)
+	}
+
+	// **A freshly resized device already reads as zeros**
+	if zeroed {
+		return nil
+	}
+
+	// **An old journal must not be replayed into the new volume, nor old snapshots, users or quotas found**
+	err = fs.clearJournal()
+	if err == nil {
+		err = fs.writeBytes(make([]byte, 4), SNAPSHOT_OFFSET)
+	}
+	if err == nil {
+		err = fs.writeBytes(make([]byte, 4), USERS_OFFSET)
+	}
+	if err == nil {
+		err = fs.writeBytes(make([]byte, 4), QUOTAS_OFFSET)
+	}
+	if err != nil {
+		return err
+	}
+
+	// **Zero out the data starting at data_start**
+	zero_cluster := make([]byte, fs.clusterSize())
+	for cluster := fs.rootCluster(); cluster < fs.fs_format.cluster_count; cluster++ {
+		err = fs.device.WriteCluster(cluster, zero_cluster)
+		if err != nil {
+			return fmt.Errorf("error writing zeros to data section: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// writeFAT stores the table one cluster at a time so formatting a large volume needs no image of the whole table
+func (fs *FileSystem) writeFAT(fat FAT, fat_start int64) error {
+
+	entries_per_cluster := int(fs.clusterSize() / FAT_ENTRY)
+	buffer := make([]byte, fs.clusterSize())
+	for start := 0; start < len(fat); start += entries_per_cluster {
+
+		clear(buffer)
+		for i, val := range fat[start:min(start+entries_per_cluster, len(fat))] {
+			binary.LittleEndian.PutUint32(buffer[i*FAT_ENTRY:], uint32(val))
+		}
+
+		err := fs.writeBytes(buffer, fat_start+int64(start)*FAT_ENTRY)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *FileSystem) readFAT(fat_start int64) (FAT, error) {
+
+	raw_fat := make([]byte, fs.fs_format.fat_size)
+	err := fs.readBytes(raw_fat, fat_start)
+	if err != nil {
+		return nil, err
+	}
+
+	fat := make(FAT, fs.fs_format.cluster_count)
+	for i := range fat {
+		fat[i] = int32(binary.LittleEndian.Uint32(raw_fat[i*FAT_ENTRY:]))
+	}
+
+	return fat, nil
+}
+
+// ReadFAT loads both FAT tables from the image
+func (fs *FileSystem) ReadFAT() (FAT, FAT, error) {
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// **Read the FAT1 table from the file**
+	fat1, err := fs.readFAT(fs.fs_format.fat1_start)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading FAT1: %w", err)
+	}
+
+	// **Read the FAT2 table from the file**
+	fat2, err := fs.readFAT(fs.fs_format.fat2_start)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading FAT2: %w", err)
+	}
+
+	return fat1, fat2, nil
+}
+
+func PrintFileSystem(fat1, fat2 FAT, filename string) error {
+
+	// **Open the file for writing**
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	// **Print the FAT1 table to the file**
+	_, err = file.WriteString("\nFAT1 Table:\n")
+	if err != nil {
+		return fmt.Errorf("error writing to file: %w", err)
+	}
+	for i, val := range fat1 {
+		_, err = file.WriteString(fmt.Sprintf("%d: %d\n", i, val))
+		if err != nil {
+			return fmt.Errorf("error writing to file: %w", err)
+		}
+	}
+
+	// **Print the FAT2 table to the file**
+	_, err = file.WriteString("\nFAT2 Table:\n")
+	if err != nil {
+		return fmt.Errorf("error writing to file: %w", err)
+	}
+	for i, val := range fat2 {
+		_, err = file.WriteString(fmt.Sprintf("%d: %d\n", i, val))
+		if err != nil {
+			return fmt.Errorf("error writing to file: %w", err)
+		}
+	}
+
+	// fmt.Println("File system details printed to file successfully!")
+	return nil
+}
+
+// PrintFormat prints the layout of the open volume
+func (fs *FileSystem) PrintFormat() {
+	fs_format := fs.fs_format
+	fmt.Printf("\nSignature: %s, version %d\n", fs.Signature(), fs_format.version)
+	fmt.Printf("File size: %d bytes\n", fs_format.file_size)
+	fmt.Printf("Cluster size: %d bytes\n", fs_format.cluster_size)
+	fmt.Printf("FAT size: %d bytes\n", fs_format.fat_size)
+	fmt.Printf("FAT cluster count: %d\n", fs_format.fat_cluster_count)
+	fmt.Printf("Cluster count: %d\n", fs_format.cluster_count)
+	fmt.Printf("FAT1 start: %d\n", fs_format.fat1_start)
+	fmt.Printf("FAT2 start: %d\n", fs_format.fat2_start)
+	fmt.Printf("Journal start: %d, %d clusters\n", fs_format.journal_start, fs_format.journal_clusters)
+	fmt.Printf("Data start: %d\n", fs_format.data_start)
+}
+
+// CalculateFS lays out a volume of file_size bytes split into clusters of cluster_size bytes,
+// a layout whose offsets would not fit an int64 or whose clusters would not fit an int32 is rejected
+func CalculateFS(file_size int64, cluster_size int) (FileSystemFormat, error) {
+
+	if !validClusterSize(cluster_size) {
+		return FileSystemFormat{}, fmt.Errorf("cluster size %d is not a power of two between %d and %d: %w", cluster_size, MIN_CLUSTER_SIZE, MAX_CLUSTER_SIZE, ErrInvalid)
+	}
+
+	// **Calculate the number of clusters based on the file size**
+	cluster_count := file_size / int64(cluster_size)
+	if file_size <= 0 || cluster_count > MAX_CLUSTERS {
+		return FileSystemFormat{}, fmt.Errorf("file system size %d is out of range: %w", file_size, ErrInvalid)
+	}
+
+	// **Calculate the FAT size and number of FAT clusters**
+	fat_size := cluster_count * FAT_ENTRY
+	fat_cluster_count := (fat_size + int64(cluster_size) - 1) / int64(cluster_size)
+
+	// **The journal sits between FAT2 and the data area**
+	descriptor_clusters, journal_blocks := journalGeometry(int(cluster_count), int(fat_cluster_count), cluster_size)
+	journal_clusters := int64(descriptor_clusters + journal_blocks)
+
+	// **Calculate the starting positions, the header takes cluster 0**
+	data_cluster := 1 + 2*fat_cluster_count + journal_clusters
+	if data_cluster > cluster_count {
+		return FileSystemFormat{}, fmt.Errorf("file system size %d leaves no room for data: %w", file_size, ErrInvalid)
+	}
+
+	var offsets [4]int64
+	for i, cluster := range []int64{1, 1 + fat_cluster_count, 1 + 2*fat_cluster_count, data_cluster} {
+		offset, err := mulOffset(cluster, int64(cluster_size))
+		if err != nil {
+			return FileSystemFormat{}, err
+		}
+		offsets[i] = offset
+	}
+
+	// **Initialize the file system format**
+	fs_format := FileSystemFormat{
+		version:           FS_VERSION,
+		file_size:         file_size,
+		cluster_size:      int32(cluster_size),
+		fat_size:          fat_size,
+		fat_cluster_count: int32(fat_cluster_count),
+		cluster_count:     int32(cluster_count),
+		fat1_start:        offsets[0],
+		fat2_start:        offsets[1],
+		journal_start:     offsets[2],
+		journal_clusters:  int32(journal_clusters),
+		data_start:        offsets[3],
+	}
+	copy(fs_format.signature[:], SIGNATURE)
+
+	return fs_format, nil
+}
+
+func (fs *FileSystem) clusterSize() int64 {
+	return int64(fs.fs_format.cluster_size)
+}
+
+func (fs *FileSystem) rootCluster() int32 {
+	return fs.clusterAt(fs.fs_format.data_start)
+}
+
+// clusterAt returns the cluster holding the byte offset, offsets of the layout always fall inside the volume
+func (fs *FileSystem) clusterAt(offset int64) int32 {
+	return int32(offset / fs.clusterSize())
+}
+
+// rootDirectory returns the first cluster of the root directory, a snapshot view has its root elsewhere
+func (fs *FileSystem) rootDirectory() int32 {
+
+	if fs.snapshot_root != 0 {
+		return fs.snapshot_root
+	}
+
+	return fs.rootCluster()
+}
+
+// clusterOffset returns the byte offset of the cluster, an int32 cluster times a cluster size
+// of at most MAX_CLUSTER_SIZE always fits an int64
+func (fs *FileSystem) clusterOffset(cluster int32) int64 {
+	return int64(cluster) * fs.clusterSize()
+}
+
+// writeDirectoryEntry adds the entry and its long name slots to the directory, growing it when it is full
+func (fs *FileSystem) writeDirectoryEntry(cluster int32, dir_entry DirectoryEntry) error {
+
+	// **Read the whole directory chain**
+	chain, dir_entries, err := fs.readDirectory(cluster)
+	if err != nil {
+		return fmt.Errorf("error reading directory entries: %w", err)
+	}
+
+	slots := append(longNameSlots(dir_entry), dir_entry)
+
+	// **Find the first run of empty slots that holds the entry with its long name**
+	run := 0
+	for i, entry := range dir_entries {
+
+		if !IsZeroEntry(entry) {
+			run = 0
+			continue
+		}
+
+		run++
+		if run == len(slots) {
+			first := i + 1 - len(slots)
+			copy(dir_entries[first:], slots)
+			return fs.writeDirectorySlots(chain, dir_entries, first, i)
+		}
+	}
+
+	// **The directory is full, grow it by the clusters holding the new entry, its owner pays for them**
+	per_cluster := fs.dirEntriesPerCluster()
+	clusters := (len(slots) + per_cluster - 1) / per_cluster
+	err = fs.chargeQuota(cluster, dir_entries[0].Uid, quotaUsage{clusters: clusters})
+	if err != nil {
+		return err
+	}
+
+	new_chain, err := fs.allocateChain(clusters)
+	if err != nil {
+		return fmt.Errorf("no empty directory slot available in cluster %d: %w", cluster, err)
+	}
+
+	new_entries := make([]DirectoryEntry, len(new_chain)*per_cluster)
+	copy(new_entries, slots)
+
+	for i, new_cluster := range new_chain {
+		err = fs.writeDirectoryEntries(new_cluster, new_entries[i*per_cluster:(i+1)*per_cluster])
+		if err != nil {
+			fs.releaseClusters(new_chain)
+			return err
+		}
+	}
+
+	err = fs.updateFatEntry(chain[len(chain)-1], new_chain[0])
+	if err != nil {
+		fs.releaseClusters(new_chain)
+		return err
+	}
+
+	return nil
+}
+
+// writeDirectorySlots writes back the clusters of the directory chain that hold the entries first to last
+func (fs *FileSystem) writeDirectorySlots(chain []int32, dir_entries []DirectoryEntry, first, last int) error {
+
+	per_cluster := fs.dirEntriesPerCluster()
+	for index := first / per_cluster * per_cluster; index <= last; index += per_cluster {
+
+		err := fs.writeDirectorySlot(chain, dir_entries, index)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeDirectorySlot writes back only the cluster of the directory chain that holds entry index
+func (fs *FileSystem) writeDirectorySlot(chain []int32, dir_entries []DirectoryEntry, index int) error {
+
+	per_cluster := fs.dirEntriesPerCluster()
+	first := index / per_cluster * per_cluster
+
+	return fs.writeDirectoryEntries(chain[index/per_cluster], dir_entries[first:first+per_cluster])
+}
+
+// writeDirectoryEntries writes one cluster worth of entries into the given cluster
+func (fs *FileSystem) writeDirectoryEntries(cluster int32, dir_entries []DirectoryEntry) error {
+
+	raw_entries := encodeDirectoryEntries(dir_entries)
+
+	// **Stage the directory entries, the commit writes them through the journal**
+	err := fs.stageBytes(raw_entries, fs.clusterOffset(cluster))
+	if err != nil {
+		return fmt.Errorf("error writing directory cluster %d: %w", cluster, err)
+	}
+
+	return nil
+}
+
+// encodeDirectoryEntries returns the on-disk form of the entries
+func encodeDirectoryEntries(dir_entries []DirectoryEntry) []byte {
+
+	raw_entries := make([]byte, len(dir_entries)*DIR_ENTRY_SIZE)
+	for i, entry := range dir_entries {
+		entry.encode(raw_entries[i*DIR_ENTRY_SIZE:])
+	}
+
+	return raw_entries
+}
+
+func (fs *FileSystem) createRootDirectory(free_cluster int32) error {
+
+	// **Update the FAT entry for the root directory**
+	err := fs.updateFatEntry(free_cluster, FAT_EOF)
+	if err != nil {
+		return fmt.Errorf("error updating FAT entry for root directory: %w", err)
+	}
+
+	// **Set the current and parent directory for the root directory**
+	return fs.setCurrentAndParentDirectory(free_cluster, free_cluster, MODE_DIR)
+}
+
+// createFile stores data as a new file named dest_name inside the directory at dest_cluster
+func (fs *FileSystem) createFile(dest_cluster int32, dest_name string, data []byte) error {
+	return fs.createEntry(dest_cluster, dest_name, data, 0, MODE_FILE) // 0 indicates a file
+}
+
+// createEntry creates a file or a symbolic link holding data, the running operation owns it
+func (fs *FileSystem) createEntry(dest_cluster int32, dest_name string, data []byte, entry_type uint8, mode uint16) error {
+
+	if dest_name == "" {
+		return ErrIsDir
+	}
+
+	// **Check if a file with the same name already exists**
+	if fs.checkIfDirectoryExists(dest_cluster, dest_name) {
+		return ErrExist
+	}
+
+	new_entry := DirectoryEntry{Is_directory: entry_type, Links: 1, Uid: fs.cred.uid, Gid: fs.cred.gid, Mode: mode}
+	err := fs.setEntryName(dest_cluster, &new_entry, dest_name)
+	if err != nil {
+		return err
+	}
+
+	// **Check the quotas and reserve the whole chain before writing anything**
+	clusters := fs.clustersForSize(int64(len(data)))
+	err = fs.chargeQuota(dest_cluster, fs.cred.uid, quotaUsage{clusters: clusters, entries: 1})
+	if err != nil {
+		return err
+	}
+
+	chain, err := fs.allocateChain(clusters)
+	if err != nil {
+		return fmt.Errorf("error allocating clusters: %w", err)
+	}
+
+	// **Write the file data into the VFS**
+	err = fs.writeChainAt(chain, data, 0)
+	if err != nil {
+		fs.releaseClusters(chain)
+		return fmt.Errorf("error writing file contents: %w", err)
+	}
+
+	// **Fill in the directory entry of the new file**
+	new_entry.Size = int64(len(data))
+	new_entry.First_cluster = chain[0]
+	new_entry.setTimes(time.Now())
+
+	// **Publish the file by writing its directory entry, the last step that can fail**
+	err = fs.writeDirectoryEntry(dest_cluster, new_entry)
+	if err != nil {
+		fs.releaseClusters(chain)
+		return fmt.Errorf("error writing directory entry: %w", err)
+	}
+
+	return nil
+}
+
+// createDirectory creates an empty directory with the given permission bits, the running operation owns it
+func (fs *FileSystem) createDirectory(parent_cluster int32, final_name string, mode uint16) error {
+
+	// **Check if the directory name is valid**
+	if final_name == "" || final_name == "." || final_name == ".." {
+		return ErrExist
+	}
+
+	// **Check if the directory already exists**
+	if fs.checkIfDirectoryExists(parent_cluster, final_name) {
+		return ErrExist
+	}
+
+	// **Name the new directory entry, long names get a short alias**
+	new_dir := DirectoryEntry{Size: 0, Is_directory: 1, Links: 1, Uid: fs.cred.uid, Gid: fs.cred.gid, Mode: mode}
+	err := fs.setEntryName(parent_cluster, &new_dir, final_name)
+	if err != nil {
+		return err
+	}
+
+	// **Check the quotas and find a free cluster for the new directory**
+	err = fs.chargeQuota(parent_cluster, fs.cred.uid, quotaUsage{clusters: 1, entries: 1})
+	if err != nil {
+		return err
+	}
+
+	free_cluster, err := fs.allocateCluster()
+	if err != nil {
+		return fmt.Errorf("error finding free cluster: %w", err)
+	}
+
+	new_dir.First_cluster = free_cluster
+	new_dir.setTimes(time.Now())
+
+	// **Set the current and parent directory for the new directory**
+	err = fs.setCurrentAndParentDirectory(free_cluster, parent_cluster, mode)
+	if err != nil {
+		fs.releaseClusters([]int32{free_cluster})
+		return err
+	}
+
+	// **Publish the directory in its parent only once it is complete**
+	err = fs.writeDirectoryEntry(parent_cluster, new_dir)
+	if err != nil {
+		fs.releaseClusters([]int32{free_cluster})
+		return fmt.Errorf("error updating parent directory: %w", err)
+	}
+
+	return nil
+}
+
+// setCurrentAndParentDirectory writes the first cluster of a new directory, both entries carry
+// the owner and the mode of the directory
+func (fs *FileSystem) setCurrentAndParentDirectory(current_cluster, parent_cluster int32, mode uint16) error {
+
+	// **Current directory entry**
+	current_entry := DirectoryEntry{
+		Name:          [MAX_FILE_NAME]byte{'.'},
+		Size:          0,
+		First_cluster: current_cluster,
+		Is_directory:  1,
+		Links:         1,
+		Uid:           fs.cred.uid,
+		Gid:           fs.cred.gid,
+		Mode:          mode,
+	}
+
+	// **Parent directory entry**
+	parent_entry := current_entry
+	parent_entry.Name = [MAX_FILE_NAME]byte{'.', '.'}
+	parent_entry.First_cluster = parent_cluster
+
+	now := time.Now()
+	current_entry.setTimes(now)
+	parent_entry.setTimes(now)
+
+	// **Zero padding for the remaining space in the cluster**
+	dir_entries := make([]DirectoryEntry, fs.dirEntriesPerCluster())
+	dir_entries[0] = current_entry
+	dir_entries[1] = parent_entry
+
+	err := fs.writeDirectoryEntries(current_cluster, dir_entries)
+	if err != nil {
+		return fmt.Errorf("error writing '.' and '..' entries: %w", err)
+	}
+
+	return nil
+}
+
+// setParentDirectory points the '..' entry of the directory at dir_cluster to parent_cluster
+func (fs *FileSystem) setParentDirectory(dir_cluster, parent_cluster int32) error {
+
+	dir_entries, err := fs.readDirectoryChain([]int32{dir_cluster})
+	if err != nil {
+		return err
+	}
+
+	dir_entries[1].First_cluster = parent_cluster
+	return fs.writeDirectoryEntries(dir_cluster, dir_entries)
+}
+
+func (fs *FileSystem) checkIfDirectoryExists(parent_cluster int32, dirName string) bool {
+
+	// **Read the directory entries from the parent cluster**
+	dir_entries, err := fs.readDirectoryEntries(parent_cluster)
+	if err != nil {
+		return false
+	}
+
+	// **Check if the directory exists in the parent cluster**
+	for _, entry := range dir_entries {
+
+		if isUsedEntry(entry) && fs.matchesName(entry, dirName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readDirectoryEntries returns the entries of every cluster in the directory chain
+func (fs *FileSystem) readDirectoryEntries(cluster int32) ([]DirectoryEntry, error) {
+
+	_, dir_entries, err := fs.readDirectory(cluster)
+	return dir_entries, err
+}
+
+// readDirectory returns the cluster chain of a directory together with all of its entries,
+// entry i lives in chain[i/fs.dirEntriesPerCluster()]
+func (fs *FileSystem) readDirectory(cluster int32) ([]int32, []DirectoryEntry, error) {
+
+	chain, err := fs.readChain(cluster)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	items, err := fs.readDirectoryChain(chain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return chain, items, nil
+}
+
+// readDirectoryChain decodes the entries stored in the given directory clusters
+func (fs *FileSystem) readDirectoryChain(chain []int32) ([]DirectoryEntry, error) {
+
+	raw_cluster := make([]byte, fs.clusterSize())
+	var items []DirectoryEntry
+	for _, current_cluster := range chain {
+
+		// **Calculate the data cluster position for the directory entry**
+		err := fs.readBytes(raw_cluster, fs.clusterOffset(current_cluster))
+		if err != nil {
+			return nil, fmt.Errorf("error reading directory cluster %d: %w", current_cluster, err)
+		}
+
+		// **Read the directory entries from the cluster**
+		for i := 0; i < fs.dirEntriesPerCluster(); i++ {
+			items = append(items, decodeDirectoryEntry(raw_cluster[i*DIR_ENTRY_SIZE:]))
+		}
+	}
+
+	// **Long names may continue across cluster boundaries, join them once the whole chain is read**
+	attachLongNames(items)
+
+	return items, nil
+}
+
+// shrinkDirectory frees the clusters at the end of a directory chain that hold no entries,
+// the first cluster always stays because it holds '.' and '..'
+func (fs *FileSystem) shrinkDirectory(chain []int32, dir_entries []DirectoryEntry) error {
+
+	per_cluster := fs.dirEntriesPerCluster()
+	keep := len(chain)
+	for keep > 1 {
+
+		in_use := false
+		for _, entry := range dir_entries[(keep-1)*per_cluster : keep*per_cluster] {
+			if !IsZeroEntry(entry) {
+				in_use = true
+				break
+			}
+		}
+
+		if in_use {
+			break
+		}
+		keep--
+	}
+
+	if keep == len(chain) {
+		return nil
+	}
+
+	err := fs.updateFatEntry(chain[keep-1], FAT_EOF)
+	if err != nil {
+		return err
+	}
+
+	return fs.freeChain(chain[keep])
+}
+
+func (fs *FileSystem) dirEntriesPerCluster() int {
+	return int(fs.clusterSize()) / DIR_ENTRY_SIZE
+}
+func IsZeroEntry(entry DirectoryEntry) bool {
+	return entry.Name[0] == 0 && entry.Size == 0 && entry.First_cluster == 0
+}
+
+func (fs *FileSystem) getParentCluster(current_cluster int32) int32 {
+
+	// **Read the parent directory entry from the second slot**
+	offset := fs.clusterOffset(current_cluster) + DIR_ENTRY_SIZE
+	raw_entry := make([]byte, DIR_ENTRY_SIZE)
+	err := fs.readBytes(raw_entry, offset)
+	if err != nil {
+		return -1
+	}
+
+	return decodeDirectoryEntry(raw_entry).First_cluster
+}
+
+// directoryPath returns the absolute path of the directory at dir_cluster by following '..' up to the root
+func (fs *FileSystem) directoryPath(dir_cluster int32) (string, error) {
+
+	var names []string
+	for cluster := dir_cluster; cluster != fs.rootDirectory(); {
+
+		if len(names) >= int(fs.fs_format.cluster_count) {
+			return "", fmt.Errorf("directory at cluster %d is not below the root: %w", dir_cluster, ErrCorrupt)
+		}
+
+		parent_cluster := fs.getParentCluster(cluster)
+		dir_entries, err := fs.readDirectoryEntries(parent_cluster)
+		if err != nil {
+			return "", err
+		}
+
+		index := slices.IndexFunc(dir_entries[2:], func(entry DirectoryEntry) bool {
+			return isUsedEntry(entry) && entry.Is_directory == 1 && entry.First_cluster == cluster
+		})
+		if index < 0 {
+			return "", fmt.Errorf("directory at cluster %d: %w", dir_cluster, ErrNotFound)
+		}
+
+		names = append(names, dir_entries[2+index].FileName())
+		cluster = parent_cluster
+	}
+
+	slices.Reverse(names)
+	return path.Join(append([]string{"/"}, names...)...), nil
+}
+
+// pathWalk is the state of one path resolution
+type pathWalk struct {
+	hops   int  // symbolic links followed so far
+	search bool // every directory looked into needs search permission, see users.go
+}
+
+// parsePath resolves dest without any permission checks, Session.parsePath checks them
+func (fs *FileSystem) parsePath(start_cluster int32, dest string, last_entry bool) (int32, string, error) {
+	return fs.walkPath(start_cluster, dest, last_entry, &pathWalk{})
+}
+
+// walkPath resolves dest like parsePath, walk counts the symbolic links followed on the way
+func (fs *FileSystem) walkPath(start_cluster int32, dest string, last_entry bool, walk *pathWalk) (int32, string, error) {
+
+	// **Check if the path is absolute or relative**
+	current_cluster := start_cluster
+	if strings.HasPrefix(dest, "/") {
+		// Absolute path (starts with "/"): Start from the root directory
+		current_cluster = fs.rootDirectory()
+	}
+
+	// **Trim the trailing slash from the destination path**
+	dest = strings.TrimRight(dest, "/")
+	path_components := strings.Split(dest, "/")
+
+	// **Split the path into components**
+	var final_name string
+	for i, component := range path_components {
+
+		if component == "" || component == "." {
+			continue // Ignore empty or current directory symbol
+		}
+
+		// **Looking up a name needs search permission on the directory holding it**
+		if walk.search {
+			err := fs.checkDirAccess(current_cluster, PERM_EXEC)
+			if err != nil {
+				return -1, "", err
+			}
+		}
+
+		if component == ".." {
+			// Handle parent directory navigation
+			current_cluster = fs.getParentCluster(current_cluster)
+			continue
+		}
+
+		if i == len(path_components)-1 {
+			final_name = component
+
+			// If `last_entry` is false, traverse into the last component
+			if !last_entry {
+				next_cluster, err := fs.enterDirectory(component, current_cluster, walk)
+				if err != nil {
+					return -1, "", fmt.Errorf("cannot enter '%s': %w", component, err)
+				}
+				current_cluster = next_cluster
+			}
+			break
+		}
+
+		// Traverse to the next directory
+		next_cluster, err := fs.enterDirectory(component, current_cluster, walk)
+		if err != nil {
+			return -1, "", fmt.Errorf("cannot enter '%s': %w", component, err)
+		}
+		current_cluster = next_cluster
+	}
+
+	return current_cluster, final_name, nil
+}
+
+// isDirectory reports whether the cluster still holds the head of a live directory
+func (fs *FileSystem) isDirectory(cluster int32) bool {
+
+	next_cluster, err := fs.readFatEntry(cluster)
+	if err != nil || next_cluster == FAT_FREE {
+		return false
+	}
+
+	entry, err := fs.findEntry(".", cluster)
+	return err == nil && entry.Is_directory == 1 && entry.First_cluster == cluster
+}
+
+// removeDirectoryEntry deletes the named entry, a directory must be empty unless recursive is set
+func (fs *FileSystem) removeDirectoryEntry(cluster int32, dir_name string, recursive bool) error {
+
+	if dir_name == "." || dir_name == ".." || dir_name == "/" || dir_name == "" {
+		return fmt.Errorf("cannot remove '%s': %w", dir_name, ErrInvalid)
+	}
+
+	// **Read the directory entries from the whole chain**
+	chain, dir_entries, err := fs.readDirectory(cluster)
+	if err != nil {
+		return fmt.Errorf("error reading directory entries: %w", err)
+	}
+
+	// **Find the directory entry to remove**
+	entry_index := -1
+	for i, entry := range dir_entries {
+		if isUsedEntry(entry) && fs.matchesName(entry, dir_name) {
+			entry_index = i
+			break
+		}
+	}
+
+	if entry_index == -1 {
+		return ErrNotFound
+	}
+
+	// **Check if the directory has contents and prevent removal if not empty**
+	entry_to_remove := dir_entries[entry_index]
+
+	if entry_to_remove.Is_directory == 1 && !recursive {
+
+		sub_entries, err := fs.readDirectoryEntries(entry_to_remove.First_cluster)
+		if err != nil {
+			return fmt.Errorf("error reading subdirectory entries: %w", err)
+		}
+
+		// Check if the subdirectory is empty
+		for _, sub_entry := range sub_entries {
+
+			name := sub_entry.FileName()
+
+			if name == "." || name == ".." {
+				continue
+			}
+
+			if isUsedEntry(sub_entry) {
+				return ErrNotEmpty
+			}
+		}
+	}
+
+	err = fs.clearDirectorySlot(chain, dir_entries, entry_index)
+	if err != nil {
+		return err
+	}
+
+	// **Clear the FAT entries for the removed entry's clusters, a file with other names keeps them**
+	return fs.freeTree(entry_to_remove, make(map[int32]bool))
+}
+
+// clearDirectorySlot empties entry index of a directory together with its long name slots and gives
+// back clusters that became empty, the chain of the entry itself is left alone
+func (fs *FileSystem) clearDirectorySlot(chain []int32, dir_entries []DirectoryEntry, index int) error {
+
+	// **Remove the directory entry by clearing it**
+	_, first := longNameRun(dir_entries, index)
+	for i := first; i <= index; i++ {
+		dir_entries[i] = DirectoryEntry{}
+	}
+
+	// **Write the updated directory entries back to the cluster**
+	err := fs.writeDirectorySlots(chain, dir_entries, first, index)
+	if err != nil {
+		return err
+	}
+
+	// **The quota usage counted so far does not follow the entries that go away**
+	fs.quotas = quotaCache{}
+
+	// **Give back directory clusters that became empty**
+	return fs.shrinkDirectory(chain, dir_entries)
+}
+
+// moveEntry relinks an entry under a new name or into another directory, its clusters stay where they are
+func (fs *FileSystem) moveEntry(src_cluster int32, src_name string, dest_cluster int32, dest_name string) error {
+
+	if src_name == "" || src_name == "." || src_name == ".." {
+		return fmt.Errorf("cannot move '%s': %w", src_name, ErrInvalid)
+	}
+
+	if dest_name == "" || dest_name == "." || dest_name == ".." {
+		return ErrExist
+	}
+
+	entry, err := fs.findEntry(src_name, src_cluster)
+	if err != nil {
+		return err
+	}
+
+	// **A directory cannot become its own descendant**
+	if entry.Is_directory == 1 && fs.isInsideTree(dest_cluster, entry.First_cluster) {
+		return fmt.Errorf("cannot move '%s' into itself: %w", src_name, ErrInvalid)
+	}
+
+	// **Directories that get the entry from outside count it against their quotas**
+	if dest_cluster != src_cluster {
+		usage, err := fs.entryUsage(entry)
+		if err == nil {
+			err = fs.checkQuota(entry.Uid, quotaUsage{}, dest_cluster, src_cluster, usage)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// **Only the entry itself may already answer to the new name, a rename that changes just the case**
+	is_self := dest_cluster == src_cluster && fs.matchesName(entry, dest_name)
+	if !is_self && fs.checkIfDirectoryExists(dest_cluster, dest_name) {
+		return ErrExist
+	}
+
+	// **Sessions and open files below a moved directory rebuild their paths**
+	if entry.Is_directory == 1 {
+		fs.dir_renames++
+	}
+
+	moved_entry := entry
+	err = fs.setEntryName(dest_cluster, &moved_entry, dest_name)
+	if err != nil {
+		return err
+	}
+
+	// **Within one directory the entry is renamed in place**
+	if dest_cluster == src_cluster {
+		return fs.updateDirectoryEntry(src_cluster, src_name, moved_entry)
+	}
+
+	// **Another name of a linked file now lives in the new parent**
+	if entry.Is_directory != 1 && entry.Links > 1 {
+		err = fs.indexLink(entry.First_cluster, dest_cluster)
+		if err != nil {
+			return err
+		}
+	}
+
+	// **Link the entry into the new parent before it leaves the old one**
+	err = fs.writeDirectoryEntry(dest_cluster, moved_entry)
+	if err != nil {
+		return err
+	}
+
+	chain, dir_entries, err := fs.readDirectory(src_cluster)
+	if err != nil {
+		return err
+	}
+
+	for i, old_entry := range dir_entries {
+		if isUsedEntry(old_entry) && fs.matchesName(old_entry, src_name) {
+
+			err = fs.clearDirectorySlot(chain, dir_entries, i)
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	// **A moved directory names its new parent in '..'**
+	if entry.Is_directory == 1 {
+		return fs.setParentDirectory(entry.First_cluster, dest_cluster)
+	}
+
+	return nil
+}
+
+func (fs *FileSystem) freeChain(start_cluster int32) error {
+
+	cluster_to_clear := start_cluster
+	for cluster_to_clear >= 0 {
+
+		next_cluster, err := fs.readFatEntry(cluster_to_clear)
+		if err != nil {
+			return fmt.Errorf("error reading FAT entry: %w", err)
+		}
+
+		// Mark the current cluster as free
+		err = fs.updateFatEntry(cluster_to_clear, FAT_FREE)
+		if err != nil {
+			return fmt.Errorf("error clearing FAT entry: %w", err)
+		}
+
+		cluster_to_clear = next_cluster
+	}
+
+	return nil
+}
+
+// freeTree frees the chain of the entry and, for a directory, the chains of everything below it,
+// the chain of a hard linked file only goes with its last name, see releaseLink
+func (fs *FileSystem) freeTree(entry DirectoryEntry, released map[int32]bool) error {
+
+	if entry.Is_directory != 1 {
+		return fs.releaseLink(entry, released)
+	}
+
+	// **Names inside the removed tree no longer count for files that have names elsewhere**
+	fs.unindexDirectory(entry.First_cluster)
+
+	dir_entries, err := fs.readDirectoryEntries(entry.First_cluster)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range dir_entries[2:] {
+		if isUsedEntry(child) {
+			err = fs.freeTree(child, released)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = fs.freeXattrs(entry)
+	if err == nil {
+		err = fs.dropQuota(entry.First_cluster)
+	}
+	if err != nil {
+		return err
+	}
+
+	return fs.freeChain(entry.First_cluster)
+}
+
+// setEntryTimes changes the access and modification time of an entry
+func (fs *FileSystem) setEntryTimes(cluster int32, name string, atime, mtime time.Time) error {
+	return fs.changeEntry(cluster, name, func(entry *DirectoryEntry) {
+		entry.Accessed, entry.Modified = atime.Unix(), mtime.Unix()
+	})
+}
+
+// changeEntry applies change to the named entry, a directory keeps its entry in the parent and
+// its '.' entry in step. An empty name stands for the directory at cluster itself.
+func (fs *FileSystem) changeEntry(cluster int32, name string, change func(entry *DirectoryEntry)) error {
+
+	// **A directory given by its own cluster is found in its parent, the root has only its '.' entry**
+	if name == "" {
+		parent_cluster := fs.getParentCluster(cluster)
+		name = "."
+
+		if parent_cluster != cluster {
+			dir_entries, err := fs.readDirectoryEntries(parent_cluster)
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range dir_entries[2:] {
+				if isUsedEntry(entry) && entry.Is_directory == 1 && entry.First_cluster == cluster {
+					name = entry.FileName()
+					cluster = parent_cluster
+					break
+				}
+			}
+		}
+	}
+
+	entry, err := fs.findEntry(name, cluster)
+	if err != nil {
+		return err
+	}
+
+	change(&entry)
+	err = fs.updateDirectoryEntry(cluster, name, entry)
+	if err != nil || entry.Is_directory != 1 || name == "." {
+		return err
+	}
+
+	self, err := fs.findEntry(".", entry.First_cluster)
+	if err != nil {
+		return err
+	}
+
+	change(&self)
+	return fs.updateDirectoryEntry(entry.First_cluster, ".", self)
+}
+
+// copyTree copies the entry as name into the directory at parent_cluster, a directory with everything below it
+func (fs *FileSystem) copyTree(entry DirectoryEntry, parent_cluster int32, name string) error {
+
+	if entry.Is_directory != 1 {
+
+		file_contents, err := fs.readFileContents(entry.First_cluster, entry.Size)
+		if err != nil {
+			return err
+		}
+
+		err = fs.createEntry(parent_cluster, name, file_contents, entry.Is_directory, entry.Mode)
+		if err != nil {
+			return err
+		}
+
+		return fs.copyXattrs(entry, parent_cluster, name)
+	}
+
+	// **Read the source first, the copy must not see its own entries**
+	dir_entries, err := fs.readDirectoryEntries(entry.First_cluster)
+	if err != nil {
+		return err
+	}
+
+	// **The new directory gets its own '.' and '..' entries, the copies keep the permission bits and the attributes**
+	err = fs.createDirectory(parent_cluster, name, entry.Mode)
+	if err == nil {
+		err = fs.copyXattrs(entry, parent_cluster, name)
+	}
+	if err != nil {
+		return err
+	}
+
+	dir_cluster, err := fs.findDirectoryCluster(name, parent_cluster)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range dir_entries[2:] {
+		if isUsedEntry(child) {
+			err = fs.copyTree(child, dir_cluster, child.FileName())
+			if err != nil {
+				return fmt.Errorf("cannot copy '%s': %w", child.FileName(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// treeClusters returns how many clusters a copy of the entry takes, directories counted without free slots
+func (fs *FileSystem) treeClusters(entry DirectoryEntry) (int, error) {
+
+	xattr_clusters, err := fs.xattrClusters(entry)
+	if err != nil {
+		return 0, err
+	}
+
+	if entry.Is_directory != 1 {
+		return fs.clustersForSize(int64(entry.Size)) + xattr_clusters, nil
+	}
+
+	dir_entries, err := fs.readDirectoryEntries(entry.First_cluster)
+	if err != nil {
+		return 0, err
+	}
+
+	used, total := 2, 0
+	for _, child := range dir_entries[2:] {
+
+		if !isUsedEntry(child) {
+			continue
+		}
+		used += 1 + len(longNameSlots(child))
+
+		clusters, err := fs.treeClusters(child)
+		if err != nil {
+			return 0, err
+		}
+		total += clusters
+	}
+
+	per_cluster := fs.dirEntriesPerCluster()
+	return total + xattr_clusters + (used+per_cluster-1)/per_cluster, nil
+}
+
+// isInsideTree reports whether the directory at cluster is dir_cluster itself or lies below it
+func (fs *FileSystem) isInsideTree(cluster, dir_cluster int32) bool {
+
+	// **Walk the '..' entries up to the root, which is its own parent**
+	for depth := int32(0); depth < fs.fs_format.cluster_count; depth++ {
+
+		if cluster == dir_cluster {
+			return true
+		}
+
+		parent_cluster := fs.getParentCluster(cluster)
+		if parent_cluster < 0 || parent_cluster == cluster {
+			return false
+		}
+		cluster = parent_cluster
+	}
+
+	return false
+}
+
+// findDirectoryCluster returns the first cluster of a subdirectory, a symbolic link to one is followed
+func (fs *FileSystem) findDirectoryCluster(dir_name string, parent_cluster int32) (int32, error) {
+	return fs.enterDirectory(dir_name, parent_cluster, &pathWalk{})
+}
+
+func (fs *FileSystem) findEntry(src string, current_cluster int32) (DirectoryEntry, error) {
+
+	// **Read the directory entries from the cluster**
+	dir_entries, err := fs.readDirectoryEntries(current_cluster)
+	if err != nil {
+		return DirectoryEntry{}, fmt.Errorf("error reading directory entries: %w", err)
+	}
+
+	// **Find the file entry in the cluster**
+	for _, entry := range dir_entries {
+		if isUsedEntry(entry) && fs.matchesName(entry, src) {
+			return entry, nil
+		}
+	}
+
+	return DirectoryEntry{}, ErrNotFound
+}
+
+func (fs *FileSystem) updateDirectoryEntry(cluster int32, name string, new_entry DirectoryEntry) error {
+
+	// **Read the directory entries from the whole chain**
+	chain, dir_entries, err := fs.readDirectory(cluster)
+	if err != nil {
+		return fmt.Errorf("error reading directory entries: %w", err)
+	}
+
+	for i, entry := range dir_entries {
+
+		if !isUsedEntry(entry) || !fs.matchesName(entry, name) {
+			continue
+		}
+
+		// **Replace the entry in place while its name stays, a new name may need other long name slots**
+		if new_entry.Name == entry.Name && new_entry.long_name == entry.long_name {
+			dir_entries[i] = new_entry
+			err = fs.writeDirectorySlot(chain, dir_entries, i)
+		} else {
+			err = fs.clearDirectorySlot(chain, dir_entries, i)
+			if err == nil {
+				err = fs.writeDirectoryEntry(cluster, new_entry)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		// **The other names of a hard linked file see the change as well**
+		return fs.syncLinks(entry, new_entry)
+	}
+
+	return ErrNotFound
+}
+
+func (fs *FileSystem) readFileContents(start_cluster int32, file_size int64) ([]byte, error) {
+
+	var file_contents []byte
+	current_cluster := start_cluster
+	remaining_size := file_size
+
+	for remaining_size > 0 {
+		// Calculate the offset for the current cluster
+		offset := fs.clusterOffset(current_cluster)
+		readSize := int(fs.clusterSize())
+		if remaining_size < fs.clusterSize() {
+			readSize = int(remaining_size)
+		}
+
+		// Read the cluster's data
+		buffer := make([]byte, readSize)
+		err := fs.readBytes(buffer, offset)
+		if err != nil {
+			return nil, fmt.Errorf("error reading cluster %d at offset %d: %w", current_cluster, offset, err)
+		}
+
+		// Append the data to the file_contents
+		file_contents = append(file_contents, buffer...)
+
+		// Reduce the remaining size
+		remaining_size -= int64(readSize)
+
+		// Stop reading once the whole file was read
+		if remaining_size <= 0 {
+			break
+		}
+
+		// Get the next cluster from FAT
+		current_cluster, err = fs.readFatEntry(current_cluster)
+		if err != nil {
+			return nil, fmt.Errorf("error reading FAT entry for cluster %d: %w", current_cluster, err)
+		}
+
+		// Check if the chain ended before the end of the file
+		if current_cluster < 0 {
+			return nil, fmt.Errorf("cluster chain of size %d ends with %d: %w", file_size, current_cluster, ErrCorrupt)
+		}
+	}
+
+	return file_contents, nil
+}
@@ -0,0 +1,273 @@
+package pseudofat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDirectoryGrowth(t *testing.T) {
+
+	fs, _ := newVolume(t, 4)
+	free_bytes, _ := fs.FreeSpace()
+
+	if err := fs.Mkdir("/d"); err != nil {
+		t.Fatal(err)
+	}
+
+	// **Hundreds of entries spread the directory over a chain of clusters**
+	const FILES = 500
+	for i := range FILES {
+		if err := fs.WriteFile(fmt.Sprintf("/d/f%d", i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	for i := range 100 {
+		if err := fs.Mkdir(fmt.Sprintf("/d/g%d", i)); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+
+	chain, err := fs.ClusterChain("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (FILES + 100 + 2 + fs.dirEntriesPerCluster() - 1) / fs.dirEntriesPerCluster(); len(chain) < want {
+		t.Fatalf("directory of %d clusters, want at least %d", len(chain), want)
+	}
+
+	entries, err := fs.ReadDir("/d")
+	if err != nil || len(entries) != FILES+100+2 {
+		t.Fatalf("%d entries, %v", len(entries), err)
+	}
+
+	// **Entries in every cluster of the chain are found**
+	for i := 0; i < FILES; i += 37 {
+		data, err := fs.ReadFile(fmt.Sprintf("/d/f%d", i))
+		if err != nil || string(data) != fmt.Sprint(i) {
+			t.Fatalf("/d/f%d reads %q, %v", i, data, err)
+		}
+	}
+	if err := fs.Chdir("/d/g99"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chdir("../.."); err != nil || fs.Getwd() != "/" {
+		t.Fatal(fs.Getwd(), err)
+	}
+	if err := fs.WriteFile(fmt.Sprintf("/d/f%d", FILES-1), nil); !errors.Is(err, ErrExist) {
+		t.Fatalf("write over the last entry: %v", err)
+	}
+	if err := fs.Remove("/d"); !errors.Is(err, ErrNotEmpty) {
+		t.Fatalf("remove of a full directory: %v", err)
+	}
+	checkClean(t, fs)
+
+	// **Emptied clusters leave the chain, the first one stays**
+	for i := range FILES {
+		if err := fs.Remove(fmt.Sprintf("/d/f%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 100 {
+		if err := fs.Remove(fmt.Sprintf("/d/g%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chain, err = fs.ClusterChain("/d")
+	if err != nil || len(chain) != 1 {
+		t.Fatalf("empty directory of %d clusters, %v", len(chain), err)
+	}
+	checkClean(t, fs)
+
+	if err := fs.Remove("/d"); err != nil {
+		t.Fatal(err)
+	}
+	if free, _ := fs.FreeSpace(); free != free_bytes {
+		t.Fatalf("%d bytes free after removing the directory, want %d", free, free_bytes)
+	}
+}
+
+func TestEntryTimes(t *testing.T) {
+
+	fs, device := newVolume(t, 2)
+
+	// inWindow tells whether a time falls between start and now at the one second resolution of entries
+	start := time.Now().Truncate(time.Second)
+	inWindow := func(at time.Time) bool {
+		return !at.Before(start) && !at.After(time.Now())
+	}
+
+	// **New files and directories carry the same creation, modification and access time**
+	if err := fs.WriteFile("/f", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/d"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/f", "/d"} {
+		entry, err := fs.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !inWindow(entry.CreationTime()) || entry.Modified != entry.Created || entry.Accessed != entry.Created {
+			t.Fatalf("'%s' created %v, modified %v, accessed %v", name, entry.CreationTime(), entry.ModTime(), entry.AccessTime())
+		}
+	}
+
+	// **Chtimes sets the access and modification time and keeps the creation time**
+	atime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	mtime := time.Date(1999, 12, 31, 23, 59, 59, 0, time.UTC)
+	for _, name := range []string{"/f", "/d"} {
+		created, _ := fs.Stat(name)
+		if err := fs.Chtimes(name, atime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		entry, _ := fs.Stat(name)
+		if !entry.AccessTime().Equal(atime) || !entry.ModTime().Equal(mtime) || entry.Created != created.Created {
+			t.Fatalf("'%s' accessed %v, modified %v after Chtimes", name, entry.AccessTime(), entry.ModTime())
+		}
+	}
+	if err := fs.Chtimes("/missing", atime, mtime); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Chtimes of a missing file: %v", err)
+	}
+
+	// **Changing the contents bumps the modification time only**
+	file, err := fs.OpenFile("/f", os.O_RDWR|os.O_APPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("more")); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	entry, _ := fs.Stat("/f")
+	if !inWindow(entry.ModTime()) || !entry.AccessTime().Equal(atime) {
+		t.Fatalf("append left modified %v, accessed %v", entry.ModTime(), entry.AccessTime())
+	}
+
+	// **An import keeps the modification time it is given, a copy gets its own times**
+	if err := fs.ImportFile("/imported", []byte("host"), mtime, nil); err != nil {
+		t.Fatal(err)
+	}
+	entry, _ = fs.Stat("/imported")
+	if !entry.ModTime().Equal(mtime) || !inWindow(entry.CreationTime()) || !inWindow(entry.AccessTime()) {
+		t.Fatalf("import created %v, modified %v, accessed %v", entry.CreationTime(), entry.ModTime(), entry.AccessTime())
+	}
+	if err := fs.Copy("/imported", "/copy"); err != nil {
+		t.Fatal(err)
+	}
+	entry, _ = fs.Stat("/copy")
+	if !inWindow(entry.ModTime()) || entry.Created != entry.Modified {
+		t.Fatalf("copy created %v, modified %v", entry.CreationTime(), entry.ModTime())
+	}
+	checkClean(t, fs)
+
+	// **The times are part of the entries on the volume**
+	want := make(map[string]DirectoryEntry)
+	for _, name := range []string{"/f", "/d", "/imported", "/copy"} {
+		want[name], _ = fs.Stat(name)
+	}
+	fs.Close()
+
+	fs, err = OpenDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, before := range want {
+		entry, err := fs.Stat(name)
+		if err != nil || entry.Created != before.Created || entry.Modified != before.Modified || entry.Accessed != before.Accessed {
+			t.Fatalf("'%s' has times %d, %d, %d after remount, want %d, %d, %d, %v", name,
+				entry.Created, entry.Modified, entry.Accessed, before.Created, before.Modified, before.Accessed, err)
+		}
+	}
+}
+
+func TestCalculateFS(t *testing.T) {
+
+	// **Offsets past 2 GiB are plain int64 values**
+	fs_format, err := CalculateFS(5<<30, MAX_CLUSTER_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs_format.file_size != 5<<30 || int64(fs_format.cluster_count)*MAX_CLUSTER_SIZE != 5<<30 {
+		t.Fatalf("layout of %d bytes in %d clusters", fs_format.file_size, fs_format.cluster_count)
+	}
+	if fs := (&FileSystem{fs_format: fs_format}); fs.clusterOffset(fs_format.cluster_count-1) != 5<<30-MAX_CLUSTER_SIZE {
+		t.Fatalf("last cluster at %d", fs.clusterOffset(fs_format.cluster_count-1))
+	}
+
+	// **Sizes whose clusters or offsets do not fit are refused instead of wrapping around**
+	for _, size := range []int64{0, -1, 1 << 62, math.MaxInt64} {
+		if _, err := CalculateFS(size, MIN_CLUSTER_SIZE); !errors.Is(err, ErrInvalid) {
+			t.Errorf("layout of %d bytes: %v", size, err)
+		}
+	}
+
+	if _, err := mulOffset(1<<40, 1<<30); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("overflowing product: %v", err)
+	}
+	if _, err := addOffset(math.MaxInt64, 1); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("overflowing sum: %v", err)
+	}
+	if sum, err := addOffset(3<<30, 3<<30); err != nil || sum != 6<<30 {
+		t.Fatalf("sum %d, %v", sum, err)
+	}
+}
+
+func TestLargeVolume(t *testing.T) {
+
+	// **A multi-GiB image is formatted without holding its data area in memory**
+	image := filepath.Join(t.TempDir(), "large.dat")
+	if err := Format(image, 5*1024, MAX_CLUSTER_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// **Clusters at the end of the image live past 4 GiB**
+	data := bytes.Repeat([]byte("tail"), MAX_CLUSTER_SIZE/2)
+	fs.alloc.cursor = fs.fs_format.cluster_count - 4
+	if err := fs.WriteFile("/tail.bin", data); err != nil {
+		t.Fatal(err)
+	}
+	chain, err := fs.ClusterChain("/tail.bin")
+	if err != nil || fs.clusterOffset(chain[0]) < 4<<30 {
+		t.Fatalf("chain %v, %v", chain, err)
+	}
+
+	file, err := fs.OpenFile("/tail.bin", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte("x"), math.MaxInt64); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("write at the largest offset: %v", err)
+	}
+	file.Close()
+	fs.Close()
+
+	fs, err = Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if got, err := fs.ReadFile("/tail.bin"); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes past 4 GiB, %v", len(got), err)
+	}
+	checkClean(t, fs)
+
+	// **Entries carry 64-bit file sizes**
+	raw := make([]byte, DIR_ENTRY_SIZE)
+	entry := DirectoryEntry{Size: 6<<30 + 1}
+	entry.encode(raw)
+	if decoded := decodeDirectoryEntry(raw); decoded.Size != entry.Size {
+		t.Fatalf("size %d decodes as %d", entry.Size, decoded.Size)
+	}
+}
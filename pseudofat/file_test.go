@@ -0,0 +1,192 @@
+package pseudofat
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestFileRandomAccess(t *testing.T) {
+
+	fs, _ := newVolume(t, 1)
+	free_bytes, _ := fs.FreeSpace()
+
+	file, err := fs.OpenFile("/a.bin", os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// **Random writes, truncates and reads are checked against a plain byte slice**
+	var model []byte
+	random := rand.New(rand.NewSource(1))
+	for step := range 300 {
+
+		switch random.Intn(3) {
+		case 0:
+			off, n := random.Intn(6000), random.Intn(3000)
+			data := make([]byte, n)
+			random.Read(data)
+
+			if _, err := file.WriteAt(data, int64(off)); err != nil {
+				t.Fatal(step, err)
+			}
+			if off+n > len(model) {
+				model = append(model, make([]byte, off+n-len(model))...)
+			}
+			copy(model[off:], data)
+
+		case 1:
+			size := random.Intn(7000)
+			if err := file.Truncate(int64(size)); err != nil {
+				t.Fatal(step, err)
+			}
+			if size < len(model) {
+				model = model[:size]
+			} else {
+				model = append(model, make([]byte, size-len(model))...)
+			}
+
+		case 2:
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(step, err)
+			}
+			got, err := io.ReadAll(file)
+			if err != nil {
+				t.Fatal(step, err)
+			}
+			if !bytes.Equal(got, model) {
+				t.Fatalf("contents differ from the model at step %d", step)
+			}
+		}
+	}
+
+	chain, err := fs.ClusterChain("/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != fs.clustersForSize(int64(len(model))) {
+		t.Fatalf("chain of %d clusters for %d bytes", len(chain), len(model))
+	}
+	checkClean(t, fs)
+
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("/a.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if free, _ := fs.FreeSpace(); free != free_bytes {
+		t.Fatalf("%d bytes free after removing the file, want %d", free, free_bytes)
+	}
+}
+
+func TestFileHandle(t *testing.T) {
+
+	fs, _ := newVolume(t, 1)
+	if err := fs.WriteFile("/f", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// **Append writes at the end whatever the offset**
+	file, err := fs.OpenFile("/f", os.O_RDWR|os.O_APPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Seek(1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+
+	// **Seek from the end and read the tail**
+	if offset, err := file.Seek(-5, io.SeekEnd); err != nil || offset != 6 {
+		t.Fatal(offset, err)
+	}
+	tail := make([]byte, 10)
+	n, err := file.Read(tail)
+	if err != nil && err != io.EOF || string(tail[:n]) != "world" {
+		t.Fatalf("read %q, %v", tail[:n], err)
+	}
+	if _, err := file.Read(tail); err != io.EOF {
+		t.Fatalf("read past the end: %v", err)
+	}
+	if _, err := file.Seek(-1, io.SeekStart); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("negative offset: %v", err)
+	}
+
+	if _, err := file.WriteAt([]byte("!"), 0); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("write at an offset of an appending handle: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// **Writing past the end leaves a hole of zeros**
+	file, err = fs.OpenFile("/f", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte("!"), 20); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := file.Stat(); err != nil || info.Size() != 21 {
+		t.Fatal(info, err)
+	}
+
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Read(tail); !errors.Is(err, iofs.ErrClosed) {
+		t.Fatalf("read after close: %v", err)
+	}
+
+	data, err := fs.ReadFile("/f")
+	if err != nil || string(data) != "hello world"+string(make([]byte, 9))+"!" {
+		t.Fatalf("contents %q, %v", data, err)
+	}
+
+	// **The open flags decide what the handle may do**
+	tests := []struct {
+		name string
+		flag int
+		op   func(file *File) error
+		want error
+	}{
+		{"read on write-only", os.O_WRONLY, func(file *File) error { _, err := file.Read(tail); return err }, ErrInvalid},
+		{"write on read-only", os.O_RDONLY, func(file *File) error { _, err := file.Write(tail); return err }, ErrInvalid},
+		{"truncate on read-only", os.O_RDONLY, func(file *File) error { return file.Truncate(0) }, ErrInvalid},
+	}
+	for _, test := range tests {
+
+		file, err := fs.OpenFile("/f", test.flag)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if err := test.op(file); !errors.Is(err, test.want) {
+			t.Fatalf("%s: %v, want %v", test.name, err, test.want)
+		}
+		file.Close()
+	}
+
+	if _, err := fs.OpenFile("/f", os.O_RDWR|os.O_CREATE|os.O_EXCL); !errors.Is(err, ErrExist) {
+		t.Fatalf("exclusive create of an existing file: %v", err)
+	}
+	if _, err := fs.OpenFile("/missing", os.O_RDONLY); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("open of a missing file: %v", err)
+	}
+
+	file, err = fs.OpenFile("/f", os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if entry, err := fs.Stat("/f"); err != nil || entry.Size != 0 {
+		t.Fatal(entry.Size, err)
+	}
+	checkClean(t, fs)
+}
@@ -0,0 +1,896 @@
+package pseudofat
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"slices"
+	"time"
+)
+
+// LOST_FOUND is the root directory that receives the orphaned chains recovered by Check
+const LOST_FOUND = "LOST.FND"
+
+// CheckReport describes the outcome of a consistency check
+type CheckReport struct {
+	Problems  []string // one line per problem found
+	Repaired  bool     // the problems were repaired
+	Reclaimed int      // clusters given back to the free pool
+	Recovered int      // orphaned chains moved into LOST_FOUND
+}
+
+// checker walks the volume from the root directory and records which cluster belongs to which chain
+type checker struct {
+	fs     *FileSystem
+	repair bool
+	report *CheckReport
+	owned  []bool // the cluster is reachable from the root directory
+
+	// **Names of files by the first cluster of their chain, hard links share one**
+	files      map[int32]*fileNames
+	file_order []int32
+}
+
+// fileNames collects the names found for one chain of a file
+type fileNames struct {
+	path  string         // first name found, its entry is the reference for the others
+	entry DirectoryEntry // entry of the first name
+	links []uint16       // link count stored in every name
+	dirs  []int32        // directory holding every name
+}
+
+// Check verifies the FAT tables against the directory tree. With repair set every
+// problem is fixed: leaked clusters are reclaimed, broken chains are truncated, sizes
+// are corrected and orphaned chains are moved into the LOST_FOUND directory. Only
+// root may repair.
+func (fs *FileSystem) Check(repair bool) (CheckReport, error) {
+
+	fs.session.lock()
+	defer fs.mu.Unlock()
+
+	if repair {
+		err := fs.requireRoot()
+		if err != nil {
+			return CheckReport{}, err
+		}
+	}
+
+	c := &checker{
+		fs:     fs,
+		repair: repair,
+		report: &CheckReport{Repaired: repair},
+		owned:  make([]bool, fs.fs_format.cluster_count),
+		files:  make(map[int32]*fileNames),
+	}
+
+	err := c.run()
+	if repair {
+		err = fs.commit(err)
+
+		// **Repairs change entries behind the link index and the quota usage, both are built again when needed**
+		fs.links = linkIndex{}
+		fs.quotas = quotaCache{}
+	}
+
+	return *c.report, err
+}
+
+func (c *checker) problem(format string, args ...any) {
+	c.report.Problems = append(c.report.Problems, fmt.Sprintf(format, args...))
+}
+
+func (c *checker) run() error {
+
+	// **FAT1 is authoritative, FAT2 must be an exact copy**
+	err := c.checkFATCopies()
+	if err != nil {
+		return err
+	}
+
+	// **The superblock and the FAT tables occupy the clusters before the root directory**
+	root := c.fs.rootCluster()
+	for cluster := int32(0); cluster < root; cluster++ {
+		c.owned[cluster] = true
+		if c.fs.fat1[cluster] != FAT_EOF {
+			c.problem("reserved cluster %d is not marked as used", cluster)
+			if c.repair {
+				c.fs.updateFatEntry(cluster, FAT_EOF)
+			}
+		}
+	}
+
+	// **The snapshot table and the frozen FATs belong to no directory**
+	snapshot_chains, err := c.fs.snapshotChains()
+	if err != nil {
+		return err
+	}
+
+	for _, start := range snapshot_chains {
+		if _, reason := c.walkChain(start); reason != "" {
+			c.problem("snapshot chain at cluster %d %s", start, reason)
+		}
+	}
+
+	// **Neither does the user table**
+	users_chain, err := c.fs.userTableChain()
+	if err != nil {
+		return err
+	}
+
+	if users_chain != 0 {
+		if _, reason := c.walkChain(users_chain); reason != "" {
+			c.problem("user table chain at cluster %d %s", users_chain, reason)
+		}
+	}
+
+	// **Nor the quota table**
+	quotas_chain, err := c.fs.quotaTableChain()
+	if err != nil {
+		return err
+	}
+
+	if quotas_chain != 0 {
+		if _, reason := c.walkChain(quotas_chain); reason != "" {
+			c.problem("quota table chain at cluster %d %s", quotas_chain, reason)
+		}
+	}
+
+	// **Walk the whole tree starting at the root directory**
+	chain, reason := c.walkChain(root)
+	if len(chain) == 0 {
+		return fmt.Errorf("root directory chain %s: %w", reason, ErrCorrupt)
+	}
+
+	err = c.fixChain("/", chain, reason)
+	if err != nil {
+		return err
+	}
+
+	// **The root has no entry in a parent, its '.' entry alone names its attributes**
+	root_entries, err := c.fs.readDirectoryChain(chain)
+	if err != nil {
+		return fmt.Errorf("error reading '/': %w", err)
+	}
+
+	_, err = c.checkXattrs("/", &root_entries[0])
+	if err != nil {
+		return err
+	}
+
+	err = c.checkDirectory("/", chain, root, root_entries[0].Xattr_cluster)
+	if err != nil {
+		return err
+	}
+
+	err = c.checkLinkCounts()
+	if err == nil {
+		err = c.checkQuotas()
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.checkOrphans()
+}
+
+// checkFATCopies compares FAT1 with FAT2 as it is on the device, the copy in memory only mirrors
+// the changes made since the mount. A snapshot view compares its own frozen copies.
+func (c *checker) checkFATCopies() error {
+
+	fat2 := c.fs.fat2
+	if c.fs.origin == nil {
+		var err error
+		fat2, err = c.fs.readFAT(c.fs.fs_format.fat2_start)
+		if err != nil {
+			return fmt.Errorf("error reading FAT2: %w", err)
+		}
+	}
+
+	diverged := 0
+	for cluster := range c.fs.fat1 {
+		if c.fs.fat1[cluster] != fat2[cluster] {
+			diverged++
+			if c.repair {
+				c.fs.updateFatEntry(int32(cluster), c.fs.fat1[cluster])
+			}
+		}
+	}
+
+	if diverged > 0 {
+		c.problem("FAT1 and FAT2 differ in %d entries", diverged)
+	}
+
+	return nil
+}
+
+// walkChain follows the chain from start and claims its clusters, it stops at the first cluster that
+// cannot belong to the chain and returns why, an empty reason means the chain ends properly
+func (c *checker) walkChain(start int32) ([]int32, string) {
+
+	var chain []int32
+	cluster := start
+	for {
+
+		if cluster < c.fs.rootCluster() || cluster >= c.fs.fs_format.cluster_count {
+			return chain, fmt.Sprintf("points outside of the data area (%d)", cluster)
+		}
+
+		if c.owned[cluster] {
+			if slices.Contains(chain, cluster) {
+				return chain, fmt.Sprintf("is cyclic at cluster %d", cluster)
+			}
+			return chain, fmt.Sprintf("is cross-linked at cluster %d", cluster)
+		}
+
+		value := c.fs.fat1[cluster]
+		if value == FAT_FREE {
+			return chain, fmt.Sprintf("runs into free cluster %d", cluster)
+		}
+		if value == FAT_BAD {
+			return chain, fmt.Sprintf("runs into bad cluster %d", cluster)
+		}
+
+		chain = append(chain, cluster)
+		c.owned[cluster] = true
+
+		if value == FAT_EOF {
+			return chain, ""
+		}
+
+		cluster = value
+	}
+}
+
+// fixChain reports a broken chain and terminates it behind its last valid cluster
+func (c *checker) fixChain(entry_path string, chain []int32, reason string) error {
+
+	if reason == "" {
+		return nil
+	}
+
+	c.problem("'%s': cluster chain %s", entry_path, reason)
+	if !c.repair || len(chain) == 0 {
+		return nil
+	}
+
+	return c.fs.updateFatEntry(chain[len(chain)-1], FAT_EOF)
+}
+
+// checkDirectory verifies the '.' and '..' entries and every entry of the directory stored in chain,
+// '.' must name the attribute chain at xattr_cluster like the entry of the directory does
+func (c *checker) checkDirectory(dir_path string, chain []int32, parent_cluster, xattr_cluster int32) error {
+
+	dir_entries, err := c.fs.readDirectoryChain(chain)
+	if err != nil {
+		return fmt.Errorf("error reading '%s': %w", dir_path, err)
+	}
+
+	// **The first two slots always hold '.' and '..'**
+	var misplaced []DirectoryEntry
+	for i, want := range []DirectoryEntry{
+		{Name: [MAX_FILE_NAME]byte{'.'}, First_cluster: chain[0], Is_directory: 1, Links: 1, Xattr_cluster: xattr_cluster},
+		{Name: [MAX_FILE_NAME]byte{'.', '.'}, First_cluster: parent_cluster, Is_directory: 1, Links: 1},
+	} {
+		// **The timestamps, owners and modes of '.' and '..' are not checked and survive a repair**
+		want.Created, want.Modified, want.Accessed = dir_entries[i].Created, dir_entries[i].Modified, dir_entries[i].Accessed
+		want.Uid, want.Gid, want.Mode = dir_entries[i].Uid, dir_entries[i].Gid, dir_entries[i].Mode
+		if dir_entries[i] == want {
+			continue
+		}
+
+		c.problem("'%s': missing or broken '%s' entry", dir_path, want.FileName())
+
+		name := dir_entries[i].FileName()
+		if isUsedEntry(dir_entries[i]) && name != "." && name != ".." {
+			misplaced = append(misplaced, dir_entries[i])
+		}
+
+		if c.repair {
+			dir_entries[i] = want
+			err = c.fs.writeDirectorySlot(chain, dir_entries, i)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// **Long name slots belong to the entry right behind them**
+	claimed := make([]bool, len(dir_entries))
+	for i := 2; i < len(dir_entries); i++ {
+		if isUsedEntry(dir_entries[i]) {
+			_, first := longNameRun(dir_entries, i)
+			for j := first; j < i; j++ {
+				claimed[j] = true
+			}
+		}
+	}
+
+	names := map[string]bool{".": true, "..": true}
+	for i := 2; i < len(dir_entries); i++ {
+
+		if IsZeroEntry(dir_entries[i]) {
+			continue
+		}
+
+		if dir_entries[i].isLongNameSlot() {
+			if !claimed[i] {
+				c.problem("'%s': long name slot %d belongs to no entry, removed", dir_path, i)
+				if c.repair {
+					dir_entries[i] = DirectoryEntry{}
+					err = c.fs.writeDirectorySlot(chain, dir_entries, i)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+
+		_, first := longNameRun(dir_entries, i)
+		keep, changed, err := c.checkEntry(dir_path, chain[0], &dir_entries[i], names)
+		if err != nil {
+			return err
+		}
+
+		if !c.repair || (keep && !changed) {
+			continue
+		}
+
+		if !keep {
+			dir_entries[i] = DirectoryEntry{}
+		}
+
+		// **An entry that was removed or lost its long name takes its long name slots along**
+		if dir_entries[i].long_name == "" {
+			for j := first; j < i; j++ {
+				dir_entries[j] = DirectoryEntry{}
+			}
+		}
+
+		err = c.fs.writeDirectorySlots(chain, dir_entries, first, i)
+		if err != nil {
+			return err
+		}
+	}
+
+	// **Entries found in the '.' and '..' slots move to a free slot**
+	for _, entry := range misplaced {
+
+		keep, _, err := c.checkEntry(dir_path, chain[0], &entry, names)
+		if err != nil {
+			return err
+		}
+
+		if keep && c.repair {
+			err = c.addEntry(chain[0], entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkEntry checks one entry of a directory and descends into subdirectories. It reports
+// whether the entry stays in the directory and whether it was changed and needs to be written back.
+func (c *checker) checkEntry(dir_path string, dir_cluster int32, entry *DirectoryEntry, names map[string]bool) (bool, bool, error) {
+
+	changed := false
+	name := entry.FileName()
+	entry_path := path.Join(dir_path, name)
+
+	// **Entries without a name cannot be reached, their chains end up as orphans**
+	if name == "" || name == "." || name == ".." {
+		c.problem("'%s': entry with invalid name '%s' removed", dir_path, name)
+		return false, false, nil
+	}
+
+	// **Duplicate names get a unique suffix**
+	if names[name] {
+		unique := uniqueName(name, names)
+		c.problem("'%s': duplicate name, renamed to '%s'", entry_path, unique)
+		entry.Name = [MAX_FILE_NAME]byte{}
+		entry.long_name = ""
+		copy(entry.Name[:], unique)
+		entry_path = path.Join(dir_path, unique)
+		name = unique
+		changed = true
+	}
+	names[name] = true
+
+	// **Another name of a hard linked file, its chain was checked with the first name**
+	if file, ok := c.files[entry.First_cluster]; ok && entry.Is_directory != 1 {
+		return true, c.checkLink(entry_path, dir_cluster, entry, file), nil
+	}
+
+	chain, reason := c.walkChain(entry.First_cluster)
+	err := c.fixChain(entry_path, chain, reason)
+	if err != nil {
+		return false, false, err
+	}
+
+	dropped, err := c.checkXattrs(entry_path, entry)
+	if err != nil {
+		return false, false, err
+	}
+	changed = changed || dropped
+
+	if entry.Is_directory == 1 {
+
+		// **A directory without its own first cluster cannot be recovered**
+		if len(chain) == 0 {
+			c.problem("'%s': directory has no valid cluster, entry removed", entry_path)
+			return false, false, nil
+		}
+
+		if entry.Size != 0 {
+			c.problem("'%s': directory size is %d instead of 0", entry_path, entry.Size)
+			entry.Size = 0
+			changed = true
+		}
+
+		return true, changed, c.checkDirectory(entry_path, chain, dir_cluster, entry.Xattr_cluster)
+	}
+
+	// **A file without a single valid cluster becomes an empty file**
+	if len(chain) == 0 {
+
+		c.problem("'%s': file has no valid cluster, truncated to 0 bytes", entry_path)
+		if c.repair {
+			new_chain, err := c.fs.allocateChain(1)
+			if err != nil {
+				return false, false, err
+			}
+
+			err = c.fs.device.WriteCluster(new_chain[0], make([]byte, c.fs.clusterSize()))
+			if err != nil {
+				return false, false, err
+			}
+
+			c.owned[new_chain[0]] = true
+			entry.First_cluster = new_chain[0]
+			entry.Size = 0
+			changed = true
+		}
+
+		c.addFile(entry_path, dir_cluster, *entry)
+		return true, changed, nil
+	}
+
+	// **The chain length must match the file size**
+	chain_bytes := int64(len(chain)) * c.fs.clusterSize()
+	needed := c.fs.clustersForSize(entry.Size)
+	switch {
+	case entry.Size < 0 || len(chain) < needed:
+		c.problem("'%s': size %d does not fit the chain of %d clusters, truncated to %d bytes", entry_path, entry.Size, len(chain), chain_bytes)
+		entry.Size = chain_bytes
+		changed = true
+
+	case len(chain) > needed:
+		c.problem("'%s': chain of %d clusters is longer than size %d needs, %d clusters reclaimed", entry_path, len(chain), entry.Size, len(chain)-needed)
+		if c.repair {
+			err = c.fs.updateFatEntry(chain[needed-1], FAT_EOF)
+			if err != nil {
+				return false, false, err
+			}
+
+			for _, cluster := range chain[needed:] {
+				c.fs.updateFatEntry(cluster, FAT_FREE)
+				c.owned[cluster] = false
+			}
+			c.report.Reclaimed += len(chain) - needed
+		}
+	}
+
+	c.addFile(entry_path, dir_cluster, *entry)
+	return true, changed, nil
+}
+
+// addFile records the first name found for the chain of a file
+func (c *checker) addFile(entry_path string, dir_cluster int32, entry DirectoryEntry) {
+	c.files[entry.First_cluster] = &fileNames{path: entry_path, entry: entry, links: []uint16{entry.Links}, dirs: []int32{dir_cluster}}
+	c.file_order = append(c.file_order, entry.First_cluster)
+}
+
+// checkLink compares another name of a file with its first name and reports whether the entry was changed
+func (c *checker) checkLink(entry_path string, dir_cluster int32, entry *DirectoryEntry, file *fileNames) bool {
+
+	file.links = append(file.links, entry.Links)
+	file.dirs = append(file.dirs, dir_cluster)
+
+	want := file.entry
+	if entry.Is_directory == want.Is_directory && entry.Size == want.Size &&
+		entry.Created == want.Created && entry.Modified == want.Modified && entry.Accessed == want.Accessed &&
+		entry.Uid == want.Uid && entry.Gid == want.Gid && entry.Mode == want.Mode && entry.Xattr_cluster == want.Xattr_cluster {
+		return false
+	}
+
+	c.problem("'%s': shares its chain with '%s' but differs from it, made equal", entry_path, file.path)
+	entry.Is_directory, entry.Size = want.Is_directory, want.Size
+	entry.Created, entry.Modified, entry.Accessed = want.Created, want.Modified, want.Accessed
+	entry.Uid, entry.Gid, entry.Mode = want.Uid, want.Gid, want.Mode
+	entry.Xattr_cluster = want.Xattr_cluster
+	return true
+}
+
+// checkXattrs claims the attribute chain of the entry, a broken chain or one holding broken records
+// is freed together with the attributes. It reports whether the entry was changed.
+func (c *checker) checkXattrs(entry_path string, entry *DirectoryEntry) (bool, error) {
+
+	if entry.Xattr_cluster == 0 {
+		return false, nil
+	}
+
+	chain, reason := c.walkChain(entry.Xattr_cluster)
+	if reason == "" {
+		if _, err := c.fs.readXattrs(*entry); err != nil {
+			reason = "holds broken records"
+		}
+	}
+
+	if reason == "" {
+		return false, nil
+	}
+
+	c.problem("'%s': attribute chain %s, attributes dropped", entry_path, reason)
+	if !c.repair {
+		return false, nil
+	}
+
+	for _, cluster := range chain {
+		err := c.fs.updateFatEntry(cluster, FAT_FREE)
+		if err != nil {
+			return false, err
+		}
+		c.owned[cluster] = false
+	}
+
+	c.report.Reclaimed += len(chain)
+	entry.Xattr_cluster = 0
+	return true, nil
+}
+
+// checkLinkCounts makes the link count of every file match the number of names found for it
+func (c *checker) checkLinkCounts() error {
+
+	for _, first_cluster := range c.file_order {
+
+		file := c.files[first_cluster]
+		count := len(file.links)
+		if !slices.ContainsFunc(file.links, func(links uint16) bool { return int(links) != count }) {
+			continue
+		}
+
+		c.problem("'%s': link count %d instead of %d", file.path, file.links[0], count)
+		if !c.repair {
+			continue
+		}
+
+		// **The names were all seen during the walk, their directories are known without the link index**
+		slices.Sort(file.dirs)
+		for _, dir_cluster := range slices.Compact(file.dirs) {
+			_, err := c.fs.updateLinksIn(dir_cluster, first_cluster, func(entry *DirectoryEntry) { entry.Links = uint16(count) })
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkQuotas drops the quotas of directories that are gone
+func (c *checker) checkQuotas() error {
+
+	table_cluster, table, err := c.fs.readQuotaTable()
+	if err != nil {
+		return err
+	}
+
+	kept := slices.DeleteFunc(slices.Clone(table), func(quota quotaEntry) bool {
+
+		if quota.Kind != QUOTA_DIR {
+			return false
+		}
+
+		if quota.Dir >= 0 && quota.Dir < c.fs.fs_format.cluster_count && c.owned[quota.Dir] && c.fs.isDirectory(quota.Dir) {
+			return false
+		}
+
+		c.problem("quota of the directory at cluster %d names no directory, removed", quota.Dir)
+		return true
+	})
+
+	if !c.repair || len(kept) == len(table) {
+		return nil
+	}
+
+	return c.fs.writeQuotaTable(table_cluster, kept)
+}
+
+// addEntry stores the entry in the directory and claims the cluster the directory may have grown by
+func (c *checker) addEntry(dir_cluster int32, entry DirectoryEntry) error {
+
+	err := c.fs.writeDirectoryEntry(dir_cluster, entry)
+	if err != nil {
+		return err
+	}
+
+	chain, err := c.fs.readChain(dir_cluster)
+	if err != nil {
+		return err
+	}
+
+	for _, cluster := range chain {
+		c.owned[cluster] = true
+	}
+
+	return nil
+}
+
+// uniqueName appends ~N to the name, shortening it so it still fits into MAX_FILE_NAME bytes
+func uniqueName(name string, names map[string]bool) string {
+
+	for n := 1; ; n++ {
+
+		suffix := fmt.Sprintf("~%d", n)
+		base := name[:min(len(name), MAX_FILE_NAME-len(suffix))]
+		if !names[base+suffix] {
+			return base + suffix
+		}
+	}
+}
+
+// checkOrphans finds allocated clusters that no entry reaches. Chains holding only zeros are
+// reclaimed, the others are moved into LOST_FOUND as files or, when they look like one, directories.
+func (c *checker) checkOrphans() error {
+
+	orphans := c.orphans()
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	c.problem("%d allocated clusters are not reachable from the root directory", len(orphans))
+	if !c.repair {
+		return nil
+	}
+
+	// **Chain heads are orphans no other orphan points to**
+	referenced := make(map[int32]bool)
+	for _, cluster := range orphans {
+		referenced[c.fs.fat1[cluster]] = true
+	}
+
+	var heads []int32
+	for _, cluster := range orphans {
+		if !referenced[cluster] {
+			heads = append(heads, cluster)
+		}
+	}
+
+	lost_cluster := int32(-1)
+
+	// **Recover lost directories first so their subtrees come back in one piece**
+	var dir_heads, child_heads []int32
+	children := make(map[int32]bool)
+	for _, head := range heads {
+		if c.looksLikeDirectory(head) {
+			dir_entries, err := c.fs.readDirectoryChain([]int32{head})
+			if err == nil {
+				for _, entry := range dir_entries[2:] {
+					children[entry.First_cluster] = true
+				}
+			}
+			dir_heads = append(dir_heads, head)
+		}
+	}
+	for _, head := range dir_heads {
+		if children[head] {
+			child_heads = append(child_heads, head)
+		}
+	}
+	dir_heads = slices.DeleteFunc(dir_heads, func(head int32) bool { return children[head] })
+
+	for _, head := range append(dir_heads, child_heads...) {
+
+		if c.owned[head] {
+			continue
+		}
+
+		err := c.recover(&lost_cluster, head, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	// **Whatever is left becomes plain files**
+	for _, head := range heads {
+
+		if c.owned[head] {
+			continue
+		}
+
+		err := c.recover(&lost_cluster, head, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	// **Cycles have no head, they are broken at their lowest cluster**
+	for orphans = c.orphans(); len(orphans) > 0; orphans = c.orphans() {
+		err := c.recover(&lost_cluster, orphans[0], false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// orphans lists the allocated clusters of the data area that are not claimed yet
+func (c *checker) orphans() []int32 {
+
+	var orphans []int32
+	for cluster := c.fs.rootCluster(); cluster < c.fs.fs_format.cluster_count; cluster++ {
+		value := c.fs.fat1[cluster]
+		if value != FAT_FREE && value != FAT_BAD && !c.owned[cluster] {
+			orphans = append(orphans, cluster)
+		}
+	}
+
+	return orphans
+}
+
+// looksLikeDirectory reports whether the cluster starts with a '.' entry pointing back to it
+func (c *checker) looksLikeDirectory(cluster int32) bool {
+
+	dir_entries, err := c.fs.readDirectoryChain([]int32{cluster})
+	if err != nil {
+		return false
+	}
+
+	dot := dir_entries[0]
+	return dot.FileName() == "." && dot.Is_directory == 1 && dot.First_cluster == cluster
+}
+
+// recover claims the orphaned chain starting at head and either reclaims it or links it into LOST_FOUND
+func (c *checker) recover(lost_cluster *int32, head int32, is_directory bool) error {
+
+	chain, reason := c.walkChain(head)
+	if reason != "" {
+		err := c.fs.updateFatEntry(chain[len(chain)-1], FAT_EOF)
+		if err != nil {
+			return err
+		}
+	}
+
+	// **Chains without any data were leaked by an interrupted operation**
+	if !is_directory {
+
+		empty, err := c.isEmptyChain(chain)
+		if err != nil {
+			return err
+		}
+
+		if empty {
+			for _, cluster := range chain {
+				c.fs.updateFatEntry(cluster, FAT_FREE)
+				c.owned[cluster] = false
+			}
+			c.report.Reclaimed += len(chain)
+			return nil
+		}
+	}
+
+	if *lost_cluster < 0 {
+		cluster, err := c.lostFound()
+		if err != nil {
+			return err
+		}
+		*lost_cluster = cluster
+	}
+
+	// **Recovered chains belong to root, who runs the repair**
+	entry := DirectoryEntry{First_cluster: head, Links: 1, Mode: MODE_FILE}
+	entry.setTimes(time.Now())
+	prefix := "FILE"
+	if is_directory {
+		entry.Is_directory = 1
+		entry.Mode = MODE_DIR
+		prefix = "DIR"
+	} else {
+		entry.Size = int64(len(chain)) * c.fs.clusterSize()
+	}
+
+	// **Pick the first free FILEnnnn.CHK or DIRnnnn.CHK name**
+	var name string
+	for n := 0; ; n++ {
+		name = fmt.Sprintf("%s%04d.CHK", prefix, n)
+		_, err := c.fs.findEntry(name, *lost_cluster)
+		if err != nil {
+			break
+		}
+	}
+	copy(entry.Name[:], name)
+	entry_path := path.Join("/", LOST_FOUND, name)
+
+	// **A directory brings along the attributes its '.' entry names**
+	if is_directory {
+		dir_entries, err := c.fs.readDirectoryChain(chain)
+		if err != nil {
+			return err
+		}
+
+		entry.Xattr_cluster = dir_entries[0].Xattr_cluster
+		_, err = c.checkXattrs(entry_path, &entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := c.addEntry(*lost_cluster, entry)
+	if err != nil {
+		return err
+	}
+	c.report.Recovered++
+
+	if is_directory {
+		return c.checkDirectory(entry_path, chain, *lost_cluster, entry.Xattr_cluster)
+	}
+
+	return nil
+}
+
+// lostFound returns the first cluster of the LOST_FOUND directory, creating it when needed
+func (c *checker) lostFound() (int32, error) {
+
+	root := c.fs.rootCluster()
+	cluster, err := c.fs.findDirectoryCluster(LOST_FOUND, root)
+	if err == nil {
+		return cluster, nil
+	}
+
+	err = c.fs.createDirectory(root, LOST_FOUND, MODE_DIR)
+	if err != nil {
+		return -1, fmt.Errorf("error creating '/%s': %w", LOST_FOUND, err)
+	}
+
+	cluster, err = c.fs.findDirectoryCluster(LOST_FOUND, root)
+	if err != nil {
+		return -1, err
+	}
+
+	// **Claim the new directory and the root cluster it may have been added to**
+	for _, start := range []int32{root, cluster} {
+		chain, err := c.fs.readChain(start)
+		if err != nil {
+			return -1, err
+		}
+		for _, cluster := range chain {
+			c.owned[cluster] = true
+		}
+	}
+
+	return cluster, nil
+}
+
+// isEmptyChain reports whether every cluster of the chain holds only zeros
+func (c *checker) isEmptyChain(chain []int32) (bool, error) {
+
+	buffer := make([]byte, c.fs.clusterSize())
+	zero := make([]byte, c.fs.clusterSize())
+	for _, cluster := range chain {
+
+		err := c.fs.readCluster(cluster, buffer)
+		if err != nil {
+			return false, err
+		}
+
+		if !bytes.Equal(buffer, zero) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,180 @@
+package pseudofat
+
+import (
+	"encoding/binary"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestFsckFAT2OnDevice damages FAT2 on the device behind the back of a mounted volume
+func TestFsckFAT2OnDevice(t *testing.T) {
+
+	fs, device := newVolume(t, 1)
+	err := fs.WriteFile("/f", make([]byte, 3*CLUSTER_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fs)
+
+	chain, err := fs.ClusterChain("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := int32(FAT_BAD)
+	for _, cluster := range chain[:2] {
+		binary.LittleEndian.PutUint32(device.data[fs.fs_format.fat2_start+int64(cluster)*FAT_ENTRY:], uint32(bad))
+	}
+
+	report, err := fs.Check(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0] != "FAT1 and FAT2 differ in 2 entries" {
+		t.Fatal("fsck missed the damaged FAT2:", report.Problems)
+	}
+
+	_, err = fs.Check(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+
+	remounted, err := OpenDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, remounted)
+
+	fat1, fat2, err := remounted.ReadFAT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cluster := range fat1 {
+		if fat1[cluster] != fat2[cluster] {
+			t.Fatalf("FAT2 still differs at cluster %d after the repair", cluster)
+		}
+	}
+}
+
+func TestFsckRepair(t *testing.T) {
+
+	fs, _ := newVolume(t, 2)
+	for _, dir := range []string{"/d", "/d/e"} {
+		if err := fs.Mkdir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"/d/a":   strings.Repeat("a", 5000),
+		"/b":     strings.Repeat("b", 3000),
+		"/c":     strings.Repeat("c", 3000),
+		"/d/e/z": strings.Repeat("z", 100),
+	}
+	for _, name := range []string{"/d/a", "/b", "/c", "/d/e/z"} {
+		if err := fs.WriteFile(name, []byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkClean(t, fs)
+
+	chain_b, _ := fs.ClusterChain("/b")
+	chain_c, _ := fs.ClusterChain("/c")
+	d_cluster, _, _ := fs.parsePath(fs.rootCluster(), "/d", false)
+	e_cluster, _, _ := fs.parsePath(fs.rootCluster(), "/d/e", false)
+
+	// **Cross link: the chain of /c runs into the chain of /b**
+	fs.updateFatEntry(chain_c[0], chain_b[1])
+
+	// **Size smaller than the chain**
+	entry, _ := fs.Stat("/d/a")
+	entry.Size = 100
+	fs.updateDirectoryEntry(d_cluster, "a", entry)
+
+	// **Orphaned chain holding data and a leaked empty cluster**
+	orphan, _ := fs.allocateChain(2)
+	fs.writeChainAt(orphan, []byte("orphan data"), 0)
+	leaked, _ := fs.allocateChain(1)
+	fs.device.WriteCluster(leaked[0], make([]byte, fs.clusterSize()))
+
+	// **Broken '..' entry**
+	dir_entries, _ := fs.readDirectoryEntries(e_cluster)
+	dir_entries[1].First_cluster = 999
+	fs.writeDirectoryEntries(e_cluster, dir_entries[:fs.dirEntriesPerCluster()])
+
+	// **Orphaned chain running in a circle**
+	cycle, _ := fs.allocateChain(3)
+	fs.writeChainAt(cycle, []byte(strings.Repeat("y", 3000)), 0)
+	fs.updateFatEntry(cycle[2], cycle[0])
+
+	report, err := fs.Check(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"'/d/e': missing or broken '..' entry",
+		"'/d/a': chain of 5 clusters is longer than size 100 needs, 4 clusters reclaimed",
+		"'/c': cluster chain is cross-linked",
+		"8 allocated clusters are not reachable from the root directory",
+	} {
+		if !slices.ContainsFunc(report.Problems, func(problem string) bool { return strings.HasPrefix(problem, want) }) {
+			t.Errorf("fsck missed %q: %q", want, report.Problems)
+		}
+	}
+
+	// **Repair keeps what the tree still names and moves the orphans into LOST_FOUND**
+	if _, err := fs.Check(true); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fs)
+
+	state := treeState(t, fs, "/")
+	want := map[string]string{
+		"/b":     files["/b"],
+		"/c":     files["/c"][:CLUSTER_SIZE],
+		"/d/a":   files["/d/a"][:100],
+		"/d/e/z": files["/d/e/z"],
+	}
+	for name, data := range want {
+		if state[name] != data {
+			t.Errorf("'%s' holds %d bytes after the repair, want %d", name, len(state[name]), len(data))
+		}
+	}
+
+	lost, err := fs.ReadDir("/" + LOST_FOUND)
+	if err != nil || len(lost) != 2+3 {
+		t.Fatalf("%d entries in %s, %v", len(lost), LOST_FOUND, err)
+	}
+	recovered := slices.Collect(maps.Values(treeState(t, fs, "/"+LOST_FOUND)))
+	if !slices.ContainsFunc(recovered, func(data string) bool { return strings.HasPrefix(data, "orphan data") }) {
+		t.Error("the orphaned chain was not recovered")
+	}
+
+	// **A directory cut off from the tree is recovered with its contents**
+	root_entries, _ := fs.readDirectoryEntries(fs.rootCluster())
+	for i := range root_entries {
+		if root_entries[i].FileName() == "d" {
+			root_entries[i] = DirectoryEntry{}
+		}
+	}
+	root_chain, _ := fs.readChain(fs.rootCluster())
+	fs.writeDirectoryEntries(root_chain[0], root_entries[:fs.dirEntriesPerCluster()])
+
+	if _, err := fs.Check(true); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fs)
+
+	recovered_dir := path.Join("/", LOST_FOUND, "DIR0000.CHK")
+	if data, err := fs.ReadFile(recovered_dir + "/a"); err != nil || string(data) != want["/d/a"] {
+		t.Fatalf("recovered /d/a reads %d bytes, %v", len(data), err)
+	}
+	if err := fs.Chdir(recovered_dir + "/e"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chdir(".."); err != nil || fs.Getwd() != recovered_dir {
+		t.Fatalf("'..' of the recovered directory leads to %s, %v", fs.Getwd(), err)
+	}
+}
@@ -0,0 +1,26 @@
+package pseudofat
+
+import (
+	"fmt"
+	"math"
+)
+
+// addOffset returns a+b, sums that do not fit an int64 fail with ErrInvalid
+func addOffset(a, b int64) (int64, error) {
+
+	if b > 0 && a > math.MaxInt64-b || b < 0 && a < math.MinInt64-b {
+		return 0, fmt.Errorf("offset %d + %d overflows: %w", a, b, ErrInvalid)
+	}
+
+	return a + b, nil
+}
+
+// mulOffset returns a*b for non-negative a and b, products that do not fit an int64 fail with ErrInvalid
+func mulOffset(a, b int64) (int64, error) {
+
+	if a < 0 || b < 0 || b != 0 && a > math.MaxInt64/b {
+		return 0, fmt.Errorf("offset %d * %d overflows: %w", a, b, ErrInvalid)
+	}
+
+	return a * b, nil
+}
@@ -0,0 +1,129 @@
+package pseudofat
+
+import (
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"testing"
+)
+
+var errCrash = errors.New("simulated crash")
+
+// crashDevice stops writing after a number of clusters as if the machine lost power, -1 never stops
+type crashDevice struct {
+	*MemoryDevice
+	writes_left int
+}
+
+func (device *crashDevice) WriteCluster(cluster int32, buffer []byte) error {
+
+	if device.writes_left == 0 {
+		return errCrash
+	}
+	if device.writes_left > 0 {
+		device.writes_left--
+	}
+
+	return device.MemoryDevice.WriteCluster(cluster, buffer)
+}
+
+// cloneDevice copies a memory device so that several runs can start from the same image
+func cloneDevice(device *MemoryDevice) *MemoryDevice {
+	return &MemoryDevice{data: slices.Clone(device.data)}
+}
+
+// newVolume formats an in-memory volume with the default cluster size
+func newVolume(t *testing.T, size_mb int) (*FileSystem, *MemoryDevice) {
+
+	t.Helper()
+
+	device := NewMemoryDevice(0)
+	fs, err := FormatDevice(device, size_mb, CLUSTER_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fs, device
+}
+
+// treeState maps every path below dir to the contents of the file, "dir" for a directory
+func treeState(t *testing.T, fs *FileSystem, dir string) map[string]string {
+
+	t.Helper()
+
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := make(map[string]string)
+	for _, entry := range entries[2:] {
+
+		entry_path := path.Join(dir, entry.FileName())
+		if entry.Is_directory == 1 {
+			state[entry_path] = "dir"
+			for sub_path, contents := range treeState(t, fs, entry_path) {
+				state[sub_path] = contents
+			}
+			continue
+		}
+
+		data, err := fs.ReadFile(entry_path)
+		if err != nil {
+			t.Fatal(entry_path, err)
+		}
+		state[entry_path] = string(data)
+	}
+
+	return state
+}
+
+// checkClean fails unless fsck finds nothing and the free count matches FAT1 and the snapshots
+func checkClean(t *testing.T, fs *FileSystem) {
+
+	t.Helper()
+
+	report, err := fs.Check(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatal("fsck found problems:", report.Problems)
+	}
+
+	free_count := countFree(fs)
+	if free_count != fs.alloc.free_count {
+		t.Fatalf("free count is %d, FAT1 has %d free clusters", fs.alloc.free_count, free_count)
+	}
+}
+
+// countFree returns the free clusters of FAT1 that no snapshot holds
+func countFree(fs *FileSystem) int32 {
+
+	free_count := int32(0)
+	for cluster, value := range fs.fat1 {
+		if value == FAT_FREE && fs.snapshotRefs(int32(cluster)) == 0 {
+			free_count++
+		}
+	}
+
+	return free_count
+}
+
+// appendFile adds data to the end of a file through the given name
+func appendFile(t *testing.T, fs *FileSystem, file_path, data string) {
+
+	t.Helper()
+
+	file, err := fs.OpenFile(file_path, os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	_, err = file.Write([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
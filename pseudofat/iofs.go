@@ -0,0 +1,252 @@
+package pseudofat
+
+import (
+	"bytes"
+	"io"
+	iofs "io/fs"
+	"slices"
+	"strings"
+	"time"
+)
+
+// VolumeFS exposes an open volume as a read-only io/fs file system rooted at "/"
+type VolumeFS struct {
+	session *Session
+}
+
+// FS returns an io/fs view of the volume that can be used with fs.WalkDir, http.FS and friends
+func (fs *FileSystem) FS() *VolumeFS {
+	return &VolumeFS{session: fs.NewSession()}
+}
+
+// entryInfo implements fs.FileInfo on top of a DirectoryEntry
+type entryInfo struct {
+	name  string
+	entry DirectoryEntry
+}
+
+func (info entryInfo) Name() string       { return info.name }
+func (info entryInfo) Size() int64        { return int64(info.entry.Size) }
+func (info entryInfo) ModTime() time.Time { return info.entry.ModTime() }
+func (info entryInfo) IsDir() bool        { return info.entry.Is_directory == 1 }
+func (info entryInfo) Sys() any           { return info.entry }
+
+func (info entryInfo) Mode() iofs.FileMode {
+
+	perm := iofs.FileMode(info.entry.Mode & MODE_MASK)
+	if info.IsDir() {
+		return iofs.ModeDir | perm
+	}
+	if info.entry.IsSymlink() {
+		return iofs.ModeSymlink | perm
+	}
+	return perm
+}
+
+// volumeFile is an open regular file, its contents are read through the FAT chain on open
+type volumeFile struct {
+	info   entryInfo
+	reader *bytes.Reader
+}
+
+func (file *volumeFile) Stat() (iofs.FileInfo, error) { return file.info, nil }
+func (file *volumeFile) Read(p []byte) (int, error)   { return file.reader.Read(p) }
+func (file *volumeFile) Close() error                 { return nil }
+
+func (file *volumeFile) ReadAt(p []byte, off int64) (int, error) {
+	return file.reader.ReadAt(p, off)
+}
+
+func (file *volumeFile) Seek(offset int64, whence int) (int64, error) {
+	return file.reader.Seek(offset, whence)
+}
+
+// volumeDir is an open directory, ReadDir continues where the previous call stopped
+type volumeDir struct {
+	info    entryInfo
+	entries []iofs.DirEntry
+	offset  int
+}
+
+func (dir *volumeDir) Stat() (iofs.FileInfo, error) { return dir.info, nil }
+func (dir *volumeDir) Close() error                 { return nil }
+
+func (dir *volumeDir) Read([]byte) (int, error) {
+	return 0, &iofs.PathError{Op: "read", Path: dir.info.name, Err: iofs.ErrInvalid}
+}
+
+func (dir *volumeDir) ReadDir(n int) ([]iofs.DirEntry, error) {
+
+	remaining := dir.entries[dir.offset:]
+	if n <= 0 {
+		dir.offset = len(dir.entries)
+		return remaining, nil
+	}
+
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(remaining))
+	dir.offset += n
+	return remaining[:n], nil
+}
+
+// volumePath converts an io/fs path into an absolute volume path
+func volumePath(op, name string) (string, error) {
+
+	if !iofs.ValidPath(name) {
+		return "", &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+
+	if name == "." {
+		return "/", nil
+	}
+
+	return "/" + name, nil
+}
+
+func baseName(name string) string {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// Open implements fs.FS
+func (vfs *VolumeFS) Open(name string) (iofs.File, error) {
+
+	vfs.session.lock()
+	defer vfs.session.fs.mu.Unlock()
+
+	info, err := vfs.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		entries, err := vfs.readDir("open", name)
+		if err != nil {
+			return nil, err
+		}
+		return &volumeDir{info: info, entries: entries}, nil
+	}
+
+	file_contents, err := vfs.readFile(info)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &volumeFile{info: info, reader: bytes.NewReader(file_contents)}, nil
+}
+
+// Stat implements fs.StatFS
+func (vfs *VolumeFS) Stat(name string) (iofs.FileInfo, error) {
+
+	vfs.session.lock()
+	defer vfs.session.fs.mu.Unlock()
+
+	info, err := vfs.stat("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// ReadDir implements fs.ReadDirFS, entries are sorted by name
+func (vfs *VolumeFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+
+	vfs.session.lock()
+	defer vfs.session.fs.mu.Unlock()
+
+	return vfs.readDir("readdir", name)
+}
+
+// ReadFile implements fs.ReadFileFS
+func (vfs *VolumeFS) ReadFile(name string) ([]byte, error) {
+
+	vfs.session.lock()
+	defer vfs.session.fs.mu.Unlock()
+
+	info, err := vfs.stat("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return nil, &iofs.PathError{Op: "readfile", Path: name, Err: ErrIsDir}
+	}
+
+	file_contents, err := vfs.readFile(info)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+
+	return file_contents, nil
+}
+
+func (vfs *VolumeFS) stat(op, name string) (entryInfo, error) {
+
+	volume_path, err := volumePath(op, name)
+	if err != nil {
+		return entryInfo{}, err
+	}
+
+	entry, err := vfs.session.stat(volume_path)
+	if err != nil {
+		return entryInfo{}, &iofs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	return entryInfo{name: baseName(name), entry: entry}, nil
+}
+
+// readFile returns the contents of a file the session may read
+func (vfs *VolumeFS) readFile(info entryInfo) ([]byte, error) {
+
+	err := vfs.session.fs.checkAccess(info.entry, PERM_READ)
+	if err != nil {
+		return nil, err
+	}
+
+	return vfs.session.fs.readFileContents(info.entry.First_cluster, info.entry.Size)
+}
+
+func (vfs *VolumeFS) readDir(op, name string) ([]iofs.DirEntry, error) {
+
+	info, err := vfs.stat(op, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, &iofs.PathError{Op: op, Path: name, Err: ErrNotDir}
+	}
+
+	err = vfs.session.fs.checkAccess(info.entry, PERM_READ)
+	if err != nil {
+		return nil, &iofs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	dir_entries, err := vfs.session.fs.readDirectoryEntries(info.entry.First_cluster)
+	if err != nil {
+		return nil, &iofs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	var entries []iofs.DirEntry
+	for _, entry := range dir_entries {
+
+		entry_name := entry.FileName()
+		if !isUsedEntry(entry) || entry_name == "." || entry_name == ".." {
+			continue
+		}
+
+		entries = append(entries, iofs.FileInfoToDirEntry(entryInfo{name: entry_name, entry: entry}))
+	}
+
+	slices.SortFunc(entries, func(a, b iofs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return entries, nil
+}
@@ -0,0 +1,119 @@
+package pseudofat
+
+import (
+	"bytes"
+	"errors"
+	iofs "io/fs"
+	"os"
+	"path"
+	"slices"
+	"testing"
+	"testing/fstest"
+)
+
+// populateVolume copies every file of the host directory host_dir into dir on the volume
+func populateVolume(t *testing.T, fs *FileSystem, host_dir, dir string) []string {
+
+	t.Helper()
+
+	host_entries, err := os.ReadDir(host_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.MkdirAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, host_entry := range host_entries {
+
+		if !host_entry.Type().IsRegular() {
+			continue
+		}
+
+		data, err := os.ReadFile(path.Join(host_dir, host_entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = fs.WriteFile(path.Join(dir, host_entry.Name()), data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, host_entry.Name())
+	}
+
+	return names
+}
+
+func TestVolumeFS(t *testing.T) {
+
+	fs, _ := newVolume(t, 4)
+
+	names := populateVolume(t, fs, "../data", "/data")
+	if len(names) == 0 {
+		t.Fatal("no files in ../data")
+	}
+	populateVolume(t, fs, "../data", "/data/nested/deeper")
+
+	if err := fs.Mkdir("/empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []string
+	for _, name := range names {
+		expected = append(expected, "data/"+name, "data/nested/deeper/"+name)
+	}
+
+	vfs := fs.FS()
+	if err := fstest.TestFS(vfs, expected...); err != nil {
+		t.Fatal(err)
+	}
+
+	// **The contents seen through io/fs are those of the host files**
+	for _, name := range names {
+
+		want, err := os.ReadFile(path.Join("../data", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := iofs.ReadFile(vfs, "data/nested/deeper/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("'%s' differs from the host file", name)
+		}
+	}
+
+	// **The walk finds exactly the populated tree**
+	var walked []string
+	err := iofs.WalkDir(vfs, ".", func(name string, entry iofs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			walked = append(walked, name)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slices.Sort(walked)
+	slices.Sort(expected)
+	if !slices.Equal(walked, expected) {
+		t.Fatalf("walk found %v, want %v", walked, expected)
+	}
+
+	// **Invalid and missing paths fail like the standard library**
+	for _, name := range []string{"/data", "data/", "../data", "data/missing"} {
+		if _, err := vfs.Open(name); err == nil {
+			t.Fatalf("opening '%s' succeeded", name)
+		}
+	}
+	if _, err := vfs.Open("data/missing"); !errors.Is(err, iofs.ErrNotExist) {
+		t.Fatalf("missing file: %v", err)
+	}
+}
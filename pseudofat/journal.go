@@ -0,0 +1,527 @@
+package pseudofat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"slices"
+)
+
+// The journal is a redo log between FAT2 and the data area. A commit first writes
+// the new images of every FAT and directory cluster the transaction changed into
+// the journal blocks, then the descriptor naming their home clusters, and only then
+// writes the clusters to their place. A crash before the descriptor is complete
+// loses the transaction, a crash after it is repaired by replaying the journal on
+// the next mount. File contents are not journaled, they reach the device before
+// the descriptor so a committed transaction never points to unwritten data.
+//
+// Descriptor layout, it may span several clusters:
+//
+//	0   magic [8]byte      JOURNAL_MAGIC or JOURNAL_CHAIN_MAGIC
+//	8   block_count uint32 blocks kept in the journal itself
+//	12  checksum uint32    CRC-32 of the targets, the extension and then the blocks
+//	16  targets [block_count]int32
+//
+// A transaction with more blocks than the journal holds is chained: the descriptor carries
+// JOURNAL_CHAIN_MAGIC and the first cluster of its extension at 16, the targets follow at 20.
+// The extension is a list of free data clusters, each of them
+//
+//	0   next int32         next cluster of the extension, 0 for the last one
+//	4   count uint32
+//	8   records [count]{target int32, block int32}
+//
+// names further targets together with the free cluster holding the block of each. Everything is
+// written before the one descriptor that commits it, so replay applies all of it or none of it.
+// A FAT1 cluster as target stands for the same cluster of both FAT tables.
+const (
+	JOURNAL_MAGIC            = "ZOSJRNL\x00"
+	JOURNAL_CHAIN_MAGIC      = "ZOSJRNL\x01"
+	JOURNAL_HEADER           = 16
+	JOURNAL_CHAIN_HEADER     = 20
+	JOURNAL_EXTRA_BLOCKS     = 64 // room for directory clusters besides a full FAT, less on tiny volumes
+	JOURNAL_TARGET_LENGTH    = 4
+	JOURNAL_EXTENSION_HEADER = 8
+	JOURNAL_RECORD_LENGTH    = 8
+)
+
+// journalGeometry returns the clusters taken by the descriptor and the number of journal
+// blocks, enough for every FAT cluster plus up to JOURNAL_EXTRA_BLOCKS directory clusters
+func journalGeometry(cluster_count, fat_cluster_count, cluster_size int) (descriptor_clusters, blocks int) {
+
+	blocks = fat_cluster_count + min(max(cluster_count/16, 4), JOURNAL_EXTRA_BLOCKS)
+	descriptor_size := JOURNAL_HEADER + blocks*JOURNAL_TARGET_LENGTH
+	descriptor_clusters = (descriptor_size + cluster_size - 1) / cluster_size
+
+	return descriptor_clusters, blocks
+}
+
+// journalLayout returns the first journal block and how many blocks one commit can hold
+func (fs *FileSystem) journalLayout() (first_block int32, capacity int) {
+
+	descriptor_clusters, capacity := journalGeometry(int(fs.fs_format.cluster_count), int(fs.fs_format.fat_cluster_count), int(fs.fs_format.cluster_size))
+	return fs.clusterAt(fs.fs_format.journal_start) + int32(descriptor_clusters), capacity
+}
+
+// readCluster reads a cluster as the running transaction sees it
+func (fs *FileSystem) readCluster(cluster int32, buffer []byte) error {
+
+	if staged, ok := fs.journal.staged[cluster]; ok {
+		copy(buffer, staged)
+		return nil
+	}
+
+	return fs.device.ReadCluster(cluster, buffer)
+}
+
+// stageBytes stores p at the byte offset in the staged copies of the clusters underneath,
+// the change reaches the device on the next commit
+func (fs *FileSystem) stageBytes(p []byte, offset int64) error {
+
+	cluster_size := fs.clusterSize()
+	for len(p) > 0 {
+
+		cluster := int32(offset / cluster_size)
+		cluster_off := offset % cluster_size
+
+		staged, ok := fs.journal.staged[cluster]
+		if !ok {
+			staged = make([]byte, cluster_size)
+			err := fs.device.ReadCluster(cluster, staged)
+			if err != nil {
+				return err
+			}
+
+			if fs.journal.staged == nil {
+				fs.journal.staged = make(map[int32][]byte)
+			}
+			fs.journal.staged[cluster] = staged
+		}
+
+		n := int64(copy(staged[cluster_off:], p))
+		p = p[n:]
+		offset += n
+	}
+
+	return nil
+}
+
+// commit ends a modifying operation. Without an error the changes of the transaction
+// are written through the journal, otherwise they are rolled back in memory. A transaction
+// whose descriptor is on the device stays, its checkpoint is retried by the next commit.
+func (fs *FileSystem) commit(err error) error {
+
+	if err == nil {
+		err = fs.flushTransaction()
+	}
+
+	// **Until a descriptor of the transaction reaches the device memory can fall back to the old state**
+	if err != nil && !fs.journal.committed {
+		fs.abort()
+	}
+
+	return err
+}
+
+// abort restores the FAT entries changed by the transaction and drops its staged clusters
+func (fs *FileSystem) abort() {
+
+	for cluster, value := range fs.journal.undo {
+		fs.fat1[cluster] = value
+		fs.fat2[cluster] = value
+		fs.markCluster(cluster, value != FAT_FREE)
+	}
+
+	fs.releaseOverflow()
+	fs.dirty_start, fs.dirty_end = 0, 0
+	fs.journal = journal{}
+
+	// **The link index may name directories of the aborted transaction, it is built again when needed**
+	fs.links = linkIndex{}
+	fs.quotas = quotaCache{}
+}
+
+// flushTransaction commits the changed FAT clusters and the staged directory clusters
+func (fs *FileSystem) flushTransaction() error {
+
+	// **A checkpoint that failed before has to finish before the journal blocks are reused**
+	if fs.journal.committed {
+		err := fs.replayJournal()
+		if err != nil {
+			return err
+		}
+		fs.releaseOverflow()
+	}
+
+	// **A transaction that changed nothing leaves the device alone**
+	if fs.dirty_start >= fs.dirty_end && len(fs.journal.staged) == 0 {
+		fs.journal = journal{}
+		return nil
+	}
+
+	// **The free cluster hint commits with the FAT it counts, freed clusters included**
+	hint_staged := fs.alloc.hint_dirty || len(fs.journal.freed) > 0
+	if hint_staged {
+		free_count := fs.alloc.free_count
+		for _, cluster := range fs.journal.freed {
+			if fs.fat1[cluster] == FAT_FREE && fs.snapshotRefs(cluster) == 0 {
+				free_count++
+			}
+		}
+
+		err := fs.stageBytes(fs.encodeFSInfo(free_count), FSINFO_OFFSET)
+		if err != nil {
+			return fmt.Errorf("error staging free cluster hint: %w", err)
+		}
+	}
+
+	blocks := fs.dirtyFATClusters()
+	for cluster, staged := range fs.journal.staged {
+		blocks[cluster] = staged
+	}
+
+	targets := make([]int32, 0, len(blocks))
+	for cluster := range blocks {
+		targets = append(targets, cluster)
+	}
+	slices.Sort(targets)
+
+	err := fs.writeTransaction(targets, blocks)
+	if err != nil {
+		return err
+	}
+
+	// **Clusters freed by the transaction can be reused from now on**
+	for _, cluster := range fs.journal.freed {
+		if fs.fat1[cluster] == FAT_FREE {
+			fs.markCluster(cluster, false)
+		}
+	}
+
+	fs.dirty_start, fs.dirty_end = 0, 0
+	fs.journal = journal{}
+	if hint_staged {
+		fs.alloc.hint_dirty = false
+	}
+
+	return nil
+}
+
+// writeTransaction logs the blocks, commits them with the descriptor and writes them to their place
+func (fs *FileSystem) writeTransaction(targets []int32, blocks map[int32][]byte) error {
+
+	first_block, capacity := fs.journalLayout()
+	descriptor := make([]byte, int64(first_block)*fs.clusterSize()-fs.fs_format.journal_start)
+
+	// **Blocks that do not fit into the journal are logged in free clusters named by the extension**
+	magic, header, in_journal := JOURNAL_MAGIC, JOURNAL_HEADER, len(targets)
+	var extension []byte
+	var locations []int32
+	if len(targets) > capacity {
+
+		magic, header = JOURNAL_CHAIN_MAGIC, JOURNAL_CHAIN_HEADER
+		in_journal = min(capacity, (len(descriptor)-JOURNAL_CHAIN_HEADER)/JOURNAL_TARGET_LENGTH)
+
+		var first_extension int32
+		var err error
+		first_extension, extension, locations, err = fs.buildExtension(targets[in_journal:])
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(descriptor[JOURNAL_HEADER:], uint32(first_extension))
+	}
+
+	copy(descriptor, magic)
+	binary.LittleEndian.PutUint32(descriptor[8:], uint32(in_journal))
+
+	raw_targets := descriptor[header : header+in_journal*JOURNAL_TARGET_LENGTH]
+	for i, target := range targets[:in_journal] {
+		binary.LittleEndian.PutUint32(raw_targets[i*JOURNAL_TARGET_LENGTH:], uint32(target))
+	}
+
+	checksum := crc32.ChecksumIEEE(raw_targets)
+	checksum = crc32.Update(checksum, crc32.IEEETable, extension)
+	for i, target := range targets {
+
+		location := first_block + int32(i)
+		if i >= in_journal {
+			location = locations[i-in_journal]
+		}
+
+		checksum = crc32.Update(checksum, crc32.IEEETable, blocks[target])
+		err := fs.device.WriteCluster(location, blocks[target])
+		if err != nil {
+			return fmt.Errorf("error writing journal: %w", err)
+		}
+	}
+	binary.LittleEndian.PutUint32(descriptor[12:], checksum)
+
+	// **The blocks and the file contents must be durable before the descriptor commits them**
+	err := fs.device.Flush()
+	if err != nil {
+		return err
+	}
+
+	err = fs.writeBytes(descriptor, fs.fs_format.journal_start)
+	if err != nil {
+		return fmt.Errorf("error writing journal: %w", err)
+	}
+
+	err = fs.device.Flush()
+	if err != nil {
+		return err
+	}
+	fs.journal.committed = true
+
+	images := make([][]byte, len(targets))
+	for i, target := range targets {
+		images[i] = blocks[target]
+	}
+
+	err = fs.checkpoint(targets, images)
+	if err != nil {
+		return err
+	}
+
+	fs.releaseOverflow()
+	return nil
+}
+
+// buildExtension reserves free clusters for the blocks of the targets and for the extension
+// listing them, it writes the extension and returns its first cluster, its contents and the
+// clusters that take the blocks in the order of the targets
+func (fs *FileSystem) buildExtension(targets []int32) (int32, []byte, []int32, error) {
+
+	cluster_size := int(fs.clusterSize())
+	per_cluster := (cluster_size - JOURNAL_EXTENSION_HEADER) / JOURNAL_RECORD_LENGTH
+	extension_count := (len(targets) + per_cluster - 1) / per_cluster
+
+	// **The clusters stay free in both FAT tables, they are only kept from the allocator until the checkpoint**
+	if !fs.hasFreeClusters(extension_count + len(targets)) {
+		return 0, nil, nil, fmt.Errorf("transaction of %d blocks does not fit into the journal: %w", len(targets), ErrNoSpace)
+	}
+
+	reserved := make([]int32, extension_count+len(targets))
+	for i := range reserved {
+		reserved[i] = fs.nextFreeCluster(fs.rootCluster())
+		if reserved[i] < 0 {
+			return 0, nil, nil, fmt.Errorf("free count %d does not match the bitmap: %w", fs.alloc.free_count, ErrCorrupt)
+		}
+		fs.markCluster(reserved[i], true)
+		fs.journal.overflow = append(fs.journal.overflow, reserved[i])
+	}
+	extension_clusters, locations := reserved[:extension_count], reserved[extension_count:]
+
+	extension := make([]byte, extension_count*cluster_size)
+	for i, cluster := range extension_clusters {
+
+		raw := extension[i*cluster_size : (i+1)*cluster_size]
+		if i+1 < extension_count {
+			binary.LittleEndian.PutUint32(raw, uint32(extension_clusters[i+1]))
+		}
+
+		records := targets[i*per_cluster : min((i+1)*per_cluster, len(targets))]
+		binary.LittleEndian.PutUint32(raw[4:], uint32(len(records)))
+		for j, target := range records {
+			record := raw[JOURNAL_EXTENSION_HEADER+j*JOURNAL_RECORD_LENGTH:]
+			binary.LittleEndian.PutUint32(record, uint32(target))
+			binary.LittleEndian.PutUint32(record[4:], uint32(locations[i*per_cluster+j]))
+		}
+
+		err := fs.device.WriteCluster(cluster, raw)
+		if err != nil {
+			return 0, nil, nil, fmt.Errorf("error writing journal: %w", err)
+		}
+	}
+
+	return extension_clusters[0], extension, locations, nil
+}
+
+// readExtension returns the targets and the block locations listed by an extension together with
+// its contents, false when the extension is not intact
+func (fs *FileSystem) readExtension(cluster int32) ([]int32, []int32, []byte, bool, error) {
+
+	cluster_size := int(fs.clusterSize())
+	per_cluster := (cluster_size - JOURNAL_EXTENSION_HEADER) / JOURNAL_RECORD_LENGTH
+	is_data := func(cluster int32) bool { return cluster >= fs.rootCluster() && cluster < fs.fs_format.cluster_count }
+
+	var targets, locations []int32
+	var extension []byte
+	for visited := int32(0); cluster != 0; visited++ {
+
+		// **A cycle or a cluster outside of the data area means the extension was never completed**
+		if !is_data(cluster) || visited >= fs.fs_format.cluster_count {
+			return nil, nil, nil, false, nil
+		}
+
+		raw := make([]byte, cluster_size)
+		err := fs.device.ReadCluster(cluster, raw)
+		if err != nil {
+			return nil, nil, nil, false, fmt.Errorf("error reading journal: %w", err)
+		}
+
+		count := int(binary.LittleEndian.Uint32(raw[4:]))
+		if count > per_cluster {
+			return nil, nil, nil, false, nil
+		}
+
+		for j := range count {
+			record := raw[JOURNAL_EXTENSION_HEADER+j*JOURNAL_RECORD_LENGTH:]
+			location := int32(binary.LittleEndian.Uint32(record[4:]))
+			if !is_data(location) {
+				return nil, nil, nil, false, nil
+			}
+			targets = append(targets, int32(binary.LittleEndian.Uint32(record)))
+			locations = append(locations, location)
+		}
+
+		extension = append(extension, raw...)
+		cluster = int32(binary.LittleEndian.Uint32(raw))
+	}
+
+	return targets, locations, extension, true, nil
+}
+
+// releaseOverflow gives the clusters that held an extension back to the allocator
+func (fs *FileSystem) releaseOverflow() {
+
+	for _, cluster := range fs.journal.overflow {
+		if fs.fat1[cluster] == FAT_FREE {
+			fs.markCluster(cluster, false)
+		}
+	}
+
+	fs.journal.overflow = nil
+}
+
+// checkpoint writes committed blocks to their place and empties the journal
+func (fs *FileSystem) checkpoint(targets []int32, images [][]byte) error {
+
+	fat1_cluster := fs.clusterAt(fs.fs_format.fat1_start)
+	for i, target := range targets {
+
+		err := fs.device.WriteCluster(target, images[i])
+
+		// **FAT clusters go to both tables**
+		if err == nil && target >= fat1_cluster && target < fat1_cluster+fs.fs_format.fat_cluster_count {
+			err = fs.device.WriteCluster(target+fs.fs_format.fat_cluster_count, images[i])
+		}
+		if err != nil {
+			return fmt.Errorf("error writing cluster %d: %w", target, err)
+		}
+	}
+
+	err := fs.device.Flush()
+	if err != nil {
+		return err
+	}
+
+	return fs.clearJournal()
+}
+
+// clearJournal marks the journal as empty
+func (fs *FileSystem) clearJournal() error {
+
+	err := fs.writeBytes(make([]byte, JOURNAL_HEADER), fs.fs_format.journal_start)
+	if err != nil {
+		return fmt.Errorf("error clearing journal: %w", err)
+	}
+
+	return nil
+}
+
+// replayJournal writes a committed transaction to its place when the volume was not
+// unmounted cleanly, a transaction whose commit was torn is dropped
+func (fs *FileSystem) replayJournal() error {
+
+	first_block, capacity := fs.journalLayout()
+	descriptor := make([]byte, int64(first_block)*fs.clusterSize()-fs.fs_format.journal_start)
+	err := fs.readBytes(descriptor, fs.fs_format.journal_start)
+	if err != nil {
+		return fmt.Errorf("error reading journal: %w", err)
+	}
+
+	header := JOURNAL_HEADER
+	switch string(descriptor[:len(JOURNAL_MAGIC)]) {
+	case JOURNAL_MAGIC:
+	case JOURNAL_CHAIN_MAGIC:
+		header = JOURNAL_CHAIN_HEADER
+	default:
+		return nil
+	}
+
+	count := int(binary.LittleEndian.Uint32(descriptor[8:]))
+	if count > capacity || header+count*JOURNAL_TARGET_LENGTH > len(descriptor) {
+		return fs.dropJournal()
+	}
+
+	raw_targets := descriptor[header : header+count*JOURNAL_TARGET_LENGTH]
+	checksum := crc32.ChecksumIEEE(raw_targets)
+
+	targets := make([]int32, count)
+	locations := make([]int32, count)
+	for i := range targets {
+		targets[i] = int32(binary.LittleEndian.Uint32(raw_targets[i*JOURNAL_TARGET_LENGTH:]))
+		locations[i] = first_block + int32(i)
+	}
+
+	// **A chained transaction lists the rest of its blocks in the extension**
+	if header == JOURNAL_CHAIN_HEADER {
+
+		more_targets, more_locations, extension, ok, err := fs.readExtension(int32(binary.LittleEndian.Uint32(descriptor[JOURNAL_HEADER:])))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fs.dropJournal()
+		}
+
+		checksum = crc32.Update(checksum, crc32.IEEETable, extension)
+		targets = append(targets, more_targets...)
+		locations = append(locations, more_locations...)
+	}
+
+	images := make([][]byte, len(targets))
+	for i := range targets {
+
+		images[i] = make([]byte, fs.clusterSize())
+		err = fs.device.ReadCluster(locations[i], images[i])
+		if err != nil {
+			return fmt.Errorf("error reading journal: %w", err)
+		}
+
+		checksum = crc32.Update(checksum, crc32.IEEETable, images[i])
+	}
+
+	if checksum != binary.LittleEndian.Uint32(descriptor[12:]) {
+		return fs.dropJournal()
+	}
+
+	// **Only the header, FAT1 and the data area may be targets**
+	fat1_cluster := fs.clusterAt(fs.fs_format.fat1_start)
+	for _, target := range targets {
+
+		is_fat := target >= fat1_cluster && target < fat1_cluster+fs.fs_format.fat_cluster_count
+		if target != 0 && !is_fat && (target < fs.rootCluster() || target >= fs.fs_format.cluster_count) {
+			return fmt.Errorf("journal writes to cluster %d: %w", target, ErrCorrupt)
+		}
+	}
+
+	err = fs.checkpoint(targets, images)
+	if errors.Is(err, ErrReadOnly) {
+		return fmt.Errorf("volume has a committed journal, mount it read-write to replay it: %w", err)
+	}
+
+	return err
+}
+
+// dropJournal discards a descriptor whose commit never completed, a read-only mount leaves it be
+func (fs *FileSystem) dropJournal() error {
+
+	err := fs.clearJournal()
+	if errors.Is(err, ErrReadOnly) {
+		return nil
+	}
+
+	return err
+}
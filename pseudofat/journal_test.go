@@ -0,0 +1,192 @@
+package pseudofat
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+)
+
+// TestJournalCrashLargeTransaction crashes a copy whose transaction is larger than the journal after
+// every possible number of writes, the volume must show either none of the copy or all of it
+func TestJournalCrashLargeTransaction(t *testing.T) {
+
+	fs, base := newVolume(t, 2)
+	for i := range 80 {
+		err := fs.MkdirAll(fmt.Sprintf("/src/d%02d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, capacity := fs.journalLayout(); capacity >= 80 {
+		t.Fatalf("journal holds %d blocks, the copy would fit", capacity)
+	}
+
+	before := treeState(t, fs, "/")
+	fs.Close()
+
+	after := maps.Clone(before)
+	after["/dst"] = "dir"
+	for i := range 80 {
+		after[fmt.Sprintf("/dst/d%02d", i)] = "dir"
+	}
+
+	for writes := 0; ; writes++ {
+
+		device := cloneDevice(base)
+		fs, err := OpenDevice(&crashDevice{MemoryDevice: device, writes_left: writes})
+		if err == nil {
+			err = fs.CopyTree("/src", "/dst")
+		}
+		if err != nil && !errors.Is(err, errCrash) {
+			t.Fatal(writes, err)
+		}
+
+		remounted, mount_err := OpenDevice(device)
+		if mount_err != nil {
+			t.Fatal(writes, mount_err)
+		}
+		checkClean(t, remounted)
+
+		state := treeState(t, remounted, "/")
+		if !maps.Equal(state, before) && !maps.Equal(state, after) {
+			t.Fatalf("crash after %d writes left a partial copy", writes)
+		}
+
+		if err == nil {
+			if !maps.Equal(state, after) {
+				t.Fatal("the copy did not persist")
+			}
+			return
+		}
+	}
+}
+
+// TestJournalCrashOperations runs a sequence of operations that crashes after every possible
+// number of writes, a remount must show the state before or after the operation that was running
+func TestJournalCrashOperations(t *testing.T) {
+
+	operations := []func(fs *FileSystem) error{
+		func(fs *FileSystem) error { return fs.Mkdir("/a") },
+		func(fs *FileSystem) error { return fs.WriteFile("/a/f", []byte(strings.Repeat("q", 5000))) },
+		func(fs *FileSystem) error { return fs.Rename("/a/f", "/g") },
+		func(fs *FileSystem) error { return fs.Remove("/g") },
+		func(fs *FileSystem) error { return fs.Remove("/a") },
+	}
+
+	base := NewMemoryDevice(0)
+	fs, err := FormatDevice(base, 1, MIN_CLUSTER_SIZE)
+	if err == nil {
+		err = fs.WriteFile("/keep", []byte("x"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+
+	// **The states between the operations, taken on a run without a crash**
+	fs, err = OpenDevice(cloneDevice(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := []map[string]string{treeState(t, fs, "/")}
+	for _, operation := range operations {
+		if err := operation(fs); err != nil {
+			t.Fatal(err)
+		}
+		states = append(states, treeState(t, fs, "/"))
+	}
+
+	for writes := 0; ; writes++ {
+
+		device := cloneDevice(base)
+		fs, err := OpenDevice(&crashDevice{MemoryDevice: device, writes_left: writes})
+		if err != nil {
+			t.Fatal(writes, err)
+		}
+
+		done := 0
+		for _, operation := range operations {
+			if err = operation(fs); err != nil {
+				break
+			}
+			done++
+		}
+		if err != nil && !errors.Is(err, errCrash) {
+			t.Fatal(writes, err)
+		}
+
+		remounted, mount_err := OpenDevice(device)
+		if mount_err != nil {
+			t.Fatal(writes, mount_err)
+		}
+		checkClean(t, remounted)
+
+		state := treeState(t, remounted, "/")
+		if !maps.Equal(state, states[done]) && (done == len(operations) || !maps.Equal(state, states[done+1])) {
+			t.Fatalf("crash after %d writes during operation %d left %v", writes, done, state)
+		}
+
+		if err == nil {
+			return
+		}
+	}
+}
+
+// TestJournalReplayLargeTransaction replays a committed transaction larger than the journal
+// whose checkpoint never ran
+func TestJournalReplayLargeTransaction(t *testing.T) {
+
+	fs, device := newVolume(t, 2)
+	for i := range 80 {
+		err := fs.MkdirAll(fmt.Sprintf("/src/d%02d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.Close()
+
+	// **Stop every write to a home cluster, the journal and the extension still get through**
+	fs, err := OpenDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.device = &checkpointFailDevice{MemoryDevice: device, fs: fs}
+	err = fs.CopyTree("/src", "/dst")
+	if !errors.Is(err, errCrash) {
+		t.Fatal("checkpoint did not fail:", err)
+	}
+
+	remounted, err := OpenDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, remounted)
+
+	entries, err := remounted.ReadDir("/dst")
+	if err != nil || len(entries) != 82 {
+		t.Fatal("replay lost the copy:", len(entries), err)
+	}
+}
+
+// checkpointFailDevice fails the first write of a FAT cluster after a chained descriptor was written
+type checkpointFailDevice struct {
+	*MemoryDevice
+	fs        *FileSystem
+	committed bool
+}
+
+func (device *checkpointFailDevice) WriteCluster(cluster int32, buffer []byte) error {
+
+	journal_cluster := device.fs.clusterAt(device.fs.fs_format.journal_start)
+	if cluster == journal_cluster && string(buffer[:len(JOURNAL_CHAIN_MAGIC)]) == JOURNAL_CHAIN_MAGIC {
+		device.committed = true
+	} else if device.committed {
+		return errCrash
+	}
+
+	return device.MemoryDevice.WriteCluster(cluster, buffer)
+}
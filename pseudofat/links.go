@@ -0,0 +1,374 @@
+package pseudofat
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// A file may have several names. Every hard link is a full directory entry pointing to the same
+// chain, all of them carry the same Links count, size and times, so a change made through one
+// name is copied to the others. The link index finds the directories holding the names without
+// walking the tree. The chain is freed when the last name goes away.
+//
+// A symbolic link is an entry of type ENTRY_SYMLINK, its chain holds the target path and Size
+// is the length of the path. Paths through the link are resolved against the directory holding it.
+const (
+	ENTRY_SYMLINK    = 2              // Is_directory value of a symbolic link
+	MAX_SYMLINK_HOPS = 40             // symbolic links followed while resolving one path
+	MAX_LINKS        = math.MaxUint16 // names one file can have
+)
+
+// IsSymlink reports whether the entry is a symbolic link
+func (entry DirectoryEntry) IsSymlink() bool {
+	return entry.Is_directory == ENTRY_SYMLINK
+}
+
+// updateLinks calls update for every name of the live tree whose chain starts at first_cluster, writes
+// back the entries it changed and returns how many names there are, a nil update only counts them
+func (fs *FileSystem) updateLinks(first_cluster int32, update func(entry *DirectoryEntry)) (int, error) {
+
+	dirs, err := fs.linkDirectories(first_cluster)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for dir_cluster := range dirs {
+		n, err := fs.updateLinksIn(dir_cluster, first_cluster, update)
+		if err != nil {
+			return 0, err
+		}
+		count += n
+	}
+
+	return count, nil
+}
+
+// updateLinksIn is updateLinks for the names held directly in the directory at dir_cluster
+func (fs *FileSystem) updateLinksIn(dir_cluster, first_cluster int32, update func(entry *DirectoryEntry)) (int, error) {
+
+	chain, dir_entries, err := fs.readDirectory(dir_cluster)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := 2; i < len(dir_entries); i++ {
+
+		entry := dir_entries[i]
+		if !isUsedEntry(entry) || entry.Is_directory == 1 || entry.First_cluster != first_cluster {
+			continue
+		}
+
+		count++
+		if update == nil {
+			continue
+		}
+
+		update(&dir_entries[i])
+		if dir_entries[i] != entry {
+			err = fs.writeDirectorySlot(chain, dir_entries, i)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return count, nil
+}
+
+// linkDirectories returns the directories that may hold names of the file whose chain starts at
+// first_cluster. The index may name directories that lost those names since, never one that
+// gained a name without being listed.
+func (fs *FileSystem) linkDirectories(first_cluster int32) (map[int32]bool, error) {
+
+	// **One walk of the tree builds the index, again after directories moved to other clusters**
+	if fs.links.dirs == nil || fs.links.dir_moves != fs.dir_moves {
+		fs.links = linkIndex{dirs: make(map[int32]map[int32]bool), dir_moves: fs.dir_moves}
+		err := fs.indexLinks(fs.rootDirectory())
+		if err != nil {
+			fs.links = linkIndex{}
+			return nil, err
+		}
+	}
+
+	return fs.links.dirs[first_cluster], nil
+}
+
+// indexLinks adds the files with several names found below the directory at dir_cluster to the link index
+func (fs *FileSystem) indexLinks(dir_cluster int32) error {
+
+	dir_entries, err := fs.readDirectoryEntries(dir_cluster)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range dir_entries[2:] {
+
+		switch {
+		case !isUsedEntry(entry):
+			continue
+
+		case entry.Is_directory == 1:
+			err = fs.indexLinks(entry.First_cluster)
+			if err != nil {
+				return err
+			}
+
+		case entry.Links > 1:
+			fs.addLinkDirectory(entry.First_cluster, dir_cluster)
+		}
+	}
+
+	return nil
+}
+
+// indexLink records that the directory at dir_cluster holds a name of the file whose chain starts at first_cluster
+func (fs *FileSystem) indexLink(first_cluster, dir_cluster int32) error {
+
+	_, err := fs.linkDirectories(first_cluster)
+	if err != nil {
+		return err
+	}
+
+	fs.addLinkDirectory(first_cluster, dir_cluster)
+	return nil
+}
+
+func (fs *FileSystem) addLinkDirectory(first_cluster, dir_cluster int32) {
+
+	dirs := fs.links.dirs[first_cluster]
+	if dirs == nil {
+		dirs = make(map[int32]bool)
+		fs.links.dirs[first_cluster] = dirs
+	}
+	dirs[dir_cluster] = true
+}
+
+// unindexDirectory drops a freed directory from the link index, its cluster may come back as a file
+func (fs *FileSystem) unindexDirectory(dir_cluster int32) {
+	for _, dirs := range fs.links.dirs {
+		delete(dirs, dir_cluster)
+	}
+}
+
+// syncLinks copies the metadata of a changed entry to its other names, old is the entry before the change
+func (fs *FileSystem) syncLinks(old, changed DirectoryEntry) error {
+
+	if old.Is_directory == 1 || old.Links <= 1 {
+		return nil
+	}
+
+	_, err := fs.updateLinks(old.First_cluster, func(entry *DirectoryEntry) {
+		entry.Size = changed.Size
+		entry.First_cluster = changed.First_cluster
+		entry.Created, entry.Modified, entry.Accessed = changed.Created, changed.Modified, changed.Accessed
+		entry.Links = changed.Links
+		entry.Uid, entry.Gid, entry.Mode = changed.Uid, changed.Gid, changed.Mode
+		entry.Xattr_cluster = changed.Xattr_cluster
+	})
+	if err != nil {
+		return err
+	}
+
+	// **A chain moved by defrag or copied away from a snapshot keeps its directories in the index**
+	if dirs, ok := fs.links.dirs[old.First_cluster]; ok && changed.First_cluster != old.First_cluster {
+		delete(fs.links.dirs, old.First_cluster)
+		fs.links.dirs[changed.First_cluster] = dirs
+	}
+
+	return nil
+}
+
+// releaseLink frees the chain of a file that lost a name unless names outside of the removed tree
+// still reference it, those get the new link count. released collects the chains freed so far,
+// a tree holding several names of one file frees its chain only once.
+func (fs *FileSystem) releaseLink(entry DirectoryEntry, released map[int32]bool) error {
+
+	if entry.Links <= 1 {
+		return fs.freeFile(entry)
+	}
+
+	if released[entry.First_cluster] {
+		return nil
+	}
+
+	count, err := fs.updateLinks(entry.First_cluster, nil)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		_, err = fs.updateLinks(entry.First_cluster, func(link *DirectoryEntry) { link.Links = uint16(count) })
+		return err
+	}
+
+	released[entry.First_cluster] = true
+	return fs.freeFile(entry)
+}
+
+// freeFile frees the contents and the attributes of a file that lost its last name
+func (fs *FileSystem) freeFile(entry DirectoryEntry) error {
+
+	delete(fs.links.dirs, entry.First_cluster)
+	err := fs.freeXattrs(entry)
+	if err != nil {
+		return err
+	}
+
+	return fs.freeChain(entry.First_cluster)
+}
+
+// link adds dest_name in dest_cluster as another name of the file src_name in src_cluster
+func (fs *FileSystem) link(src_cluster int32, src_name string, dest_cluster int32, dest_name string) error {
+
+	entry, err := fs.findEntry(src_name, src_cluster)
+	if err != nil {
+		return err
+	}
+
+	if entry.Is_directory == 1 {
+		return fmt.Errorf("cannot link directory '%s': %w", src_name, ErrIsDir)
+	}
+
+	if entry.Links >= MAX_LINKS {
+		return fmt.Errorf("'%s' has %d links: %w", src_name, entry.Links, ErrInvalid)
+	}
+
+	if dest_name == "" || fs.checkIfDirectoryExists(dest_cluster, dest_name) {
+		return ErrExist
+	}
+
+	// **The owner gets another entry, directories that get the name from outside get the chains as well**
+	usage, err := fs.entryUsage(entry)
+	if err == nil {
+		err = fs.checkQuota(entry.Uid, quotaUsage{entries: 1}, dest_cluster, src_cluster, usage)
+	}
+	if err != nil {
+		return err
+	}
+
+	// **The new name is a copy of the entry, only the name differs**
+	new_entry := entry
+	err = fs.setEntryName(dest_cluster, &new_entry, dest_name)
+	if err != nil {
+		return err
+	}
+
+	// **Both directories hold a name from now on, the index finds them**
+	err = fs.indexLink(entry.First_cluster, src_cluster)
+	if err == nil {
+		err = fs.indexLink(entry.First_cluster, dest_cluster)
+	}
+	if err != nil {
+		return err
+	}
+
+	new_entry.Links = max(entry.Links, 1) + 1
+	_, err = fs.updateLinks(entry.First_cluster, func(link *DirectoryEntry) { link.Links = new_entry.Links })
+	if err != nil {
+		return err
+	}
+
+	return fs.writeDirectoryEntry(dest_cluster, new_entry)
+}
+
+// createSymlink creates a symbolic link called name pointing to target, the target is not checked
+func (fs *FileSystem) createSymlink(dir_cluster int32, name, target string) error {
+
+	if target == "" || strings.ContainsRune(target, 0) {
+		return fmt.Errorf("invalid link target '%s': %w", target, ErrInvalid)
+	}
+
+	// **The target is kept in a single cluster**
+	if int64(len(target)) > fs.clusterSize() {
+		return fmt.Errorf("link target longer than %d bytes: %w", fs.clusterSize(), ErrNameTooLong)
+	}
+
+	return fs.createEntry(dir_cluster, name, []byte(target), ENTRY_SYMLINK, MODE_SYMLINK)
+}
+
+// readLink returns the target of a symbolic link
+func (fs *FileSystem) readLink(entry DirectoryEntry) (string, error) {
+
+	if !entry.IsSymlink() {
+		return "", fmt.Errorf("'%s' is not a symbolic link: %w", entry.FileName(), ErrInvalid)
+	}
+
+	target, err := fs.readFileContents(entry.First_cluster, entry.Size)
+	if err != nil {
+		return "", err
+	}
+
+	return string(target), nil
+}
+
+// followLink returns the target of a symbolic link met while resolving a path, the walk counts the
+// links followed so far and stops a path that runs in circles
+func (fs *FileSystem) followLink(entry DirectoryEntry, walk *pathWalk) (string, error) {
+
+	walk.hops++
+	if walk.hops > MAX_SYMLINK_HOPS {
+		return "", fmt.Errorf("cannot follow '%s': %w", entry.FileName(), ErrLoop)
+	}
+
+	return fs.readLink(entry)
+}
+
+// enterDirectory returns the first cluster of the directory called name, a symbolic link to a directory is followed
+func (fs *FileSystem) enterDirectory(name string, parent_cluster int32, walk *pathWalk) (int32, error) {
+
+	entry, err := fs.findEntry(name, parent_cluster)
+	if errors.Is(err, ErrNotFound) {
+		return -1, ErrPathNotFound
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	if entry.IsSymlink() {
+		target, err := fs.followLink(entry, walk)
+		if err != nil {
+			return -1, err
+		}
+
+		dir_cluster, _, err := fs.walkPath(parent_cluster, target, false, walk)
+		return dir_cluster, err
+	}
+
+	if entry.Is_directory != 1 {
+		return -1, ErrNotDir
+	}
+
+	return entry.First_cluster, nil
+}
+
+// followLinks resolves the entry name in dir_cluster as long as it is a symbolic link and returns the
+// directory and name of the entry it finally points to, which need not exist
+func (fs *FileSystem) followLinks(dir_cluster int32, name string, walk *pathWalk) (int32, string, error) {
+
+	for name != "" {
+
+		entry, err := fs.findEntry(name, dir_cluster)
+		if errors.Is(err, ErrNotFound) || err == nil && !entry.IsSymlink() {
+			break
+		}
+		if err != nil {
+			return -1, "", err
+		}
+
+		target, err := fs.followLink(entry, walk)
+		if err != nil {
+			return -1, "", err
+		}
+
+		dir_cluster, name, err = fs.walkPath(dir_cluster, target, true, walk)
+		if err != nil {
+			return -1, "", err
+		}
+	}
+
+	return dir_cluster, name, nil
+}
@@ -0,0 +1,350 @@
+package pseudofat
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// checkNames fails unless every name reads want and carries links as its count
+func checkNames(t *testing.T, fs *FileSystem, names []string, want string, links uint16) {
+
+	t.Helper()
+
+	for _, name := range names {
+
+		data, err := fs.ReadFile(name)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if string(data) != want {
+			t.Fatalf("'%s' reads %q, want %q", name, data, want)
+		}
+
+		entry, err := fs.Stat(name)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if entry.Links != links {
+			t.Fatalf("'%s' has %d links, want %d", name, entry.Links, links)
+		}
+	}
+}
+
+func TestLinkIndex(t *testing.T) {
+
+	fs, _ := newVolume(t, 4)
+	free_bytes, _ := fs.FreeSpace()
+
+	for _, dir := range []string{"/a", "/b", "/c", "/other/deep"} {
+		if err := fs.MkdirAll(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// **A name moved to another directory still sees writes through the others**
+	if err := fs.WriteFile("/a/f", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/other/deep/filler", []byte("filler")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Link("/a/f", "/b/g"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rename("/b/g", "/c/g"); err != nil {
+		t.Fatal(err)
+	}
+
+	content := "one" + strings.Repeat("+", CLUSTER_SIZE)
+	appendFile(t, fs, "/a/f", content[3:])
+	checkNames(t, fs, []string{"/a/f", "/c/g"}, content, 2)
+	checkClean(t, fs)
+
+	// **Only the directories holding names are searched**
+	entry, err := fs.Stat("/a/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"/a", "/c", "/other", "/other/deep"} {
+
+		dir_entry, err := fs.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		indexed := fs.links.dirs[entry.First_cluster][dir_entry.First_cluster]
+		if want := dir == "/a" || dir == "/c"; indexed != want {
+			t.Fatalf("'%s' indexed %v, want %v", dir, indexed, want)
+		}
+	}
+
+	// **Defrag moves the fragmented chain, the names follow it**
+	if err := fs.Remove("/other/deep/filler"); err != nil {
+		t.Fatal(err)
+	}
+	content += "two"
+	appendFile(t, fs, "/c/g", "two")
+	report, err := fs.Defrag("/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Moves) == 0 {
+		t.Fatal("defrag moved no chain")
+	}
+	content += "three"
+	appendFile(t, fs, "/a/f", "three")
+	checkNames(t, fs, []string{"/a/f", "/c/g"}, content, 2)
+	checkClean(t, fs)
+
+	// **A write after a snapshot copies the chain, a rollback copies the directories**
+	if err := fs.CreateSnapshot("s1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, fs, "/c/g", "four")
+	checkNames(t, fs, []string{"/a/f", "/c/g"}, content+"four", 2)
+
+	if err := fs.RollbackSnapshot("s1"); err != nil {
+		t.Fatal(err)
+	}
+	content += "five"
+	appendFile(t, fs, "/a/f", "five")
+	checkNames(t, fs, []string{"/a/f", "/c/g"}, content, 2)
+	checkClean(t, fs)
+
+	if err := fs.DeleteSnapshot("s1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// **Names inside a removed tree stop counting, the chain is freed with the last name**
+	if err := fs.Link("/a/f", "/c/h"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RemoveTree("/c"); err != nil {
+		t.Fatal(err)
+	}
+	checkNames(t, fs, []string{"/a/f"}, content, 1)
+	checkClean(t, fs)
+
+	for _, name := range []string{"/a", "/b", "/other"} {
+		if err := fs.RemoveTree(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkClean(t, fs)
+
+	if free, _ := fs.FreeSpace(); free != free_bytes {
+		t.Fatalf("%d bytes free after removing everything, want %d", free, free_bytes)
+	}
+}
+
+func TestHardLinks(t *testing.T) {
+
+	fs, device := newVolume(t, 2)
+	free_bytes, _ := fs.FreeSpace()
+
+	if err := fs.MkdirAll("/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/a/f.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// **Every name counts, a link into a directory keeps the name**
+	if err := fs.Link("/a/f.txt", "/a/b/g.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Link("/a/f.txt", "/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"/a/f.txt", "/a/b/g.txt", "/a/b/f.txt"}
+	checkNames(t, fs, names, "hello", 3)
+	if err := fs.Link("/a/b", "/dir"); !errors.Is(err, ErrIsDir) {
+		t.Fatalf("link of a directory: %v", err)
+	}
+	if err := fs.Link("/a/f.txt", "/a/b/g.txt"); !errors.Is(err, ErrExist) {
+		t.Fatalf("link onto an existing name: %v", err)
+	}
+
+	// **A change through one name is seen through the others**
+	file, err := fs.OpenFile("/a/b/g.txt", os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte(strings.Repeat(" world", 1000))); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	want := "hello" + strings.Repeat(" world", 1000)
+	checkNames(t, fs, names, want, 3)
+	checkClean(t, fs)
+
+	// **The chain is freed with the last name only**
+	if err := fs.Remove("/a/f.txt"); err != nil {
+		t.Fatal(err)
+	}
+	checkNames(t, fs, names[1:], want, 2)
+	if err := fs.Link("/a/b/g.txt", "/keep"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RemoveTree("/a"); err != nil {
+		t.Fatal(err)
+	}
+	checkNames(t, fs, []string{"/keep"}, want, 1)
+	if err := fs.Remove("/keep"); err != nil {
+		t.Fatal(err)
+	}
+	if free, _ := fs.FreeSpace(); free != free_bytes {
+		t.Fatalf("%d bytes free after removing every name, want %d", free, free_bytes)
+	}
+	checkClean(t, fs)
+
+	// **fsck repairs a wrong link count**
+	data := bytes.Repeat([]byte("x"), 5000)
+	if err := fs.WriteFile("/h1", data); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/h2", "/h3"} {
+		if err := fs.Link("/h1", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.changeEntry(fs.rootCluster(), "h3", func(entry *DirectoryEntry) { entry.Links = 7 }); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	if report, _ := fs.Check(false); len(report.Problems) == 0 {
+		t.Fatal("fsck missed the wrong link count")
+	}
+	if _, err := fs.Check(true); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fs)
+
+	// **The counts are on the volume**
+	fs.Close()
+	fs, err = OpenDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	checkNames(t, fs, []string{"/h1", "/h2", "/h3"}, string(data), 3)
+}
+
+func TestSymlinks(t *testing.T) {
+
+	fs, _ := newVolume(t, 2)
+	if err := fs.MkdirAll("/real/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/real/dir/file", []byte("via link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// **Absolute and relative targets are followed, the link itself keeps the target text**
+	if err := fs.Symlink("/real/dir", "/ld"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Symlink("dir/file", "/real/lf"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/ld/file", "/real/lf"} {
+		if data, err := fs.ReadFile(name); err != nil || string(data) != "via link" {
+			t.Fatalf("'%s' reads %q, %v", name, data, err)
+		}
+	}
+	if target, err := fs.Readlink("/real/lf"); err != nil || target != "dir/file" {
+		t.Fatalf("target '%s', %v", target, err)
+	}
+	if _, err := fs.Readlink("/real/dir/file"); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("readlink of a file: %v", err)
+	}
+
+	link, err := fs.Lstat("/ld")
+	if err != nil || !link.IsSymlink() {
+		t.Fatalf("lstat %+v, %v", link, err)
+	}
+	if target, err := fs.Stat("/ld"); err != nil || target.Is_directory != 1 {
+		t.Fatalf("stat %+v, %v", target, err)
+	}
+
+	// **Directories are entered and created through a link**
+	if err := fs.Chdir("/ld"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadFile("file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chdir("/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.MkdirAll("/ld/new/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/real/dir/new/sub"); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := fs.OpenFile("/real/lf", os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("new"))
+	file.Close()
+	if data, err := fs.ReadFile("/ld/file"); err != nil || string(data) != "new" {
+		t.Fatalf("write through a link left %q, %v", data, err)
+	}
+
+	// **Loops end with ErrLoop, a dangling link with ErrNotFound**
+	for _, step := range []error{
+		fs.Symlink("/loop2", "/loop1"),
+		fs.Symlink("/loop1", "/loop2"),
+		fs.Symlink(".", "/self"),
+		fs.Symlink("/nope", "/dangling"),
+	} {
+		if step != nil {
+			t.Fatal(step)
+		}
+	}
+	if _, err := fs.ReadFile("/loop1"); !errors.Is(err, ErrLoop) {
+		t.Fatalf("read through a loop: %v", err)
+	}
+	if _, err := fs.ReadDir("/loop1/x"); !errors.Is(err, ErrLoop) {
+		t.Fatalf("directory through a loop: %v", err)
+	}
+	if _, err := fs.Stat("/self/self/self/real"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/dangling"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("stat of a dangling link: %v", err)
+	}
+	if _, err := fs.Lstat("/dangling"); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fs)
+
+	// **Copies, moves and removals handle the link, not its target**
+	if err := fs.CopyTree("/real", "/copy"); err != nil {
+		t.Fatal(err)
+	}
+	if copied, err := fs.Lstat("/copy/lf"); err != nil || !copied.IsSymlink() || copied.Links != 1 {
+		t.Fatalf("copied link %+v, %v", copied, err)
+	}
+	if err := fs.Remove("/ld"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/real/dir/file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rename("/real/lf", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := fs.Readlink("/moved"); err != nil || target != "dir/file" {
+		t.Fatalf("moved link points to '%s', %v", target, err)
+	}
+	checkClean(t, fs)
+}
@@ -0,0 +1,245 @@
+package pseudofat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Names longer than the Name field are stored VFAT style: a run of long name slots right in front
+// of the entry carries the UTF-8 name while the entry itself holds a short alias that is unique in
+// its directory. A long name slot has the size of a DirectoryEntry and is marked by LONG_NAME_ATTR
+// in the Is_directory byte:
+//
+//	 0  sequence uint8     1 for the first slot, the last one is or-ed with LONG_NAME_LAST
+//	 1  checksum uint8     of the Name field of the entry the run belongs to
+//	 2  name [22]byte      first part of the chunk
+//	24  attribute uint8    LONG_NAME_ATTR
+//	25  name [36]byte      second part of the chunk
+//
+// Every slot carries LONG_NAME_CHUNK bytes of the name, the last one is padded with zeros.
+const (
+	LONG_NAME_ATTR  = 0x0F // Is_directory value of a long name slot
+	LONG_NAME_LAST  = 0x40 // flag in the sequence number of the last slot of a run
+	LONG_NAME_CHUNK = DIR_ENTRY_SIZE - 3
+	ENTRY_ATTR      = MAX_FILE_NAME + 8 + 4 // offset of the Is_directory byte in an encoded slot
+)
+
+// isLongNameSlot reports whether the slot carries part of a long name instead of an entry
+func (entry DirectoryEntry) isLongNameSlot() bool {
+	return entry.Is_directory == LONG_NAME_ATTR
+}
+
+// isUsedEntry reports whether the slot holds a file or a directory
+func isUsedEntry(entry DirectoryEntry) bool {
+	return !IsZeroEntry(entry) && !entry.isLongNameSlot()
+}
+
+// decodeDirectoryEntry reads one slot, long name slots decode like any other entry so they survive a rewrite
+func decodeDirectoryEntry(raw []byte) DirectoryEntry {
+
+	var entry DirectoryEntry
+	copy(entry.Name[:], raw)
+	entry.Size = int64(binary.LittleEndian.Uint64(raw[12:]))
+	entry.First_cluster = int32(binary.LittleEndian.Uint32(raw[20:]))
+	entry.Is_directory = raw[ENTRY_ATTR]
+	entry.Created = int64(binary.LittleEndian.Uint64(raw[25:]))
+	entry.Modified = int64(binary.LittleEndian.Uint64(raw[33:]))
+	entry.Accessed = int64(binary.LittleEndian.Uint64(raw[41:]))
+	entry.Links = binary.LittleEndian.Uint16(raw[49:])
+	entry.Uid = binary.LittleEndian.Uint16(raw[51:])
+	entry.Gid = binary.LittleEndian.Uint16(raw[53:])
+	entry.Mode = binary.LittleEndian.Uint16(raw[55:])
+	entry.Xattr_cluster = int32(binary.LittleEndian.Uint32(raw[57:]))
+
+	return entry
+}
+
+// encode writes the on-disk form of the entry into raw, the long name is not part of it
+func (entry DirectoryEntry) encode(raw []byte) {
+
+	copy(raw, entry.Name[:])
+	binary.LittleEndian.PutUint64(raw[12:], uint64(entry.Size))
+	binary.LittleEndian.PutUint32(raw[20:], uint32(entry.First_cluster))
+	raw[ENTRY_ATTR] = entry.Is_directory
+	binary.LittleEndian.PutUint64(raw[25:], uint64(entry.Created))
+	binary.LittleEndian.PutUint64(raw[33:], uint64(entry.Modified))
+	binary.LittleEndian.PutUint64(raw[41:], uint64(entry.Accessed))
+	binary.LittleEndian.PutUint16(raw[49:], entry.Links)
+	binary.LittleEndian.PutUint16(raw[51:], entry.Uid)
+	binary.LittleEndian.PutUint16(raw[53:], entry.Gid)
+	binary.LittleEndian.PutUint16(raw[55:], entry.Mode)
+	binary.LittleEndian.PutUint32(raw[57:], uint32(entry.Xattr_cluster))
+}
+
+// nameChecksum ties the long name slots to the short name of their entry
+func nameChecksum(name [MAX_FILE_NAME]byte) uint8 {
+
+	var sum uint8
+	for _, b := range name {
+		sum = (sum>>1 | sum<<7) + b
+	}
+
+	return sum
+}
+
+// longNameSlots returns the slots that go in front of the entry, none for an entry without a long name
+func longNameSlots(entry DirectoryEntry) []DirectoryEntry {
+
+	count := (len(entry.long_name) + LONG_NAME_CHUNK - 1) / LONG_NAME_CHUNK
+	checksum := nameChecksum(entry.Name)
+
+	slots := make([]DirectoryEntry, count)
+	for i := range slots {
+
+		chunk := make([]byte, LONG_NAME_CHUNK)
+		copy(chunk, entry.long_name[i*LONG_NAME_CHUNK:])
+
+		raw := make([]byte, DIR_ENTRY_SIZE)
+		raw[0] = uint8(i + 1)
+		if i == count-1 {
+			raw[0] |= LONG_NAME_LAST
+		}
+		raw[1] = checksum
+		copy(raw[2:ENTRY_ATTR], chunk)
+		raw[ENTRY_ATTR] = LONG_NAME_ATTR
+		copy(raw[ENTRY_ATTR+1:], chunk[ENTRY_ATTR-2:])
+
+		slots[i] = decodeDirectoryEntry(raw)
+	}
+
+	return slots
+}
+
+// longNameRun returns the long name of the entry at index together with the index of its first
+// slot, a run that is broken or belongs to another entry is ignored
+func longNameRun(dir_entries []DirectoryEntry, index int) (string, int) {
+
+	checksum := nameChecksum(dir_entries[index].Name)
+	raw := make([]byte, DIR_ENTRY_SIZE)
+
+	var name []byte
+	count := 0
+	for i := index - 1; i >= 0 && dir_entries[i].isLongNameSlot(); i-- {
+
+		dir_entries[i].encode(raw)
+
+		// **The slot next to the entry is the last one, from there the sequence counts down to 1**
+		sequence, is_last := int(raw[0]&^LONG_NAME_LAST), raw[0]&LONG_NAME_LAST != 0
+		if i == index-1 {
+			count = sequence
+		}
+		if raw[1] != checksum || is_last != (i == index-1) || sequence != count-(index-1-i) || sequence == 0 {
+			break
+		}
+
+		chunk := append(append([]byte{}, raw[2:ENTRY_ATTR]...), raw[ENTRY_ATTR+1:]...)
+		name = append(chunk, name...)
+
+		if sequence == 1 {
+			long_name := strings.TrimRight(string(name), "\x00")
+			if long_name == "" || !utf8.ValidString(long_name) {
+				break
+			}
+			return long_name, i
+		}
+	}
+
+	return "", index
+}
+
+// attachLongNames gives every entry of a directory the long name stored in front of it
+func attachLongNames(dir_entries []DirectoryEntry) {
+
+	for i := range dir_entries {
+		if isUsedEntry(dir_entries[i]) {
+			dir_entries[i].long_name, _ = longNameRun(dir_entries, i)
+		}
+	}
+}
+
+// setEntryName names a new or renamed entry of the directory at dir_cluster. A name that is
+// not a valid 8.3 name becomes a long name with an alias unique in that directory.
+func (fs *FileSystem) setEntryName(dir_cluster int32, entry *DirectoryEntry, name string) error {
+
+	name, err := validateName(name)
+	if err != nil {
+		return err
+	}
+
+	entry.Name = [MAX_FILE_NAME]byte{}
+	entry.long_name = ""
+
+	if isShortName(name) {
+		copy(entry.Name[:], name)
+		return nil
+	}
+
+	alias, err := fs.shortAlias(dir_cluster, name)
+	if err != nil {
+		return err
+	}
+
+	copy(entry.Name[:], alias)
+	entry.long_name = name
+	return nil
+}
+
+// shortAlias derives a BASE~N.EXT name from a long name, N is the first number no entry of the directory uses
+func (fs *FileSystem) shortAlias(dir_cluster int32, name string) (string, error) {
+
+	base, ext := name, ""
+	if dot := strings.LastIndex(name, "."); dot > 0 {
+		base, ext = name[:dot], name[dot+1:]
+	}
+
+	base, ext = aliasPart(base), aliasPart(ext)
+	if base == "" {
+		base = "_"
+	}
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	if ext != "" {
+		ext = "." + ext
+	}
+
+	dir_entries, err := fs.readDirectoryEntries(dir_cluster)
+	if err != nil {
+		return "", err
+	}
+
+	for n := 1; n < 1000000; n++ {
+
+		suffix := fmt.Sprintf("~%d", n)
+		alias := base[:min(len(base), 8-len(suffix))] + suffix + ext
+
+		taken := false
+		for _, entry := range dir_entries {
+			if isUsedEntry(entry) && fs.matchesName(entry, alias) {
+				taken = true
+				break
+			}
+		}
+
+		if !taken {
+			return alias, nil
+		}
+	}
+
+	return "", fmt.Errorf("no free short alias for '%s': %w", name, ErrExist)
+}
+
+// aliasPart keeps the upper-cased ASCII letters and digits of a name part
+func aliasPart(part string) string {
+
+	var alias strings.Builder
+	for _, r := range strings.ToUpper(part) {
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			alias.WriteRune(r)
+		}
+	}
+
+	return alias.String()
+}
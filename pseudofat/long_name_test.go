@@ -0,0 +1,155 @@
+package pseudofat
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestLongNames(t *testing.T) {
+
+	device := NewMemoryDevice(0)
+	fs, err := FormatDevice(device, 2, MIN_CLUSTER_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// **A long name gets a short alias that finds the same file**
+	report := "a very long descriptive name for the quarterly report.final.txt"
+	if err := fs.WriteFile("/"+report, []byte("txt")); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := fs.Stat("/" + report)
+	if err != nil || entry.FileName() != report {
+		t.Fatalf("'%s', %v", entry.FileName(), err)
+	}
+	if data, err := fs.ReadFile("/" + entry.ShortName()); err != nil || string(data) != "txt" {
+		t.Fatalf("alias '%s' reads %q, %v", entry.ShortName(), data, err)
+	}
+
+	// **Names that share their beginning get different aliases**
+	other := strings.TrimSuffix(report, ".txt") + ".doc"
+	if err := fs.WriteFile("/"+other, []byte("doc")); err != nil {
+		t.Fatal(err)
+	}
+	if other_entry, _ := fs.Stat("/" + other); other_entry.ShortName() == entry.ShortName() {
+		t.Fatalf("'%s' and '%s' share the alias '%s'", report, other, entry.ShortName())
+	}
+
+	// **UTF-8 names of up to 255 bytes are kept, a longer one is refused**
+	longest := strings.Repeat("é", 127) + "z"
+	if len(longest) != 255 {
+		t.Fatalf("name of %d bytes", len(longest))
+	}
+	if err := fs.MkdirAll("/" + longest + "/sub/" + report); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/"+longest+"zz", nil); !errors.Is(err, ErrNameTooLong) {
+		t.Fatalf("name of 257 bytes: %v", err)
+	}
+	if err := fs.Mkdir("/" + longest + "zz"); !errors.Is(err, ErrNameTooLong) {
+		t.Fatalf("directory name of 257 bytes: %v", err)
+	}
+
+	// **Long names in a directory spread over several clusters survive copies, moves and removals**
+	for i := range 30 {
+		name := fmt.Sprintf("/%s/file number %d with a long name", longest, i)
+		if err := fs.WriteFile(name, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.CopyTree("/"+longest, "/copy of the long directory"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rename("/"+report, "/short"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rename("/short", "/"+longest+"/sub/back to a long name again"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i += 2 {
+		if err := fs.Remove(fmt.Sprintf("/%s/file number %d with a long name", longest, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Chdir("/" + longest + "/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.ReadFile("back to a long name again"); err != nil || string(data) != "txt" {
+		t.Fatalf("moved file reads %q, %v", data, err)
+	}
+	if err := fs.Chdir("/"); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fs)
+	before := treeState(t, fs, "/")
+
+	// **The names come back after a remount, a defrag and a rollback**
+	fs.Close()
+	fs, err = OpenDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if got := treeState(t, fs, "/"); !maps.Equal(got, before) {
+		t.Fatalf("tree %v after remount, want %v", got, before)
+	}
+
+	if _, err := fs.Defrag("/", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RemoveTree("/" + longest); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RollbackSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if got := treeState(t, fs, "/"); !maps.Equal(got, before) {
+		t.Fatalf("tree %v after defrag and rollback, want %v", got, before)
+	}
+	checkClean(t, fs)
+}
+
+func TestLongNameOrphanSlot(t *testing.T) {
+
+	fs, _ := newVolume(t, 1)
+	if err := fs.WriteFile("/a file with a long name", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	// **A long name slot whose entry is gone is reported and cleared by fsck**
+	chain, dir_entries, err := fs.readDirectory(fs.rootCluster())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range dir_entries {
+		if IsZeroEntry(dir_entries[i]) {
+			dir_entries[i] = longNameSlots(DirectoryEntry{long_name: "orphan name here"})[0]
+			if err := fs.writeDirectorySlot(chain, dir_entries, i); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if err := fs.commit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := fs.Check(false)
+	if err != nil || len(report.Problems) != 1 {
+		t.Fatal("fsck found", report.Problems, err)
+	}
+	if _, err := fs.Check(true); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fs)
+
+	if data, err := fs.ReadFile("/a file with a long name"); err != nil || string(data) != "data" {
+		t.Fatalf("repair lost the long name, read %q, %v", data, err)
+	}
+}
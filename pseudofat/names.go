@@ -0,0 +1,207 @@
+package pseudofat
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Every name that ends up in a directory entry goes through validateName. Names are stored in
+// Unicode NFC so canonically equivalent spellings collide, and lookups normalize the name they
+// look for the same way. A name that is a valid 8.3 name is stored in the entry itself with its
+// case preserved, any other valid name gets long name slots and a short alias, see long_name.go.
+const (
+	RESERVED_CHARS   = "/\\:*?\"<>|"      // never allowed in a name
+	SHORT_NAME_CHARS = "!#$%&'()-@^_`{}~" // allowed in 8.3 names besides letters and digits
+	SHORT_NAME_BASE  = 8
+	SHORT_NAME_EXT   = 3
+)
+
+// RESERVED_NAMES are device names that cannot be used as a name, with or without an extension
+var RESERVED_NAMES = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// validateName checks a name for a new or renamed entry and returns it in NFC
+func validateName(name string) (string, error) {
+
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("file name is not valid UTF-8: %w", ErrInvalid)
+	}
+
+	name = norm.NFC.String(name)
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid file name '%s': %w", name, ErrInvalid)
+	}
+
+	if len(name) > MAX_LONG_NAME {
+		return "", ErrNameTooLong
+	}
+
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(RESERVED_CHARS, r) {
+			return "", fmt.Errorf("file name '%s' contains reserved character %q: %w", name, r, ErrInvalid)
+		}
+	}
+
+	// **Trailing dots and spaces would be lost by the 8.3 alias and are confusing anyway**
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return "", fmt.Errorf("file name '%s' ends with a dot or a space: %w", name, ErrInvalid)
+	}
+
+	base, _, _ := strings.Cut(name, ".")
+	for _, reserved := range RESERVED_NAMES {
+		if strings.EqualFold(base, reserved) {
+			return "", fmt.Errorf("file name '%s' is reserved: %w", name, ErrInvalid)
+		}
+	}
+
+	return name, nil
+}
+
+// isShortName reports whether the name follows the 8.3 rules: a base of 1 to 8 and an optional
+// extension of 1 to 3 characters, both made of letters, digits and SHORT_NAME_CHARS
+func isShortName(name string) bool {
+
+	base, ext, has_ext := strings.Cut(name, ".")
+	if base == "" || len(base) > SHORT_NAME_BASE || len(ext) > SHORT_NAME_EXT || has_ext && ext == "" {
+		return false
+	}
+
+	for _, r := range base + ext {
+		if !isShortNameChar(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isShortNameChar(r rune) bool {
+	return r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune(SHORT_NAME_CHARS, r)
+}
+
+// caseInsensitive reports whether names on the volume match regardless of case
+func (fs *FileSystem) caseInsensitive() bool {
+	return fs.fs_format.flags&FLAG_CASE_INSENSITIVE != 0
+}
+
+// nameKey returns the form of a name that lookups compare
+func (fs *FileSystem) nameKey(name string) string {
+
+	if !norm.NFC.IsNormalString(name) {
+		name = norm.NFC.String(name)
+	}
+
+	if fs.caseInsensitive() {
+		return cases.Fold().String(name)
+	}
+
+	return name
+}
+
+// matchesName reports whether the entry is called name, by its long or its short name
+func (fs *FileSystem) matchesName(entry DirectoryEntry, name string) bool {
+
+	// **Names on the volume are NFC already, the exact match needs no work**
+	if entry.hasName(name) {
+		return true
+	}
+
+	key := fs.nameKey(name)
+	return fs.nameKey(entry.FileName()) == key || fs.nameKey(entry.ShortName()) == key
+}
+
+// CaseInsensitive reports whether the volume matches names regardless of case
+func (fs *FileSystem) CaseInsensitive() bool {
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.caseInsensitive()
+}
+
+// SetCaseInsensitive switches between exact and case-insensitive, case-preserving lookup. Switching
+// it on fails with ErrExist while a directory holds names that differ only in case.
+func (fs *FileSystem) SetCaseInsensitive(on bool) error {
+
+	fs.session.lock()
+	defer fs.mu.Unlock()
+
+	// **The flag lives in memory as well, it follows the superblock when the commit is lost**
+	old_flags := fs.fs_format.flags
+	err := fs.commit(fs.setCaseInsensitive(on))
+	if err != nil && !fs.journal.committed {
+		fs.fs_format.flags = old_flags
+	}
+
+	return err
+}
+
+func (fs *FileSystem) setCaseInsensitive(on bool) error {
+
+	err := fs.requireRoot()
+	if err != nil {
+		return err
+	}
+
+	old_flags := fs.fs_format.flags
+	if on {
+		fs.fs_format.flags |= FLAG_CASE_INSENSITIVE
+	} else {
+		fs.fs_format.flags &^= FLAG_CASE_INSENSITIVE
+	}
+
+	if fs.fs_format.flags == old_flags {
+		return nil
+	}
+
+	// **Names that only differ in case would become ambiguous**
+	err = fs.checkNameCollisions(fs.rootDirectory(), "/")
+	if err != nil {
+		return err
+	}
+
+	return fs.stageBytes(fs.encodeFormat(), 0)
+}
+
+// checkNameCollisions walks the tree below the directory and fails on two entries with the same lookup key
+func (fs *FileSystem) checkNameCollisions(dir_cluster int32, dir_path string) error {
+
+	dir_entries, err := fs.readDirectoryEntries(dir_cluster)
+	if err != nil {
+		return err
+	}
+
+	names := map[string]string{}
+	for _, entry := range dir_entries[2:] {
+
+		if !isUsedEntry(entry) {
+			continue
+		}
+
+		for _, name := range []string{entry.FileName(), entry.ShortName()} {
+
+			key := fs.nameKey(name)
+			if other, ok := names[key]; ok && other != entry.FileName() {
+				return fmt.Errorf("'%s' and '%s' in '%s' differ only in case: %w", other, entry.FileName(), dir_path, ErrExist)
+			}
+			names[key] = entry.FileName()
+		}
+
+		if entry.Is_directory == 1 {
+			err = fs.checkNameCollisions(entry.First_cluster, path.Join(dir_path, entry.FileName()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
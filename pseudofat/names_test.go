@@ -0,0 +1,176 @@
+package pseudofat
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		want  error
+		short bool
+	}{
+		{"README.TXT", nil, true},
+		{"readme.txt", nil, true},
+		{"x-y_z.c", nil, true},
+		{"A~1", nil, true},
+		{"abcdefghi", nil, false},
+		{"a.b.c", nil, false},
+		{"x.abcd", nil, false},
+		{"with space", nil, false},
+		{"Žluťoučký", nil, false},
+		{"", ErrInvalid, false},
+		{".", ErrInvalid, false},
+		{"..", ErrInvalid, false},
+		{"a/b", ErrInvalid, false},
+		{"a:b", ErrInvalid, false},
+		{"a*b", ErrInvalid, false},
+		{"a\\b", ErrInvalid, false},
+		{"a|b", ErrInvalid, false},
+		{"q?", ErrInvalid, false},
+		{"nul\x00", ErrInvalid, false},
+		{"a\x01", ErrInvalid, false},
+		{"x.", ErrInvalid, false},
+		{"x ", ErrInvalid, false},
+		{"con", ErrInvalid, false},
+		{"CON.txt", ErrInvalid, false},
+		{"lpt1.x", ErrInvalid, false},
+		{"console", nil, true},
+		{"\xff", ErrInvalid, false},
+		{strings.Repeat("n", MAX_LONG_NAME), nil, false},
+		{strings.Repeat("n", MAX_LONG_NAME+1), ErrNameTooLong, false},
+	}
+
+	for _, test := range tests {
+		got, err := validateName(test.name)
+		if !errors.Is(err, test.want) {
+			t.Errorf("validateName(%q): %v, want %v", test.name, err, test.want)
+			continue
+		}
+		if err == nil && isShortName(got) != test.short {
+			t.Errorf("isShortName(%q) is %v, want %v", got, !test.short, test.short)
+		}
+	}
+
+	// **Canonically equivalent spellings validate to the same NFC name**
+	composed, _ := validateName("café")
+	decomposed, _ := validateName("cafe\u0301")
+	if composed != decomposed {
+		t.Fatalf("%q and %q differ after validation", composed, decomposed)
+	}
+}
+
+func TestNames(t *testing.T) {
+
+	fs, _ := newVolume(t, 1)
+
+	// **Every operation that creates or renames an entry refuses an invalid name**
+	if err := fs.WriteFile("/f", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a:b", "a\x01", "CON.txt", "x."} {
+		steps := []struct {
+			name string
+			run  func() error
+		}{
+			{"write", func() error { return fs.WriteFile("/"+name, nil) }},
+			{"mkdir", func() error { return fs.Mkdir("/" + name) }},
+			{"copy", func() error { return fs.Copy("/f", "/"+name) }},
+			{"rename", func() error { return fs.Rename("/f", "/"+name) }},
+		}
+		for _, step := range steps {
+			if err := step.run(); !errors.Is(err, ErrInvalid) {
+				t.Errorf("%s of %q: %v", step.name, name, err)
+			}
+		}
+	}
+
+	// **8.3 names are stored in the entry with their case, others in long name slots**
+	for _, name := range []string{"README.TXT", "readme.txt", "abcdefghi", "Žluťoučký"} {
+		if err := fs.WriteFile("/"+name, []byte(name)); err != nil {
+			t.Fatal(name, err)
+		}
+		entry, err := fs.Stat("/" + name)
+		if err != nil || entry.FileName() != name || (entry.long_name == "") != isShortName(name) {
+			t.Fatalf("'%s' stored as '%s' with long name '%s', %v", name, entry.FileName(), entry.long_name, err)
+		}
+	}
+
+	// **Equivalent spellings are the same name**
+	if err := fs.WriteFile("/café", []byte("composed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/cafe\u0301", nil); !errors.Is(err, ErrExist) {
+		t.Fatalf("decomposed duplicate: %v", err)
+	}
+	if data, err := fs.ReadFile("/cafe\u0301"); err != nil || string(data) != "composed" {
+		t.Fatalf("decomposed lookup reads %q, %v", data, err)
+	}
+	checkClean(t, fs)
+}
+
+func TestCaseInsensitive(t *testing.T) {
+
+	fs, device := newVolume(t, 1)
+	for _, name := range []string{"README.TXT", "readme.txt", "Žluťoučký"} {
+		if err := fs.WriteFile("/"+name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// **Names that differ only in case keep the volume case sensitive**
+	if err := fs.SetCaseInsensitive(true); !errors.Is(err, ErrExist) {
+		t.Fatalf("switch with colliding names: %v", err)
+	}
+	if fs.CaseInsensitive() {
+		t.Fatal("the refused switch was kept")
+	}
+	if _, err := fs.Stat("/ReadMe.Txt"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("case sensitive lookup: %v", err)
+	}
+
+	if err := fs.Remove("/readme.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetCaseInsensitive(true); err != nil {
+		t.Fatal(err)
+	}
+
+	// **Lookups ignore case, the stored names keep it**
+	if data, err := fs.ReadFile("/ReadMe.Txt"); err != nil || string(data) != "README.TXT" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	if data, err := fs.ReadFile("/ŽLUŤOUČKÝ"); err != nil || string(data) != "Žluťoučký" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	if err := fs.WriteFile("/readme.TXT", nil); !errors.Is(err, ErrExist) {
+		t.Fatalf("write of a name differing in case: %v", err)
+	}
+	if err := fs.Rename("/README.TXT", "/ReadMe.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := fs.Stat("/readme.txt"); entry.FileName() != "ReadMe.txt" {
+		t.Fatalf("rename to another case stored '%s'", entry.FileName())
+	}
+	checkClean(t, fs)
+
+	// **The mode is part of the superblock**
+	fs.Close()
+	fs, err := OpenDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if !fs.CaseInsensitive() {
+		t.Fatal("case-insensitive mode lost on remount")
+	}
+	if err := fs.SetCaseInsensitive(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/README.TXT"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("lookup after switching back: %v", err)
+	}
+}
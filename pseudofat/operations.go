@@ -0,0 +1,204 @@
+package pseudofat
+
+import "time"
+
+// The path methods of FileSystem work in the default session, use NewSession
+// when several users need their own working directories
+
+// Mkdir creates a new empty directory
+func (fs *FileSystem) Mkdir(dir_path string) error {
+	return fs.session.Mkdir(dir_path)
+}
+
+// MkdirAll creates a directory together with every missing parent
+func (fs *FileSystem) MkdirAll(dir_path string) error {
+	return fs.session.MkdirAll(dir_path)
+}
+
+// Remove deletes a file or an empty directory
+func (fs *FileSystem) Remove(file_path string) error {
+	return fs.session.Remove(file_path)
+}
+
+// RemoveTree deletes a file or a directory together with everything below it
+func (fs *FileSystem) RemoveTree(file_path string) error {
+	return fs.session.RemoveTree(file_path)
+}
+
+// Stat returns the directory entry describing the given path
+func (fs *FileSystem) Stat(file_path string) (DirectoryEntry, error) {
+	return fs.session.Stat(file_path)
+}
+
+// ReadFile returns the whole contents of a file
+func (fs *FileSystem) ReadFile(file_path string) ([]byte, error) {
+	return fs.session.ReadFile(file_path)
+}
+
+// WriteFile creates a new file holding data, the destination must not exist yet
+func (fs *FileSystem) WriteFile(file_path string, data []byte) error {
+	return fs.session.WriteFile(file_path, data)
+}
+
+// ImportFile creates a new file with its modification time and extended attributes in one step
+func (fs *FileSystem) ImportFile(file_path string, data []byte, mtime time.Time, attrs map[string][]byte) error {
+	return fs.session.ImportFile(file_path, data, mtime, attrs)
+}
+
+// Copy duplicates a file under a new name
+func (fs *FileSystem) Copy(src, dest string) error {
+	return fs.session.Copy(src, dest)
+}
+
+// CopyTree duplicates a file or a whole directory tree under a new name
+func (fs *FileSystem) CopyTree(src, dest string) error {
+	return fs.session.CopyTree(src, dest)
+}
+
+// Rename moves a file or a directory to a new name or into an existing directory
+func (fs *FileSystem) Rename(src, dest string) error {
+	return fs.session.Rename(src, dest)
+}
+
+// Lstat describes the given path without following a symbolic link
+func (fs *FileSystem) Lstat(file_path string) (DirectoryEntry, error) {
+	return fs.session.Lstat(file_path)
+}
+
+// Link gives the file src another name
+func (fs *FileSystem) Link(src, dest string) error {
+	return fs.session.Link(src, dest)
+}
+
+// Symlink creates a symbolic link at dest pointing to target
+func (fs *FileSystem) Symlink(target, dest string) error {
+	return fs.session.Symlink(target, dest)
+}
+
+// Readlink returns the target of a symbolic link
+func (fs *FileSystem) Readlink(file_path string) (string, error) {
+	return fs.session.Readlink(file_path)
+}
+
+// Chtimes changes the access and modification time of a file or a directory
+func (fs *FileSystem) Chtimes(file_path string, atime, mtime time.Time) error {
+	return fs.session.Chtimes(file_path, atime, mtime)
+}
+
+// Chmod sets the permission bits of a file or a directory
+func (fs *FileSystem) Chmod(file_path string, mode uint16) error {
+	return fs.session.Chmod(file_path, mode)
+}
+
+// Chown gives a file or a directory to another user and group
+func (fs *FileSystem) Chown(file_path, user, group string) error {
+	return fs.session.Chown(file_path, user, group)
+}
+
+// Listxattr returns the names of the extended attributes of a file or a directory
+func (fs *FileSystem) Listxattr(file_path string) ([]string, error) {
+	return fs.session.Listxattr(file_path)
+}
+
+// Getxattr returns the value of an extended attribute
+func (fs *FileSystem) Getxattr(file_path, name string) ([]byte, error) {
+	return fs.session.Getxattr(file_path, name)
+}
+
+// Setxattr creates or replaces an extended attribute
+func (fs *FileSystem) Setxattr(file_path, name string, value []byte) error {
+	return fs.session.Setxattr(file_path, name, value)
+}
+
+// Removexattr deletes an extended attribute
+func (fs *FileSystem) Removexattr(file_path, name string) error {
+	return fs.session.Removexattr(file_path, name)
+}
+
+// SetUserQuota limits the clusters and entries a user owns, 0 means no limit
+func (fs *FileSystem) SetUserQuota(user string, max_clusters, max_entries int) error {
+	return fs.session.SetUserQuota(user, max_clusters, max_entries)
+}
+
+// SetDirQuota limits the clusters and entries below a directory, 0 means no limit
+func (fs *FileSystem) SetDirQuota(dir_path string, max_clusters, max_entries int) error {
+	return fs.session.SetDirQuota(dir_path, max_clusters, max_entries)
+}
+
+// UserQuota returns the quota and the usage of a user, an empty name means the current user
+func (fs *FileSystem) UserQuota(user string) (QuotaInfo, error) {
+	return fs.session.UserQuota(user)
+}
+
+// DirQuota returns the quota and the usage of a directory tree
+func (fs *FileSystem) DirQuota(dir_path string) (QuotaInfo, error) {
+	return fs.session.DirQuota(dir_path)
+}
+
+// Login switches the default session to another user
+func (fs *FileSystem) Login(name, password string) error {
+	return fs.session.Login(name, password)
+}
+
+// Passwd changes the password of a user
+func (fs *FileSystem) Passwd(name, password string) error {
+	return fs.session.Passwd(name, password)
+}
+
+// User returns the names of the user and the group the default session acts for
+func (fs *FileSystem) User() (string, string) {
+	return fs.session.User()
+}
+
+// ReadDir lists the used entries of a directory, an empty path lists the current directory
+func (fs *FileSystem) ReadDir(dir_path string) ([]DirectoryEntry, error) {
+	return fs.session.ReadDir(dir_path)
+}
+
+// Chdir changes the current working directory
+func (fs *FileSystem) Chdir(dir_path string) error {
+	return fs.session.Chdir(dir_path)
+}
+
+// Getwd returns the current working directory
+func (fs *FileSystem) Getwd() string {
+	return fs.session.Getwd()
+}
+
+// OpenFile opens a file in the default session, see Session.OpenFile
+func (fs *FileSystem) OpenFile(file_path string, flag int) (*File, error) {
+	return fs.session.OpenFile(file_path, flag)
+}
+
+// ClusterChain returns the clusters occupied by the given entry in FAT order
+func (fs *FileSystem) ClusterChain(file_path string) ([]int32, error) {
+	return fs.session.ClusterChain(file_path)
+}
+
+// MarkBad marks the first cluster of a file as bad, used to simulate corruption
+func (fs *FileSystem) MarkBad(file_path string) error {
+	return fs.session.MarkBad(file_path)
+}
+
+// Defrag makes every chain under target contiguous, see Session.Defrag
+func (fs *FileSystem) Defrag(target string, dry_run bool) (DefragReport, error) {
+	return fs.session.Defrag(target, dry_run)
+}
+
+// BadClusters lists clusters marked as bad in either FAT table
+func (fs *FileSystem) BadClusters() ([]int32, error) {
+
+	fat1, fat2, err := fs.ReadFAT()
+	if err != nil {
+		return nil, err
+	}
+
+	var bad_clusters []int32
+	for i := 0; i < len(fat1); i++ {
+		if fat1[i] == FAT_BAD || fat2[i] == FAT_BAD {
+			bad_clusters = append(bad_clusters, int32(i))
+		}
+	}
+
+	return bad_clusters, nil
+}
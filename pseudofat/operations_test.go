@@ -0,0 +1,220 @@
+package pseudofat
+
+import (
+	"errors"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestVolumeRoundTrip(t *testing.T) {
+
+	image := filepath.Join(t.TempDir(), "volume.dat")
+	if err := Format(image, 2, CLUSTER_SIZE); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// **The operations of the shell are plain methods of the library**
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"mkdir", func() error { return fs.Mkdir("/docs") }},
+		{"write", func() error { return fs.WriteFile("/docs/a.txt", []byte("alpha")) }},
+		{"write", func() error { return fs.WriteFile("/b.txt", []byte("beta")) }},
+		{"copy", func() error { return fs.Copy("/b.txt", "/docs/c.txt") }},
+		{"rename", func() error { return fs.Rename("/b.txt", "/docs/b.txt") }},
+		{"chdir", func() error { return fs.Chdir("/docs") }},
+		{"remove", func() error { return fs.Remove("a.txt") }},
+	}
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			t.Fatal(step.name, err)
+		}
+	}
+
+	want := map[string]string{
+		"/docs":       "dir",
+		"/docs/b.txt": "beta",
+		"/docs/c.txt": "beta",
+	}
+	if got := treeState(t, fs, "/"); !maps.Equal(got, want) {
+		t.Fatalf("tree %v, want %v", got, want)
+	}
+	if fs.Getwd() != "/docs" {
+		t.Fatalf("working directory '%s', want '/docs'", fs.Getwd())
+	}
+	checkClean(t, fs)
+
+	// **Everything is on the image once the volume is closed**
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err = Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	if got := treeState(t, fs, "/"); !maps.Equal(got, want) {
+		t.Fatalf("tree %v after reopening, want %v", got, want)
+	}
+	checkClean(t, fs)
+}
+
+func TestRecursiveOperations(t *testing.T) {
+
+	fs, _ := newVolume(t, 2)
+	free_bytes, _ := fs.FreeSpace()
+
+	// **MkdirAll creates the missing parents and accepts existing ones**
+	if err := fs.MkdirAll("/src/a/b/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.MkdirAll("/src/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/src/file", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.MkdirAll("/src/file/x"); !errors.Is(err, ErrNotDir) {
+		t.Fatalf("mkdir below a file: %v", err)
+	}
+
+	files := map[string]string{
+		"/src/a/one":      "one",
+		"/src/a/b/two":    strings.Repeat("2", 3000),
+		"/src/a/b/c/tree": "three",
+	}
+	for name, data := range files {
+		if err := fs.WriteFile(name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// **CopyTree duplicates the structure with its own '.' and '..' entries**
+	if err := fs.CopyTree("/src", "/dst"); err != nil {
+		t.Fatal(err)
+	}
+	src, dst := treeState(t, fs, "/src"), treeState(t, fs, "/dst")
+	if len(src) != len(dst) {
+		t.Fatalf("copy holds %d paths, want %d", len(dst), len(src))
+	}
+	for name, data := range src {
+		if dst["/dst"+strings.TrimPrefix(name, "/src")] != data {
+			t.Fatalf("'%s' was not copied", name)
+		}
+	}
+	if err := fs.Chdir("/dst/a/b/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chdir("../.."); err != nil || fs.Getwd() != "/dst/a" {
+		t.Fatalf("'..' of the copy leads to %s, %v", fs.Getwd(), err)
+	}
+	if err := fs.Chdir("/"); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fs)
+
+	// **A copy into itself or one that does not fit is refused before anything is written**
+	if err := fs.CopyTree("/src", "/src/a/inside"); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("copy into itself: %v", err)
+	}
+	free, _ := fs.FreeSpace()
+	if err := fs.WriteFile("/filler", make([]byte, free-3*CLUSTER_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CopyTree("/src", "/full"); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("copy larger than the free space: %v", err)
+	}
+	if _, err := fs.Stat("/full"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("refused copy left '/full': %v", err)
+	}
+	checkClean(t, fs)
+
+	// **RemoveTree frees every cluster of the subtree**
+	for _, name := range []string{"/filler", "/src", "/dst"} {
+		if err := fs.RemoveTree(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if free, _ := fs.FreeSpace(); free != free_bytes {
+		t.Fatalf("%d bytes free after removing everything, want %d", free, free_bytes)
+	}
+	checkClean(t, fs)
+}
+
+func TestRename(t *testing.T) {
+
+	fs, _ := newVolume(t, 2)
+	for _, step := range []error{
+		fs.MkdirAll("/a/sub"),
+		fs.Mkdir("/b"),
+		fs.WriteFile("/a/file", []byte(strings.Repeat("f", 3000))),
+		fs.WriteFile("/a/sub/inner", []byte("inner")),
+		fs.WriteFile("/b/taken", nil),
+	} {
+		if step != nil {
+			t.Fatal(step)
+		}
+	}
+
+	file_chain, _ := fs.ClusterChain("/a/file")
+	dir_chain, _ := fs.ClusterChain("/a/sub")
+	free_bytes, _ := fs.FreeSpace()
+
+	// **Moves relink the entries, the chains and the free space stay as they are**
+	if err := fs.Rename("/a/file", "/b/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rename("/a/sub", "/b/sub"); err != nil {
+		t.Fatal(err)
+	}
+
+	if chain, _ := fs.ClusterChain("/b/moved"); !slices.Equal(chain, file_chain) {
+		t.Fatalf("moved file has chain %v, want %v", chain, file_chain)
+	}
+	if chain, _ := fs.ClusterChain("/b/sub"); !slices.Equal(chain, dir_chain) {
+		t.Fatalf("moved directory has chain %v, want %v", chain, dir_chain)
+	}
+	if free, _ := fs.FreeSpace(); free != free_bytes {
+		t.Fatalf("%d bytes free after the moves, want %d", free, free_bytes)
+	}
+
+	// **The moved directory names its new parent in '..'**
+	if err := fs.Chdir("/b/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chdir(".."); err != nil || fs.Getwd() != "/b" {
+		t.Fatalf("'..' of the moved directory leads to %s, %v", fs.Getwd(), err)
+	}
+	if data, err := fs.ReadFile("sub/inner"); err != nil || string(data) != "inner" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	checkClean(t, fs)
+
+	tests := []struct {
+		name     string
+		src, dst string
+		want     error
+	}{
+		{"into itself", "/b", "/b/sub/b", ErrInvalid},
+		{"onto an existing name", "/b/moved", "/b/taken", ErrExist},
+		{"missing source", "/a/file", "/a/again", ErrNotFound},
+		{"into a missing directory", "/b/moved", "/nodir/moved", ErrPathNotFound},
+	}
+	for _, test := range tests {
+		if err := fs.Rename(test.src, test.dst); !errors.Is(err, test.want) {
+			t.Errorf("%s: %v, want %v", test.name, err, test.want)
+		}
+	}
+	checkClean(t, fs)
+}
@@ -0,0 +1,571 @@
+package pseudofat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// A quota limits the clusters and the directory entries either of one user or of a directory with
+// everything below it. The quota table is a chain whose first cluster is kept in the header cluster
+// at QUOTAS_OFFSET, 0 without quotas. Usage is not stored, it is counted by walking the tree the first
+// time an operation that allocates needs it and kept in memory. Charges for new data add to the kept
+// usage, everything that releases or moves entries drops it and the next charge counts it again. A
+// user is charged for the entries and the chains it owns, a directory for everything below it and
+// for its own chain. A file with several names is counted once.
+const (
+	QUOTAS_OFFSET = USERS_OFFSET + 4 // first cluster of the quota table, 0 without quotas
+
+	QUOTA_USER = 1
+	QUOTA_DIR  = 2
+)
+
+// quotaEntry is one record of the quota table, a record without a kind ends the table
+type quotaEntry struct {
+	Kind         uint8  // QUOTA_USER or QUOTA_DIR
+	Uid          uint16 // user of a user quota
+	Dir          int32  // first cluster of the directory of a directory quota
+	Max_clusters int32  // 0 for no limit
+	Max_entries  int32  // 0 for no limit
+}
+
+// QuotaInfo describes a quota together with the usage it limits
+type QuotaInfo struct {
+	User        string // user of a user quota, empty for a directory quota
+	Path        string // directory of a directory quota, empty for a user quota
+	Clusters    int    // clusters in use
+	Entries     int    // directory entries in use
+	MaxClusters int    // 0 for no limit
+	MaxEntries  int    // 0 for no limit
+}
+
+// quotaUsage counts clusters and directory entries
+type quotaUsage struct {
+	clusters int
+	entries  int
+}
+
+func (usage *quotaUsage) add(other quotaUsage) {
+	usage.clusters += other.clusters
+	usage.entries += other.entries
+}
+
+// exceeds reports whether adding to the usage goes over the limits of the quota, only what grows is checked
+func (quota quotaEntry) exceeds(used, added quotaUsage) bool {
+	return added.clusters > 0 && quota.Max_clusters > 0 && used.clusters+added.clusters > int(quota.Max_clusters) ||
+		added.entries > 0 && quota.Max_entries > 0 && used.entries+added.entries > int(quota.Max_entries)
+}
+
+// readQuotaTable returns the first cluster of the quota table, 0 without one, and its records
+func (fs *FileSystem) readQuotaTable() (int32, []quotaEntry, error) {
+
+	// **Snapshot views never allocate, quotas do not apply to them**
+	if fs.origin != nil {
+		return 0, nil, nil
+	}
+
+	table_cluster, raw_table, err := fs.readHeaderChain(QUOTAS_OFFSET, "quota table")
+	if err != nil || table_cluster == 0 {
+		return 0, nil, err
+	}
+
+	var table []quotaEntry
+	reader := bytes.NewReader(raw_table)
+	for reader.Len() >= binary.Size(quotaEntry{}) {
+
+		var quota quotaEntry
+		err = binary.Read(reader, binary.LittleEndian, &quota)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error reading quota table: %w", err)
+		}
+
+		if quota.Kind == 0 {
+			break
+		}
+		table = append(table, quota)
+	}
+
+	return table_cluster, table, nil
+}
+
+// writeQuotaTable stages the table, its chain goes away with the last quota
+func (fs *FileSystem) writeQuotaTable(table_cluster int32, table []quotaEntry) error {
+
+	buffer := new(bytes.Buffer)
+	for _, quota := range table {
+		err := binary.Write(buffer, binary.LittleEndian, quota)
+		if err != nil {
+			return fmt.Errorf("error writing quota table: %w", err)
+		}
+	}
+
+	return fs.writeHeaderChain(QUOTAS_OFFSET, table_cluster, buffer.Bytes(), "quota table")
+}
+
+// quotaTableChain returns the first cluster of the quota table, 0 without one
+func (fs *FileSystem) quotaTableChain() (int32, error) {
+
+	table_cluster, _, err := fs.readQuotaTable()
+	return table_cluster, err
+}
+
+// treeUsage counts the directory at dir_cluster with everything below it, for uid >= 0 only the
+// entries and the chains uid owns. seen collects the files counted so far.
+func (fs *FileSystem) treeUsage(dir_cluster int32, uid int, seen map[int32]bool) (quotaUsage, error) {
+
+	chain, dir_entries, err := fs.readDirectory(dir_cluster)
+	if err != nil {
+		return quotaUsage{}, err
+	}
+
+	owned := func(entry DirectoryEntry) bool { return uid < 0 || int(entry.Uid) == uid }
+
+	// **The directory itself is described by its '.' entry**
+	var usage quotaUsage
+	if owned(dir_entries[0]) {
+		xattr_clusters, err := fs.xattrClusters(dir_entries[0])
+		if err != nil {
+			return quotaUsage{}, err
+		}
+		usage.clusters += len(chain) + xattr_clusters
+	}
+
+	for _, entry := range dir_entries[2:] {
+
+		if !isUsedEntry(entry) {
+			continue
+		}
+
+		if owned(entry) {
+			usage.entries++
+		}
+
+		if entry.Is_directory == 1 {
+			sub_usage, err := fs.treeUsage(entry.First_cluster, uid, seen)
+			if err != nil {
+				return quotaUsage{}, err
+			}
+			usage.add(sub_usage)
+			continue
+		}
+
+		if seen[entry.First_cluster] || !owned(entry) {
+			continue
+		}
+		seen[entry.First_cluster] = true
+
+		clusters, err := fs.fileClusters(entry)
+		if err != nil {
+			return quotaUsage{}, err
+		}
+		usage.clusters += clusters
+	}
+
+	return usage, nil
+}
+
+// fileClusters returns the length of the chain of a file together with its attribute chain
+func (fs *FileSystem) fileClusters(entry DirectoryEntry) (int, error) {
+
+	chain, err := fs.readChain(entry.First_cluster)
+	if err != nil {
+		return 0, err
+	}
+
+	xattr_clusters, err := fs.xattrClusters(entry)
+	return len(chain) + xattr_clusters, err
+}
+
+// entryUsage returns what the entry with everything below it adds to the quota of a directory
+func (fs *FileSystem) entryUsage(entry DirectoryEntry) (quotaUsage, error) {
+
+	if entry.Is_directory == 1 {
+		usage, err := fs.treeUsage(entry.First_cluster, -1, make(map[int32]bool))
+		usage.entries++
+		return usage, err
+	}
+
+	clusters, err := fs.fileClusters(entry)
+	return quotaUsage{clusters: clusters, entries: 1}, err
+}
+
+// quotaUsed returns the usage a quota limits, counted once and then kept until something is released
+func (fs *FileSystem) quotaUsed(quota quotaEntry) (quotaUsage, error) {
+
+	// **Directories that moved to other clusters leave their usage behind, count again**
+	if fs.quotas.usage == nil || fs.quotas.dir_moves != fs.dir_moves {
+		fs.quotas = quotaCache{usage: make(map[quotaKey]quotaUsage), dir_moves: fs.dir_moves}
+	}
+
+	key := quotaKey{kind: quota.Kind, uid: quota.Uid, dir: quota.Dir}
+	if usage, ok := fs.quotas.usage[key]; ok {
+		return usage, nil
+	}
+
+	var usage quotaUsage
+	var err error
+	if quota.Kind == QUOTA_USER {
+		usage, err = fs.treeUsage(fs.rootDirectory(), int(quota.Uid), make(map[int32]bool))
+	} else {
+		usage, err = fs.treeUsage(quota.Dir, -1, make(map[int32]bool))
+	}
+	if err != nil {
+		return quotaUsage{}, err
+	}
+
+	fs.quotas.usage[key] = usage
+	return usage, nil
+}
+
+// quotaCharge is what one operation adds to the usage of one quota
+type quotaCharge struct {
+	key   quotaKey
+	added quotaUsage
+}
+
+// chargeQuota fails with ErrQuota when new clusters and entries owned by uid in the directory at
+// dir_cluster would exceed a quota, it is called before anything is allocated. The charge adds to
+// the usage kept for the quotas.
+func (fs *FileSystem) chargeQuota(dir_cluster int32, uid uint16, added quotaUsage) error {
+
+	charges, err := fs.quotaCharges(uid, added, dir_cluster, -1, added)
+	if err != nil {
+		return err
+	}
+
+	for _, charge := range charges {
+		usage := fs.quotas.usage[charge.key]
+		usage.add(charge.added)
+		fs.quotas.usage[charge.key] = usage
+	}
+
+	return nil
+}
+
+// checkQuota fails with ErrQuota like quotaCharges, for changes that move usage between users
+// and directories. The usage kept for the quotas cannot follow them and is dropped.
+func (fs *FileSystem) checkQuota(uid uint16, user_added quotaUsage, dir_cluster, from_cluster int32, tree_added quotaUsage) error {
+
+	_, err := fs.quotaCharges(uid, user_added, dir_cluster, from_cluster, tree_added)
+	fs.quotas = quotaCache{}
+	return err
+}
+
+// quotaCharges fails with ErrQuota when user_added would exceed the quota of uid or tree_added the quota
+// of dir_cluster or one of its parents, otherwise it returns what every quota gets. Directories holding
+// from_cluster as well are skipped, what moves inside of a directory does not change its usage.
+// from_cluster is -1 for new data.
+func (fs *FileSystem) quotaCharges(uid uint16, user_added quotaUsage, dir_cluster, from_cluster int32, tree_added quotaUsage) ([]quotaCharge, error) {
+
+	_, table, err := fs.readQuotaTable()
+	if err != nil || len(table) == 0 {
+		return nil, err
+	}
+
+	var charges []quotaCharge
+	for _, quota := range table {
+
+		// **The usage is only counted for quotas that something is added to**
+		var added quotaUsage
+		switch {
+		case quota.Kind == QUOTA_USER && quota.Uid == uid && (user_added.clusters > 0 || user_added.entries > 0):
+			added = user_added
+
+		case quota.Kind == QUOTA_DIR && (tree_added.clusters > 0 || tree_added.entries > 0) &&
+			fs.isInsideTree(dir_cluster, quota.Dir) && (from_cluster < 0 || !fs.isInsideTree(from_cluster, quota.Dir)):
+			added = tree_added
+
+		default:
+			continue
+		}
+
+		used, err := fs.quotaUsed(quota)
+		if err != nil {
+			return nil, err
+		}
+
+		if quota.exceeds(used, added) && quota.Kind == QUOTA_USER {
+			return nil, fmt.Errorf("quota of user %d: %w", quota.Uid, ErrQuota)
+		}
+		if quota.exceeds(used, added) {
+			return nil, fmt.Errorf("quota of the directory at cluster %d: %w", quota.Dir, ErrQuota)
+		}
+
+		charges = append(charges, quotaCharge{key: quotaKey{kind: quota.Kind, uid: quota.Uid, dir: quota.Dir}, added: added})
+	}
+
+	return charges, nil
+}
+
+// moveQuota keeps the quota of a directory that moved from one cluster to another
+func (fs *FileSystem) moveQuota(from, to int32) error {
+
+	table_cluster, table, err := fs.readQuotaTable()
+	if err != nil {
+		return err
+	}
+
+	index := slices.IndexFunc(table, func(quota quotaEntry) bool { return quota.Kind == QUOTA_DIR && quota.Dir == from })
+	if index < 0 {
+		return nil
+	}
+
+	table[index].Dir = to
+	return fs.writeQuotaTable(table_cluster, table)
+}
+
+// dropQuota removes the quota of a directory that is going away
+func (fs *FileSystem) dropQuota(dir_cluster int32) error {
+
+	table_cluster, table, err := fs.readQuotaTable()
+	if err != nil {
+		return err
+	}
+
+	index := slices.IndexFunc(table, func(quota quotaEntry) bool { return quota.Kind == QUOTA_DIR && quota.Dir == dir_cluster })
+	if index < 0 {
+		return nil
+	}
+
+	return fs.writeQuotaTable(table_cluster, slices.Delete(table, index, index+1))
+}
+
+// quotaDirectories returns the quota table together with the path of the directory of every
+// directory quota, rollback uses them to find the directories again
+func (fs *FileSystem) quotaDirectories() ([]quotaEntry, []string, error) {
+
+	_, table, err := fs.readQuotaTable()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	paths := make([]string, len(table))
+	for i, quota := range table {
+		if quota.Kind == QUOTA_DIR {
+			paths[i], err = fs.directoryPath(quota.Dir)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return table, paths, nil
+}
+
+// restoreQuotas writes the table saved by quotaDirectories back, a directory quota goes to the
+// directory now found at its path and is dropped when there is none
+func (fs *FileSystem) restoreQuotas(table []quotaEntry, paths []string) error {
+
+	table_cluster, _, err := fs.readQuotaTable()
+	if err != nil {
+		return err
+	}
+
+	var restored []quotaEntry
+	for i, quota := range table {
+
+		if quota.Kind == QUOTA_DIR {
+			quota.Dir, _, err = fs.parsePath(fs.rootDirectory(), paths[i], false)
+			if err != nil {
+				continue
+			}
+		}
+
+		restored = append(restored, quota)
+	}
+
+	return fs.writeQuotaTable(table_cluster, restored)
+}
+
+// quotaInfo counts the usage a quota limits
+func (fs *FileSystem) quotaInfo(quota quotaEntry) (QuotaInfo, error) {
+
+	info := QuotaInfo{MaxClusters: int(quota.Max_clusters), MaxEntries: int(quota.Max_entries)}
+
+	var usage quotaUsage
+	var err error
+	if quota.Kind == QUOTA_USER {
+		info.User, _ = fs.accountNames(quota.Uid, quota.Uid)
+		usage, err = fs.treeUsage(fs.rootDirectory(), int(quota.Uid), make(map[int32]bool))
+	} else {
+		info.Path, err = fs.directoryPath(quota.Dir)
+		if err == nil {
+			usage, err = fs.treeUsage(quota.Dir, -1, make(map[int32]bool))
+		}
+	}
+
+	info.Clusters, info.Entries = usage.clusters, usage.entries
+	return info, err
+}
+
+// setQuota replaces the quota of the same user or directory, zero limits remove it
+func (fs *FileSystem) setQuota(quota quotaEntry) error {
+
+	err := fs.requireRoot()
+	if err != nil {
+		return err
+	}
+
+	if quota.Max_clusters < 0 || quota.Max_entries < 0 {
+		return fmt.Errorf("negative quota limit: %w", ErrInvalid)
+	}
+
+	table_cluster, table, err := fs.readQuotaTable()
+	if err != nil {
+		return err
+	}
+
+	table = slices.DeleteFunc(table, func(old quotaEntry) bool {
+		return old.Kind == quota.Kind && old.Uid == quota.Uid && old.Dir == quota.Dir
+	})
+
+	if quota.Max_clusters != 0 || quota.Max_entries != 0 {
+		table = append(table, quota)
+	}
+
+	return fs.writeQuotaTable(table_cluster, table)
+}
+
+// SetUserQuota limits the clusters and the entries a user owns, 0 means no limit and two zeros
+// remove the quota. The limits may be lower than the usage, then only freeing space works. Only
+// root may set quotas.
+func (s *Session) SetUserQuota(user string, max_clusters, max_entries int) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	_, table, err := s.fs.readUserTable()
+	if err != nil {
+		return pathError("quota", user, err)
+	}
+
+	index := findAccount(table, ACCOUNT_USER, user)
+	if index < 0 {
+		return pathError("quota", user, ErrNoUser)
+	}
+
+	quota := quotaEntry{Kind: QUOTA_USER, Uid: table[index].Id, Max_clusters: int32(max_clusters), Max_entries: int32(max_entries)}
+	return pathError("quota", user, s.fs.commit(s.fs.setQuota(quota)))
+}
+
+// SetDirQuota limits the clusters and the entries of a directory with everything below it, like SetUserQuota
+func (s *Session) SetDirQuota(dir_path string, max_clusters, max_entries int) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	dir_cluster, _, err := s.parsePath(dir_path, false)
+	if err != nil {
+		return pathError("quota", dir_path, err)
+	}
+
+	quota := quotaEntry{Kind: QUOTA_DIR, Dir: dir_cluster, Max_clusters: int32(max_clusters), Max_entries: int32(max_entries)}
+	return pathError("quota", dir_path, s.fs.commit(s.fs.setQuota(quota)))
+}
+
+// UserQuota returns the quota and the usage of a user, an empty name stands for the session user.
+// Users without a quota have zero limits. Only root may look at the quota of somebody else.
+func (s *Session) UserQuota(user string) (QuotaInfo, error) {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	uid := s.cred.uid
+	if user != "" {
+		_, table, err := s.fs.readUserTable()
+		if err != nil {
+			return QuotaInfo{}, pathError("quota", user, err)
+		}
+
+		index := findAccount(table, ACCOUNT_USER, user)
+		if index < 0 {
+			return QuotaInfo{}, pathError("quota", user, ErrNoUser)
+		}
+		uid = table[index].Id
+	}
+
+	err := s.fs.checkOwner(DirectoryEntry{Uid: uid})
+	if err != nil {
+		return QuotaInfo{}, pathError("quota", user, err)
+	}
+
+	_, table, err := s.fs.readQuotaTable()
+	if err != nil {
+		return QuotaInfo{}, pathError("quota", user, err)
+	}
+
+	quota := quotaEntry{Kind: QUOTA_USER, Uid: uid}
+	if index := slices.IndexFunc(table, func(q quotaEntry) bool { return q.Kind == QUOTA_USER && q.Uid == uid }); index >= 0 {
+		quota = table[index]
+	}
+
+	info, err := s.fs.quotaInfo(quota)
+	return info, pathError("quota", user, err)
+}
+
+// DirQuota returns the quota and the usage of a directory, a directory without a quota has zero limits
+func (s *Session) DirQuota(dir_path string) (QuotaInfo, error) {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	dir_cluster, _, err := s.parsePath(dir_path, false)
+	if err != nil {
+		return QuotaInfo{}, pathError("quota", dir_path, err)
+	}
+
+	_, table, err := s.fs.readQuotaTable()
+	if err != nil {
+		return QuotaInfo{}, pathError("quota", dir_path, err)
+	}
+
+	quota := quotaEntry{Kind: QUOTA_DIR, Dir: dir_cluster}
+	if index := slices.IndexFunc(table, func(q quotaEntry) bool { return q.Kind == QUOTA_DIR && q.Dir == dir_cluster }); index >= 0 {
+		quota = table[index]
+	}
+
+	info, err := s.fs.quotaInfo(quota)
+	return info, pathError("quota", dir_path, err)
+}
+
+// Quotas lists every quota with its usage, user quotas first. Only root may list them.
+func (fs *FileSystem) Quotas() ([]QuotaInfo, error) {
+
+	fs.session.lock()
+	defer fs.mu.Unlock()
+
+	err := fs.requireRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	_, table, err := fs.readQuotaTable()
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []QuotaInfo
+	for _, quota := range table {
+		info, err := fs.quotaInfo(quota)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+
+	slices.SortStableFunc(infos, func(a, b QuotaInfo) int {
+		switch {
+		case a.User != "" && b.User == "":
+			return -1
+		case a.User == "" && b.User != "":
+			return 1
+		case a.User != "":
+			return strings.Compare(a.User, b.User)
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+
+	return infos, nil
+}
@@ -0,0 +1,403 @@
+package pseudofat
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestDirQuota(t *testing.T) {
+
+	fs, err := FormatDevice(NewMemoryDevice(0), 1, MIN_CLUSTER_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/lim"); err != nil {
+		t.Fatal(err)
+	}
+
+	// **A fresh quota counts the cluster of the directory and none of its entries**
+	if err := fs.SetDirQuota("/lim", 5, 3); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.DirQuota("/lim")
+	if err != nil || info.Path != "/lim" || info.Clusters != 1 || info.Entries != 0 || info.MaxClusters != 5 || info.MaxEntries != 3 {
+		t.Fatalf("quota %+v, %v", info, err)
+	}
+
+	// **A write over the limit fails before anything is allocated**
+	free_bytes, _ := fs.FreeSpace()
+	if err := fs.WriteFile("/lim/big", make([]byte, 5*MIN_CLUSTER_SIZE)); !errors.Is(err, ErrQuota) {
+		t.Fatalf("write over the cluster limit: %v", err)
+	}
+	if free, _ := fs.FreeSpace(); free != free_bytes {
+		t.Fatalf("refused write took %d bytes", free_bytes-free)
+	}
+
+	for _, step := range []error{
+		fs.WriteFile("/lim/a", make([]byte, 2*MIN_CLUSTER_SIZE)),
+		fs.Mkdir("/lim/d"),
+		fs.WriteFile("/lim/d/y", nil),
+		fs.WriteFile("/x", make([]byte, 10)),
+	} {
+		if step != nil {
+			t.Fatal(step)
+		}
+	}
+
+	// **Every way into the subtree is checked, nested directories count for the quota above**
+	file, err := fs.OpenFile("/lim/a", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, write_err := file.WriteAt([]byte("x"), 3*MIN_CLUSTER_SIZE)
+	file.Close()
+
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"mkdir over the entry limit", fs.Mkdir("/lim/e")},
+		{"write in a nested directory", fs.WriteFile("/lim/d/z", nil)},
+		{"move into the subtree", fs.Rename("/x", "/lim/x")},
+		{"copy into the subtree", fs.Copy("/x", "/lim/d/x2")},
+		{"attribute over the cluster limit", fs.Setxattr("/lim/a", "k", make([]byte, 600))},
+		{"growing write", write_err},
+	}
+	for _, test := range tests {
+		if !errors.Is(test.err, ErrQuota) {
+			t.Errorf("%s: %v", test.name, test.err)
+		}
+	}
+
+	// **Moves within the subtree and removals free nothing twice**
+	if err := fs.Rename("/lim/d/y", "/lim/y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("/lim/y"); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := fs.DirQuota("/lim"); info.Entries != 2 {
+		t.Fatalf("%d entries after a removal, want 2", info.Entries)
+	}
+	if err := fs.WriteFile("/lim/d/y", nil); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fs)
+
+	// **The quota goes with its directory**
+	if err := fs.RemoveTree("/lim"); err != nil {
+		t.Fatal(err)
+	}
+	if infos, err := fs.Quotas(); err != nil || len(infos) != 0 {
+		t.Fatalf("quotas %v after removing the directory, %v", infos, err)
+	}
+	checkClean(t, fs)
+}
+
+func TestUserQuota(t *testing.T) {
+
+	fs, err := FormatDevice(NewMemoryDevice(0), 1, MIN_CLUSTER_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.UserAdd("bob", "pw", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/home"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chown("/home", "bob", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/lim"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetUserQuota("bob", 6, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetUserQuota("ghost", 1, 1); !errors.Is(err, ErrNoUser) {
+		t.Fatalf("quota of an unknown user: %v", err)
+	}
+
+	// **The quota counts everything the user owns**
+	bob := fs.NewSession()
+	if err := bob.Login("bob", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.WriteFile("/home/b1", make([]byte, 4*MIN_CLUSTER_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.WriteFile("/home/b2", make([]byte, 2*MIN_CLUSTER_SIZE)); !errors.Is(err, ErrQuota) {
+		t.Fatalf("write over the user quota: %v", err)
+	}
+	if err := bob.CopyTree("/home/b1", "/home/c1"); !errors.Is(err, ErrQuota) {
+		t.Fatalf("copy over the user quota: %v", err)
+	}
+	info, err := bob.UserQuota("")
+	if err != nil || info.User != "bob" || info.Clusters != 5 || info.Entries != 2 || info.MaxClusters != 6 {
+		t.Fatalf("quota %+v, %v", info, err)
+	}
+
+	// **Only root sets quotas and sees the report**
+	if err := bob.SetUserQuota("bob", 0, 0); !errors.Is(err, ErrPermission) {
+		t.Fatalf("quota set by a user: %v", err)
+	}
+	if err := fs.Login("bob", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Quotas(); !errors.Is(err, ErrPermission) {
+		t.Fatalf("report for a user: %v", err)
+	}
+	if err := fs.Login("root", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// **A chown charges the new owner**
+	if err := fs.WriteFile("/lim/a", make([]byte, 2*MIN_CLUSTER_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chown("/lim/a", "bob", ""); !errors.Is(err, ErrQuota) {
+		t.Fatalf("chown over the user quota: %v", err)
+	}
+	checkClean(t, fs)
+
+	// **0:0 removes the quota**
+	if err := fs.SetUserQuota("bob", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chown("/lim/a", "bob", ""); err != nil {
+		t.Fatal(err)
+	}
+	if infos, err := fs.Quotas(); err != nil || len(infos) != 0 {
+		t.Fatalf("quotas %v, %v", infos, err)
+	}
+	checkClean(t, fs)
+}
+
+func TestQuotaPersistence(t *testing.T) {
+
+	device := NewMemoryDevice(0)
+	fs, err := FormatDevice(device, 1, MIN_CLUSTER_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/q"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 20 {
+		if err := fs.WriteFile(fmt.Sprintf("/q/f%d", i), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.UserAdd("bob", "pw", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetUserQuota("bob", 10, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetDirQuota("/q", 26, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// **A defrag that moves the directory keeps its quota**
+	before, _ := fs.Stat("/q")
+	if _, err := fs.Defrag("/", false); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := fs.Stat("/q")
+	if after.First_cluster == before.First_cluster {
+		t.Fatal("defrag did not move the directory")
+	}
+	if info, err := fs.DirQuota("/q"); err != nil || info.MaxClusters != 26 {
+		t.Fatalf("quota %+v after defrag, %v", info, err)
+	}
+	if err := fs.WriteFile("/q/a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/q/b", make([]byte, 4*MIN_CLUSTER_SIZE)); !errors.Is(err, ErrQuota) {
+		t.Fatalf("write over the moved quota: %v", err)
+	}
+	checkClean(t, fs)
+
+	// **Quotas are on the volume, a rollback keeps the current ones for the directories it restores**
+	fs.Close()
+	fs, err = OpenDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	infos, err := fs.Quotas()
+	if err != nil || len(infos) != 2 || infos[0].User != "bob" || infos[1].Path != "/q" {
+		t.Fatalf("quotas %+v after remount, %v", infos, err)
+	}
+
+	if err := fs.CreateSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetDirQuota("/q", 24, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RemoveTree("/q/f0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RollbackSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DeleteSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := fs.DirQuota("/q"); err != nil || info.MaxClusters != 24 {
+		t.Fatalf("quota %+v after rollback, %v", info, err)
+	}
+	if _, err := fs.Stat("/q/f0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/q/b", make([]byte, 2*MIN_CLUSTER_SIZE)); !errors.Is(err, ErrQuota) {
+		t.Fatalf("write over the quota after rollback: %v", err)
+	}
+	checkClean(t, fs)
+
+	// **fsck drops a quota whose directory is gone**
+	table_cluster, table, err := fs.readQuotaTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	table = append(table, quotaEntry{Kind: QUOTA_DIR, Dir: before.First_cluster, Max_clusters: 1})
+	if err := fs.commit(fs.writeQuotaTable(table_cluster, table)); err != nil {
+		t.Fatal(err)
+	}
+	report, err := fs.Check(true)
+	if err != nil || len(report.Problems) != 1 {
+		t.Fatal("fsck found", report.Problems, err)
+	}
+	checkClean(t, fs)
+	if infos, _ := fs.Quotas(); len(infos) != 2 {
+		t.Fatalf("quotas %+v after the repair", infos)
+	}
+}
+
+func TestQuotaUsageKept(t *testing.T) {
+
+	fs, err := FormatDevice(NewMemoryDevice(0), 1, MIN_CLUSTER_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.MkdirAll("/src/d"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 12 {
+		if err := fs.WriteFile(fmt.Sprintf("/src/d/f%d", i), make([]byte, i*50)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Mkdir("/q"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetDirQuota("/q", 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetUserQuota("root", 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	// **Charges add to the usage counted once, it always matches a walk of the tree**
+	if err := fs.CopyTree("/src", "/q/a"); err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.OpenFile("/q/a/d/f1", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 5 {
+		if _, err := file.WriteAt([]byte("x"), int64(i+1)*MIN_CLUSTER_SIZE); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.Close()
+	if len(fs.quotas.usage) != 2 {
+		t.Fatalf("usage of %d quotas kept after growing writes, want 2", len(fs.quotas.usage))
+	}
+	checkQuotaUsage(t, fs)
+
+	// **Releases drop the usage, the next charge counts it again**
+	if err := fs.RemoveTree("/q/a/d"); err != nil {
+		t.Fatal(err)
+	}
+	if fs.quotas.usage != nil {
+		t.Fatal("usage kept after a removal")
+	}
+	if err := fs.Rename("/src/d", "/q/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/q/d/new", make([]byte, 3*MIN_CLUSTER_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	checkQuotaUsage(t, fs)
+}
+
+// checkQuotaUsage compares the usage kept for every quota with a walk of the tree
+func checkQuotaUsage(t *testing.T, fs *FileSystem) {
+	t.Helper()
+
+	for key, kept := range fs.quotas.usage {
+
+		var counted quotaUsage
+		var err error
+		if key.kind == QUOTA_USER {
+			counted, err = fs.treeUsage(fs.rootDirectory(), int(key.uid), make(map[int32]bool))
+		} else {
+			counted, err = fs.treeUsage(key.dir, -1, make(map[int32]bool))
+		}
+		if err != nil || kept != counted {
+			t.Errorf("quota %+v keeps %+v, the tree has %+v, %v", key, kept, counted, err)
+		}
+	}
+}
+
+func TestQuotaDirectoryGrowth(t *testing.T) {
+
+	fs, err := FormatDevice(NewMemoryDevice(0), 1, MIN_CLUSTER_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/g"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range fs.dirEntriesPerCluster() - 2 {
+		if err := fs.WriteFile(fmt.Sprintf("/g/%d", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := fs.DirQuota("/g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetDirQuota("/g", info.Clusters+1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// **A full directory grows by a cluster, the quota counts it together with the new file**
+	free_bytes, _ := fs.FreeSpace()
+	if err := fs.WriteFile("/g/x", nil); !errors.Is(err, ErrQuota) {
+		t.Fatalf("write into a full directory at the limit: %v", err)
+	}
+	if err := fs.Mkdir("/g/y"); !errors.Is(err, ErrQuota) {
+		t.Fatalf("mkdir in a full directory at the limit: %v", err)
+	}
+	if free, _ := fs.FreeSpace(); free != free_bytes {
+		t.Fatalf("refused entries took %d bytes", free_bytes-free)
+	}
+
+	if err := fs.SetDirQuota("/g", info.Clusters+2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/g/x", nil); err != nil {
+		t.Fatal(err)
+	}
+	if grown, _ := fs.DirQuota("/g"); grown.Clusters != info.Clusters+2 {
+		t.Fatalf("%d clusters after the directory grew, want %d", grown.Clusters, info.Clusters+2)
+	}
+	checkClean(t, fs)
+}
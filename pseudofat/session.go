@@ -0,0 +1,708 @@
+package pseudofat
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// NewSession starts a new session in the root directory, every session keeps its own working directory.
+// It acts for root while root has no password and for nobody otherwise, see Login.
+func (fs *FileSystem) NewSession() *Session {
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.newSession()
+}
+
+func (fs *FileSystem) newSession() *Session {
+	return &Session{fs: fs, current_cluster: fs.rootDirectory(), current_path: "/", dir_moves: fs.dir_moves, dir_renames: fs.dir_renames, cred: fs.defaultCredentials()}
+}
+
+// followWorkingDirectory keeps up with the working directory after defrag moved it to another cluster
+// or a rename gave it another path
+func (s *Session) followWorkingDirectory() {
+
+	switch {
+	case s.dir_moves != s.fs.dir_moves:
+		cluster, _, err := s.fs.parsePath(s.fs.rootDirectory(), s.current_path, false)
+		if err == nil {
+			s.current_cluster = cluster
+		}
+
+	case s.dir_renames != s.fs.dir_renames:
+		dir_path, err := s.fs.directoryPath(s.current_cluster)
+		if err == nil {
+			s.current_path = dir_path
+		}
+	}
+
+	s.dir_moves, s.dir_renames = s.fs.dir_moves, s.fs.dir_renames
+}
+
+// lock takes the volume lock for an operation of the session, the operation acts for the session user
+func (s *Session) lock() {
+	s.fs.mu.Lock()
+	s.fs.cred = s.cred
+}
+
+// parsePath resolves relative paths against the session working directory
+func (s *Session) parsePath(dest string, last_entry bool) (int32, string, error) {
+
+	s.followWorkingDirectory()
+
+	// **The working directory may have been removed by another session**
+	if !path.IsAbs(dest) && !s.fs.isDirectory(s.current_cluster) {
+		return -1, "", ErrPathNotFound
+	}
+
+	return s.fs.walkPath(s.current_cluster, dest, last_entry, &pathWalk{search: true})
+}
+
+// parseWritable works like parsePath with last_entry set, the directory holding the last component
+// must be writable for the session
+func (s *Session) parseWritable(dest string) (int32, string, error) {
+
+	dir_cluster, name, err := s.parsePath(dest, true)
+	if err != nil {
+		return -1, "", err
+	}
+
+	return dir_cluster, name, s.fs.checkDirAccess(dir_cluster, PERM_WRITE)
+}
+
+// resolvePath works like parsePath with last_entry set, but a symbolic link named by the last component is followed
+func (s *Session) resolvePath(dest string) (int32, string, error) {
+
+	dir_cluster, name, err := s.parsePath(dest, true)
+	if err != nil {
+		return -1, "", err
+	}
+
+	return s.fs.followLinks(dir_cluster, name, &pathWalk{search: true})
+}
+
+// Mkdir creates a new empty directory
+func (s *Session) Mkdir(dir_path string) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	// **Parse the path to get the parent cluster and final directory name**
+	parent_cluster, final_name, err := s.parseWritable(dir_path)
+	if err != nil {
+		return pathError("mkdir", dir_path, err)
+	}
+
+	return pathError("mkdir", dir_path, s.fs.commit(s.fs.createDirectory(parent_cluster, final_name, MODE_DIR)))
+}
+
+// MkdirAll creates a directory together with every missing parent, existing directories on the way are kept
+func (s *Session) MkdirAll(dir_path string) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	return pathError("mkdir", dir_path, s.fs.commit(s.mkdirAll(dir_path)))
+}
+
+func (s *Session) mkdirAll(dir_path string) error {
+
+	// **Start in the working directory or in the root**
+	current_cluster, _, err := s.parsePath(".", false)
+	if err != nil {
+		return err
+	}
+	if path.IsAbs(dir_path) {
+		current_cluster = s.fs.rootDirectory()
+	}
+
+	for _, component := range strings.Split(dir_path, "/") {
+
+		if component == "" || component == "." {
+			continue
+		}
+
+		err = s.fs.checkDirAccess(current_cluster, PERM_EXEC)
+		if err != nil {
+			return fmt.Errorf("cannot enter '%s': %w", component, err)
+		}
+
+		if component == ".." {
+			current_cluster = s.fs.getParentCluster(current_cluster)
+			continue
+		}
+
+		// **Create the component only when it is missing**
+		next_cluster, err := s.fs.findDirectoryCluster(component, current_cluster)
+		if errors.Is(err, ErrPathNotFound) {
+			err = s.fs.checkDirAccess(current_cluster, PERM_WRITE)
+			if err == nil {
+				err = s.fs.createDirectory(current_cluster, component, MODE_DIR)
+			}
+			if err == nil {
+				next_cluster, err = s.fs.findDirectoryCluster(component, current_cluster)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("cannot create '%s': %w", component, err)
+		}
+
+		current_cluster = next_cluster
+	}
+
+	return nil
+}
+
+// Remove deletes a file or an empty directory
+func (s *Session) Remove(file_path string) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	return pathError("remove", file_path, s.fs.commit(s.remove(file_path)))
+}
+
+func (s *Session) remove(file_path string) error {
+
+	file_cluster, file_name, err := s.parseWritable(file_path)
+	if err != nil {
+		return err
+	}
+
+	return s.fs.removeDirectoryEntry(file_cluster, file_name, false)
+}
+
+// RemoveTree deletes a file or a directory together with everything below it
+func (s *Session) RemoveTree(file_path string) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	file_cluster, file_name, err := s.parseWritable(file_path)
+	if err != nil {
+		return pathError("remove", file_path, err)
+	}
+
+	// **Emptying a directory needs the same permissions on every directory below it**
+	entry, err := s.fs.findEntry(entryName(file_name), file_cluster)
+	if err == nil {
+		err = s.fs.checkTree(entry, 0, PERM_READ|PERM_WRITE|PERM_EXEC)
+	}
+	if err != nil {
+		return pathError("remove", file_path, err)
+	}
+
+	return pathError("remove", file_path, s.fs.commit(s.fs.removeDirectoryEntry(file_cluster, file_name, true)))
+}
+
+// Stat returns the directory entry describing the given path
+func (s *Session) Stat(file_path string) (DirectoryEntry, error) {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	entry, err := s.stat(file_path)
+	return entry, pathError("stat", file_path, err)
+}
+
+// Lstat works like Stat, but a symbolic link is described itself instead of the entry it points to
+func (s *Session) Lstat(file_path string) (DirectoryEntry, error) {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	entry, err := s.lstat(file_path)
+	return entry, pathError("lstat", file_path, err)
+}
+
+func (s *Session) stat(file_path string) (DirectoryEntry, error) {
+
+	src_cluster, src_name, err := s.resolvePath(file_path)
+	if err != nil {
+		return DirectoryEntry{}, err
+	}
+
+	return s.fs.findEntry(entryName(src_name), src_cluster)
+}
+
+func (s *Session) lstat(file_path string) (DirectoryEntry, error) {
+
+	src_cluster, src_name, err := s.parsePath(file_path, true)
+	if err != nil {
+		return DirectoryEntry{}, err
+	}
+
+	return s.fs.findEntry(entryName(src_name), src_cluster)
+}
+
+// entryName maps the empty name parsePath returns for a directory to its '.' entry,
+// the root directory has no entry of its own
+func entryName(name string) string {
+
+	if name == "" {
+		return "."
+	}
+
+	return name
+}
+
+// ReadFile returns the whole contents of a file
+func (s *Session) ReadFile(file_path string) ([]byte, error) {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	entry, err := s.stat(file_path)
+	if err != nil {
+		return nil, pathError("read", file_path, err)
+	}
+
+	if entry.Is_directory == 1 {
+		return nil, pathError("read", file_path, ErrIsDir)
+	}
+
+	err = s.fs.checkAccess(entry, PERM_READ)
+	if err != nil {
+		return nil, pathError("read", file_path, err)
+	}
+
+	// **Read the file contents**
+	file_contents, err := s.fs.readFileContents(entry.First_cluster, entry.Size)
+	if err != nil {
+		return nil, pathError("read", file_path, err)
+	}
+
+	return file_contents, nil
+}
+
+// WriteFile creates a new file holding data, the destination must not exist yet
+func (s *Session) WriteFile(file_path string, data []byte) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	return pathError("write", file_path, s.fs.commit(s.writeFile(file_path, data)))
+}
+
+func (s *Session) writeFile(file_path string, data []byte) error {
+
+	// **Parse the destination path**
+	dest_cluster, dest_name, err := s.parseWritable(file_path)
+	if err != nil {
+		return err
+	}
+
+	return s.fs.createFile(dest_cluster, dest_name, data)
+}
+
+// ImportFile creates a new file holding data with the modification time and the extended attributes
+// of a file brought in from elsewhere. It is one transaction, a failure leaves no file behind.
+func (s *Session) ImportFile(file_path string, data []byte, mtime time.Time, attrs map[string][]byte) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	return pathError("import", file_path, s.fs.commit(s.importFile(file_path, data, mtime, attrs)))
+}
+
+func (s *Session) importFile(file_path string, data []byte, mtime time.Time, attrs map[string][]byte) error {
+
+	// **The attributes are checked before anything is allocated**
+	for name, value := range attrs {
+		err := validateXattr(name, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	dest_cluster, dest_name, err := s.parseWritable(file_path)
+	if err != nil {
+		return err
+	}
+
+	err = s.fs.createFile(dest_cluster, dest_name, data)
+	if err == nil {
+		err = s.fs.setEntryTimes(dest_cluster, dest_name, time.Now(), mtime)
+	}
+	if err != nil || len(attrs) == 0 {
+		return err
+	}
+
+	entry, err := s.fs.findEntry(dest_name, dest_cluster)
+	if err != nil {
+		return err
+	}
+
+	return s.fs.replaceXattrs(dest_cluster, dest_name, entry, attrs)
+}
+
+// Copy duplicates a file under a new name
+func (s *Session) Copy(src, dest string) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	return s.fs.commit(s.copy("copy", src, dest))
+}
+
+func (s *Session) copy(op, src, dest string) error {
+
+	// **Locate the source file**
+	src_entry, err := s.stat(src)
+	if err != nil {
+		return pathError(op, src, err)
+	}
+
+	// **Check if source is a directory**
+	if src_entry.Is_directory == 1 {
+		return pathError(op, src, ErrIsDir)
+	}
+
+	err = s.fs.checkAccess(src_entry, PERM_READ)
+	if err != nil {
+		return pathError(op, src, err)
+	}
+
+	// **Read file contents using the helper function**
+	file_contents, err := s.fs.readFileContents(src_entry.First_cluster, src_entry.Size)
+	if err != nil {
+		return pathError(op, src, err)
+	}
+
+	// **The copy belongs to the session user and keeps the permission bits and the attributes**
+	dest_cluster, dest_name, err := s.parseWritable(dest)
+	if err != nil {
+		return pathError(op, dest, err)
+	}
+
+	err = s.fs.createEntry(dest_cluster, dest_name, file_contents, 0, src_entry.Mode)
+	if err == nil {
+		err = s.fs.copyXattrs(src_entry, dest_cluster, dest_name)
+	}
+
+	return pathError(op, dest, err)
+}
+
+// CopyTree duplicates a file or a directory with everything below it under a new name,
+// nothing is copied unless the whole tree fits into the free space
+func (s *Session) CopyTree(src, dest string) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	return s.fs.commit(s.copyTree(src, dest))
+}
+
+func (s *Session) copyTree(src, dest string) error {
+
+	// **Locate the source, everything below it must be readable**
+	src_entry, err := s.stat(src)
+	if err == nil {
+		err = s.fs.checkTree(src_entry, PERM_READ, PERM_READ|PERM_EXEC)
+	}
+	if err != nil {
+		return pathError("copy", src, err)
+	}
+
+	dest_cluster, dest_name, err := s.parseWritable(dest)
+	if err != nil {
+		return pathError("copy", dest, err)
+	}
+
+	// **A directory cannot be copied into itself, the copy would never end**
+	if src_entry.Is_directory == 1 && s.fs.isInsideTree(dest_cluster, src_entry.First_cluster) {
+		return pathError("copy", dest, fmt.Errorf("cannot copy '%s' into itself: %w", src, ErrInvalid))
+	}
+
+	if s.fs.checkIfDirectoryExists(dest_cluster, dest_name) {
+		return pathError("copy", dest, ErrExist)
+	}
+
+	// **Check the free space before the first cluster is written**
+	needed, err := s.fs.treeClusters(src_entry)
+	if err != nil {
+		return pathError("copy", src, err)
+	}
+	if !s.fs.hasFreeClusters(needed) {
+		return pathError("copy", dest, ErrNoSpace)
+	}
+
+	// **The quotas are checked for the whole tree, every copied entry charges its own share**
+	usage, err := s.fs.entryUsage(src_entry)
+	if err == nil {
+		usage.clusters = needed
+		_, err = s.fs.quotaCharges(s.fs.cred.uid, usage, dest_cluster, -1, usage)
+	}
+	if err != nil {
+		return pathError("copy", dest, err)
+	}
+
+	return pathError("copy", dest, s.fs.copyTree(src_entry, dest_cluster, dest_name))
+}
+
+// Rename moves a file or a directory to a new name or into an existing directory
+func (s *Session) Rename(src, dest string) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	// **Locate the source, a symbolic link is moved itself**
+	src_entry, err := s.lstat(src)
+	if err != nil {
+		return pathError("rename", src, err)
+	}
+
+	src_cluster, src_name, err := s.parsePath(src, true)
+	if err != nil {
+		return pathError("rename", src, err)
+	}
+
+	dest_cluster, dest_name, err := s.parsePath(dest, true)
+	if err != nil {
+		return pathError("rename", dest, err)
+	}
+
+	// **Moving into an existing directory keeps the source name, unless the destination is the source
+	// itself under a name that differs only in case**
+	dest_entry, err := s.stat(dest)
+	is_self := err == nil && dest_cluster == src_cluster && s.fs.matchesName(src_entry, dest_name)
+	if err == nil && !is_self {
+		if dest_entry.Is_directory != 1 {
+			return pathError("rename", dest, ErrExist)
+		}
+		dest = path.Join(dest, src_entry.FileName())
+
+		dest_cluster, dest_name, err = s.parsePath(dest, true)
+		if err != nil {
+			return pathError("rename", dest, err)
+		}
+	} else if err != nil && !errors.Is(err, ErrNotFound) {
+		return pathError("rename", dest, err)
+	}
+
+	// **Both directories change, a directory that gets a new parent changes its '..' entry too**
+	err = s.fs.checkDirAccess(src_cluster, PERM_WRITE)
+	if err != nil {
+		return pathError("rename", src, err)
+	}
+
+	err = s.fs.checkDirAccess(dest_cluster, PERM_WRITE)
+	if err == nil && src_entry.Is_directory == 1 && dest_cluster != src_cluster {
+		err = s.fs.checkAccess(src_entry, PERM_WRITE)
+	}
+	if err != nil {
+		return pathError("rename", dest, err)
+	}
+
+	// **Only the directory entry moves, the clusters of the file stay**
+	return pathError("rename", dest, s.fs.commit(s.fs.moveEntry(src_cluster, src_name, dest_cluster, dest_name)))
+}
+
+// Link gives the file src another name, linking into an existing directory keeps the source name
+func (s *Session) Link(src, dest string) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	// **A symbolic link gets a second name itself, like any other file**
+	src_entry, err := s.lstat(src)
+	if err != nil {
+		return pathError("link", src, err)
+	}
+
+	src_cluster, src_name, err := s.parsePath(src, true)
+	if err != nil {
+		return pathError("link", src, err)
+	}
+
+	dest_cluster, dest_name, err := s.linkDestination(dest, src_entry.FileName())
+	if err != nil {
+		return pathError("link", dest, err)
+	}
+
+	return pathError("link", dest, s.fs.commit(s.fs.link(src_cluster, src_name, dest_cluster, dest_name)))
+}
+
+// Symlink creates a symbolic link at dest pointing to target, the target need not exist
+func (s *Session) Symlink(target, dest string) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	dest_cluster, dest_name, err := s.linkDestination(dest, path.Base(target))
+	if err != nil {
+		return pathError("symlink", dest, err)
+	}
+
+	return pathError("symlink", dest, s.fs.commit(s.fs.createSymlink(dest_cluster, dest_name, target)))
+}
+
+// linkDestination resolves where a new link goes, a link into an existing directory is called name
+func (s *Session) linkDestination(dest, name string) (int32, string, error) {
+
+	dest_entry, err := s.stat(dest)
+	if err == nil && dest_entry.Is_directory == 1 {
+		dest = path.Join(dest, name)
+	}
+
+	return s.parseWritable(dest)
+}
+
+// Readlink returns the target of a symbolic link
+func (s *Session) Readlink(file_path string) (string, error) {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	entry, err := s.lstat(file_path)
+	if err != nil {
+		return "", pathError("readlink", file_path, err)
+	}
+
+	target, err := s.fs.readLink(entry)
+	return target, pathError("readlink", file_path, err)
+}
+
+// Chtimes changes the access and modification time of a file or a directory
+func (s *Session) Chtimes(file_path string, atime, mtime time.Time) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	dir_cluster, file_name, err := s.resolvePath(file_path)
+	if err != nil {
+		return pathError("chtimes", file_path, err)
+	}
+
+	// **The owner may set any time, others need write permission**
+	entry, err := s.fs.findEntry(entryName(file_name), dir_cluster)
+	if err == nil && s.fs.checkOwner(entry) != nil {
+		err = s.fs.checkAccess(entry, PERM_WRITE)
+	}
+	if err != nil {
+		return pathError("chtimes", file_path, err)
+	}
+
+	return pathError("chtimes", file_path, s.fs.commit(s.fs.setEntryTimes(dir_cluster, file_name, atime, mtime)))
+}
+
+// ReadDir lists the used entries of a directory, an empty path lists the working directory
+func (s *Session) ReadDir(dir_path string) ([]DirectoryEntry, error) {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	dir_cluster, _, err := s.parsePath(dir_path, false)
+	if err == nil {
+		err = s.fs.checkDirAccess(dir_cluster, PERM_READ)
+	}
+	if err != nil {
+		return nil, pathError("readdir", dir_path, err)
+	}
+
+	dir_entries, err := s.fs.readDirectoryEntries(dir_cluster)
+	if err != nil {
+		return nil, pathError("readdir", dir_path, err)
+	}
+
+	var items []DirectoryEntry
+	for _, entry := range dir_entries {
+		if isUsedEntry(entry) {
+			items = append(items, entry)
+		}
+	}
+
+	return items, nil
+}
+
+// Chdir changes the working directory of the session
+func (s *Session) Chdir(dir_path string) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	// **Resolve the directory cluster**
+	dir_cluster, _, err := s.parsePath(dir_path, false)
+	if err == nil {
+		err = s.fs.checkDirAccess(dir_cluster, PERM_EXEC)
+	}
+	if err != nil {
+		return pathError("chdir", dir_path, err)
+	}
+
+	s.current_cluster = dir_cluster
+	if path.IsAbs(dir_path) {
+		s.current_path = path.Clean(dir_path)
+	} else {
+		s.current_path = path.Join(s.current_path, dir_path)
+	}
+
+	return nil
+}
+
+// Getwd returns the working directory of the session
+func (s *Session) Getwd() string {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	s.followWorkingDirectory()
+	return s.current_path
+}
+
+// ClusterChain returns the clusters occupied by the given entry in FAT order, a symbolic link is not followed
+func (s *Session) ClusterChain(file_path string) ([]int32, error) {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	entry, err := s.lstat(file_path)
+	if err != nil {
+		return nil, pathError("info", file_path, err)
+	}
+
+	var chain []int32
+	current_cluster := entry.First_cluster
+	for current_cluster >= 0 {
+
+		chain = append(chain, current_cluster)
+
+		next_cluster, err := s.fs.readFatEntry(current_cluster)
+		if err != nil {
+			return chain, pathError("info", file_path, err)
+		}
+
+		current_cluster = next_cluster
+	}
+
+	return chain, nil
+}
+
+// MarkBad marks the first cluster of a file as bad, used to simulate corruption
+func (s *Session) MarkBad(file_path string) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	err := s.fs.requireRoot()
+	if err != nil {
+		return pathError("bug", file_path, err)
+	}
+
+	entry, err := s.stat(file_path)
+	if err != nil {
+		return pathError("bug", file_path, err)
+	}
+
+	// **Update the FAT entry to mark the file as corrupted (FAT_BAD_CLUSTER)**
+	err = s.fs.commit(s.fs.updateFatEntry(entry.First_cluster, FAT_BAD))
+	if err != nil {
+		return pathError("bug", file_path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package pseudofat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestSessionRenameWorkingDirectory moves a parent of the working directory of two sessions
+func TestSessionRenameWorkingDirectory(t *testing.T) {
+
+	fs, _ := newVolume(t, 1)
+	other := fs.NewSession()
+
+	for _, step := range []error{
+		fs.MkdirAll("/z/c"),
+		fs.Mkdir("/b"),
+		fs.Chdir("/z/c"),
+		other.Chdir("/z"),
+		fs.Rename("/z", "/a"),
+		fs.Rename("/a", "/b/a"),
+	} {
+		if step != nil {
+			t.Fatal(step)
+		}
+	}
+
+	if cwd := fs.Getwd(); cwd != "/b/a/c" {
+		t.Fatalf("working directory is %s, want /b/a/c", cwd)
+	}
+	if cwd := other.Getwd(); cwd != "/b/a" {
+		t.Fatalf("working directory of the other session is %s, want /b/a", cwd)
+	}
+
+	err := fs.Chdir("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cwd := fs.Getwd(); cwd != "/b/a" {
+		t.Fatalf("working directory after cd .. is %s, want /b/a", cwd)
+	}
+
+	err = other.WriteFile("c/f", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/b/a/c/f"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSessions gives two sessions their own working directories on one volume
+func TestSessions(t *testing.T) {
+
+	fs, _ := newVolume(t, 2)
+	a, b := fs.NewSession(), fs.NewSession()
+
+	if err := a.Mkdir("x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Chdir("x"); err != nil {
+		t.Fatal(err)
+	}
+	if a.Getwd() != "/x" || b.Getwd() != "/" || fs.Getwd() != "/" {
+		t.Fatalf("working directories %s, %s and %s", a.Getwd(), b.Getwd(), fs.Getwd())
+	}
+
+	// **Relative paths resolve against the working directory of the session**
+	if err := a.WriteFile("f", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := b.ReadFile("/x/f"); err != nil || string(data) != "hi" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	if _, err := b.ReadFile("f"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("relative path of another session: %v", err)
+	}
+
+	// **A working directory removed by another session is reported, not reused**
+	if err := b.Remove("/x/f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Remove("/x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.ReadDir(""); !errors.Is(err, ErrPathNotFound) {
+		t.Fatalf("listing a removed working directory: %v", err)
+	}
+	if err := a.Chdir("/"); err != nil {
+		t.Fatal(err)
+	}
+
+	// **Sessions used from several goroutines at once keep their own state**
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			session := fs.NewSession()
+			dir := fmt.Sprintf("/d%d", i)
+			if err := session.Mkdir(dir); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := session.Chdir(dir); err != nil {
+				t.Error(err)
+				return
+			}
+
+			for j := range 20 {
+				if err := session.WriteFile(fmt.Sprintf("f%d", j), bytes.Repeat([]byte{byte(j)}, 1500)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range 8 {
+		for j := range 20 {
+			data, err := fs.ReadFile(fmt.Sprintf("/d%d/f%d", i, j))
+			if err != nil || !bytes.Equal(data, bytes.Repeat([]byte{byte(j)}, 1500)) {
+				t.Fatalf("/d%d/f%d: %v", i, j, err)
+			}
+		}
+	}
+	checkClean(t, fs)
+}
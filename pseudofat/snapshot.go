@@ -0,0 +1,798 @@
+package pseudofat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A snapshot freezes the whole tree under a name. It owns a copy of every directory
+// and a frozen FAT that describes its tree, the clusters of the files stay shared
+// with the live tree. The snapshot table is a single cluster whose number is kept
+// in the header cluster at SNAPSHOT_OFFSET, the table and the frozen FATs are chains
+// of the live FAT. Every cluster a frozen FAT uses is counted in snapshot_refs, such
+// a cluster is never allocated again and the live tree copies it before writing
+// into it (see unshareChain), so the snapshot never changes.
+const (
+	SNAPSHOT_OFFSET = FSINFO_OFFSET + 12 // first cluster of the snapshot table, 0 without snapshots
+)
+
+// snapshotEntry is one slot of the snapshot table, an empty name marks a free slot
+type snapshotEntry struct {
+	Name        [MAX_FILE_NAME]byte
+	Root        int32 // first cluster of the snapshot root directory
+	FAT_cluster int32 // first cluster of the frozen FAT
+	Created     int64 // Unix time
+}
+
+// FileName returns the snapshot name without the null padding
+func (entry snapshotEntry) FileName() string {
+	return string(bytes.Trim(entry.Name[:], "\x00"))
+}
+
+// SnapshotInfo describes one snapshot
+type SnapshotInfo struct {
+	Name      string
+	Created   time.Time
+	Clusters  int // clusters referenced by the snapshot
+	Exclusive int // clusters only this snapshot references, freed when it is deleted
+}
+
+// CreateSnapshot freezes the current tree under the given name
+func (fs *FileSystem) CreateSnapshot(name string) error {
+
+	fs.session.lock()
+	defer fs.mu.Unlock()
+
+	return pathError("snapshot", name, fs.commit(fs.createSnapshot(name)))
+}
+
+// DeleteSnapshot removes a snapshot and frees the clusters nothing else references
+func (fs *FileSystem) DeleteSnapshot(name string) error {
+
+	fs.session.lock()
+	defer fs.mu.Unlock()
+
+	return pathError("snapshot", name, fs.commit(fs.deleteSnapshot(name)))
+}
+
+// RollbackSnapshot replaces the live tree with the tree of the snapshot, the snapshot stays
+func (fs *FileSystem) RollbackSnapshot(name string) error {
+
+	fs.session.lock()
+	defer fs.mu.Unlock()
+
+	return pathError("snapshot", name, fs.commit(fs.rollbackSnapshot(name)))
+}
+
+// Snapshots lists the snapshots in the order they were created
+func (fs *FileSystem) Snapshots() ([]SnapshotInfo, error) {
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	_, table, err := fs.readSnapshotTable()
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []SnapshotInfo
+	for _, entry := range table {
+
+		fat, err := fs.readSnapshotFAT(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		info := SnapshotInfo{Name: entry.FileName(), Created: time.Unix(entry.Created, 0)}
+		for cluster := fs.rootCluster(); cluster < int32(len(fat)); cluster++ {
+			if fat[cluster] == FAT_FREE {
+				continue
+			}
+
+			info.Clusters++
+			if fs.snapshotRefs(cluster) == 1 && fs.fat1[cluster] == FAT_FREE {
+				info.Exclusive++
+			}
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// OpenSnapshot returns a read-only view of the snapshot tree, close it before the snapshot is deleted
+func (fs *FileSystem) OpenSnapshot(name string) (*FileSystem, error) {
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	_, table, err := fs.readSnapshotTable()
+	if err != nil {
+		return nil, pathError("snapshot", name, err)
+	}
+
+	index := slices.IndexFunc(table, func(entry snapshotEntry) bool { return entry.FileName() == name })
+	if index < 0 {
+		return nil, pathError("snapshot", name, ErrNotFound)
+	}
+
+	view, err := fs.snapshotView(table[index])
+	if err != nil {
+		return nil, pathError("snapshot", name, err)
+	}
+
+	// **The view is browsed by the user of the default session**
+	view.session.cred = fs.session.cred
+
+	if fs.snapshot_views == nil {
+		fs.snapshot_views = make(map[string]int)
+	}
+	fs.snapshot_views[name]++
+
+	return view, nil
+}
+
+func (fs *FileSystem) createSnapshot(name string) error {
+
+	err := fs.requireRoot()
+	if err != nil {
+		return err
+	}
+
+	if name == "" || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("invalid snapshot name: %w", ErrInvalid)
+	}
+
+	if len(name) > MAX_FILE_NAME {
+		return ErrNameTooLong
+	}
+
+	table_cluster, table, err := fs.readSnapshotTable()
+	if err != nil {
+		return err
+	}
+
+	if slices.ContainsFunc(table, func(entry snapshotEntry) bool { return entry.FileName() == name }) {
+		return ErrExist
+	}
+
+	if len(table) >= fs.snapshotsPerCluster() {
+		return fmt.Errorf("snapshot table is full: %w", ErrNoSpace)
+	}
+
+	// **The frozen FAT starts with the reserved clusters and gets the copied tree**
+	fat := make(FAT, len(fs.fat1))
+	for cluster := range fat {
+		fat[cluster] = FAT_FREE
+	}
+	copy(fat, fs.fat1[:fs.rootCluster()])
+
+	tree := &treeCopy{
+		fs:  fs,
+		src: fs,
+		link: func(cluster, next int32) error {
+			fat[cluster] = next
+			return nil
+		},
+	}
+
+	root_chain, err := fs.readChain(fs.rootCluster())
+	if err != nil {
+		return err
+	}
+
+	snapshot_root, err := tree.newChain(len(root_chain))
+	if err != nil {
+		return err
+	}
+
+	err = tree.copyDirectory(fs.rootCluster(), snapshot_root, snapshot_root[0])
+	if err != nil {
+		return err
+	}
+
+	fat_cluster, err := fs.writeSnapshotFAT(fat)
+	if err != nil {
+		return err
+	}
+
+	entry := snapshotEntry{Root: snapshot_root[0], FAT_cluster: fat_cluster, Created: time.Now().Unix()}
+	copy(entry.Name[:], name)
+
+	err = fs.writeSnapshotTable(table_cluster, append(table, entry))
+	if err != nil {
+		return err
+	}
+
+	// **Hand the directory copies over from the live FAT to the snapshot**
+	fs.referenceSnapshot(fat, 1)
+	for _, cluster := range tree.allocated {
+		err = fs.updateFatEntry(cluster, FAT_FREE)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *FileSystem) deleteSnapshot(name string) error {
+
+	err := fs.requireRoot()
+	if err != nil {
+		return err
+	}
+
+	table_cluster, table, err := fs.readSnapshotTable()
+	if err != nil {
+		return err
+	}
+
+	index := slices.IndexFunc(table, func(entry snapshotEntry) bool { return entry.FileName() == name })
+	if index < 0 {
+		return ErrNotFound
+	}
+
+	if fs.snapshot_views[name] > 0 {
+		return fmt.Errorf("snapshot is open: %w", ErrBusy)
+	}
+
+	fat, err := fs.readSnapshotFAT(table[index])
+	if err != nil {
+		return err
+	}
+
+	err = fs.freeChain(table[index].FAT_cluster)
+	if err != nil {
+		return err
+	}
+
+	err = fs.writeSnapshotTable(table_cluster, slices.Delete(table, index, index+1))
+	if err != nil {
+		return err
+	}
+
+	fs.referenceSnapshot(fat, -1)
+	return nil
+}
+
+func (fs *FileSystem) rollbackSnapshot(name string) error {
+
+	err := fs.requireRoot()
+	if err != nil {
+		return err
+	}
+
+	_, table, err := fs.readSnapshotTable()
+	if err != nil {
+		return err
+	}
+
+	index := slices.IndexFunc(table, func(entry snapshotEntry) bool { return entry.FileName() == name })
+	if index < 0 {
+		return ErrNotFound
+	}
+
+	view, err := fs.snapshotView(table[index])
+	if err != nil {
+		return err
+	}
+
+	// **Directory quotas follow their directories by path**
+	quotas, quota_paths, err := fs.quotaDirectories()
+	if err != nil {
+		return err
+	}
+
+	// **Drop the live tree, the clusters the snapshot shares stay allocated through its references.
+	// The root is emptied first so no name of a hard linked file is left to keep its chain.**
+	root := fs.rootCluster()
+	live_chain, dir_entries, err := fs.readDirectory(root)
+	if err != nil {
+		return err
+	}
+
+	live_entries := slices.Clone(dir_entries)
+	clear(dir_entries[2:])
+	err = fs.writeDirectorySlots(live_chain, dir_entries, 2, len(dir_entries)-1)
+	if err != nil {
+		return err
+	}
+
+	released := make(map[int32]bool)
+	for _, entry := range live_entries[2:] {
+		if isUsedEntry(entry) {
+			err = fs.freeTree(entry, released)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// **The root keeps its own attributes in '.', they are replaced by those of the snapshot**
+	err = fs.freeXattrs(live_entries[0])
+	if err != nil {
+		return err
+	}
+
+	// **Copy the snapshot directories back, the files share their clusters with it again**
+	snapshot_chain, err := view.readChain(view.snapshot_root)
+	if err != nil {
+		return err
+	}
+
+	err = fs.resizeChain(root, len(snapshot_chain))
+	if err != nil {
+		return err
+	}
+
+	root_chain, err := fs.readChain(root)
+	if err != nil {
+		return err
+	}
+
+	tree := &treeCopy{fs: fs, src: view, link: fs.updateFatEntry}
+	err = tree.copyDirectory(view.snapshot_root, root_chain, root)
+	if err != nil {
+		return err
+	}
+
+	// **Every directory below the root moved, sessions and open files find theirs again by path**
+	fs.dir_moves++
+	return fs.restoreQuotas(quotas, quota_paths)
+}
+
+// treeCopy duplicates a directory tree from src into fs, the files keep sharing their clusters
+type treeCopy struct {
+	fs        *FileSystem
+	src       *FileSystem
+	link      func(cluster, next int32) error // records a chain link in the FAT describing the copy
+	allocated []int32                         // directory clusters taken from the live allocator
+}
+
+// newChain allocates n clusters for a directory copy
+func (tree *treeCopy) newChain(n int) ([]int32, error) {
+
+	chain, err := tree.fs.allocateChain(n)
+	if err != nil {
+		return nil, err
+	}
+
+	tree.allocated = append(tree.allocated, chain...)
+	return chain, tree.linkChain(chain)
+}
+
+func (tree *treeCopy) linkChain(chain []int32) error {
+
+	for i, cluster := range chain {
+
+		next := int32(FAT_EOF)
+		if i+1 < len(chain) {
+			next = chain[i+1]
+		}
+
+		err := tree.link(cluster, next)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// shareChain links the file chain at start in the copy exactly like in src, a chain cut short by a bad cluster included
+func (tree *treeCopy) shareChain(start int32) error {
+
+	cluster := start
+	for steps := 0; cluster >= 0; steps++ {
+
+		if steps >= len(tree.src.fat1) {
+			return fmt.Errorf("cluster chain starting at %d is cyclic: %w", start, ErrCorrupt)
+		}
+
+		next, err := tree.src.readFatEntry(cluster)
+		if err == nil {
+			err = tree.link(cluster, next)
+		}
+		if err != nil {
+			return err
+		}
+
+		cluster = next
+	}
+
+	return nil
+}
+
+// copyDirectory copies the directory at src_cluster into dst_chain, the live root directory
+// is written through the journal and the fresh directory clusters are written directly
+func (tree *treeCopy) copyDirectory(src_cluster int32, dst_chain []int32, parent int32) error {
+
+	dir_entries, err := tree.src.readDirectoryEntries(src_cluster)
+	if err != nil {
+		return err
+	}
+
+	dir_entries[0].First_cluster = dst_chain[0]
+	dir_entries[1].First_cluster = parent
+
+	// **Attribute chains are shared like file chains, a directory names its chain in '.' and in its parent**
+	for i := 0; i < len(dir_entries); i++ {
+		if i != 1 && isUsedEntry(dir_entries[i]) && dir_entries[i].Xattr_cluster != 0 {
+			err = tree.shareChain(dir_entries[i].Xattr_cluster)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := 2; i < len(dir_entries); i++ {
+
+		entry := &dir_entries[i]
+		if !isUsedEntry(*entry) {
+			continue
+		}
+
+		if entry.Is_directory != 1 {
+			err = tree.shareChain(entry.First_cluster)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		src_chain, err := tree.src.readChain(entry.First_cluster)
+		if err != nil {
+			return err
+		}
+
+		child_chain, err := tree.newChain(len(src_chain))
+		if err != nil {
+			return err
+		}
+
+		err = tree.copyDirectory(entry.First_cluster, child_chain, dst_chain[0])
+		if err != nil {
+			return err
+		}
+
+		entry.First_cluster = child_chain[0]
+	}
+
+	per_cluster := tree.fs.dirEntriesPerCluster()
+	for i, cluster := range dst_chain {
+
+		cluster_entries := dir_entries[i*per_cluster : (i+1)*per_cluster]
+		if dst_chain[0] == tree.fs.rootCluster() {
+			err = tree.fs.writeDirectoryEntries(cluster, cluster_entries)
+		} else {
+			err = tree.fs.writeFreshDirectory(cluster, cluster_entries)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeFreshDirectory writes the entries into a cluster no committed tree uses yet
+func (fs *FileSystem) writeFreshDirectory(cluster int32, dir_entries []DirectoryEntry) error {
+
+	raw_entries := encodeDirectoryEntries(dir_entries)
+	raw_cluster := make([]byte, fs.clusterSize())
+	copy(raw_cluster, raw_entries)
+
+	err := fs.device.WriteCluster(cluster, raw_cluster)
+	if err != nil {
+		return fmt.Errorf("error writing directory cluster %d: %w", cluster, err)
+	}
+
+	return nil
+}
+
+// snapshotView opens the tree of a snapshot as a read-only FileSystem sharing the device
+func (fs *FileSystem) snapshotView(entry snapshotEntry) (*FileSystem, error) {
+
+	fat, err := fs.readSnapshotFAT(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	_, accounts, err := fs.readUserTable()
+	if err != nil {
+		return nil, err
+	}
+
+	view := &FileSystem{
+		device:        ReadOnly(fs.device),
+		fs_format:     fs.fs_format,
+		fat1:          fat,
+		fat2:          slices.Clone(fat),
+		snapshot_root: entry.Root,
+		snapshot_name: entry.FileName(),
+		origin:        fs,
+		accounts:      accounts,
+	}
+	view.initAllocator()
+	view.session = view.newSession()
+
+	if !view.isDirectory(entry.Root) {
+		return nil, fmt.Errorf("snapshot root %d is not a directory: %w", entry.Root, ErrCorrupt)
+	}
+
+	return view, nil
+}
+
+// closeView detaches a snapshot view from its live volume
+func (fs *FileSystem) closeView() {
+
+	fs.origin.mu.Lock()
+	defer fs.origin.mu.Unlock()
+
+	fs.origin.snapshot_views[fs.snapshot_name]--
+	if fs.origin.snapshot_views[fs.snapshot_name] <= 0 {
+		delete(fs.origin.snapshot_views, fs.snapshot_name)
+	}
+}
+
+// loadSnapshots counts the references of every snapshot, the allocator must be initialized
+func (fs *FileSystem) loadSnapshots() error {
+
+	fs.snapshot_refs = nil
+
+	_, table, err := fs.readSnapshotTable()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range table {
+
+		fat, err := fs.readSnapshotFAT(entry)
+		if err != nil {
+			return err
+		}
+
+		fs.referenceSnapshot(fat, 1)
+	}
+
+	return nil
+}
+
+// referenceSnapshot adds (delta 1) or drops (delta -1) the references of a frozen FAT
+func (fs *FileSystem) referenceSnapshot(fat FAT, delta int) {
+
+	if fs.snapshot_refs == nil {
+		fs.snapshot_refs = make([]uint16, len(fs.fat1))
+	}
+
+	for cluster := fs.rootCluster(); cluster < int32(len(fat)); cluster++ {
+		if fat[cluster] != FAT_FREE {
+			fs.snapshot_refs[cluster] = uint16(int(fs.snapshot_refs[cluster]) + delta)
+			fs.markCluster(cluster, fs.fat1[cluster] != FAT_FREE)
+		}
+	}
+}
+
+// snapshotRefs returns how many snapshots reference the cluster
+func (fs *FileSystem) snapshotRefs(cluster int32) uint16 {
+
+	if int(cluster) >= len(fs.snapshot_refs) || cluster < 0 {
+		return 0
+	}
+
+	return fs.snapshot_refs[cluster]
+}
+
+// unshareChain gives the live tree its own copies of chain[from..to] where a snapshot still
+// references the cluster, the chain is updated in place and chain[0] may change
+func (fs *FileSystem) unshareChain(chain []int32, from, to int) error {
+
+	if len(fs.snapshot_refs) == 0 {
+		return nil
+	}
+
+	buffer := make([]byte, fs.clusterSize())
+	for i := from; i <= to && i < len(chain); i++ {
+
+		if fs.snapshotRefs(chain[i]) == 0 {
+			continue
+		}
+
+		next, err := fs.readFatEntry(chain[i])
+		if err != nil {
+			return err
+		}
+
+		cluster, err := fs.allocateCluster()
+		if err != nil {
+			return err
+		}
+
+		err = fs.readCluster(chain[i], buffer)
+		if err == nil {
+			err = fs.device.WriteCluster(cluster, buffer)
+		}
+		if err != nil {
+			return fmt.Errorf("error copying cluster %d: %w", chain[i], err)
+		}
+
+		// **Link the copy in place of the shared cluster, the snapshot keeps the original**
+		err = fs.updateFatEntry(cluster, next)
+		if err == nil && i > 0 {
+			err = fs.updateFatEntry(chain[i-1], cluster)
+		}
+		if err == nil {
+			err = fs.updateFatEntry(chain[i], FAT_FREE)
+		}
+		if err != nil {
+			return err
+		}
+
+		chain[i] = cluster
+	}
+
+	return nil
+}
+
+func (fs *FileSystem) snapshotsPerCluster() int {
+	return int(fs.clusterSize()) / binary.Size(snapshotEntry{})
+}
+
+// readSnapshotTable returns the table cluster, 0 without snapshots, and the used slots
+func (fs *FileSystem) readSnapshotTable() (int32, []snapshotEntry, error) {
+
+	raw_pointer := make([]byte, 4)
+	err := fs.readBytes(raw_pointer, SNAPSHOT_OFFSET)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error reading snapshot table: %w", err)
+	}
+
+	table_cluster := int32(binary.LittleEndian.Uint32(raw_pointer))
+	if table_cluster == 0 {
+		return 0, nil, nil
+	}
+
+	if table_cluster < fs.rootCluster() || table_cluster >= fs.fs_format.cluster_count {
+		return 0, nil, fmt.Errorf("snapshot table at cluster %d: %w", table_cluster, ErrCorrupt)
+	}
+
+	raw_table := make([]byte, fs.clusterSize())
+	err = fs.readCluster(table_cluster, raw_table)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error reading snapshot table: %w", err)
+	}
+
+	var table []snapshotEntry
+	reader := bytes.NewReader(raw_table)
+	for range fs.snapshotsPerCluster() {
+
+		var entry snapshotEntry
+		err = binary.Read(reader, binary.LittleEndian, &entry)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error reading snapshot table: %w", err)
+		}
+
+		if entry.Name[0] != 0 {
+			table = append(table, entry)
+		}
+	}
+
+	return table_cluster, table, nil
+}
+
+// writeSnapshotTable stages the table, it gets a cluster with the first snapshot and gives it back with the last one
+func (fs *FileSystem) writeSnapshotTable(table_cluster int32, table []snapshotEntry) error {
+
+	if len(table) == 0 {
+		if table_cluster != 0 {
+			err := fs.freeChain(table_cluster)
+			if err != nil {
+				return err
+			}
+		}
+
+		return fs.stageBytes(make([]byte, 4), SNAPSHOT_OFFSET)
+	}
+
+	if table_cluster == 0 {
+
+		cluster, err := fs.allocateCluster()
+		if err != nil {
+			return err
+		}
+
+		raw_pointer := make([]byte, 4)
+		binary.LittleEndian.PutUint32(raw_pointer, uint32(cluster))
+		err = fs.stageBytes(raw_pointer, SNAPSHOT_OFFSET)
+		if err != nil {
+			return err
+		}
+
+		table_cluster = cluster
+	}
+
+	buffer := bytes.NewBuffer(make([]byte, 0, fs.clusterSize()))
+	for _, entry := range table {
+		err := binary.Write(buffer, binary.LittleEndian, entry)
+		if err != nil {
+			return fmt.Errorf("error writing snapshot table: %w", err)
+		}
+	}
+
+	raw_table := make([]byte, fs.clusterSize())
+	copy(raw_table, buffer.Bytes())
+
+	return fs.stageBytes(raw_table, fs.clusterOffset(table_cluster))
+}
+
+// readSnapshotFAT loads the frozen FAT of a snapshot
+func (fs *FileSystem) readSnapshotFAT(entry snapshotEntry) (FAT, error) {
+
+	chain, err := fs.readChain(entry.FAT_cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(chain) != int(fs.fs_format.fat_cluster_count) {
+		return nil, fmt.Errorf("frozen FAT of snapshot %s has %d clusters: %w", entry.FileName(), len(chain), ErrCorrupt)
+	}
+
+	raw_fat := make([]byte, int64(len(chain))*fs.clusterSize())
+	err = fs.readChainAt(chain, raw_fat, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fat := make(FAT, len(fs.fat1))
+	for cluster := range fat {
+		fat[cluster] = int32(binary.LittleEndian.Uint32(raw_fat[cluster*FAT_ENTRY:]))
+	}
+
+	return fat, nil
+}
+
+// writeSnapshotFAT stores the frozen FAT in a new chain and returns its first cluster
+func (fs *FileSystem) writeSnapshotFAT(fat FAT) (int32, error) {
+
+	chain, err := fs.allocateChain(int(fs.fs_format.fat_cluster_count))
+	if err != nil {
+		return -1, err
+	}
+
+	raw_fat := make([]byte, int64(len(chain))*fs.clusterSize())
+	for cluster, value := range fat {
+		binary.LittleEndian.PutUint32(raw_fat[cluster*FAT_ENTRY:], uint32(value))
+	}
+
+	// **The chain is fresh, the commit publishing the table comes after it**
+	for i, cluster := range chain {
+		err = fs.device.WriteCluster(cluster, raw_fat[int64(i)*fs.clusterSize():int64(i+1)*fs.clusterSize()])
+		if err != nil {
+			return -1, fmt.Errorf("error writing frozen FAT: %w", err)
+		}
+	}
+
+	return chain[0], nil
+}
+
+// snapshotChains returns the first clusters of the snapshot table and the frozen FATs
+func (fs *FileSystem) snapshotChains() ([]int32, error) {
+
+	table_cluster, table, err := fs.readSnapshotTable()
+	if err != nil || table_cluster == 0 {
+		return nil, err
+	}
+
+	chains := []int32{table_cluster}
+	for _, entry := range table {
+		chains = append(chains, entry.FAT_cluster)
+	}
+
+	return chains, nil
+}
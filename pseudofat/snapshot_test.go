@@ -0,0 +1,193 @@
+package pseudofat
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+
+	fs, device := newVolume(t, 2)
+	for _, dir := range []string{"/d", "/d/e"} {
+		if err := fs.Mkdir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"/d/a":   strings.Repeat("a", 3000),
+		"/d/e/b": "bee",
+		"/top":   strings.Repeat("t", 5000),
+	}
+	for name, data := range files {
+		if err := fs.WriteFile(name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := treeState(t, fs, "/")
+
+	if err := fs.CreateSnapshot("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateSnapshot("s1"); !errors.Is(err, ErrExist) {
+		t.Fatalf("second snapshot with the same name: %v", err)
+	}
+	checkClean(t, fs)
+
+	// **The live tree changes, the snapshot keeps the old clusters**
+	file, err := fs.OpenFile("/d/a", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("XYZ"), 0)
+	file.WriteAt([]byte("END"), 2998)
+	file.Close()
+
+	for _, step := range []error{
+		fs.Remove("/d/e/b"),
+		fs.Remove("/top"),
+		fs.WriteFile("/new", []byte("new")),
+	} {
+		if step != nil {
+			t.Fatal(step)
+		}
+	}
+	checkClean(t, fs)
+	after := treeState(t, fs, "/")
+
+	// **A mounted snapshot shows the old tree and refuses changes**
+	view, err := fs.OpenSnapshot("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := treeState(t, view, "/"); !maps.Equal(got, before) {
+		t.Fatalf("snapshot shows %v, want %v", got, before)
+	}
+	if err := view.Mkdir("/x"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("mkdir in a snapshot: %v", err)
+	}
+	if err := view.Chdir("/d/e"); err != nil {
+		t.Fatal(err)
+	}
+	if err := view.Chdir("../.."); err != nil || view.Getwd() != "/" {
+		t.Fatal(view.Getwd(), err)
+	}
+	if err := fs.DeleteSnapshot("s1"); !errors.Is(err, ErrBusy) {
+		t.Fatalf("delete of a mounted snapshot: %v", err)
+	}
+	view.Close()
+
+	// **Snapshots survive a remount**
+	fs.Close()
+	fs, err = OpenDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fs)
+
+	infos, err := fs.Snapshots()
+	if err != nil || len(infos) != 1 || infos[0].Name != "s1" {
+		t.Fatalf("snapshots %v, %v", infos, err)
+	}
+	if got := treeState(t, fs, "/"); !maps.Equal(got, after) {
+		t.Fatalf("live tree %v after remount, want %v", got, after)
+	}
+
+	// **Rollback brings back a snapshot, a newer snapshot can bring back the later state**
+	if err := fs.CreateSnapshot("s2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RollbackSnapshot("s1"); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fs)
+	if got := treeState(t, fs, "/"); !maps.Equal(got, before) {
+		t.Fatalf("tree %v after rollback to s1, want %v", got, before)
+	}
+
+	if err := fs.WriteFile("/d/more", []byte(strings.Repeat("m", 4000))); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DeleteSnapshot("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RollbackSnapshot("s2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := treeState(t, fs, "/"); !maps.Equal(got, after) {
+		t.Fatalf("tree %v after rollback to s2, want %v", got, after)
+	}
+	if err := fs.DeleteSnapshot("s2"); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fs)
+
+	// **Without snapshots every cluster they held is free again**
+	if slices.ContainsFunc(fs.snapshot_refs, func(refs uint16) bool { return refs != 0 }) {
+		t.Fatal("clusters still referenced after deleting every snapshot")
+	}
+}
+
+func TestSnapshotCrash(t *testing.T) {
+
+	base := NewMemoryDevice(0)
+	fs, err := FormatDevice(base, 1, MIN_CLUSTER_SIZE)
+	if err == nil {
+		err = fs.Mkdir("/d")
+	}
+	if err == nil {
+		err = fs.WriteFile("/d/a", []byte(strings.Repeat("a", 3000)))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := treeState(t, fs, "/")
+	fs.Close()
+
+	// **A crash anywhere leaves a clean volume and, if the snapshot exists, it shows the old tree**
+	for writes := 0; ; writes++ {
+
+		device := cloneDevice(base)
+		fs, err := OpenDevice(&crashDevice{MemoryDevice: device, writes_left: writes})
+		if err != nil {
+			t.Fatal(writes, err)
+		}
+
+		err = fs.CreateSnapshot("s")
+		if err == nil {
+			err = fs.WriteFile("/d/b", []byte("b"))
+		}
+		if err == nil {
+			err = fs.RollbackSnapshot("s")
+		}
+		if err == nil {
+			err = fs.DeleteSnapshot("s")
+		}
+		if err != nil && !errors.Is(err, errCrash) {
+			t.Fatal(writes, err)
+		}
+
+		remounted, mount_err := OpenDevice(device)
+		if mount_err != nil {
+			t.Fatal(writes, mount_err)
+		}
+		checkClean(t, remounted)
+
+		if view, err := remounted.OpenSnapshot("s"); err == nil {
+			if got := treeState(t, view, "/"); !maps.Equal(got, before) {
+				t.Fatalf("crash after %d writes changed the snapshot to %v", writes, got)
+			}
+			view.Close()
+		}
+
+		if err == nil {
+			if got := treeState(t, remounted, "/"); !maps.Equal(got, before) {
+				t.Fatalf("tree %v after the rollback, want %v", got, before)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package pseudofat
+
+import (
+	"bytes"
+	"math"
+	"sync"
+	"time"
+)
+
+// Constants for file system
+const (
+	CLUSTER_SIZE  = 1024 // default cluster size of 1KB, every volume stores its own in the superblock
+	FAT_ENTRY     = 4    // FAT entry size in bytes
+	MAX_FILE_NAME = 12   // 8.3 format = 11 chars + null terminator, longer names go to long name slots
+	MAX_LONG_NAME = 255  // longest file name in bytes of UTF-8
+	FAT_FREE      = -1   // FAT free cluster marker
+	FAT_EOF       = -2   // FAT end of file marker
+	FAT_BAD       = -3   // FAT bad cluster marker
+
+	MIN_CLUSTER_SIZE = 512           // smallest cluster size Format accepts
+	MAX_CLUSTER_SIZE = 64 * 1024     // largest cluster size Format accepts
+	MAX_CLUSTERS     = math.MaxInt32 // cluster numbers are int32, the negative ones are FAT markers
+)
+
+// FileSystemFormat struct to store file system metadata
+type FileSystemFormat struct {
+	version           uint32
+	signature         [SIGNATURE_SIZE]byte
+	file_size         int64 // sizes and byte offsets are 64-bit, cluster numbers and counts stay int32
+	cluster_size      int32
+	fat_size          int64
+	fat_cluster_count int32
+	cluster_count     int32
+	fat1_start        int64
+	fat2_start        int64
+	journal_start     int64
+	journal_clusters  int32
+	data_start        int64
+	flags             uint32
+}
+
+// FAT entry struct to simulate FAT table
+type FAT []int32
+
+// DirectoryEntry stores file metadata
+type DirectoryEntry struct {
+	Name          [MAX_FILE_NAME]byte
+	Size          int64
+	First_cluster int32
+	Is_directory  uint8  // use 1 for true and 0 for false, ENTRY_SYMLINK for a symbolic link
+	Created       int64  // Unix time, set once when the entry is created
+	Modified      int64  // Unix time of the last change of the contents
+	Accessed      int64  // Unix time, reads do not update it so they never write to the volume
+	Links         uint16 // names of the file, every hard link carries the same count, see links.go
+	Uid           uint16 // owner, see users.go
+	Gid           uint16 // group of the owner
+	Mode          uint16 // rwx bits for the owner, the group and the others
+	Xattr_cluster int32  // first cluster of the extended attributes, 0 without any, see xattr.go
+
+	long_name string // read from the long name slots in front of the entry, see long_name.go
+}
+
+// DIR_ENTRY_SIZE is the on-disk size of a DirectoryEntry without long_name
+const DIR_ENTRY_SIZE = MAX_FILE_NAME + 8 + 4 + 1 + 3*8 + 2 + 3*2 + 4
+
+// FileName returns the long name of the entry when it has one, otherwise the short name
+func (entry DirectoryEntry) FileName() string {
+
+	if entry.long_name != "" {
+		return entry.long_name
+	}
+
+	return entry.ShortName()
+}
+
+// ShortName returns the name stored in the entry itself without the null padding,
+// for an entry with a long name this is its unique 8.3 alias
+func (entry DirectoryEntry) ShortName() string {
+	return string(bytes.Trim(entry.Name[:], "\x00"))
+}
+
+// hasName reports whether the entry is called name, either by its long name or by its short name
+func (entry DirectoryEntry) hasName(name string) bool {
+	return entry.FileName() == name || entry.ShortName() == name
+}
+
+// CreationTime returns the time the entry was created
+func (entry DirectoryEntry) CreationTime() time.Time { return time.Unix(entry.Created, 0) }
+
+// ModTime returns the time the contents were last changed
+func (entry DirectoryEntry) ModTime() time.Time { return time.Unix(entry.Modified, 0) }
+
+// AccessTime returns the last access time as set on creation or by Chtimes
+func (entry DirectoryEntry) AccessTime() time.Time { return time.Unix(entry.Accessed, 0) }
+
+// setTimes stamps a new entry with the same creation, modification and access time
+func (entry *DirectoryEntry) setTimes(now time.Time) {
+	entry.Created = now.Unix()
+	entry.Modified = entry.Created
+	entry.Accessed = entry.Created
+}
+
+// FileSystem is an open pseudo-FAT volume stored on a BlockDevice
+type FileSystem struct {
+	mu        sync.Mutex
+	device    BlockDevice
+	fs_format FileSystemFormat
+	session   *Session    // default session used by the FileSystem path methods
+	cred      credentials // user the running operation acts for, set together with mu, see users.go
+
+	// **Both FAT tables are kept in memory, entries in [dirty_start, dirty_end) wait for the next commit**
+	fat1        FAT
+	fat2        FAT
+	dirty_start int32
+	dirty_end   int32
+	alloc       allocator
+	journal     journal
+
+	dir_moves   uint64 // counts directories moved to other clusters, see Session.parsePath
+	dir_renames uint64 // counts directories moved to other paths, see Session.parsePath
+	links       linkIndex
+	quotas      quotaCache
+
+	// **Snapshots, see snapshot.go**
+	snapshot_refs  []uint16       // per cluster, how many snapshots reference it
+	snapshot_views map[string]int // open read-only views per snapshot name
+	snapshot_root  int32          // root directory of a snapshot view, 0 on the live volume
+	snapshot_name  string         // name of the snapshot a view shows
+	origin         *FileSystem    // the live volume a snapshot view belongs to
+	accounts       []account      // user table of the live volume, read when a snapshot view is opened
+}
+
+// allocator tracks free clusters in a bitmap that mirrors FAT1, a set bit means the cluster is in use
+type allocator struct {
+	bitmap     []uint64
+	free_count int32
+	cursor     int32 // next-fit: the search for a free cluster starts here
+	hint_dirty bool  // the persisted free count and cursor are out of date
+}
+
+// journal collects the metadata changes of the running transaction, see journal.go
+type journal struct {
+	staged map[int32][]byte // header and directory clusters written by the transaction
+	undo   map[int32]int32  // FAT values before the transaction changed them
+	freed  []int32          // clusters freed by the transaction, reused only after the commit
+
+	overflow []int32 // free clusters holding the extension of a chained transaction until its checkpoint
+
+	committed bool // a descriptor reached the device, the transaction can no longer be aborted
+}
+
+// linkIndex remembers the directories holding the names of files with several names, see links.go
+type linkIndex struct {
+	dirs      map[int32]map[int32]bool // directory clusters per first cluster of a file, nil until first needed
+	dir_moves uint64                   // value of fs.dir_moves when dirs was built
+}
+
+// quotaCache remembers the usage of the quotas charged so far, see quota.go
+type quotaCache struct {
+	usage     map[quotaKey]quotaUsage // usage per quota, nil until first needed
+	dir_moves uint64                  // value of fs.dir_moves when usage was started
+}
+
+// quotaKey names the user or the directory a quota limits
+type quotaKey struct {
+	kind uint8
+	uid  uint16
+	dir  int32
+}
+
+// Session is one logical user of a volume with its own working directory,
+// any number of sessions can share one FileSystem
+type Session struct {
+	fs              *FileSystem
+	current_cluster int32
+	current_path    string
+	dir_moves       uint64      // value of fs.dir_moves when current_cluster was resolved
+	dir_renames     uint64      // value of fs.dir_renames when current_path was built
+	cred            credentials // user the session acts for, see Session.Login
+}
+
+// credentials identify a user and the group it acts with
+type credentials struct {
+	uid uint16
+	gid uint16
+}
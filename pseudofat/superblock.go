@@ -0,0 +1,161 @@
+package pseudofat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math/bits"
+)
+
+// Superblock layout at the start of cluster 0, all integers are little endian:
+//
+//	 0  magic [8]byte        "ZOSPFAT\x00"
+//	 8  version uint32
+//	12  signature [9]byte    author login, padded to 12 bytes
+//	24  disk_size int64
+//	32  cluster_size int32
+//	36  cluster_count int32
+//	40  fat_size int64       bytes of one FAT table
+//	48  fat_cluster_count int32
+//	52  journal_clusters int32
+//	56  fat1_start int64
+//	64  fat2_start int64
+//	72  journal_start int64
+//	80  data_start int64
+//	88  flags uint32         FLAG_* options of the volume
+//	92  checksum uint32      CRC-32 of bytes 0..91
+//	96  free cluster hint    see allocator.go, not covered by the checksum
+//
+// The superblock fits into the smallest cluster so it can be read before the cluster size is known.
+const (
+	SUPERBLOCK_MAGIC = "ZOSPFAT\x00"
+	FS_VERSION       = 10         // version 2 added the journal, 3 timestamps in directory entries, 4 long file names, 5 flags, 6 64-bit sizes and offsets, 7 links, 8 owners and modes, 9 extended attributes, 10 chained journal transactions
+	SIGNATURE        = "kevinvar" // author login stored in every formatted volume
+	SIGNATURE_SIZE   = 9
+
+	SUPERBLOCK_FLAGS    = 88
+	SUPERBLOCK_CHECKSUM = 92
+	SUPERBLOCK_SIZE     = 96
+
+	FLAG_CASE_INSENSITIVE = 1 << 0 // names match regardless of case, see names.go
+)
+
+// saveFormat writes the superblock describing fs.fs_format
+func (fs *FileSystem) saveFormat() error {
+
+	// **Write the header at the start of the image**
+	err := fs.writeBytes(fs.encodeFormat(), 0)
+	if err != nil {
+		return fmt.Errorf("error writing file system format: %w", err)
+	}
+
+	return nil
+}
+
+// encodeFormat returns the superblock describing fs.fs_format
+func (fs *FileSystem) encodeFormat() []byte {
+
+	fs_format := fs.fs_format
+
+	// **Write the file system format to the buffer**
+	header := make([]byte, SUPERBLOCK_CHECKSUM+4)
+	copy(header, SUPERBLOCK_MAGIC)
+	binary.LittleEndian.PutUint32(header[8:], fs_format.version)
+	copy(header[12:], fs_format.signature[:])
+
+	binary.LittleEndian.PutUint64(header[24:], uint64(fs_format.file_size))
+	binary.LittleEndian.PutUint32(header[32:], uint32(fs_format.cluster_size))
+	binary.LittleEndian.PutUint32(header[36:], uint32(fs_format.cluster_count))
+	binary.LittleEndian.PutUint64(header[40:], uint64(fs_format.fat_size))
+	binary.LittleEndian.PutUint32(header[48:], uint32(fs_format.fat_cluster_count))
+	binary.LittleEndian.PutUint32(header[52:], uint32(fs_format.journal_clusters))
+	binary.LittleEndian.PutUint64(header[56:], uint64(fs_format.fat1_start))
+	binary.LittleEndian.PutUint64(header[64:], uint64(fs_format.fat2_start))
+	binary.LittleEndian.PutUint64(header[72:], uint64(fs_format.journal_start))
+	binary.LittleEndian.PutUint64(header[80:], uint64(fs_format.data_start))
+
+	binary.LittleEndian.PutUint32(header[SUPERBLOCK_FLAGS:], fs_format.flags)
+	binary.LittleEndian.PutUint32(header[SUPERBLOCK_CHECKSUM:], crc32.ChecksumIEEE(header[:SUPERBLOCK_CHECKSUM]))
+
+	return header
+}
+
+// loadFormat reads and validates the superblock, foreign and damaged images are rejected
+func (fs *FileSystem) loadFormat() (FileSystemFormat, error) {
+
+	// **The superblock always fits into the smallest cluster**
+	header := make([]byte, MIN_CLUSTER_SIZE)
+	if fs.device.Size() < MIN_CLUSTER_SIZE {
+		return FileSystemFormat{}, fmt.Errorf("device of %d bytes has no superblock: %w", fs.device.Size(), ErrNotFormatted)
+	}
+
+	err := fs.device.ReadCluster(0, header)
+	if err != nil {
+		return FileSystemFormat{}, fmt.Errorf("error reading file system format: %w", err)
+	}
+
+	if string(header[:len(SUPERBLOCK_MAGIC)]) != SUPERBLOCK_MAGIC {
+		return FileSystemFormat{}, fmt.Errorf("bad magic number: %w", ErrNotFormatted)
+	}
+
+	// **Initialize the file system format**
+	fs_format := FileSystemFormat{}
+	fs_format.version = binary.LittleEndian.Uint32(header[8:])
+	if fs_format.version != FS_VERSION {
+		return FileSystemFormat{}, fmt.Errorf("version %d, this build reads version %d: %w", fs_format.version, FS_VERSION, ErrVersion)
+	}
+
+	checksum := binary.LittleEndian.Uint32(header[SUPERBLOCK_CHECKSUM:])
+	if checksum != crc32.ChecksumIEEE(header[:SUPERBLOCK_CHECKSUM]) {
+		return FileSystemFormat{}, fmt.Errorf("superblock checksum mismatch: %w", ErrCorrupt)
+	}
+
+	copy(fs_format.signature[:], header[12:12+SIGNATURE_SIZE])
+	fs_format.flags = binary.LittleEndian.Uint32(header[SUPERBLOCK_FLAGS:])
+	if fs_format.flags&^FLAG_CASE_INSENSITIVE != 0 {
+		return FileSystemFormat{}, fmt.Errorf("unknown flags %#x: %w", fs_format.flags, ErrVersion)
+	}
+
+	// **Read the file system format from the header**
+	fs_format.file_size = int64(binary.LittleEndian.Uint64(header[24:]))
+	fs_format.cluster_size = int32(binary.LittleEndian.Uint32(header[32:]))
+	fs_format.cluster_count = int32(binary.LittleEndian.Uint32(header[36:]))
+	fs_format.fat_size = int64(binary.LittleEndian.Uint64(header[40:]))
+	fs_format.fat_cluster_count = int32(binary.LittleEndian.Uint32(header[48:]))
+	fs_format.journal_clusters = int32(binary.LittleEndian.Uint32(header[52:]))
+	fs_format.fat1_start = int64(binary.LittleEndian.Uint64(header[56:]))
+	fs_format.fat2_start = int64(binary.LittleEndian.Uint64(header[64:]))
+	fs_format.journal_start = int64(binary.LittleEndian.Uint64(header[72:]))
+	fs_format.data_start = int64(binary.LittleEndian.Uint64(header[80:]))
+
+	// **The layout must be exactly the one CalculateFS produces for the stored sizes**
+	expected, err := CalculateFS(fs_format.file_size, int(fs_format.cluster_size))
+	if err != nil {
+		return FileSystemFormat{}, fmt.Errorf("invalid geometry: %w", ErrCorrupt)
+	}
+
+	expected.version = fs_format.version
+	expected.signature = fs_format.signature
+	expected.flags = fs_format.flags
+	if expected != fs_format {
+		return FileSystemFormat{}, fmt.Errorf("inconsistent layout in superblock: %w", ErrCorrupt)
+	}
+
+	return fs_format, nil
+}
+
+// validClusterSize reports whether the cluster size is a power of two between MIN_CLUSTER_SIZE and MAX_CLUSTER_SIZE
+func validClusterSize(cluster_size int) bool {
+	return cluster_size >= MIN_CLUSTER_SIZE && cluster_size <= MAX_CLUSTER_SIZE && bits.OnesCount(uint(cluster_size)) == 1
+}
+
+// Signature returns the author signature stored in the superblock
+func (fs *FileSystem) Signature() string {
+	return string(bytes.TrimRight(fs.fs_format.signature[:], "\x00"))
+}
+
+// ClusterSize returns the cluster size of the volume in bytes
+func (fs *FileSystem) ClusterSize() int {
+	return int(fs.fs_format.cluster_size)
+}
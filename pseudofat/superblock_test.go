@@ -0,0 +1,105 @@
+package pseudofat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+)
+
+func TestSuperblockClusterSizes(t *testing.T) {
+
+	data := bytes.Repeat([]byte("abc"), 30000)
+	for _, cluster_size := range []int{MIN_CLUSTER_SIZE, 1024, 4096, MAX_CLUSTER_SIZE} {
+
+		device := NewMemoryDevice(0)
+		fs, err := FormatDevice(device, 2, cluster_size)
+		if err != nil {
+			t.Fatal(cluster_size, err)
+		}
+		if err := fs.MkdirAll("/d"); err != nil {
+			t.Fatal(cluster_size, err)
+		}
+		if err := fs.WriteFile("/d/f", data); err != nil {
+			t.Fatal(cluster_size, err)
+		}
+		if err := fs.Close(); err != nil {
+			t.Fatal(cluster_size, err)
+		}
+
+		// **The superblock tells a mount the cluster size the volume was formatted with**
+		fs, err = OpenDevice(device)
+		if err != nil {
+			t.Fatal(cluster_size, err)
+		}
+		if fs.ClusterSize() != cluster_size || fs.Signature() != SIGNATURE {
+			t.Fatalf("cluster size %d and signature '%s', want %d and '%s'", fs.ClusterSize(), fs.Signature(), cluster_size, SIGNATURE)
+		}
+		if got, err := fs.ReadFile("/d/f"); err != nil || !bytes.Equal(got, data) {
+			t.Fatal(cluster_size, err)
+		}
+
+		chain, err := fs.ClusterChain("/d/f")
+		if err != nil || len(chain) != (len(data)+cluster_size-1)/cluster_size {
+			t.Fatalf("chain of %d clusters with %d byte clusters, %v", len(chain), cluster_size, err)
+		}
+		fs.Close()
+	}
+
+	for _, cluster_size := range []int{256, 1000, 2 * MAX_CLUSTER_SIZE} {
+		if _, err := FormatDevice(NewMemoryDevice(0), 2, cluster_size); !errors.Is(err, ErrInvalid) {
+			t.Errorf("format with %d byte clusters: %v", cluster_size, err)
+		}
+	}
+}
+
+func TestSuperblockValidation(t *testing.T) {
+
+	device := NewMemoryDevice(0)
+	fs, err := FormatDevice(device, 1, CLUSTER_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+
+	// resign rewrites the checksum after a field was changed on purpose
+	resign := func(image []byte) {
+		binary.LittleEndian.PutUint32(image[SUPERBLOCK_CHECKSUM:], crc32.ChecksumIEEE(image[:SUPERBLOCK_CHECKSUM]))
+	}
+
+	tests := []struct {
+		name   string
+		damage func(image []byte)
+		want   error
+	}{
+		{"text file", func(image []byte) { copy(image, "hello world, this is text") }, ErrNotFormatted},
+		{"flipped bit", func(image []byte) { image[30] ^= 1 }, ErrCorrupt},
+		{"future version", func(image []byte) {
+			binary.LittleEndian.PutUint32(image[8:], FS_VERSION+1)
+			resign(image)
+		}, ErrVersion},
+		{"old version", func(image []byte) {
+			binary.LittleEndian.PutUint32(image[8:], FS_VERSION-1)
+			resign(image)
+		}, ErrVersion},
+		{"foreign cluster size", func(image []byte) {
+			binary.LittleEndian.PutUint32(image[32:], 1000)
+			resign(image)
+		}, ErrCorrupt},
+	}
+
+	for _, test := range tests {
+
+		damaged := cloneDevice(device)
+		test.damage(damaged.data)
+
+		if _, err := OpenDevice(damaged); !errors.Is(err, test.want) {
+			t.Errorf("%s: %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	if _, err := OpenDevice(cloneDevice(device)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,594 @@
+package pseudofat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Every entry belongs to a user and a group and carries Unix style rwx bits for its owner, its
+// group and everybody else. A directory keeps its owner and mode in its '.' entry as well, that is
+// where a lookup checks the search bit. Users and groups live in the user table, a chain whose first
+// cluster is kept in the header cluster at USERS_OFFSET. A volume without a table knows only root,
+// who passes every check. A session starts as root while root has no password, otherwise as nobody
+// until Login.
+const (
+	USERS_OFFSET  = SNAPSHOT_OFFSET + 4 // first cluster of the user table, 0 while only root exists
+	MAX_USER_NAME = 16                  // longest user or group name in bytes
+	ROOT_ID       = 0                   // uid of root and gid of its group
+	FIRST_ID      = 1000                // ids of added users and groups start here
+	NOBODY_ID     = math.MaxUint16      // uid and gid of a session nobody logged in to
+
+	ACCOUNT_USER  = 1
+	ACCOUNT_GROUP = 2
+
+	PERM_READ  = 4 // bits of one class, the owner bits are shifted left by 6 and the group bits by 3
+	PERM_WRITE = 2
+	PERM_EXEC  = 1 // search permission of a directory
+
+	MODE_MASK    = 0o777
+	MODE_FILE    = 0o644 // mode of new files
+	MODE_DIR     = 0o755 // mode of new directories
+	MODE_SYMLINK = 0o777 // a symbolic link is never checked, the entry it points to is
+)
+
+// account is one record of the user table, users and groups have separate ids
+type account struct {
+	Name     [MAX_USER_NAME]byte
+	Kind     uint8  // ACCOUNT_USER or ACCOUNT_GROUP
+	Id       uint16 // uid of a user, gid of a group
+	Gid      uint16 // group of a user
+	Salt     [8]byte
+	Password [sha256.Size]byte // SHA-256 of the salt followed by the password, zeros without a password
+}
+
+func newAccount(kind uint8, name string, id, gid uint16) account {
+
+	acc := account{Kind: kind, Id: id, Gid: gid}
+	copy(acc.Name[:], name)
+
+	return acc
+}
+
+// name returns the account name without the null padding
+func (acc account) name() string {
+	return string(bytes.Trim(acc.Name[:], "\x00"))
+}
+
+// setPassword stores the hash of the password under a new salt, an empty password removes it
+func (acc *account) setPassword(password string) error {
+
+	acc.Salt, acc.Password = [8]byte{}, [sha256.Size]byte{}
+	if password == "" {
+		return nil
+	}
+
+	_, err := rand.Read(acc.Salt[:])
+	if err != nil {
+		return err
+	}
+
+	acc.Password = passwordHash(acc.Salt, password)
+	return nil
+}
+
+// checkPassword reports whether password is the password of the account
+func (acc account) checkPassword(password string) bool {
+
+	if acc.Password == ([sha256.Size]byte{}) {
+		return password == ""
+	}
+
+	hash := passwordHash(acc.Salt, password)
+	return subtle.ConstantTimeCompare(hash[:], acc.Password[:]) == 1
+}
+
+func passwordHash(salt [8]byte, password string) [sha256.Size]byte {
+	return sha256.Sum256(append(salt[:], password...))
+}
+
+// validateAccountName accepts names of letters, digits, '.', '_' and '-'
+func validateAccountName(name string) error {
+
+	if name == "" {
+		return fmt.Errorf("empty user name: %w", ErrInvalid)
+	}
+
+	if len(name) > MAX_USER_NAME {
+		return fmt.Errorf("'%s' is longer than %d bytes: %w", name, MAX_USER_NAME, ErrNameTooLong)
+	}
+
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("._-", r)) {
+			return fmt.Errorf("invalid character %q in '%s': %w", r, name, ErrInvalid)
+		}
+	}
+
+	return nil
+}
+
+// findAccount returns the index of the account of the kind called name, -1 when there is none
+func findAccount(table []account, kind uint8, name string) int {
+	return slices.IndexFunc(table, func(acc account) bool { return acc.Kind == kind && acc.name() == name })
+}
+
+// findAccountId returns the index of the account of the kind with the id, -1 when there is none
+func findAccountId(table []account, kind uint8, id uint16) int {
+	return slices.IndexFunc(table, func(acc account) bool { return acc.Kind == kind && acc.Id == id })
+}
+
+// nextId returns the lowest id of the kind from FIRST_ID on that is still free
+func nextId(table []account, kind uint8) (uint16, error) {
+
+	for id := FIRST_ID; id < NOBODY_ID; id++ {
+		if findAccountId(table, kind, uint16(id)) < 0 {
+			return uint16(id), nil
+		}
+	}
+
+	return 0, fmt.Errorf("no free id: %w", ErrNoSpace)
+}
+
+// defaultAccounts is the user table of a volume that has none
+func defaultAccounts() []account {
+	return []account{newAccount(ACCOUNT_USER, "root", ROOT_ID, ROOT_ID), newAccount(ACCOUNT_GROUP, "root", ROOT_ID, ROOT_ID)}
+}
+
+// readUserTable returns the first cluster of the user table, 0 without one, and its accounts
+func (fs *FileSystem) readUserTable() (int32, []account, error) {
+
+	// **A snapshot view sees the users its live volume had when the view was opened**
+	if fs.origin != nil {
+		return 0, fs.accounts, nil
+	}
+
+	table_cluster, raw_table, err := fs.readHeaderChain(USERS_OFFSET, "user table")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if table_cluster == 0 {
+		return 0, defaultAccounts(), nil
+	}
+
+	// **The table ends with the first record without a name or with its chain**
+	var table []account
+	reader := bytes.NewReader(raw_table)
+	for reader.Len() >= binary.Size(account{}) {
+
+		var acc account
+		err = binary.Read(reader, binary.LittleEndian, &acc)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error reading user table: %w", err)
+		}
+
+		if acc.Name[0] == 0 {
+			break
+		}
+		table = append(table, acc)
+	}
+
+	return table_cluster, table, nil
+}
+
+// writeUserTable stages the table, its chain is created with the first added user and grows with the table
+func (fs *FileSystem) writeUserTable(table_cluster int32, table []account) error {
+
+	buffer := new(bytes.Buffer)
+	for _, acc := range table {
+		err := binary.Write(buffer, binary.LittleEndian, acc)
+		if err != nil {
+			return fmt.Errorf("error writing user table: %w", err)
+		}
+	}
+
+	return fs.writeHeaderChain(USERS_OFFSET, table_cluster, buffer.Bytes(), "user table")
+}
+
+// userTableChain returns the first cluster of the user table, 0 without one
+func (fs *FileSystem) userTableChain() (int32, error) {
+
+	table_cluster, _, err := fs.readUserTable()
+	return table_cluster, err
+}
+
+// defaultCredentials returns root while root has no password, otherwise nobody
+func (fs *FileSystem) defaultCredentials() credentials {
+
+	_, table, err := fs.readUserTable()
+	if err == nil {
+		index := findAccountId(table, ACCOUNT_USER, ROOT_ID)
+		if index >= 0 && table[index].checkPassword("") {
+			return credentials{uid: ROOT_ID, gid: ROOT_ID}
+		}
+	}
+
+	return credentials{uid: NOBODY_ID, gid: NOBODY_ID}
+}
+
+// accountNames returns the names of the user and the group, ids without a name are returned as numbers
+func (fs *FileSystem) accountNames(uid, gid uint16) (string, string) {
+
+	_, table, _ := fs.readUserTable()
+
+	names := [2]string{}
+	for i, kind := range []uint8{ACCOUNT_USER, ACCOUNT_GROUP} {
+
+		id := []uint16{uid, gid}[i]
+		index := findAccountId(table, kind, id)
+		switch {
+		case index >= 0:
+			names[i] = table[index].name()
+		case id == NOBODY_ID:
+			names[i] = "nobody"
+		default:
+			names[i] = strconv.Itoa(int(id))
+		}
+	}
+
+	return names[0], names[1]
+}
+
+// permits reports whether the running operation has the wanted PERM_* bits on the entry, root has all of them
+func (fs *FileSystem) permits(entry DirectoryEntry, want uint16) bool {
+
+	if fs.cred.uid == ROOT_ID {
+		return true
+	}
+
+	// **Only the class the user falls into counts, like on Unix**
+	mode := entry.Mode
+	switch {
+	case entry.Uid == fs.cred.uid:
+		mode >>= 6
+	case entry.Gid == fs.cred.gid:
+		mode >>= 3
+	}
+
+	return mode&want == want
+}
+
+// checkAccess fails with ErrPermission unless the running operation has the wanted bits on the entry
+func (fs *FileSystem) checkAccess(entry DirectoryEntry, want uint16) error {
+
+	if !fs.permits(entry, want) {
+		return ErrPermission
+	}
+
+	return nil
+}
+
+// checkDirAccess works like checkAccess for the directory at dir_cluster, described by its '.' entry
+func (fs *FileSystem) checkDirAccess(dir_cluster int32, want uint16) error {
+
+	if fs.cred.uid == ROOT_ID {
+		return nil
+	}
+
+	self, err := fs.findEntry(".", dir_cluster)
+	if err != nil {
+		return err
+	}
+
+	return fs.checkAccess(self, want)
+}
+
+// checkTree checks file_want on every file and dir_want on every directory of the tree, links are skipped
+func (fs *FileSystem) checkTree(entry DirectoryEntry, file_want, dir_want uint16) error {
+
+	if fs.cred.uid == ROOT_ID || entry.IsSymlink() {
+		return nil
+	}
+
+	if entry.Is_directory != 1 {
+		return fs.checkAccess(entry, file_want)
+	}
+
+	err := fs.checkAccess(entry, dir_want)
+	if err != nil {
+		return fmt.Errorf("'%s': %w", entry.FileName(), err)
+	}
+
+	dir_entries, err := fs.readDirectoryEntries(entry.First_cluster)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range dir_entries[2:] {
+		if isUsedEntry(child) {
+			err = fs.checkTree(child, file_want, dir_want)
+			if err != nil {
+				return fmt.Errorf("'%s': %w", child.FileName(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkOwner fails with ErrPermission unless the running operation acts for the owner of the entry or for root
+func (fs *FileSystem) checkOwner(entry DirectoryEntry) error {
+
+	if fs.cred.uid != ROOT_ID && fs.cred.uid != entry.Uid {
+		return ErrPermission
+	}
+
+	return nil
+}
+
+// requireRoot fails with ErrPermission unless the running operation acts for root
+func (fs *FileSystem) requireRoot() error {
+
+	if fs.cred.uid != ROOT_ID {
+		return fmt.Errorf("only root may do this: %w", ErrPermission)
+	}
+
+	return nil
+}
+
+// ModeString returns the type and the permission bits of the entry the way ls -l shows them
+func (entry DirectoryEntry) ModeString() string {
+
+	var mode strings.Builder
+	switch {
+	case entry.Is_directory == 1:
+		mode.WriteByte('d')
+	case entry.IsSymlink():
+		mode.WriteByte('l')
+	default:
+		mode.WriteByte('-')
+	}
+
+	for shift := 6; shift >= 0; shift -= 3 {
+		for i, flag := range "rwx" {
+			if entry.Mode>>shift&(PERM_READ>>i) != 0 {
+				mode.WriteRune(flag)
+			} else {
+				mode.WriteByte('-')
+			}
+		}
+	}
+
+	return mode.String()
+}
+
+// Owner returns the names of the user and the group owning the entry
+func (fs *FileSystem) Owner(entry DirectoryEntry) (string, string) {
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.accountNames(entry.Uid, entry.Gid)
+}
+
+// UserAdd adds a user with its password. The user joins group, which is created when it is missing,
+// an empty group gives the user a group of its own name. Only root may add users.
+func (fs *FileSystem) UserAdd(name, password, group string) error {
+
+	fs.session.lock()
+	defer fs.mu.Unlock()
+
+	return pathError("useradd", name, fs.commit(fs.userAdd(name, password, group)))
+}
+
+func (fs *FileSystem) userAdd(name, password, group string) error {
+
+	err := fs.requireRoot()
+	if err != nil {
+		return err
+	}
+
+	if group == "" {
+		group = name
+	}
+
+	for _, account_name := range []string{name, group} {
+		err = validateAccountName(account_name)
+		if err != nil {
+			return err
+		}
+	}
+
+	table_cluster, table, err := fs.readUserTable()
+	if err != nil {
+		return err
+	}
+
+	if findAccount(table, ACCOUNT_USER, name) >= 0 {
+		return ErrExist
+	}
+
+	// **Join the group or create it**
+	group_index := findAccount(table, ACCOUNT_GROUP, group)
+	if group_index < 0 {
+
+		gid, err := nextId(table, ACCOUNT_GROUP)
+		if err != nil {
+			return err
+		}
+
+		table = append(table, newAccount(ACCOUNT_GROUP, group, gid, gid))
+		group_index = len(table) - 1
+	}
+
+	uid, err := nextId(table, ACCOUNT_USER)
+	if err != nil {
+		return err
+	}
+
+	user := newAccount(ACCOUNT_USER, name, uid, table[group_index].Id)
+	err = user.setPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return fs.writeUserTable(table_cluster, append(table, user))
+}
+
+// Login switches the session to another user, root switches without the password. Unknown users
+// and wrong passwords fail alike with ErrPermission.
+func (s *Session) Login(name, password string) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	_, table, err := s.fs.readUserTable()
+	if err != nil {
+		return pathError("login", name, err)
+	}
+
+	index := findAccount(table, ACCOUNT_USER, name)
+	if index < 0 || s.cred.uid != ROOT_ID && !table[index].checkPassword(password) {
+		return pathError("login", name, ErrPermission)
+	}
+
+	s.cred = credentials{uid: table[index].Id, gid: table[index].Gid}
+	return nil
+}
+
+// User returns the names of the user and the group the session acts for
+func (s *Session) User() (string, string) {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	return s.fs.accountNames(s.cred.uid, s.cred.gid)
+}
+
+// Passwd changes the password of a user, only root may change the password of somebody else
+func (s *Session) Passwd(name, password string) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	return pathError("passwd", name, s.fs.commit(s.fs.passwd(name, password)))
+}
+
+func (fs *FileSystem) passwd(name, password string) error {
+
+	table_cluster, table, err := fs.readUserTable()
+	if err != nil {
+		return err
+	}
+
+	index := findAccount(table, ACCOUNT_USER, name)
+	if index < 0 {
+		return ErrNoUser
+	}
+
+	err = fs.checkOwner(DirectoryEntry{Uid: table[index].Id})
+	if err != nil {
+		return err
+	}
+
+	err = table[index].setPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return fs.writeUserTable(table_cluster, table)
+}
+
+// Chmod sets the permission bits of a file or a directory, only its owner and root may change them
+func (s *Session) Chmod(file_path string, mode uint16) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	return pathError("chmod", file_path, s.fs.commit(s.chmod(file_path, mode)))
+}
+
+func (s *Session) chmod(file_path string, mode uint16) error {
+
+	if mode&^MODE_MASK != 0 {
+		return fmt.Errorf("mode %#o: %w", mode, ErrInvalid)
+	}
+
+	dir_cluster, name, err := s.resolvePath(file_path)
+	if err != nil {
+		return err
+	}
+
+	entry, err := s.fs.findEntry(entryName(name), dir_cluster)
+	if err != nil {
+		return err
+	}
+
+	err = s.fs.checkOwner(entry)
+	if err != nil {
+		return err
+	}
+
+	return s.fs.changeEntry(dir_cluster, name, func(entry *DirectoryEntry) { entry.Mode = mode })
+}
+
+// Chown gives a file or a directory to another user and group, an empty name keeps the current one.
+// Only root may change the owner.
+func (s *Session) Chown(file_path, user, group string) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	return pathError("chown", file_path, s.fs.commit(s.chown(file_path, user, group)))
+}
+
+func (s *Session) chown(file_path, user, group string) error {
+
+	err := s.fs.requireRoot()
+	if err != nil {
+		return err
+	}
+
+	dir_cluster, name, err := s.resolvePath(file_path)
+	if err != nil {
+		return err
+	}
+
+	entry, err := s.fs.findEntry(entryName(name), dir_cluster)
+	if err != nil {
+		return err
+	}
+
+	_, table, err := s.fs.readUserTable()
+	if err != nil {
+		return err
+	}
+
+	// **Look up the new owner and group by name**
+	uid, gid := entry.Uid, entry.Gid
+	if user != "" {
+		index := findAccount(table, ACCOUNT_USER, user)
+		if index < 0 {
+			return fmt.Errorf("user '%s': %w", user, ErrNoUser)
+		}
+		uid = table[index].Id
+	}
+
+	if group != "" {
+		index := findAccount(table, ACCOUNT_GROUP, group)
+		if index < 0 {
+			return fmt.Errorf("group '%s': %w", group, ErrNoUser)
+		}
+		gid = table[index].Id
+	}
+
+	// **The new owner is charged for the entry, every name of it and its chains**
+	if uid != entry.Uid {
+		clusters, err := s.fs.fileClusters(entry)
+		if err == nil {
+			err = s.fs.checkQuota(uid, quotaUsage{clusters: clusters, entries: int(max(entry.Links, 1))}, dir_cluster, -1, quotaUsage{})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.fs.changeEntry(dir_cluster, name, func(entry *DirectoryEntry) { entry.Uid, entry.Gid = uid, gid })
+}
@@ -0,0 +1,228 @@
+package pseudofat
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAccounts(t *testing.T) {
+
+	fs, device := newVolume(t, 1)
+
+	// **Root adds users, a user without a group gets one of its own name**
+	for _, user := range []struct{ name, password, group string }{
+		{"alice", "secret", "staff"},
+		{"bob", "hunter2", "staff"},
+		{"carol", "pw", ""},
+	} {
+		if err := fs.UserAdd(user.name, user.password, user.group); err != nil {
+			t.Fatal(user.name, err)
+		}
+	}
+
+	tests := []struct {
+		name, group string
+		want        error
+	}{
+		{"alice", "", ErrExist},
+		{"", "", ErrInvalid},
+		{"bad name", "", ErrInvalid},
+		{"tab\tname", "", ErrInvalid},
+		{"ok", "bad/group", ErrInvalid},
+		{strings.Repeat("n", MAX_USER_NAME+1), "", ErrNameTooLong},
+	}
+	for _, test := range tests {
+		if err := fs.UserAdd(test.name, "pw", test.group); !errors.Is(err, test.want) {
+			t.Errorf("useradd %q: %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	// **Login checks the password, unknown users fail the same way**
+	session := fs.NewSession()
+	if err := session.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if user, group := session.User(); user != "alice" || group != "staff" {
+		t.Fatalf("logged in as %s:%s", user, group)
+	}
+	for _, login := range [][2]string{{"bob", "wrong"}, {"bob", ""}, {"nobody-here", ""}} {
+		if err := session.Login(login[0], login[1]); !errors.Is(err, ErrPermission) {
+			t.Errorf("login of %s: %v", login[0], err)
+		}
+	}
+	if user, _ := session.User(); user != "alice" {
+		t.Fatalf("failed login switched the session to %s", user)
+	}
+
+	// **Only root adds users and changes passwords of others**
+	if err := session.Passwd("bob", "taken"); !errors.Is(err, ErrPermission) {
+		t.Fatalf("passwd of bob as alice: %v", err)
+	}
+	if err := session.Passwd("alice", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Passwd("ghost", "pw"); !errors.Is(err, ErrNoUser) {
+		t.Fatalf("passwd of an unknown user: %v", err)
+	}
+	if err := fs.Login("bob", ""); err != nil {
+		t.Fatalf("root switching without a password: %v", err)
+	}
+	if err := fs.Login("alice", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.UserAdd("dave", "pw", ""); !errors.Is(err, ErrPermission) {
+		t.Fatalf("useradd as alice: %v", err)
+	}
+
+	// **With a root password a mount starts as nobody**
+	other := fs.NewSession()
+	if err := other.Passwd("root", "toor"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Login("root", ""); !errors.Is(err, ErrPermission) {
+		t.Fatalf("back to root without its password: %v", err)
+	}
+	checkClean(t, fs)
+	fs.Close()
+
+	fs, err := OpenDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if user, group := fs.User(); user != "nobody" || group != "nobody" {
+		t.Fatalf("mount with a root password acts for %s:%s", user, group)
+	}
+	if err := fs.Login("carol", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if user, group := fs.User(); user != "carol" || group != "carol" {
+		t.Fatalf("logged in as %s:%s after remount", user, group)
+	}
+	if err := fs.Login("root", "toor"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+
+	fs, _ := newVolume(t, 1)
+	for _, user := range []string{"alice", "bob", "mallory"} {
+		group := "staff"
+		if user == "mallory" {
+			group = ""
+		}
+		if err := fs.UserAdd(user, "pw", group); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Mkdir("/home"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chmod("/home", 0o777); err != nil {
+		t.Fatal(err)
+	}
+
+	// login returns a new session acting for the user
+	login := func(user string) *Session {
+		t.Helper()
+		session := fs.NewSession()
+		if err := session.Login(user, "pw"); err != nil {
+			t.Fatal(err)
+		}
+		return session
+	}
+	alice, bob, mallory := login("alice"), login("bob"), login("mallory")
+
+	// **New entries belong to their creator with the default modes**
+	if err := alice.Mkdir("/home/alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.WriteFile("/home/alice/notes", []byte("notes")); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := fs.Stat("/home/alice/notes")
+	if err != nil || entry.ModeString() != "-rw-r--r--" {
+		t.Fatalf("new file has mode %s, %v", entry.ModeString(), err)
+	}
+	if user, group := fs.Owner(entry); user != "alice" || group != "staff" {
+		t.Fatalf("new file belongs to %s:%s", user, group)
+	}
+	if dir, _ := fs.Stat("/home/alice"); dir.ModeString() != "drwxr-xr-x" {
+		t.Fatalf("new directory has mode %s", dir.ModeString())
+	}
+
+	// **Others read but do not change what alice owns**
+	if _, err := bob.ReadFile("/home/alice/notes"); err != nil {
+		t.Fatal(err)
+	}
+	denied := []struct {
+		name string
+		run  func() error
+	}{
+		{"write into the directory", func() error { return bob.WriteFile("/home/alice/x", nil) }},
+		{"remove from the directory", func() error { return bob.Remove("/home/alice/notes") }},
+		{"rename out of the directory", func() error { return bob.Rename("/home/alice/notes", "/home/n") }},
+		{"chmod of a foreign file", func() error { return bob.Chmod("/home/alice/notes", 0o666) }},
+		{"chown as a user", func() error { return alice.Chown("/home/alice/notes", "bob", "") }},
+		{"mkdir in the root", func() error { return bob.Mkdir("/bob") }},
+	}
+	for _, step := range denied {
+		if err := step.run(); !errors.Is(err, ErrPermission) {
+			t.Errorf("%s: %v", step.name, err)
+		}
+	}
+
+	// **The group bits apply to the group, the other bits to everybody else**
+	if err := alice.Chmod("/home/alice/notes", 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.ReadFile("/home/alice/notes"); err != nil {
+		t.Fatalf("read by the group: %v", err)
+	}
+	if _, err := mallory.ReadFile("/home/alice/notes"); !errors.Is(err, ErrPermission) {
+		t.Fatalf("read by others: %v", err)
+	}
+
+	// **A directory without the search bit cannot be entered, without the read bit not listed**
+	if err := alice.Chmod("/home/alice", 0o744); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Chdir("/home/alice"); !errors.Is(err, ErrPermission) {
+		t.Fatalf("chdir without the search bit: %v", err)
+	}
+	if _, err := bob.ReadFile("/home/alice/notes"); !errors.Is(err, ErrPermission) {
+		t.Fatalf("lookup without the search bit: %v", err)
+	}
+	if err := alice.Chmod("/home/alice", 0o711); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.ReadDir("/home/alice"); !errors.Is(err, ErrPermission) {
+		t.Fatalf("listing without the read bit: %v", err)
+	}
+	if _, err := bob.ReadFile("/home/alice/notes"); err != nil {
+		t.Fatalf("read with the search bit only: %v", err)
+	}
+
+	// **Root passes every check and gives entries away**
+	if err := fs.Chmod("/home/alice/notes", 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadFile("/home/alice/notes"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chown("/home/alice/notes", "bob", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.ReadFile("/home/alice/notes"); err != nil {
+		t.Fatalf("read by the new owner: %v", err)
+	}
+	if err := fs.Chown("/home/alice/notes", "ghost", ""); !errors.Is(err, ErrNoUser) {
+		t.Fatalf("chown to an unknown user: %v", err)
+	}
+	if err := fs.Chmod("/home/alice/notes", 0o1777); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("chmod beyond the permission bits: %v", err)
+	}
+	checkClean(t, fs)
+}
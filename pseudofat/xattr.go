@@ -0,0 +1,343 @@
+package pseudofat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Extended attributes are name/value pairs attached to a file or a directory. They are kept in a
+// chain of their own whose first cluster is stored in Xattr_cluster, 0 for an entry without any.
+// The chain holds one record per attribute, sorted by name:
+//
+//	0  name length uint8     0 ends the list
+//	1  value length uint16
+//	3  name, then the value
+//
+// The chain is never written in place, every change writes a new chain and frees the old one, so a
+// snapshot that still shares the old chain keeps it unchanged. Hard links share the chain like they
+// share the contents, a directory keeps it in its '.' entry as well.
+const (
+	XATTR_NAME_MAX  = math.MaxUint8  // longest attribute name in bytes
+	XATTR_VALUE_MAX = math.MaxUint16 // largest attribute value in bytes
+	XATTR_HEADER    = 3              // bytes in front of the name of every record
+)
+
+// validateXattrName accepts non-empty UTF-8 names without spaces, control characters and '='
+func validateXattrName(name string) error {
+
+	if name == "" {
+		return fmt.Errorf("empty attribute name: %w", ErrInvalid)
+	}
+
+	if len(name) > XATTR_NAME_MAX {
+		return fmt.Errorf("attribute name '%s' is longer than %d bytes: %w", name, XATTR_NAME_MAX, ErrNameTooLong)
+	}
+
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("attribute name %q is not UTF-8: %w", name, ErrInvalid)
+	}
+
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || r == '=' {
+			return fmt.Errorf("invalid character %q in attribute name '%s': %w", r, name, ErrInvalid)
+		}
+	}
+
+	return nil
+}
+
+// validateXattr checks the name and the length of the value of an attribute
+func validateXattr(name string, value []byte) error {
+
+	err := validateXattrName(name)
+	if err != nil {
+		return err
+	}
+
+	if len(value) > XATTR_VALUE_MAX {
+		return fmt.Errorf("value of '%s' is longer than %d bytes: %w", name, XATTR_VALUE_MAX, ErrInvalid)
+	}
+
+	return nil
+}
+
+// encodeXattrs returns the records of the attributes sorted by name
+func encodeXattrs(attrs map[string][]byte) []byte {
+
+	var raw []byte
+	for _, name := range slices.Sorted(maps.Keys(attrs)) {
+		value := attrs[name]
+		raw = append(raw, uint8(len(name)))
+		raw = binary.LittleEndian.AppendUint16(raw, uint16(len(value)))
+		raw = append(raw, name...)
+		raw = append(raw, value...)
+	}
+
+	return raw
+}
+
+// decodeXattrs reads the records up to the first one without a name or the end of raw
+func decodeXattrs(raw []byte) (map[string][]byte, error) {
+
+	attrs := make(map[string][]byte)
+	for len(raw) >= XATTR_HEADER && raw[0] != 0 {
+
+		name_len := int(raw[0])
+		value_len := int(binary.LittleEndian.Uint16(raw[1:]))
+		if len(raw) < XATTR_HEADER+name_len+value_len {
+			return nil, fmt.Errorf("attribute record runs past its chain: %w", ErrCorrupt)
+		}
+
+		name := string(raw[XATTR_HEADER : XATTR_HEADER+name_len])
+		attrs[name] = slices.Clone(raw[XATTR_HEADER+name_len : XATTR_HEADER+name_len+value_len])
+		raw = raw[XATTR_HEADER+name_len+value_len:]
+	}
+
+	return attrs, nil
+}
+
+// readXattrs returns the attributes of the entry, an empty map when it has none
+func (fs *FileSystem) readXattrs(entry DirectoryEntry) (map[string][]byte, error) {
+
+	if entry.Xattr_cluster == 0 {
+		return make(map[string][]byte), nil
+	}
+
+	chain, err := fs.readChain(entry.Xattr_cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, int64(len(chain))*fs.clusterSize())
+	err = fs.readChainAt(chain, raw, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error reading attributes: %w", err)
+	}
+
+	return decodeXattrs(raw)
+}
+
+// writeXattrs stores the attributes in a new chain and returns its first cluster, 0 for no attributes
+func (fs *FileSystem) writeXattrs(attrs map[string][]byte) (int32, error) {
+
+	if len(attrs) == 0 {
+		return 0, nil
+	}
+
+	raw := encodeXattrs(attrs)
+	chain, err := fs.allocateChain(fs.clustersForSize(int64(len(raw))))
+	if err != nil {
+		return 0, err
+	}
+
+	// **Whole clusters are written, the zeros behind the last record end the list**
+	padded := make([]byte, int64(len(chain))*fs.clusterSize())
+	copy(padded, raw)
+
+	err = fs.writeChainAt(chain, padded, 0)
+	if err != nil {
+		fs.releaseClusters(chain)
+		return 0, fmt.Errorf("error writing attributes: %w", err)
+	}
+
+	return chain[0], nil
+}
+
+// replaceXattrs gives the named entry a new chain holding attrs and frees its old one
+func (fs *FileSystem) replaceXattrs(dir_cluster int32, name string, old DirectoryEntry, attrs map[string][]byte) error {
+
+	// **A longer chain is charged to the owner and the directory before it is written**
+	old_clusters, err := fs.xattrClusters(old)
+	if err != nil {
+		return err
+	}
+
+	new_clusters := 0
+	if len(attrs) > 0 {
+		new_clusters = fs.clustersForSize(int64(len(encodeXattrs(attrs))))
+	}
+
+	err = fs.chargeQuota(dir_cluster, old.Uid, quotaUsage{clusters: new_clusters - old_clusters})
+	if err != nil {
+		return err
+	}
+
+	xattr_cluster, err := fs.writeXattrs(attrs)
+	if err != nil {
+		return err
+	}
+
+	err = fs.changeEntry(dir_cluster, name, func(entry *DirectoryEntry) { entry.Xattr_cluster = xattr_cluster })
+	if err != nil {
+		if xattr_cluster != 0 {
+			fs.freeChain(xattr_cluster)
+		}
+		return err
+	}
+
+	return fs.freeXattrs(old)
+}
+
+// freeXattrs frees the attribute chain of an entry that is going away
+func (fs *FileSystem) freeXattrs(entry DirectoryEntry) error {
+
+	if entry.Xattr_cluster == 0 {
+		return nil
+	}
+
+	return fs.freeChain(entry.Xattr_cluster)
+}
+
+// copyXattrs gives the named entry a copy of the attributes of src
+func (fs *FileSystem) copyXattrs(src DirectoryEntry, dest_cluster int32, dest_name string) error {
+
+	if src.Xattr_cluster == 0 {
+		return nil
+	}
+
+	attrs, err := fs.readXattrs(src)
+	if err != nil {
+		return err
+	}
+
+	dest, err := fs.findEntry(dest_name, dest_cluster)
+	if err != nil {
+		return err
+	}
+
+	return fs.replaceXattrs(dest_cluster, dest_name, dest, attrs)
+}
+
+// xattrClusters returns the length of the attribute chain of the entry
+func (fs *FileSystem) xattrClusters(entry DirectoryEntry) (int, error) {
+
+	if entry.Xattr_cluster == 0 {
+		return 0, nil
+	}
+
+	chain, err := fs.readChain(entry.Xattr_cluster)
+	return len(chain), err
+}
+
+// xattrTarget resolves the entry whose attributes a path names, symbolic links are followed
+func (s *Session) xattrTarget(file_path string, want uint16) (int32, string, DirectoryEntry, error) {
+
+	dir_cluster, name, err := s.resolvePath(file_path)
+	if err != nil {
+		return -1, "", DirectoryEntry{}, err
+	}
+
+	entry, err := s.fs.findEntry(entryName(name), dir_cluster)
+	if err == nil {
+		err = s.fs.checkAccess(entry, want)
+	}
+
+	return dir_cluster, name, entry, err
+}
+
+// Listxattr returns the names of the attributes of a file or a directory sorted by name
+func (s *Session) Listxattr(file_path string) ([]string, error) {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	_, _, entry, err := s.xattrTarget(file_path, PERM_READ)
+	if err != nil {
+		return nil, pathError("listxattr", file_path, err)
+	}
+
+	attrs, err := s.fs.readXattrs(entry)
+	if err != nil {
+		return nil, pathError("listxattr", file_path, err)
+	}
+
+	return slices.Sorted(maps.Keys(attrs)), nil
+}
+
+// Getxattr returns the value of an attribute, ErrNoAttr when the entry has no such attribute
+func (s *Session) Getxattr(file_path, name string) ([]byte, error) {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	_, _, entry, err := s.xattrTarget(file_path, PERM_READ)
+	if err != nil {
+		return nil, pathError("getxattr", file_path, err)
+	}
+
+	attrs, err := s.fs.readXattrs(entry)
+	if err != nil {
+		return nil, pathError("getxattr", file_path, err)
+	}
+
+	value, ok := attrs[name]
+	if !ok {
+		return nil, pathError("getxattr", file_path, fmt.Errorf("'%s': %w", name, ErrNoAttr))
+	}
+
+	return value, nil
+}
+
+// Setxattr creates or replaces an attribute, it takes write permission on the entry
+func (s *Session) Setxattr(file_path, name string, value []byte) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	return pathError("setxattr", file_path, s.fs.commit(s.setxattr(file_path, name, value)))
+}
+
+func (s *Session) setxattr(file_path, name string, value []byte) error {
+
+	err := validateXattr(name, value)
+	if err != nil {
+		return err
+	}
+
+	dir_cluster, entry_name, entry, err := s.xattrTarget(file_path, PERM_WRITE)
+	if err != nil {
+		return err
+	}
+
+	attrs, err := s.fs.readXattrs(entry)
+	if err != nil {
+		return err
+	}
+
+	attrs[name] = slices.Clone(value)
+	return s.fs.replaceXattrs(dir_cluster, entry_name, entry, attrs)
+}
+
+// Removexattr deletes an attribute, ErrNoAttr when the entry has no such attribute
+func (s *Session) Removexattr(file_path, name string) error {
+
+	s.lock()
+	defer s.fs.mu.Unlock()
+
+	return pathError("removexattr", file_path, s.fs.commit(s.removexattr(file_path, name)))
+}
+
+func (s *Session) removexattr(file_path, name string) error {
+
+	dir_cluster, entry_name, entry, err := s.xattrTarget(file_path, PERM_WRITE)
+	if err != nil {
+		return err
+	}
+
+	attrs, err := s.fs.readXattrs(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := attrs[name]; !ok {
+		return fmt.Errorf("'%s': %w", name, ErrNoAttr)
+	}
+
+	delete(attrs, name)
+	return s.fs.replaceXattrs(dir_cluster, entry_name, entry, attrs)
+}
@@ -0,0 +1,264 @@
+package pseudofat
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestImportFileAllOrNothing lets the attributes of an import fail, no file may stay behind
+func TestImportFileAllOrNothing(t *testing.T) {
+
+	fs, _ := newVolume(t, 1)
+	free, _ := fs.FreeSpace()
+	data := bytes.Repeat([]byte("d"), 2*CLUSTER_SIZE)
+
+	for _, attrs := range []map[string][]byte{
+		{"ok": []byte("1"), "bad name": []byte("2")},
+		{"big": make([]byte, XATTR_VALUE_MAX+1)},
+	} {
+		err := fs.ImportFile("/f", data, time.Now(), attrs)
+		if !errors.Is(err, ErrInvalid) {
+			t.Fatal("import accepted a bad attribute:", err)
+		}
+	}
+
+	// **The free clusters take the contents, none is left for the attributes**
+	filler := make([]byte, free-int64(len(data)))
+	err := fs.WriteFile("/filler", filler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	free, _ = fs.FreeSpace()
+
+	err = fs.ImportFile("/f", data, time.Now(), map[string][]byte{"k": []byte("v")})
+	if !errors.Is(err, ErrNoSpace) {
+		t.Fatal("import did not run out of space:", err)
+	}
+
+	if _, err := fs.Stat("/f"); !errors.Is(err, ErrNotFound) {
+		t.Fatal("a failed import left the file behind:", err)
+	}
+	if now, _ := fs.FreeSpace(); now != free {
+		t.Fatalf("a failed import leaked %d bytes", free-now)
+	}
+	checkClean(t, fs)
+
+	// **With room for everything the file gets its time and its attributes**
+	err = fs.Remove("/filler")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = fs.ImportFile("/f", data, mtime, map[string][]byte{"k": []byte("v")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := fs.Stat("/f")
+	if err != nil || entry.Modified != mtime.Unix() {
+		t.Fatal("import lost the modification time:", err)
+	}
+	if value, err := fs.Getxattr("/f", "k"); err != nil || string(value) != "v" {
+		t.Fatal("import lost the attribute:", err)
+	}
+	checkClean(t, fs)
+}
+
+func TestXattr(t *testing.T) {
+
+	fs, device := newVolume(t, 1)
+	free_bytes, _ := fs.FreeSpace()
+
+	if err := fs.WriteFile("/f", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/d"); err != nil {
+		t.Fatal(err)
+	}
+
+	// **Files, directories and the root carry attributes, a large value spans clusters**
+	big := bytes.Repeat([]byte("z"), 3000)
+	for _, attr := range []struct {
+		path, name string
+		value      []byte
+	}{
+		{"/f", "user.src", []byte("http://example.com/f")},
+		{"/f", "status", []byte("draft")},
+		{"/d", "big", big},
+		{"/", "rootattr", []byte("r")},
+	} {
+		if err := fs.Setxattr(attr.path, attr.name, attr.value); err != nil {
+			t.Fatal(attr.path, attr.name, err)
+		}
+	}
+
+	if names, err := fs.Listxattr("/f"); err != nil || !slices.Equal(names, []string{"status", "user.src"}) {
+		t.Fatalf("attributes %v, %v", names, err)
+	}
+	if value, err := fs.Getxattr("/d/.", "big"); err != nil || !bytes.Equal(value, big) {
+		t.Fatalf("'.' of the directory reads %d bytes, %v", len(value), err)
+	}
+	if err := fs.Setxattr("/f", "status", []byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"missing attribute", func() error { _, err := fs.Getxattr("/f", "nope"); return err }(), ErrNoAttr},
+		{"remove of a missing attribute", fs.Removexattr("/f", "nope"), ErrNoAttr},
+		{"name with a space", fs.Setxattr("/f", "a b", nil), ErrInvalid},
+		{"empty name", fs.Setxattr("/f", "", nil), ErrInvalid},
+		{"name too long", fs.Setxattr("/f", strings.Repeat("n", XATTR_NAME_MAX+1), nil), ErrInvalid},
+		{"value too large", fs.Setxattr("/f", "v", make([]byte, XATTR_VALUE_MAX+1)), ErrInvalid},
+		{"missing file", fs.Setxattr("/missing", "k", nil), ErrNotFound},
+	}
+	for _, test := range tests {
+		if !errors.Is(test.err, test.want) {
+			t.Errorf("%s: %v, want %v", test.name, test.err, test.want)
+		}
+	}
+
+	// **Copies take the attributes along, moves and links keep them**
+	if err := fs.Copy("/f", "/g"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CopyTree("/d", "/e"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rename("/g", "/d/g"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := fs.Getxattr("/d/g", "status"); string(value) != "ok" {
+		t.Fatalf("copied and moved file has status %q", value)
+	}
+	if value, _ := fs.Getxattr("/e", "big"); !bytes.Equal(value, big) {
+		t.Fatal("the copied tree lost the directory attribute")
+	}
+	if err := fs.Link("/f", "/h"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Setxattr("/h", "status", []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := fs.Getxattr("/f", "status"); string(value) != "changed" {
+		t.Fatalf("other name of the link has status %q", value)
+	}
+	if value, _ := fs.Getxattr("/d/g", "status"); string(value) != "ok" {
+		t.Fatalf("the copy shares the attributes, status %q", value)
+	}
+	checkClean(t, fs)
+
+	// **A snapshot keeps the old attributes and a rollback brings them back**
+	if err := fs.CreateSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Setxattr("/f", "status", []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Removexattr("/", "rootattr"); err != nil {
+		t.Fatal(err)
+	}
+	view, err := fs.OpenSnapshot("s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := view.Getxattr("/f", "status"); err != nil || string(value) != "changed" {
+		t.Fatalf("snapshot shows status %q, %v", value, err)
+	}
+	if value, err := view.Getxattr("/", "rootattr"); err != nil || string(value) != "r" {
+		t.Fatalf("snapshot shows root attribute %q, %v", value, err)
+	}
+	view.Close()
+
+	if err := fs.RollbackSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DeleteSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := fs.Getxattr("/h", "status"); string(value) != "changed" {
+		t.Fatalf("status %q after rollback", value)
+	}
+	if value, _ := fs.Getxattr("/", "rootattr"); string(value) != "r" {
+		t.Fatalf("root attribute %q after rollback", value)
+	}
+	checkClean(t, fs)
+
+	// **Attributes are on the volume and their clusters are freed with the entries**
+	fs.Close()
+	fs, err = OpenDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if value, _ := fs.Getxattr("/e", "big"); !bytes.Equal(value, big) {
+		t.Fatal("directory attribute lost on remount")
+	}
+
+	for _, name := range []string{"/d", "/e", "/f", "/h"} {
+		if err := fs.RemoveTree(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Removexattr("/", "rootattr"); err != nil {
+		t.Fatal(err)
+	}
+	if free, _ := fs.FreeSpace(); free != free_bytes {
+		t.Fatalf("%d bytes free after removing everything, want %d", free, free_bytes)
+	}
+	checkClean(t, fs)
+}
+
+func TestXattrFsck(t *testing.T) {
+
+	fs, _ := newVolume(t, 1)
+	for _, step := range []error{
+		fs.WriteFile("/f", []byte("hi")),
+		fs.Mkdir("/d"),
+		fs.Setxattr("/f", "a", bytes.Repeat([]byte("q"), 2500)),
+		fs.Setxattr("/d", "a", []byte("x")),
+	} {
+		if step != nil {
+			t.Fatal(step)
+		}
+	}
+
+	// **A broken attribute chain is reported and dropped, the other attributes stay**
+	entry, _ := fs.Stat("/f")
+	chain, err := fs.readChain(entry.Xattr_cluster)
+	if err != nil || len(chain) < 2 {
+		t.Fatalf("attribute chain %v, %v", chain, err)
+	}
+	if err := fs.updateFatEntry(chain[1], FAT_FREE); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.commit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if report, _ := fs.Check(false); len(report.Problems) == 0 {
+		t.Fatal("fsck missed the broken attribute chain")
+	}
+	if _, err := fs.Check(true); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, fs)
+
+	if entry, _ := fs.Stat("/f"); entry.Xattr_cluster != 0 {
+		t.Fatal("the broken attributes were kept")
+	}
+	if data, err := fs.ReadFile("/f"); err != nil || string(data) != "hi" {
+		t.Fatalf("repair changed the file to %q, %v", data, err)
+	}
+	if value, err := fs.Getxattr("/d", "a"); err != nil || string(value) != "x" {
+		t.Fatalf("directory attribute %q, %v", value, err)
+	}
+}